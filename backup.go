@@ -0,0 +1,322 @@
+package notbadger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/pkg/errors"
+)
+
+const (
+	// backupEntryHeaderSize is the size of the fixed width fields at the start of every backup entry.
+	//
+	// Layout: Partition Id (uint32) | Version (uint64) | ExpiresAt (uint64) | Meta | UserMeta | Key Length (uint32)
+	backupEntryHeaderSize = 4 + 8 + 8 + 1 + 1 + 4
+)
+
+type (
+	// backupEntry is a single version of a key within a backup stream. Every entry is written as a frame, prefixed
+	// with the length of the encoded entry as a big endian uint32.
+	backupEntry struct {
+		partitionId PartitionId
+		key         []byte
+		value       []byte
+		meta        byte
+		userMeta    byte
+		expiresAt   uint64
+		version     uint64
+	}
+
+	// backupLoader batches the entries of a backup into write requests, limiting the number of requests that are
+	// waiting to be written.
+	backupLoader struct {
+		db          *DB
+		throttle    *z.Throttle
+		entries     []*Entry
+		entriesSize int64
+		maxVersion  uint64
+	}
+)
+
+// Backup writes every version of every key in every partition that is newer than the since timestamp to the provided
+// writer. All of the partitions are read at a single read timestamp so the backup is consistent. The returned version
+// is the largest version that was written, it can be provided as since to a later Backup to make an incremental
+// backup.
+//
+// Deleted and expired keys are included so that they are deleted when the backup is loaded, but versions older than a
+// deletion are not.
+func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
+	txn := db.newLatestTransaction()
+	defer txn.Discard()
+
+	writer := bufio.NewWriterSize(w, 1<<20)
+	var maxVersion uint64
+	for _, partitionId := range db.Partitions() {
+		version, err := txn.backupPartition(writer, partitionId, since)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to backup partition %d", partitionId)
+		}
+
+		if version > maxVersion {
+			maxVersion = version
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return 0, errors.Wrap(err, "failed to flush backup")
+	}
+
+	return maxVersion, nil
+}
+
+// Load reads a backup that was written by Backup and writes all of its entries to the database. The versions of the
+// entries are preserved so the history of every key is restored as it was. The database must be empty, otherwise
+// ErrLoadNotEmpty is returned. At most maxPendingWrites batches of entries will be waiting to be written at a time.
+func (db *DB) Load(r io.Reader, maxPendingWrites int) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if !db.isEmpty() {
+		return ErrLoadNotEmpty
+	}
+
+	loader := &backupLoader{
+		db:       db,
+		throttle: z.NewThrottle(maxPendingWrites),
+	}
+
+	reader := bufio.NewReaderSize(r, 16<<10)
+	var buf []byte
+	for {
+		var entry backupEntry
+		var err error
+		if buf, err = readBackupEntry(reader, buf, &entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if err := loader.set(&entry); err != nil {
+			return err
+		}
+	}
+
+	if err := loader.finish(); err != nil {
+		return err
+	}
+
+	// Every version that was loaded has now been committed, new transactions need to read and commit after them.
+	db.oracle.Lock()
+	if loader.maxVersion >= db.oracle.nextTransactionTimestamp {
+		db.oracle.nextTransactionTimestamp = loader.maxVersion + 1
+		db.oracle.transactionMark.SetDoneUntil(loader.maxVersion)
+		db.oracle.readMark.SetDoneUntil(loader.maxVersion)
+	}
+	db.oracle.Unlock()
+
+	return nil
+}
+
+// set adds the backup entry to the current batch, sending the batch to be written once it is full.
+func (l *backupLoader) set(e *backupEntry) error {
+	if err := validateKey(e.key); err != nil {
+		return err
+	} else if int64(len(e.value)) > l.db.options.maxValueSize(len(e.key)) {
+		return ErrValueTooLarge
+	}
+
+	// The key and value of the backup entry reference the read buffer, so they need to be copied.
+	entry := &Entry{
+		Key:         z.KeyWithTs(e.key, e.version),
+		Value:       z.Copy(e.value),
+		UserMeta:    e.userMeta,
+		ExpiresAt:   e.expiresAt,
+		meta:        e.meta,
+		partitionId: e.partitionId,
+		version:     e.version,
+	}
+	size := int64(entry.estimateSize(l.db.options.ValueThreshold))
+
+	if int64(len(l.entries))+1 >= l.db.options.maxBatchCount || l.entriesSize+size >= l.db.options.maxBatchSize {
+		if err := l.send(); err != nil {
+			return err
+		}
+	}
+
+	l.entries = append(l.entries, entry)
+	l.entriesSize += size
+	if e.version > l.maxVersion {
+		l.maxVersion = e.version
+	}
+
+	return nil
+}
+
+// send sends the current batch to be written without waiting for the write to finish.
+func (l *backupLoader) send() error {
+	if len(l.entries) == 0 {
+		return nil
+	}
+
+	if err := l.throttle.Do(); err != nil {
+		return err
+	}
+
+	req, err := l.db.sendToWriteChannel(l.entries, l.db.options.SyncWrites)
+	if err != nil {
+		l.throttle.Done(err)
+		return err
+	}
+
+	go func() {
+		l.throttle.Done(req.Wait())
+	}()
+
+	l.entries = make([]*Entry, 0, len(l.entries))
+	l.entriesSize = 0
+
+	return nil
+}
+
+// finish sends the final batch and waits for every batch to be written.
+func (l *backupLoader) finish() error {
+	if err := l.send(); err != nil {
+		_ = l.throttle.Finish()
+		return err
+	}
+
+	return l.throttle.Finish()
+}
+
+// backupPartition writes all of the versions in the provided partition that are visible to the transaction and newer
+// than the since timestamp.
+func (txn *Transaction) backupPartition(w io.Writer, partitionId PartitionId, since uint64) (uint64, error) {
+	iterator := txn.NewIterator(partitionId, IteratorOptions{
+		AllVersions: true,
+	})
+	defer iterator.Close()
+
+	var maxVersion uint64
+	var buf []byte
+	var skipKey []byte
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		item := iterator.Item()
+
+		// Once a key has been deleted, or the versions are older than since, the remaining versions are not needed.
+		if skipKey != nil && bytes.Equal(item.Key(), skipKey) {
+			continue
+		}
+		skipKey = nil
+
+		if item.Version() <= since {
+			skipKey = item.KeyCopy(skipKey)
+			continue
+		}
+
+		entry := backupEntry{
+			partitionId: partitionId,
+			key:         item.Key(),
+			// Clear the transaction bits, the entries will be written as part of a new transaction when they are
+			// loaded.
+			meta:      item.meta &^ (bitTxn | bitFinTxn),
+			userMeta:  item.UserMeta(),
+			expiresAt: item.ExpiresAt(),
+			version:   item.Version(),
+		}
+
+		// No need to write the value if the item is deleted or expired.
+		if !item.IsDeletedOrExpired() {
+			entry.value = item.value
+		}
+
+		buf = entry.encode(buf[:0])
+		if _, err := w.Write(buf); err != nil {
+			return 0, err
+		}
+
+		if entry.version > maxVersion {
+			maxVersion = entry.version
+		}
+
+		if item.DiscardEarlierVersions() || item.IsDeletedOrExpired() {
+			skipKey = item.KeyCopy(skipKey)
+		}
+	}
+
+	// A backup that stopped at a table that couldn't be read would be missing the rest of the partition.
+	if err := iterator.Err(); err != nil {
+		return 0, z.Wrapf(err, "failed to read partition %d for backup", partitionId)
+	}
+
+	return maxVersion, nil
+}
+
+// encode appends the entry to the provided buffer as a length prefixed frame.
+func (e *backupEntry) encode(buf []byte) []byte {
+	size := backupEntryHeaderSize + len(e.key) + len(e.value)
+
+	var header [4 + backupEntryHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(size))
+	binary.BigEndian.PutUint32(header[4:8], uint32(e.partitionId))
+	binary.BigEndian.PutUint64(header[8:16], e.version)
+	binary.BigEndian.PutUint64(header[16:24], e.expiresAt)
+	header[24] = e.meta
+	header[25] = e.userMeta
+	binary.BigEndian.PutUint32(header[26:30], uint32(len(e.key)))
+
+	buf = append(buf, header[:]...)
+	buf = append(buf, e.key...)
+	return append(buf, e.value...)
+}
+
+// decode reads the entry from a single frame, not including the length prefix. The key and value of the entry will
+// reference the provided buffer.
+func (e *backupEntry) decode(buf []byte) error {
+	if len(buf) < backupEntryHeaderSize {
+		return errors.Errorf("backup entry is too short, expected at least %d bytes got %d",
+			backupEntryHeaderSize, len(buf))
+	}
+
+	e.partitionId = PartitionId(binary.BigEndian.Uint32(buf[0:4]))
+	e.version = binary.BigEndian.Uint64(buf[4:12])
+	e.expiresAt = binary.BigEndian.Uint64(buf[12:20])
+	e.meta = buf[20]
+	e.userMeta = buf[21]
+	keyLength := int(binary.BigEndian.Uint32(buf[22:26]))
+	if len(buf) < backupEntryHeaderSize+keyLength {
+		return errors.Errorf("backup entry is too short for key of %d bytes", keyLength)
+	}
+
+	e.key = buf[backupEntryHeaderSize : backupEntryHeaderSize+keyLength]
+	e.value = buf[backupEntryHeaderSize+keyLength:]
+	return nil
+}
+
+// readBackupEntry reads the next frame from the reader and decodes it into the entry. The provided buffer is reused
+// for the frame when it is large enough, the buffer that was used is returned. io.EOF is returned once there are no
+// more entries.
+func readBackupEntry(r io.Reader, buf []byte, e *backupEntry) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return buf, err
+	}
+
+	length := int(binary.BigEndian.Uint32(size[:]))
+	if cap(buf) < length {
+		buf = make([]byte, length)
+	}
+	buf = buf[:length]
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return buf, errors.Wrap(err, "failed to read backup entry")
+	}
+
+	return buf, e.decode(buf)
+}
@@ -0,0 +1,111 @@
+package notbadger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readTestBackup decodes every entry in the backup into a readable form.
+func readTestBackup(t *testing.T, r io.Reader) (entries []string) {
+	var buf []byte
+	for {
+		var e backupEntry
+		var err error
+		buf, err = readBackupEntry(r, buf, &e)
+		if err == io.EOF {
+			return entries
+		}
+		require.NoError(t, err)
+
+		deleted := ""
+		if e.meta&bitDelete > 0 {
+			deleted = " (deleted)"
+		}
+		entries = append(entries, fmt.Sprintf("%d/%s@%d=%s%s", e.partitionId, e.key, e.version, e.value, deleted))
+	}
+}
+
+func TestDB_Backup(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			require.NoError(t, txn.Set(0, []byte("a"), []byte("a1")))
+			return txn.Set(1, []byte("b"), []byte("b1"))
+		}))
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			require.NoError(t, txn.Set(0, []byte("a"), []byte("a2")))
+			return txn.Delete(1, []byte("b"))
+		}))
+
+		var backup bytes.Buffer
+		since, err := db.Backup(&backup, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), since)
+
+		// Every version is included, except for the versions that are older than a deletion.
+		require.Equal(t, []string{
+			"0/a@2=a2",
+			"0/a@1=a1",
+			"1/b@2= (deleted)",
+		}, readTestBackup(t, &backup))
+
+		// An incremental backup should only include the versions written after the previous backup.
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			require.NoError(t, txn.Set(0, []byte("a"), []byte("a3")))
+			return txn.Set(2, []byte("c"), []byte("c3"))
+		}))
+
+		backup.Reset()
+		since, err = db.Backup(&backup, since)
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), since)
+		require.Equal(t, []string{
+			"0/a@3=a3",
+			"2/c@3=c3",
+		}, readTestBackup(t, &backup))
+	})
+}
+
+func TestDB_Load(t *testing.T) {
+	var backup bytes.Buffer
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			require.NoError(t, txn.Set(0, []byte("a"), []byte("a1")))
+			return txn.Set(1, []byte("b"), []byte("b1"))
+		}))
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			require.NoError(t, txn.Set(0, []byte("a"), []byte("a2")))
+			return txn.Set(2, []byte("c"), []byte("c2"))
+		}))
+
+		_, err := db.Backup(&backup, 0)
+		require.NoError(t, err)
+	})
+
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Load(bytes.NewReader(backup.Bytes()), 2))
+
+		// A backup of the loaded database should contain the same versions as the original.
+		var restored bytes.Buffer
+		since, err := db.Backup(&restored, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), since)
+		require.Equal(t, readTestBackup(t, bytes.NewReader(backup.Bytes())), readTestBackup(t, &restored))
+
+		// New transactions should commit after the versions that were loaded.
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(0, []byte("a"), []byte("a3"))
+		}))
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			item, err := txn.Get(0, []byte("a"))
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), item.Version())
+			return nil
+		}))
+
+		require.Equal(t, ErrLoadNotEmpty, db.Load(bytes.NewReader(backup.Bytes()), 2))
+	})
+}
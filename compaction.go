@@ -3,8 +3,11 @@ package notbadger
 import (
 	"bytes"
 	"fmt"
+	"github.com/elliotcourant/notbadger/table"
 	"github.com/elliotcourant/notbadger/z"
+	"math"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -27,6 +30,61 @@ type (
 	levelCompactionStatus struct {
 		ranges     []keyRange
 		deleteSize int64
+
+		// activeCompactions and compactingSize describe the compactions that are currently compacting tables out of
+		// this level. compactedSize is the total size of the tables that have been compacted out of this level and
+		// merged with the next level since the database was opened, and writtenSize is the total size of the tables
+		// those compactions wrote. Both must be accessed via atomics.
+		activeCompactions int
+		compactingSize    int64
+		compactedSize     int64
+		writtenSize       int64
+	}
+
+	// CompactionStats describes the compactions of a single level of a partition. Comparing the compacted bytes over
+	// time with the rate of writes tells whether compactions are keeping up.
+	CompactionStats struct {
+		PartitionId PartitionId
+		Level       uint8
+
+		// ActiveCompactions is the number of compactions that are currently compacting tables out of the level.
+		ActiveCompactions int
+
+		// CompactingBytes is the size of the tables that are being compacted out of the level, along with the tables
+		// of the next level that they are being merged with.
+		CompactingBytes int64
+
+		// CompactedBytes is the total size of the tables that have been compacted out of the level, along with the
+		// tables of the next level they were merged with, since the database was opened.
+		CompactedBytes int64
+
+		// WrittenBytes is the total size of the tables that were written by the compactions out of the level since the
+		// database was opened. Dividing it by the size of the tables that were flushed gives the write amplification
+		// of the compactions.
+		WrittenBytes int64
+	}
+
+	// compactDef describes a single compaction of tables from one level into the next level of a partition.
+	compactDef struct {
+		partitionId PartitionId
+
+		thisLevel *levelHandler
+		nextLevel *levelHandler
+
+		top []*table.Table
+		bot []*table.Table
+
+		thisRange keyRange
+		nextRange keyRange
+
+		thisSize int64
+
+		// dropPrefix is a prefix of keys that should be discarded entirely by the compaction.
+		dropPrefix []byte
+
+		// collapsedRangeDeletes are the range deletes that were discarded by the compaction, they are set by
+		// compactBuildTables.
+		collapsedRangeDeletes []rangeDelete
 	}
 )
 
@@ -40,6 +98,10 @@ func (r keyRange) equals(destination keyRange) bool {
 		r.infinite == destination.infinite
 }
 
+func (r keyRange) isEmpty() bool {
+	return len(r.left) == 0 && len(r.right) == 0 && !r.infinite
+}
+
 func (r keyRange) overlapsWith(destination keyRange) bool {
 	// If either one of the ranges is infinite then it will overlap.
 	// TODO (elliotcourant) This logic was copied from badger, but this seems weird. Double check this.
@@ -60,3 +122,236 @@ func (r keyRange) overlapsWith(destination keyRange) bool {
 	// Under any other scenarios the key ranges would overlap.
 	return true
 }
+
+// extend grows the key range so that it also covers the provided key range. Extending an empty range results in the
+// provided range, and extending with an infinite range results in an infinite range.
+func (r *keyRange) extend(other keyRange) {
+	if other.isEmpty() {
+		return
+	}
+
+	if r.isEmpty() {
+		*r = other
+		return
+	}
+
+	if other.infinite {
+		r.infinite = true
+	}
+
+	if len(r.left) == 0 || (len(other.left) > 0 && z.CompareKeys(other.left, r.left) < 0) {
+		r.left = other.left
+	}
+
+	if len(r.right) == 0 || (len(other.right) > 0 && z.CompareKeys(other.right, r.right) > 0) {
+		r.right = other.right
+	}
+}
+
+// deleteSize returns the total size of the tables that are currently being compacted out of the provided level.
+func (cs *compactionStatus) deleteSize(level uint8) int64 {
+	cs.RLock()
+	defer cs.RUnlock()
+	return cs.levels[level].deleteSize
+}
+
+// overlapsWith returns true if the provided key range overlaps with any compaction that is currently in progress for
+// the provided level.
+func (cs *compactionStatus) overlapsWith(level uint8, r keyRange) bool {
+	cs.RLock()
+	defer cs.RUnlock()
+	return cs.levels[level].overlapsWith(r)
+}
+
+// compareAndAdd reserves the key ranges of the provided compaction on both of its levels, or only on its own level if it
+// merges tables within a single level. If either of the ranges overlap with a compaction that is already in progress
+// then nothing is reserved and false is returned. Each partition has its own compaction status, so the compaction must
+// belong to the provided partition.
+func (cs *compactionStatus) compareAndAdd(partitionId PartitionId, cd compactDef) bool {
+	cs.Lock()
+	defer cs.Unlock()
+
+	z.AssertTruef(cd.partitionId == partitionId,
+		"compaction for partition %d added to partition %d", cd.partitionId, partitionId)
+
+	level := cd.thisLevel.level
+	z.AssertTruef(int(level) < len(cs.levels)-1, "got level %d. max levels: %d", level, len(cs.levels))
+
+	thisLevel, nextLevel := cs.levels[level], cs.levels[level+1]
+	if thisLevel.overlapsWith(cd.thisRange) || (!cd.withinLevel() && nextLevel.overlapsWith(cd.nextRange)) {
+		return false
+	}
+
+	thisLevel.ranges = append(thisLevel.ranges, cd.thisRange)
+	if !cd.withinLevel() {
+		nextLevel.ranges = append(nextLevel.ranges, cd.nextRange)
+	}
+	thisLevel.deleteSize += cd.thisSize
+	thisLevel.activeCompactions++
+	thisLevel.compactingSize += cd.size()
+
+	return true
+}
+
+// reserveAll reserves every key range of every level so no compaction can be started. This only succeeds if there are
+// no compactions in progress, false is returned otherwise. The reservation must be released with releaseAll.
+func (cs *compactionStatus) reserveAll() bool {
+	cs.Lock()
+	defer cs.Unlock()
+
+	for _, level := range cs.levels {
+		if len(level.ranges) > 0 {
+			return false
+		}
+	}
+
+	for _, level := range cs.levels {
+		level.ranges = append(level.ranges, infiniteRange)
+	}
+
+	return true
+}
+
+// releaseAll releases the reservation that was made by reserveAll.
+func (cs *compactionStatus) releaseAll() {
+	cs.Lock()
+	defer cs.Unlock()
+
+	for _, level := range cs.levels {
+		z.AssertTruef(len(level.ranges) == 1 && level.ranges[0].equals(infiniteRange),
+			"expected only the reserved range, got %v", level.ranges)
+		level.ranges = nil
+	}
+}
+
+// delete releases the key ranges that were reserved for the provided compaction by compareAndAdd.
+func (cs *compactionStatus) delete(cd compactDef) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	level := cd.thisLevel.level
+	z.AssertTruef(int(level) < len(cs.levels)-1, "got level %d. max levels: %d", level, len(cs.levels))
+
+	thisLevel, nextLevel := cs.levels[level], cs.levels[level+1]
+	thisLevel.deleteSize -= cd.thisSize
+	thisLevel.activeCompactions--
+	thisLevel.compactingSize -= cd.size()
+	found := thisLevel.remove(cd.thisRange)
+	if !cd.withinLevel() && !cd.nextRange.isEmpty() {
+		found = nextLevel.remove(cd.nextRange) && found
+	}
+
+	z.AssertTruef(found, "key range not found in compaction status. this: %s next: %s", cd.thisRange, cd.nextRange)
+}
+
+// compacted adds the size of a compaction that finished successfully, and the size of the tables that it wrote, to the
+// totals of its level.
+func (cs *compactionStatus) compacted(cd compactDef, writtenSize int64) {
+	atomic.AddInt64(&cs.levels[cd.thisLevel.level].compactedSize, cd.size())
+	atomic.AddInt64(&cs.levels[cd.thisLevel.level].writtenSize, writtenSize)
+}
+
+// stats returns the compaction statistics of every level of the partition.
+func (cs *compactionStatus) stats(partitionId PartitionId) []CompactionStats {
+	cs.RLock()
+	defer cs.RUnlock()
+
+	stats := make([]CompactionStats, len(cs.levels))
+	for i, level := range cs.levels {
+		stats[i] = CompactionStats{
+			PartitionId:       partitionId,
+			Level:             uint8(i),
+			ActiveCompactions: level.activeCompactions,
+			CompactingBytes:   level.compactingSize,
+			CompactedBytes:    atomic.LoadInt64(&level.compactedSize),
+			WrittenBytes:      atomic.LoadInt64(&level.writtenSize),
+		}
+	}
+
+	return stats
+}
+
+func (lcs *levelCompactionStatus) overlapsWith(destination keyRange) bool {
+	for _, r := range lcs.ranges {
+		if r.overlapsWith(destination) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (lcs *levelCompactionStatus) remove(destination keyRange) bool {
+	final := lcs.ranges[:0]
+	var found bool
+	for _, r := range lcs.ranges {
+		if !r.equals(destination) {
+			final = append(final, r)
+		} else {
+			found = true
+		}
+	}
+
+	lcs.ranges = final
+	return found
+}
+
+// withinLevel returns true if the compaction merges tables of a level into new tables in the same level.
+func (cd *compactDef) withinLevel() bool {
+	return cd.thisLevel == cd.nextLevel
+}
+
+// lockLevels acquires a read lock on both levels of the compaction so that their tables do not change while the
+// tables for the compaction are being picked.
+func (cd *compactDef) lockLevels() {
+	cd.thisLevel.RLock()
+	if !cd.withinLevel() {
+		cd.nextLevel.RLock()
+	}
+}
+
+func (cd *compactDef) unlockLevels() {
+	if !cd.withinLevel() {
+		cd.nextLevel.RUnlock()
+	}
+	cd.thisLevel.RUnlock()
+}
+
+// size returns the total size of the tables of both levels that are being compacted.
+func (cd *compactDef) size() int64 {
+	var size int64
+	for _, t := range cd.top {
+		size += t.Size()
+	}
+
+	for _, t := range cd.bot {
+		size += t.Size()
+	}
+
+	return size
+}
+
+// getKeyRange returns the smallest key range that contains every version of every key in the provided tables.
+func getKeyRange(tables ...*table.Table) keyRange {
+	if len(tables) == 0 {
+		return keyRange{}
+	}
+
+	smallest, largest := tables[0].Smallest(), tables[0].Largest()
+	for _, t := range tables[1:] {
+		if z.CompareKeys(t.Smallest(), smallest) < 0 {
+			smallest = t.Smallest()
+		}
+
+		if z.CompareKeys(t.Largest(), largest) > 0 {
+			largest = t.Largest()
+		}
+	}
+
+	// We pick all the versions of the smallest and the largest key. Note that version zero would be the rightmost
+	// key, considering versions are sorted in descending order.
+	return keyRange{
+		left:  z.KeyWithTs(z.ParseKey(smallest), math.MaxUint64),
+		right: z.KeyWithTs(z.ParseKey(largest), 0),
+	}
+}
@@ -0,0 +1,171 @@
+package notbadger
+
+import (
+	"fmt"
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestCompactionStatus(levels int) *compactionStatus {
+	cs := &compactionStatus{
+		levels: make([]*levelCompactionStatus, levels),
+	}
+	for i := range cs.levels {
+		cs.levels[i] = new(levelCompactionStatus)
+	}
+
+	return cs
+}
+
+// newTestKeyRange returns a key range that includes every version of the left and right keys, like getKeyRange.
+func newTestKeyRange(left, right string) keyRange {
+	return keyRange{
+		left:  z.KeyWithTs([]byte(left), math.MaxUint64),
+		right: z.KeyWithTs([]byte(right), 0),
+	}
+}
+
+func TestCompactionStatus_CompareAndAdd(t *testing.T) {
+	cs := newTestCompactionStatus(3)
+	levelOne, levelTwo := &levelHandler{level: 1}, &levelHandler{level: 2}
+
+	first := compactDef{
+		thisLevel: levelOne,
+		nextLevel: levelTwo,
+		thisRange: newTestKeyRange("a", "c"),
+		nextRange: newTestKeyRange("a", "d"),
+		thisSize:  10,
+	}
+	require.True(t, cs.compareAndAdd(0, first))
+	require.True(t, cs.overlapsWith(1, newTestKeyRange("b", "b")))
+	require.True(t, cs.overlapsWith(2, newTestKeyRange("d", "e")))
+	require.False(t, cs.overlapsWith(1, newTestKeyRange("x", "z")))
+	require.Equal(t, int64(10), cs.deleteSize(1))
+
+	// A compaction whose next level overlaps with the reserved range should be rejected.
+	second := compactDef{
+		thisLevel: levelOne,
+		nextLevel: levelTwo,
+		thisRange: newTestKeyRange("e", "f"),
+		nextRange: newTestKeyRange("d", "f"),
+	}
+	require.False(t, cs.compareAndAdd(0, second))
+
+	// Once the first compaction is released the second one can proceed.
+	cs.delete(first)
+	require.False(t, cs.overlapsWith(1, infiniteRange))
+	require.Equal(t, int64(0), cs.deleteSize(1))
+	require.True(t, cs.compareAndAdd(0, second))
+	cs.delete(second)
+}
+
+func TestCompactionStatus_CompareAndAdd_Concurrent(t *testing.T) {
+	cs := newTestCompactionStatus(3)
+	levelOne, levelTwo := &levelHandler{level: 1}, &levelHandler{level: 2}
+
+	// Every worker tries to reserve the same overlapping range, only one of them should ever hold it at a time.
+	const workers = 16
+	var holders, maxHolders, reservations int32
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cd := compactDef{
+				thisLevel: levelOne,
+				nextLevel: levelTwo,
+				thisRange: newTestKeyRange("a", fmt.Sprintf("m%02d", i)),
+				nextRange: newTestKeyRange("a", "z"),
+			}
+
+			for attempt := 0; attempt < 100; attempt++ {
+				if !cs.compareAndAdd(0, cd) {
+					continue
+				}
+
+				current := atomic.AddInt32(&holders, 1)
+				for {
+					max := atomic.LoadInt32(&maxHolders)
+					if current <= max || atomic.CompareAndSwapInt32(&maxHolders, max, current) {
+						break
+					}
+				}
+				atomic.AddInt32(&reservations, 1)
+				atomic.AddInt32(&holders, -1)
+				cs.delete(cd)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), maxHolders)
+	require.True(t, reservations > 0)
+	require.False(t, cs.overlapsWith(1, infiniteRange))
+	require.False(t, cs.overlapsWith(2, infiniteRange))
+}
+
+func TestKeyRange_Extend(t *testing.T) {
+	tests := []struct {
+		name        string
+		base, other keyRange
+		expected    keyRange
+	}{
+		{"empty with empty", keyRange{}, keyRange{}, keyRange{}},
+		{"empty with range", keyRange{}, newTestKeyRange("b", "d"), newTestKeyRange("b", "d")},
+		{"range with empty", newTestKeyRange("b", "d"), keyRange{}, newTestKeyRange("b", "d")},
+		{"contained range", newTestKeyRange("a", "z"), newTestKeyRange("b", "d"), newTestKeyRange("a", "z")},
+		{"extend left", newTestKeyRange("c", "e"), newTestKeyRange("a", "d"), newTestKeyRange("a", "e")},
+		{"extend right", newTestKeyRange("c", "e"), newTestKeyRange("d", "g"), newTestKeyRange("c", "g")},
+		{"disjoint ranges", newTestKeyRange("x", "z"), newTestKeyRange("a", "b"), newTestKeyRange("a", "z")},
+		{"empty with infinite", keyRange{}, infiniteRange, infiniteRange},
+		{"infinite with range", infiniteRange, newTestKeyRange("b", "d"), keyRange{
+			left:     newTestKeyRange("b", "d").left,
+			right:    newTestKeyRange("b", "d").right,
+			infinite: true,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := test.base
+			r.extend(test.other)
+			require.True(t, r.equals(test.expected), "expected %s, got %s", test.expected, r)
+		})
+	}
+
+	// Once a range has been extended with an infinite range it overlaps with everything.
+	r := newTestKeyRange("b", "d")
+	r.extend(infiniteRange)
+	require.True(t, r.infinite)
+	require.True(t, r.overlapsWith(newTestKeyRange("x", "z")))
+}
+
+func TestGetKeyRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	tables := buildTestLevelTables(t, dir,
+		[2]string{"e", "g"},
+		[2]string{"a", "c"},
+		[2]string{"i", "k"},
+	)
+	defer func() {
+		require.NoError(t, decrementReferences(tables))
+	}()
+
+	require.True(t, getKeyRange().isEmpty())
+	require.True(t, getKeyRange(tables[0]).equals(newTestKeyRange("e", "g")))
+	require.True(t, getKeyRange(tables...).equals(newTestKeyRange("a", "k")))
+
+	// The range of several tables should be the union of the range of each table.
+	var union keyRange
+	for _, tbl := range tables {
+		union.extend(getKeyRange(tbl))
+	}
+	require.True(t, union.equals(getKeyRange(tables...)))
+}
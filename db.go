@@ -1,16 +1,19 @@
 package notbadger
 
 import (
+	"bytes"
 	"github.com/elliotcourant/timber"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/ristretto"
-	"github.com/elliotcourant/notbadger/options"
 	"github.com/elliotcourant/notbadger/skiplist"
+	"github.com/elliotcourant/notbadger/table"
 	"github.com/elliotcourant/notbadger/z"
 	"github.com/pkg/errors"
 	"golang.org/x/net/trace"
@@ -19,12 +22,38 @@ import (
 var (
 	notBadgerPrefix   = []byte("!notbgr!")        // Prefix for internal keys used by badger.
 	head              = []byte("!notbgr!head")    // For storing value offset for replay.
+	replayHead        = []byte("!notbgr!replay")  // For storing where replay of the value log starts.
 	transactionKey    = []byte("!notbgr!txn")     // For indicating end of entries in txn.
+	dropPartitionKey  = []byte("!notbgr!drop")    // For indicating a partition was dropped in the value log.
 	notBadgerMove     = []byte("!notbgr!move")    // For key-value pairs which got moved during GC.
 	lfDiscardStatsKey = []byte("!notbgr!discard") // For storing lfDiscardStats
+	rangeDeleteKey    = []byte("!notbgr!range")   // Prefix for range deletes.
+)
+
+// isInternalKey returns true if the key is used internally by the database. Internal keys cannot be written by users and
+// are hidden from iterators unless IteratorOptions.InternalAccess is set.
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, notBadgerPrefix)
+}
+
+const (
+	// writeChannelCapacity is the number of requests that can be queued on the write channel before senders block.
+	writeChannelCapacity = 1000
 )
 
 type (
+	// DB is the database. Its locks must always be acquired in the order below, and a lock must never be acquired
+	// while a lock that comes after it in the order is held. Operations on more than one partition lock the memory
+	// tables of the partitions in ascending order of their Ids with lockPartitions.
+	//
+	//  1. oracle.writeChannelLock, then the oracle itself.
+	//  2. DB.flushLock.
+	//  3. DB.partitionsWriteLock, then DB.partitionsReadLock.
+	//  4. partitionMemoryTables, in ascending order of partition Id.
+	//  5. levelsController.partitionsLock.
+	//  6. compactionStatus or partitionLevels.summaryLock, then levelHandler in ascending order of level.
+	//  7. valueLog.filesLock, then logFile, or writeAheadLog.lock.
+	//  8. rangeDeletes.lock.
 	DB struct {
 		// eventLog is for debugging and doing traces within NotBadger.
 		eventLog trace.EventLog
@@ -32,24 +61,38 @@ type (
 		// TODO (elliotcourant) add meaningful comment.
 		directoryLockGuard *directoryLockGuard
 
-		// valueDirectoryLockGuard will be nil if the primary directory and the value directory are the same.
-		valueDirectoryLockGuard *directoryLockGuard
+		// valueDirectoryLockGuards holds a lock for every value directory that is not the primary directory. It will be
+		// empty if the value log is stored in the primary directory.
+		valueDirectoryLockGuards []*directoryLockGuard
 
 		// partitions represents the groups of in memory tables that will be used for each partition.
 		partitions          map[PartitionId]*partitionMemoryTables
 		partitionsReadLock  sync.RWMutex
 		partitionsWriteLock sync.Mutex
 
+		// flushLock makes sure that only one caller writes memory tables to level 0 at a time, since handleFlushTask
+		// must be run serially.
+		flushLock sync.Mutex
+
 		// levelsController manages the individual tables for each partition.
 		levelsController *levelsController
 
 		valueLog valueLog
 
-		// less than or equal to a pointer to the last valueLog value put into any of the partitions active table.
-		valueHead valuePointer
+		// writeAheadLog is written to instead of the value log when UseWAL is set.
+		writeAheadLog writeAheadLog
+
+		// rangeDeletes are the range deletes of every partition that have not been discarded by compactions.
+		rangeDeletes rangeDeletes
+
+		// publisher delivers the committed entries to the subscribers created by Subscribe.
+		publisher *publisher
 
 		writeChannel chan *request
 
+		// flushChannel receives the partitions that have memory tables to write to level 0, see doFlushes.
+		flushChannel chan flushRequest
+
 		manifest   *manifestFile
 		blockCache *ristretto.Cache
 
@@ -64,6 +107,10 @@ type (
 
 		// closeOnce is used to make sure that the database can only be closed once.
 		closeOnce sync.Once
+
+		// blockWrites is set to 1 when the database is closing and new writes should be rejected. Must be accessed
+		// via atomics.
+		blockWrites int32
 	}
 
 	// TODO (elliotcourant) Add meaningful comment.
@@ -75,21 +122,77 @@ type (
 		// partition.
 		active *skiplist.SkipList
 
-		// flushed is equivalent to badger's DB.imm. Add here only AFTER pushing to the flush channel.
+		// flushed is equivalent to badger's DB.imm. These are the memory tables that have been rotated out and are
+		// waiting to be written to level 0, oldest first. Tables are appended by rotate and removed by removeOldest
+		// once they have been written, writes wait while the partition has numMemoryTables of them, see isFull.
 		flushed []*skiplist.SkipList
+
+		// maxTableSize and numMemoryTables default to the MaxTableSize and NumMemoryTables options, but can be changed
+		// for each partition with SetPartitionOptions.
+		maxTableSize    int64
+		numMemoryTables int
+
+		// activeMaxTableSize is the max table size the arena of the active table was sized for. This can be smaller
+		// than maxTableSize if maxTableSize was increased after the active table was created.
+		activeMaxTableSize int64
+
+		// adaptiveTableSize is the size that new memory tables of the partition have grown to with the rate of writes
+		// when AdaptiveMaxTableSize is set, see adaptTableSize. It is never used when it is below maxTableSize.
+		// activeCreatedAt is when the active table was created, and activeFilledAt is when it first had no room for a
+		// write or zero while it still has room.
+		adaptiveTableSize int64
+		activeCreatedAt   time.Time
+		activeFilledAt    time.Time
+
+		// activeHead points to the last entry in the value log that was written to the active table, and flushedHeads
+		// holds the same for each of the flushed tables. The head is stored in the level 0 table when a memory table is
+		// flushed so the entries before it are not replayed from the value log when the database is opened.
+		activeHead   valuePointer
+		flushedHeads []valuePointer
+
+		// activeFirst points to the first entry in the value log that was written to the active table, and flushedFirsts
+		// holds the same for each of the flushed tables. Every entry in the value log before the first entry of every
+		// memory table is already in a level 0 table, see replayStart.
+		activeFirst   valuePointer
+		flushedFirsts []valuePointer
+
+		// activeLogFileId is the first write-ahead log file with an entry that was written to the active table, and
+		// flushedLogFileIds holds the same for each of the flushed tables. They are zero for tables that don't have any
+		// entries from the write-ahead log.
+		activeLogFileId   uint32
+		flushedLogFileIds []uint32
+
+		// dropped is set once the partition has been dropped and removed from DB.partitions, its tables are released.
+		// Anything that looked the partition up before it was dropped must look it up again.
+		dropped bool
 	}
 
-	// TODO (elliotcourant) Add meaningful comment.
+	// flushTask is a request to write a memory table of a partition to a level 0 table.
 	flushTask struct {
+		partitionId  PartitionId
 		memoryTable  *skiplist.SkipList
 		valuePointer valuePointer
-		dropPrefix   []byte
+
+		// replayStart is stored in the level 0 table so that replay of the value log can start there when the database is
+		// opened, see replayStart.
+		replayStart valuePointer
+
+		// dropPrefix is a prefix of keys that should not be written to the level 0 table.
+		dropPrefix []byte
+	}
+
+	// flushRequest asks the flush goroutine to write the flushed memory tables of a partition to level 0. The active table
+	// is rotated and written as well when includeActive is set. The result of the flush is sent on done if it is not nil.
+	flushRequest struct {
+		partitionId   PartitionId
+		includeActive bool
+		done          chan error
 	}
 
 	closers struct {
 		updateSize            *z.Closer
 		compactors            *z.Closer
-		memoryTable           *z.Closer // TODO this might need to be split for partitions
+		memoryTable           *z.Closer
 		writes                *z.Closer
 		valueGarbageCollector *z.Closer
 		publish               *z.Closer
@@ -97,27 +200,26 @@ type (
 )
 
 func Open(opts Options) (db *DB, err error) {
-	if opts.InMemory && (opts.Directory != "" || opts.ValueDirectory != "") {
-		return nil, errors.New("Cannot use badger in Disk-less mode with Directory or ValueDirectory set")
+	if err := opts.validate(); err != nil {
+		return nil, err
 	}
 
-	opts.maxBatchSize = (15 * opts.MaxTableSize) / 100
-	opts.maxBatchCount = opts.maxBatchSize / int64(skiplist.MaxNodeSize)
+	if opts.TrackTableReferences {
+		opts.tableReferences = table.NewReferenceTracker()
+	}
 
-	// We are limiting opt.ValueThreshold to maxValueThreshold for now.
-	if opts.ValueThreshold > maxValueThreshold {
-		return nil, errors.Errorf(
-			"Invalid ValueThreshold, must be less or equal to %d",
-			maxValueThreshold,
-		)
+	if opts.clock == nil {
+		opts.clock = z.NewMonotonicClock()
 	}
 
-	if !(opts.ValueLogFileSize <= 2<<30 && opts.ValueLogFileSize >= 1<<20) {
-		return nil, ErrValueLogSize
+	if opts.FileSystem == nil {
+		opts.FileSystem = z.OSFileSystem
 	}
 
-	if !(opts.ValueLogLoadingMode == options.FileIO || opts.ValueLogLoadingMode == options.MemoryMap) {
-		return nil, ErrInvalidLoadingMode
+	opts.maxBatchSize = (15 * opts.MaxTableSize) / 100
+	opts.maxBatchCount = opts.maxBatchSize / int64(skiplist.MaxNodeSize)
+	if err := checkArenaSize(opts, opts.MaxTableSize); err != nil {
+		return nil, err
 	}
 
 	// Compact L0 on close if either it is set or if KeepL0InMemory is set. When keepL0InMemory is set we need to
@@ -131,7 +233,8 @@ func Open(opts Options) (db *DB, err error) {
 		opts.CompactL0OnClose = false
 	}
 
-	var directoryLockGuard, valueDirectoryLockGuard *directoryLockGuard
+	var valueDirectoryLockGuards []*directoryLockGuard
+	var directoryLockGuard *directoryLockGuard
 
 	// Create directories and acquire lock on it only if badger is not running in InMemory mode. We don't have any
 	// directories/files in InMemory mode so we don't need to acquire any locks on them.
@@ -158,27 +261,36 @@ func Open(opts Options) (db *DB, err error) {
 			return nil, err
 		}
 
-		absoluteValueDirectoryPath, err := filepath.Abs(opts.ValueDirectory)
-		if err != nil {
-			return nil, err
-		}
+		// Make sure that if something fails later on we still clean up the value directory locks.
+		defer func() {
+			for _, guard := range valueDirectoryLockGuards {
+				_ = guard.release()
+			}
+		}()
 
-		// If the value directory path is not the same as the normal directory path then we need to acquire a directory
+		// If a value directory path is not the same as the normal directory path then we need to acquire a directory
 		// lock on the value directory as well. We want to do this comparison with the absolute paths to make sure that
 		// the paths are actually the same. It's possible to provide a path to the same directory as different strings
 		// but by resolving the absolute directory we know the actual path and can compare them.
-		if absoluteValueDirectoryPath != absoluteDirectoryPath {
-			valueDirectoryLockGuard, err = acquireDirectoryLock(opts.ValueDirectory, lockFileName, opts.ReadOnly)
+		lockedPaths := map[string]struct{}{
+			absoluteDirectoryPath: {},
+		}
+		for _, valueDirectory := range opts.valueDirectories() {
+			absoluteValueDirectoryPath, err := filepath.Abs(valueDirectory)
 			if err != nil {
 				return nil, err
 			}
 
-			// Make sure that if something fails later on we still clean up this directory lock.
-			defer func() {
-				if valueDirectoryLockGuard != nil {
-					_ = valueDirectoryLockGuard.release()
-				}
-			}()
+			if _, ok := lockedPaths[absoluteValueDirectoryPath]; ok {
+				continue
+			}
+			lockedPaths[absoluteValueDirectoryPath] = struct{}{}
+
+			guard, err := acquireDirectoryLock(valueDirectory, lockFileName, opts.ReadOnly)
+			if err != nil {
+				return nil, err
+			}
+			valueDirectoryLockGuards = append(valueDirectoryLockGuards, guard)
 		}
 	}
 
@@ -214,21 +326,22 @@ func Open(opts Options) (db *DB, err error) {
 	}
 
 	db = &DB{
-		blockCache:              cache,
-		closeOnce:               sync.Once{},
-		directoryLockGuard:      directoryLockGuard,
-		eventLog:                eventLog,
-		manifest:                manifestFile,
-		partitions:              make(map[PartitionId]*partitionMemoryTables),
-		partitionsReadLock:      sync.RWMutex{},
-		partitionsWriteLock:     sync.Mutex{},
-		options:                 opts,
-		oracle:                  newOracle(opts),
-		size:                    &databaseSize{},
-		valueDirectoryLockGuard: valueDirectoryLockGuard,
-		valueHead:               valuePointer{},
-		valueLog:                valueLog{},
-		writeChannel:            nil,
+		blockCache:               cache,
+		closeOnce:                sync.Once{},
+		directoryLockGuard:       directoryLockGuard,
+		eventLog:                 eventLog,
+		manifest:                 manifestFile,
+		partitions:               make(map[PartitionId]*partitionMemoryTables),
+		partitionsReadLock:       sync.RWMutex{},
+		partitionsWriteLock:      sync.Mutex{},
+		options:                  opts,
+		oracle:                   newOracle(opts),
+		publisher:                newPublisher(),
+		size:                     &databaseSize{},
+		valueDirectoryLockGuards: valueDirectoryLockGuards,
+		valueLog:                 valueLog{directoryPaths: opts.valueDirectories()},
+		writeChannel:             make(chan *request, writeChannelCapacity),
+		flushChannel:             make(chan flushRequest, opts.NumMemoryTables),
 	}
 
 	if db.options.InMemory {
@@ -236,18 +349,38 @@ func Open(opts Options) (db *DB, err error) {
 		db.options.ValueThreshold = maxValueThreshold
 	}
 
+	// If the database fails to open then the goroutines that were started below are stopped and everything that was
+	// opened is closed again, this is skipped once the database has been opened.
+	opening := db
+	defer func() {
+		if opening != nil {
+			opening.abortOpen()
+		}
+	}()
+
 	keyRegistryOptions := KeyRegistryOptions{
 		Directory:                     opts.Directory,
 		ReadOnly:                      opts.ReadOnly,
 		EncryptionKey:                 opts.EncryptionKey,
 		EncryptionKeyRotationDuration: opts.EncryptionKeyRotationDuration,
 		InMemory:                      opts.InMemory,
+		FileSystem:                    opts.FileSystem,
 	}
 
 	if db.registry, err = OpenKeyRegistry(keyRegistryOptions); err != nil {
 		return nil, err
 	}
 
+	if !opts.InMemory {
+		if err := db.valueLog.open(db); err != nil {
+			return nil, err
+		}
+
+		if err := db.writeAheadLog.open(db); err != nil {
+			return nil, err
+		}
+	}
+
 	// Calculate the size of the database on the disk.
 	db.calculateSize()
 	db.closers.updateSize = z.NewCloser(1)
@@ -255,127 +388,1639 @@ func Open(opts Options) (db *DB, err error) {
 	go db.updateSize(db.closers.updateSize)
 
 	// 0 is the default partition.
-	db.partitions[0] = &partitionMemoryTables{
-		active:  skiplist.NewSkiplist(arenaSize(db.options)),
-		flushed: make([]*skiplist.SkipList, db.options.NumMemoryTables),
-	}
+	db.partitions[0] = db.newPartitionMemoryTables()
 
 	// newLevelsController potentially loads files in the directory.
 	if db.levelsController, err = newLevelsController(db, &manifest); err != nil {
 		return nil, err
 	}
 
+	if err := db.loadRangeDeletes(); err != nil {
+		return nil, err
+	}
+
+	// The head key is written with the latest commit timestamp whenever a memory table is flushed, so the next
+	// transaction timestamp will always be greater than any version that has been persisted.
+	headKey := z.KeyWithTs(head, math.MaxUint64)
+	headValue, err := db.get(0, headKey)
+	if err != nil {
+		return nil, z.Wrapf(err, "failed to retrieve head")
+	}
+	db.oracle.nextTransactionTimestamp = headValue.Version + 1
+
+	// Memory tables are rotated while the log is replayed, so they need to be flushed from here on. Nothing can be
+	// flushed in read only mode.
+	if !opts.ReadOnly {
+		// Flushes that stall on level 0 compact it before the compactors are started, compactions read the closer of
+		// the compactors so it has to exist before anything is flushed.
+		db.closers.compactors = z.NewCloser(0)
+		db.closers.memoryTable = z.NewCloser(1)
+		go db.doFlushes(db.closers.memoryTable)
+	}
+
+	if !opts.InMemory {
+		if err := db.replayValueLog(); err != nil {
+			return nil, err
+		}
+
+		if err := db.replayWriteAheadLog(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every version up to the head, and every version in the value log, has already been committed, so new read
+	// timestamps should not wait on them.
+	db.oracle.transactionMark.SetDoneUntil(db.oracle.nextTransactionTimestamp - 1)
+	db.oracle.readMark.SetDoneUntil(db.oracle.nextTransactionTimestamp - 1)
+	db.levelsController.initDiscardTimestamps(headValue.Version)
+
+	// Compactions are only started once the logs have been replayed, until then the flushes that stall on level 0
+	// compact it themselves, see addLevel0Table.
 	if !opts.ReadOnly {
-		db.closers.compactors = z.NewCloser(1)
-		// TODO left off here.
+		db.levelsController.startCompaction(db.closers.compactors)
 	}
 
-	valueDirectoryLockGuard = nil
+	db.closers.writes = z.NewCloser(1)
+	go db.doWrites(db.closers.writes)
+
+	db.closers.publish = z.NewCloser(1)
+	go db.publisher.listenForUpdates(db.closers.publish)
+
+	valueDirectoryLockGuards = nil
 	directoryLockGuard = nil
 	manifestFile = nil
+	opening = nil
 
 	return db, nil
 }
 
-// handleFlushTask must be run serially.
-func (db *DB) handleFlushTask(task flushTask) error {
-	// There can be a scenario, when an empty memory table is flushed. For example, when the memory
-	// table is empty and after writing the request to the value log, the rotation count exceeds
-	// db.LogRotatesToFlush.
-	if task.memoryTable.Empty() {
+// abortOpen stops the goroutines that Open started and closes what it opened when the database fails to open. The
+// directory locks and the manifest are released by Open itself. The errors are ignored, the error that stopped Open is
+// the one that is returned.
+func (db *DB) abortOpen() {
+	if db.closers.memoryTable != nil {
+		db.closers.memoryTable.SignalAndWait()
+	}
+
+	if db.closers.compactors != nil {
+		db.closers.compactors.SignalAndWait()
+	}
+
+	if db.closers.updateSize != nil {
+		db.closers.updateSize.SignalAndWait()
+	}
+	db.oracle.closer.SignalAndWait()
+
+	if db.levelsController != nil {
+		_ = db.levelsController.close()
+	}
+
+	_ = db.valueLog.close()
+	_ = db.writeAheadLog.close(false)
+	if db.registry != nil {
+		_ = db.registry.Close()
+	}
+	db.blockCache.Close()
+}
+
+// replayValueLog writes the entries in the value log that are not in the tables of their partitions back into the
+// memory tables. The head stored with the tables of each partition points to the last entry that was in the memory
+// tables that were flushed, so every entry up to it is skipped. Replay starts at the newest replay start stored with the
+// tables of any partition, or at the beginning of the value log for a new database. Only transactions that were
+// completely written to the value log are replayed, a transaction that was cut short by a crash is not applied to any
+// of its partitions.
+func (db *DB) replayValueLog() error {
+	headKey, replayKey := z.KeyWithTs(head, math.MaxUint64), z.KeyWithTs(replayHead, math.MaxUint64)
+	heads := map[PartitionId]valuePointer{}
+	var replayStart valuePointer
+	for _, partitionId := range db.Partitions() {
+		headValue, err := db.get(partitionId, headKey)
+		if err != nil {
+			return z.Wrapf(err, "failed to retrieve head for partition %d", partitionId)
+		}
+
+		// The head is written to the default partition without a pointer when another partition is flushed.
+		var pointer valuePointer
+		if err := pointer.Decode(headValue.Value); err == nil {
+			heads[partitionId] = pointer
+		}
+
+		replayValue, err := db.get(partitionId, replayKey)
+		if err != nil {
+			return z.Wrapf(err, "failed to retrieve replay start for partition %d", partitionId)
+		}
+
+		// Tables that were flushed before anything was in the value log don't have a replay start.
+		var start valuePointer
+		if err := start.Decode(replayValue.Value); err == nil && replayStart.Less(start) {
+			replayStart = start
+		}
+	}
+
+	start := time.Now()
+	var replayed int
+	// The flush goroutine reads the next timestamp while the log is replayed.
+	raiseNextTimestamp := func(version uint64) {
+		db.oracle.Lock()
+		if version >= db.oracle.nextTransactionTimestamp {
+			db.oracle.nextTransactionTimestamp = version + 1
+		}
+		db.oracle.Unlock()
+	}
+
+	maxVersion, err := db.valueLog.replay(replayStart, func(entries []*Entry, pointers []valuePointer) error {
+		for i, e := range entries {
+			if head := heads[e.partitionId]; !head.IsZero() && !head.Less(pointers[i]) {
+				continue
+			}
+
+			// The head written by a flush while replaying must be newer than the entries that were replayed.
+			raiseNextTimestamp(z.ParseTs(e.Key))
+			if err := db.makeRoomForReplay(e.partitionId); err != nil {
+				return err
+			}
+
+			if err := db.writeToLSM(&request{
+				Entries:  []*Entry{e},
+				Pointers: []valuePointer{pointers[i]},
+			}); err != nil {
+				return err
+			}
+			replayed++
+		}
+
 		return nil
+	})
+	if err != nil {
+		return z.Wrapf(err, "failed to replay value log")
 	}
 
-	// TODO (elliotcourant) Add Option logging.
-	db.eventLog.Printf("storing offset: %+v\n", task.valuePointer)
-	value := task.valuePointer.Encode()
+	raiseNextTimestamp(maxVersion)
+	db.eventLog.Printf("Replayed %d entries from the value log in %s", replayed, time.Since(start))
 
-	// Pick the max commit ts, so in case of crash, our read ts would be higher than all the commits
-	headTimestamp := z.KeyWithTs(head, db.oracle.nextTimestamp())
+	return nil
+}
 
-	task.memoryTable.Put(headTimestamp, z.ValueStruct{
-		Value: value,
+// replayWriteAheadLog writes the entries in the write-ahead log back into the memory tables. The files of the log are
+// only removed once every memory table with entries from them has been flushed, so entries that are already in tables
+// are replayed again, which does no harm as they have the same versions. A dropped partition is different, the drop
+// must not be replayed once the partition has been flushed after it. The head that is written by every flush of the
+// partition tells when that happened, so the drop and the entries of the partition before it are skipped.
+func (db *DB) replayWriteAheadLog() error {
+	headKey := z.KeyWithTs(head, math.MaxUint64)
+	applied := map[PartitionId]uint64{}
+	err := db.writeAheadLog.replay(func(req *request, _ uint32) error {
+		for _, e := range req.Entries {
+			if !isDropPartitionEntry(e) {
+				continue
+			}
+
+			headValue, err := db.get(e.partitionId, headKey)
+			if err != nil {
+				return z.Wrapf(err, "failed to retrieve head for partition %d", e.partitionId)
+			}
+
+			if version := z.ParseTs(e.Key); headValue.Version > version && version > applied[e.partitionId] {
+				applied[e.partitionId] = version
+			}
+		}
+
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var replayed int
+	err = db.writeAheadLog.replay(func(req *request, fileId uint32) error {
+		for _, e := range req.Entries {
+			// Commits after a drop can have the same version as the drop.
+			version := z.ParseTs(e.Key)
+			if version < applied[e.partitionId] || (version == applied[e.partitionId] && isDropPartitionEntry(e)) {
+				continue
+			}
+
+			// The head written by a flush while replaying must be newer than the entries that were replayed.
+			db.oracle.Lock()
+			if version >= db.oracle.nextTransactionTimestamp {
+				db.oracle.nextTransactionTimestamp = version + 1
+			}
+			db.oracle.Unlock()
+
+			if err := db.makeRoomForReplay(e.partitionId); err != nil {
+				return err
+			}
+
+			if err := db.writeToLSM(&request{
+				Entries:   []*Entry{e},
+				logFileId: fileId,
+			}); err != nil {
+				return err
+			}
+			replayed++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-	// dataKey, err := db.
+	db.eventLog.Printf("Replayed %d entries from the write-ahead log in %s", replayed, time.Since(start))
 
 	return nil
 }
 
-func (db *DB) updateSize(lc *z.Closer) {
-	defer lc.Done()
-	if db.options.InMemory {
-		return
+// makeRoomForReplay flushes the memory tables of the partition when all of them are full, rather than waiting for the
+// flush goroutine in ensureRoomForWrite. In read only mode nothing can be flushed, so the partition is allowed to keep
+// another memory table instead.
+func (db *DB) makeRoomForReplay(partitionId PartitionId) error {
+	partition := db.getPartition(partitionId)
+	partition.Lock()
+	isFull := partition.isFull() && partition.active.MemSize() >= partition.activeLimit()
+	if isFull && db.options.ReadOnly {
+		partition.numMemoryTables++
 	}
+	partition.Unlock()
 
-	metricsTicker := time.NewTicker(time.Minute)
-	defer metricsTicker.Stop()
+	if !isFull || db.options.ReadOnly {
+		return nil
+	}
 
-	for {
-		select {
-		case <-metricsTicker.C:
-			db.calculateSize()
-		case <-lc.HasBeenClosed():
-			return
+	return z.Wrapf(db.flushPartition(partitionId, true), "failed to flush partition %d", partitionId)
+}
+
+// OpenManaged opens the database like Open, but the read and commit timestamps of transactions are managed by the user.
+// Transactions must be created with NewTransactionAt and committed with CommitAt, and the versions that compactions
+// may discard are set with SetDiscardTimestamp. This is only useful for databases built on top of NotBadger that keep
+// their own timestamps.
+func OpenManaged(opts Options) (*DB, error) {
+	opts.managedTransactions = true
+	return Open(opts)
+}
+
+// SetDiscardTimestamp sets the timestamp at or below which versions of keys can be discarded by compactions when the
+// database was opened with OpenManaged. The newest version at or below the timestamp is still kept. Reads below the
+// timestamp might return ErrVersionDiscarded.
+func (db *DB) SetDiscardTimestamp(ts uint64) error {
+	if !db.oracle.isManaged {
+		return ErrNotManaged
+	}
+
+	db.oracle.setDiscardTimestamp(ts)
+	return nil
+}
+
+// Close closes a DB. It's crucial to call it to ensure all the pending updates make their way to disk. Calling
+// DB.Close() multiple times would still only close the DB once.
+func (db *DB) Close() error {
+	var err error
+	db.closeOnce.Do(func() {
+		err = db.close()
+	})
+
+	return err
+}
+
+// Tables returns the live layout of the LSM tree. Every level of every partition is returned along with the tables
+// that are currently in it, ordered by partition and then by level.
+func (db *DB) Tables() []LevelInfo {
+	return db.levelsController.getLevelInfo()
+}
+
+// CompactionStats returns the compactions that are running and the total size that has been compacted since the
+// database was opened, for every level of every partition. The stats are ordered by partition and then by level.
+func (db *DB) CompactionStats() []CompactionStats {
+	return db.levelsController.getCompactionStats()
+}
+
+// KeySplits returns keys that split the partition into ranges of roughly equal size, in ascending order, which can be
+// used to process the partition in parallel. The first range starts at the prefix and ends before the first split, and
+// the last range starts at the last split. The splits are the boundaries of the tables in the levels of the partition,
+// so a partition that only has data in its memory tables or in level 0 is not split. Only keys with the provided prefix
+// are returned.
+func (db *DB) KeySplits(partitionId PartitionId, prefix []byte) [][]byte {
+	return db.levelsController.keySplits(partitionId, prefix)
+}
+
+// Flatten compacts every partition until all of its tables are in a single level, which is useful to get consistent
+// results from benchmarks. Up to the provided number of compactions of a partition run at the same time. The
+// background compactors keep running, Flatten waits for their compactions when it needs the same tables. An error is
+// returned if no tables can be compacted out of a level that still has tables.
+func (db *DB) Flatten(workers int) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	for _, partitionId := range db.levelsController.partitionIds() {
+		if err := db.levelsController.flatten(partitionId, workers); err != nil {
+			return z.Wrapf(err, "failed to flatten partition %d", partitionId)
 		}
 	}
+
+	return nil
 }
 
-// calculateSize does a file walk, calculates the size of the value log and stores it in the
-// z.LSMSize and z.ValueLogSize
-func (db *DB) calculateSize() {
+// Sync syncs the database content to disk. This gives users a durability barrier when SyncWrites is disabled. Any writes
+// that have already been sent to the database are written before the log and the manifest are synced.
+func (db *DB) Sync() error {
 	if db.options.InMemory {
-		return
+		return nil
 	}
 
-	totalSize := func(dir string) (lsmSize, valueLogSize int64) {
-		if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+	// Requests are written in the order that they are received, so once this empty request has been written and synced
+	// every request that was sent before it has been written and synced as well.
+	req, err := db.sendToWriteChannel(nil, true)
+	if err != nil {
+		return err
+	}
 
-			fileExtension := filepath.Ext(path)
+	return req.Wait()
+}
 
-			switch fileExtension {
-			case tableFileExtension:
-				lsmSize += info.Size()
-			case valueLogFileExtension:
-				valueLogSize += info.Size()
-			default:
-				timber.Warningf(
-					"unknown file extension '%s' for file %s/%s",
-					fileExtension,
-					dir,
-					info.Name(),
-				)
-			}
+// RotateDataKey creates a new data key for the partition when an encryption key is set. The tables of the partition
+// that are written after this are encrypted with the new key, the data keys of the other partitions are not changed.
+// Data keys are also rotated on their own once they are older than EncryptionKeyRotationDuration.
+func (db *DB) RotateDataKey(partitionId PartitionId) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
 
-			return nil
-		}); err != nil {
-			db.eventLog.Printf("error while calculating total size of directory: %s", dir)
+	if err := db.validatePartitionId(partitionId); err != nil {
+		return err
+	}
+
+	_, err := db.registry.rotateDataKey(partitionId)
+	return z.Wrapf(err, "failed to rotate data key of partition %d", partitionId)
+}
+
+func (db *DB) close() (err error) {
+	db.eventLog.Printf("Closing database")
+
+	// Don't accept any more writes.
+	atomic.StoreInt32(&db.blockWrites, 1)
+
+	// Stop writes next, this will drain any of the writes that are still pending.
+	db.closers.writes.SignalAndWait()
+
+	// Once the writes have stopped nothing else will be published, so every subscriber can be stopped.
+	db.closers.publish.SignalAndWait()
+
+	// Nothing rotates the memory tables anymore, the flush goroutine finishes the flushes that are still pending.
+	if db.closers.memoryTable != nil {
+		db.closers.memoryTable.SignalAndWait()
+	}
+
+	// Write the memory tables to level 0 while the compactors are still running, otherwise level 0 could stall forever.
+	if !db.options.ReadOnly {
+		if flushErr := db.flushMemoryTables(); flushErr != nil {
+			err = z.Wrapf(flushErr, "failed to flush memory tables")
 		}
+	}
 
-		return
+	// Now that the writes have stopped we can stop the watermarks.
+	db.oracle.closer.SignalAndWait()
+	db.closers.updateSize.SignalAndWait()
+
+	// Stop the compactors before the tables are closed.
+	if db.closers.compactors != nil {
+		db.closers.compactors.SignalAndWait()
 	}
 
-	lsmSize, valueLogSize := totalSize(db.options.Directory)
+	// Compact level 0 now that nothing else can add to it, so the database does not start with a full level 0.
+	if db.options.CompactL0OnClose && !db.options.InMemory && err == nil {
+		if compactErr := db.levelsController.compactLevel0(); compactErr != nil {
+			err = z.Wrapf(compactErr, "failed to compact level 0")
+		}
+	}
 
-	// If valueDir is different from dir, we'd have to do another walk.
-	if db.options.ValueDirectory != db.options.Directory {
-		_, valueLogSize = totalSize(db.options.ValueDirectory)
+	// Level 0 tables that were kept in memory have to be written to disk now or they will be lost. This only has
+	// anything to do if the compaction above failed.
+	if db.options.KeepL0InMemory && db.options.CompactL0OnClose && !db.options.InMemory {
+		if persistErr := db.levelsController.persistLevel0Tables(); err == nil {
+			err = z.Wrapf(persistErr, "failed to persist level 0 tables")
+		}
 	}
 
-	atomic.StoreInt64(&db.size.LSMSize, lsmSize)
-	atomic.StoreInt64(&db.size.ValueLogSize, valueLogSize)
-}
+	db.eventLog.Printf("Waiting for closer")
+	db.partitionsReadLock.RLock()
+	for _, partition := range db.partitions {
+		partition.Lock()
+		partition.active.DecrementReferences()
+		for _, memoryTable := range partition.flushed {
+			memoryTable.DecrementReferences()
+		}
+		partition.active, partition.flushed = nil, nil
+		partition.activeHead, partition.flushedHeads = valuePointer{}, nil
+		partition.activeFirst, partition.flushedFirsts = valuePointer{}, nil
+		partition.activeLogFileId, partition.flushedLogFileIds = 0, nil
+		partition.Unlock()
+	}
+	db.partitionsReadLock.RUnlock()
 
-func arenaSize(options Options) int64 {
-	return options.MaxTableSize + options.maxBatchSize + options.maxBatchCount*
-		int64(skiplist.MaxNodeSize)
+	if levelsErr := db.levelsController.close(); err == nil {
+		err = z.Wrapf(levelsErr, "failed to close levels controller")
+	}
+
+	if valueLogErr := db.valueLog.close(); err == nil {
+		err = z.Wrapf(valueLogErr, "failed to close value log")
+	}
+
+	// Level 0 tables that are kept in memory don't store a replay start, so the value log files can only be removed
+	// once those tables have been written to disk above. The file that was written to last is kept so that the Ids of
+	// new files continue after it.
+	if err == nil && !db.options.ReadOnly && !db.options.UseWAL && db.options.KeepL0InMemory &&
+		db.options.CompactL0OnClose && !db.options.InMemory {
+		err = db.valueLog.removeBefore(atomic.LoadUint32(&db.valueLog.maxFileId))
+	}
+
+	// Everything that was written to the write-ahead log is in tables on disk now, unless something above failed.
+	if !db.options.InMemory {
+		removeLog := err == nil && !db.options.ReadOnly
+		if logErr := db.writeAheadLog.close(removeLog); err == nil {
+			err = z.Wrapf(logErr, "failed to close write-ahead log")
+		}
+	}
+
+	if registryErr := db.registry.Close(); err == nil {
+		err = z.Wrapf(registryErr, "failed to close key registry")
+	}
+
+	if manifestErr := db.manifest.close(); err == nil {
+		err = z.Wrapf(manifestErr, "failed to close manifest")
+	}
+
+	if !db.options.InMemory {
+		if syncErr := syncDir(db.options.Directory); err == nil {
+			err = z.Wrapf(syncErr, "failed to sync directory")
+		}
+
+		if guardErr := db.directoryLockGuard.release(); err == nil {
+			err = z.Wrapf(guardErr, "failed to release directory lock")
+		}
+
+		for _, guard := range db.valueDirectoryLockGuards {
+			if guardErr := guard.release(); err == nil {
+				err = z.Wrapf(guardErr, "failed to release value directory lock")
+			}
+		}
+	}
+
+	db.eventLog.Finish()
+
+	return err
+}
+
+// newPartitionMemoryTables creates the in memory tables for a new partition.
+func (db *DB) newPartitionMemoryTables() *partitionMemoryTables {
+	return &partitionMemoryTables{
+		active:             skiplist.NewSkiplist(arenaSize(db.options, db.options.MaxTableSize)),
+		flushed:            make([]*skiplist.SkipList, 0, db.options.NumMemoryTables),
+		flushedHeads:       make([]valuePointer, 0, db.options.NumMemoryTables),
+		flushedFirsts:      make([]valuePointer, 0, db.options.NumMemoryTables),
+		flushedLogFileIds:  make([]uint32, 0, db.options.NumMemoryTables),
+		maxTableSize:       db.options.MaxTableSize,
+		numMemoryTables:    db.options.NumMemoryTables,
+		activeMaxTableSize: db.options.MaxTableSize,
+		activeCreatedAt:    db.options.clock.Now(),
+	}
+}
+
+// SetPartitionOptions changes the size that the memory tables of the partition can grow to before they are rotated and
+// the number of memory tables that the partition can have before writes have to wait for them to be flushed. This
+// allows busy partitions to use larger memory tables than partitions that are rarely written to. Partitions that are
+// not configured use the MaxTableSize and NumMemoryTables options. The partition options are not persisted.
+func (db *DB) SetPartitionOptions(partitionId PartitionId, maxTableSize int64, numMemoryTables int) error {
+	if maxTableSize <= 0 {
+		return errors.Errorf("Invalid max table size %d for partition %d, must be greater than 0",
+			maxTableSize, partitionId)
+	}
+
+	if numMemoryTables < 1 {
+		return errors.Errorf("Invalid number of memory tables %d for partition %d, must be at least 1",
+			numMemoryTables, partitionId)
+	}
+
+	if err := checkArenaSize(db.options, maxTableSize); err != nil {
+		return errors.Wrapf(err, "Invalid max table size for partition %d", partitionId)
+	}
+
+	partition := db.lockPartition(partitionId)
+	defer partition.Unlock()
+
+	partition.maxTableSize = maxTableSize
+	partition.numMemoryTables = numMemoryTables
+
+	// If nothing has been written to the active table yet then it can be replaced with one that is sized for the new
+	// max table size right away. Otherwise the new size is used once the active table is rotated.
+	if partition.active.Empty() {
+		partition.active.DecrementReferences()
+		partition.active = skiplist.NewSkiplist(arenaSize(db.options, partition.tableSize()))
+		partition.activeMaxTableSize = partition.tableSize()
+	}
+
+	return nil
+}
+
+// rotate moves the active table and its pointers into the value log to the flushed tables and creates a new active
+// table. The partition must be locked.
+func (p *partitionMemoryTables) rotate(options Options) {
+	p.flushed = append(p.flushed, p.active)
+	p.flushedHeads = append(p.flushedHeads, p.activeHead)
+	p.flushedFirsts = append(p.flushedFirsts, p.activeFirst)
+	p.flushedLogFileIds = append(p.flushedLogFileIds, p.activeLogFileId)
+	p.active = skiplist.NewSkiplist(arenaSize(options, p.tableSize()))
+	p.activeMaxTableSize = p.tableSize()
+	p.activeCreatedAt, p.activeFilledAt = options.clock.Now(), time.Time{}
+	p.activeHead, p.activeFirst, p.activeLogFileId = valuePointer{}, valuePointer{}, 0
+}
+
+// removeOldest removes the oldest flushed table and its pointers into the value log once it has been written to level
+// 0, the caller must release the reference to the table. The slot is cleared so the table isn't kept alive by the
+// slice. The partition must be locked.
+func (p *partitionMemoryTables) removeOldest() {
+	p.flushed[0] = nil
+	p.flushed, p.flushedHeads = p.flushed[1:], p.flushedHeads[1:]
+	p.flushedFirsts, p.flushedLogFileIds = p.flushedFirsts[1:], p.flushedLogFileIds[1:]
+}
+
+// isFull returns true if the partition has as many flushed tables as it is allowed to, the active table can't be
+// rotated until one of them has been written to level 0. The partition must be locked.
+func (p *partitionMemoryTables) isFull() bool {
+	return len(p.flushed) >= p.numMemoryTables
+}
+
+// tableSize returns the size that new memory tables of the partition are created for.
+func (p *partitionMemoryTables) tableSize() int64 {
+	if p.adaptiveTableSize > p.maxTableSize {
+		return p.adaptiveTableSize
+	}
+
+	return p.maxTableSize
+}
+
+// adaptTableSize changes the size of the next memory table of the partition with how long the active table took to
+// fill up. A table that filled up within AdaptiveRotationInterval means the partition is busy, so the next table is
+// twice as large, up to AdaptiveMaxTableSize. A table that took longer than four intervals means the partition has
+// quieted down, so the next table is half as large, down to the max table size of the partition. Doubling the size
+// doubles the time a table takes to fill at the same rate of writes, so a steady rate does not flip between sizes. The
+// time ends when the table filled up rather than when it is rotated, writes that wait in ensureRoomForWrite for the
+// flush goroutine to catch up would otherwise make a busy partition look idle. This is called when the active table is
+// rotated because it is full, the partition must be locked.
+func (p *partitionMemoryTables) adaptTableSize(options Options) {
+	if options.AdaptiveMaxTableSize <= p.maxTableSize {
+		p.adaptiveTableSize = 0
+		return
+	}
+
+	size := p.tableSize()
+	switch elapsed := p.activeFilledAt.Sub(p.activeCreatedAt); {
+	case elapsed < options.AdaptiveRotationInterval:
+		size *= 2
+	case elapsed > 4*options.AdaptiveRotationInterval:
+		size /= 2
+	}
+
+	switch {
+	case size > options.AdaptiveMaxTableSize:
+		size = options.AdaptiveMaxTableSize
+	case size < p.maxTableSize:
+		size = p.maxTableSize
+	}
+	p.adaptiveTableSize = size
+}
+
+// firstPointer returns the first entry in the value log that was written to any of the memory tables of the partition,
+// or a zero pointer if the memory tables don't have any entries from the value log. The partition must be locked.
+func (p *partitionMemoryTables) firstPointer() valuePointer {
+	for _, first := range p.flushedFirsts {
+		if !first.IsZero() {
+			return first
+		}
+	}
+
+	return p.activeFirst
+}
+
+// firstLogFileId returns the first write-ahead log file with an entry that was written to any of the memory tables of
+// the partition, or zero if the memory tables don't have any entries from the write-ahead log. The partition must be
+// locked.
+func (p *partitionMemoryTables) firstLogFileId() uint32 {
+	for _, fileId := range p.flushedLogFileIds {
+		if fileId != 0 {
+			return fileId
+		}
+	}
+
+	return p.activeLogFileId
+}
+
+// activeLimit returns the size the active table can grow to before it needs to be rotated.
+func (p *partitionMemoryTables) activeLimit() int64 {
+	if p.activeMaxTableSize < p.tableSize() {
+		return p.activeMaxTableSize
+	}
+
+	return p.tableSize()
+}
+
+// isEmpty returns true if there is no data in any of the memory tables or levels of the database.
+func (db *DB) isEmpty() bool {
+	db.partitionsReadLock.RLock()
+	for _, partition := range db.partitions {
+		partition.RLock()
+		empty := partition.active.Empty() && len(partition.flushed) == 0
+		partition.RUnlock()
+		if !empty {
+			db.partitionsReadLock.RUnlock()
+			return false
+		}
+	}
+	db.partitionsReadLock.RUnlock()
+
+	for _, level := range db.levelsController.getLevelInfo() {
+		if len(level.Tables) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CreatePartition sets up the memory tables and levels for a new partition so it is ready to be written to. Partitions
+// are also created automatically the first time they are written to, so this is only needed to provision partitions
+// ahead of time. ErrPartitionExists is returned if the partition already exists. A partition that has never had any
+// data flushed to a table will not exist once the database is reopened.
+func (db *DB) CreatePartition(partitionId PartitionId) error {
+	if err := db.validatePartitionId(partitionId); err != nil {
+		return err
+	}
+
+	db.partitionsWriteLock.Lock()
+	defer db.partitionsWriteLock.Unlock()
+
+	db.partitionsReadLock.RLock()
+	_, exists := db.partitions[partitionId]
+	db.partitionsReadLock.RUnlock()
+	if _, ok := db.levelsController.getPartition(partitionId); exists || ok {
+		return ErrPartitionExists
+	}
+
+	partition := db.newPartitionMemoryTables()
+	db.partitionsReadLock.Lock()
+	db.partitions[partitionId] = partition
+	db.partitionsReadLock.Unlock()
+
+	db.levelsController.getOrSetupPartition(partitionId)
+
+	return nil
+}
+
+// Partitions returns the Ids of every partition that has either memory tables or levels, in ascending order.
+func (db *DB) Partitions() []PartitionId {
+	ids := map[PartitionId]struct{}{}
+	db.partitionsReadLock.RLock()
+	for partitionId := range db.partitions {
+		ids[partitionId] = struct{}{}
+	}
+	db.partitionsReadLock.RUnlock()
+
+	db.levelsController.partitionsLock.RLock()
+	for partitionId := range db.levelsController.partitions {
+		ids[partitionId] = struct{}{}
+	}
+	db.levelsController.partitionsLock.RUnlock()
+
+	result := make([]PartitionId, 0, len(ids))
+	for partitionId := range ids {
+		result = append(result, partitionId)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+
+	return result
+}
+
+// getPartition returns the in memory tables for the provided partition. If the partition does not exist yet then it
+// will be created.
+func (db *DB) getPartition(partitionId PartitionId) *partitionMemoryTables {
+	db.partitionsReadLock.RLock()
+	partition, ok := db.partitions[partitionId]
+	db.partitionsReadLock.RUnlock()
+	if ok {
+		return partition
+	}
+
+	db.partitionsWriteLock.Lock()
+	defer db.partitionsWriteLock.Unlock()
+
+	// Another writer might have created the partition while we were waiting for the lock.
+	db.partitionsReadLock.RLock()
+	partition, ok = db.partitions[partitionId]
+	db.partitionsReadLock.RUnlock()
+	if ok {
+		return partition
+	}
+
+	partition = db.newPartitionMemoryTables()
+
+	db.partitionsReadLock.Lock()
+	db.partitions[partitionId] = partition
+	db.partitionsReadLock.Unlock()
+
+	return partition
+}
+
+// lockPartition returns the memory tables of the provided partition with the exclusive lock held. If the partition is
+// dropped while waiting for the lock then the partition that replaces it is locked instead.
+func (db *DB) lockPartition(partitionId PartitionId) *partitionMemoryTables {
+	for {
+		partition := db.getPartition(partitionId)
+		partition.Lock()
+		if !partition.dropped {
+			return partition
+		}
+		partition.Unlock()
+	}
+}
+
+// lockPartitions acquires the exclusive locks of the memory tables of the provided partitions in ascending order of
+// their Ids, so that two operations that lock some of the same partitions can never deadlock. Only the partitions that
+// exist are locked and returned. The caller must hold the partitionsReadLock so that no partitions are added or removed
+// while they are locked, and must call the returned function to unlock them.
+func (db *DB) lockPartitions(partitionIds []PartitionId) (map[PartitionId]*partitionMemoryTables, func()) {
+	sorted := sortPartitionIds(partitionIds)
+	partitions := make(map[PartitionId]*partitionMemoryTables, len(sorted))
+	locked := make([]*partitionMemoryTables, 0, len(sorted))
+	for _, partitionId := range sorted {
+		partition, ok := db.partitions[partitionId]
+		if !ok {
+			continue
+		}
+
+		partition.Lock()
+		partitions[partitionId] = partition
+		locked = append(locked, partition)
+	}
+
+	return partitions, func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			locked[i].Unlock()
+		}
+	}
+}
+
+// getMemoryTables returns the current memory tables for the provided partition, newest first. The returned function
+// must be called once the caller is done with the tables to release the references.
+func (db *DB) getMemoryTables(partitionId PartitionId) ([]*skiplist.SkipList, func()) {
+	db.partitionsReadLock.RLock()
+	partition, ok := db.partitions[partitionId]
+	db.partitionsReadLock.RUnlock()
+	if !ok {
+		return nil, func() {}
+	}
+
+	partition.RLock()
+	defer partition.RUnlock()
+
+	// The partition was dropped after it was looked up, so it doesn't have any memory tables anymore.
+	if partition.dropped {
+		return nil, func() {}
+	}
+
+	tables := make([]*skiplist.SkipList, 0, len(partition.flushed)+1)
+
+	// Get the mutable memory table.
+	tables = append(tables, partition.active)
+	partition.active.IncrementReferences()
+
+	// Get the immutable memory tables, the most recently flushed table is at the end.
+	for i := len(partition.flushed) - 1; i >= 0; i-- {
+		tables = append(tables, partition.flushed[i])
+		partition.flushed[i].IncrementReferences()
+	}
+
+	return tables, func() {
+		for _, table := range tables {
+			table.DecrementReferences()
+		}
+	}
+}
+
+// get returns the value in the memory tables or the level tables for the given key. Note that the value will include
+// the meta byte.
+//
+// IMPORTANT: We should never write an entry with an older timestamp for the same key, We need to maintain this
+// invariant to search for the latest value of a key, or else we need to search in all tables and find the max version
+// among them. To maintain this invariant, we also need to ensure that all versions of a key are always present in the
+// same table from level 1, because compaction can push any table down.
+func (db *DB) get(partitionId PartitionId, key []byte) (z.ValueStruct, error) {
+	return db.getWithOptions(partitionId, key, ReadOptions{})
+}
+
+// getWithOptions returns the value for the given key like get, reading the tables with the provided read options.
+func (db *DB) getWithOptions(partitionId PartitionId, key []byte, opts ReadOptions) (z.ValueStruct, error) {
+	tables, decrement := db.getMemoryTables(partitionId)
+	defer decrement()
+
+	return db.getFromTables(tables, partitionId, key, opts)
+}
+
+// getFromTables returns the value for the given key like get, looking in the provided memory tables of the partition
+// before its levels. This lets many keys be read with the same memory tables.
+func (db *DB) getFromTables(
+	tables []*skiplist.SkipList,
+	partitionId PartitionId,
+	key []byte,
+	opts ReadOptions,
+) (z.ValueStruct, error) {
+	var maxValue *z.ValueStruct
+	version := z.ParseTs(key)
+	for _, table := range tables {
+		value := table.Get(key)
+		if value.Meta == 0 && value.Value == nil {
+			continue
+		}
+
+		// Found a version of the key. For the user keyspace, return immediately. For the internal keyspace
+		// (version == math.MaxUint64) we need to keep looking for the largest version.
+		if value.Version == version {
+			return value, nil
+		}
+
+		if maxValue == nil || maxValue.Version < value.Version {
+			maxValue = &value
+		}
+	}
+
+	return db.levelsController.get(partitionId, key, maxValue, opts)
+}
+
+// sendToWriteChannel queues the provided entries to be written by the write goroutine. The returned request can be
+// waited on for the write to complete. If sync is true then the write is synced to disk before the request is done.
+func (db *DB) sendToWriteChannel(entries []*Entry, sync bool) (*request, error) {
+	if atomic.LoadInt32(&db.blockWrites) == 1 {
+		return nil, ErrBlockedWrites
+	}
+
+	var count, size int64
+	for _, e := range entries {
+		size += int64(e.estimateSize(db.options.ValueThreshold))
+		count++
+	}
+
+	if count >= db.options.maxBatchCount || size >= db.options.maxBatchSize {
+		return nil, ErrTxnTooBig
+	}
+
+	req := &request{
+		Entries: entries,
+		sync:    sync,
+	}
+	req.Wg.Add(1)
+	db.writeChannel <- req // Nothing should get blocked here.
+
+	return req, nil
+}
+
+// doWrites pulls requests off of the write channel and writes them in batches. Only one batch is written at a time,
+// while a batch is being written the next batch is collected from the channel.
+func (db *DB) doWrites(closer *z.Closer) {
+	defer closer.Done()
+
+	pendingChannel := make(chan struct{}, 1)
+
+	writeRequests := func(requests []*request) {
+		if err := db.writeRequests(requests); err != nil {
+			timber.Errorf("writeRequests: %v", err)
+		}
+		<-pendingChannel
+	}
+
+	requests := make([]*request, 0, 10)
+	for {
+		var req *request
+		select {
+		case req = <-db.writeChannel:
+		case <-closer.HasBeenClosed():
+			goto closedCase
+		}
+
+		for {
+			requests = append(requests, req)
+			if len(requests) >= 3*writeChannelCapacity {
+				pendingChannel <- struct{}{} // blocking.
+				goto writeCase
+			}
+
+			select {
+			// Either push to pending, or continue to pick from the write channel.
+			case req = <-db.writeChannel:
+			case pendingChannel <- struct{}{}:
+				requests = db.waitForSyncedWrites(requests, closer)
+				goto writeCase
+			case <-closer.HasBeenClosed():
+				goto closedCase
+			}
+		}
+
+	closedCase:
+		// All the pending request are drained. Don't close the write channel, because it has be used in several
+		// places.
+		for {
+			select {
+			case req = <-db.writeChannel:
+				requests = append(requests, req)
+			default:
+				pendingChannel <- struct{}{} // Push to pending before doing a write.
+				writeRequests(requests)
+				return
+			}
+		}
+
+	writeCase:
+		go writeRequests(requests)
+		requests = make([]*request, 0, 10)
+	}
+}
+
+// waitForSyncedWrites picks more requests from the write channel for up to SyncInterval when any of the requests need
+// to be synced, so that the requests that arrive in that time are synced along with them. The requests are returned
+// right away if none of them need to be synced, or when the database is being closed.
+func (db *DB) waitForSyncedWrites(requests []*request, closer *z.Closer) []*request {
+	if db.options.SyncInterval <= 0 || db.options.InMemory || !requestsNeedSync(requests) {
+		return requests
+	}
+
+	timer := time.NewTimer(db.options.SyncInterval)
+	defer timer.Stop()
+	for len(requests) < 3*writeChannelCapacity {
+		select {
+		case req := <-db.writeChannel:
+			requests = append(requests, req)
+		case <-timer.C:
+			return requests
+		case <-closer.HasBeenClosed():
+			return requests
+		}
+	}
+
+	return requests
+}
+
+// writeRequests is called serially by only one goroutine.
+func (db *DB) writeRequests(requests []*request) error {
+	if len(requests) == 0 {
+		return nil
+	}
+
+	done := func(err error) {
+		for _, req := range requests {
+			req.Err = err
+			req.Wg.Done()
+		}
+	}
+
+	db.eventLog.Printf("writeRequests called")
+
+	// Every request is written to the value log before any of it is written to the memory tables. A transaction ends
+	// with a marker in the value log, so if the database crashes before the marker is written none of the transaction
+	// is replayed when the database is opened again.
+	// With the write-ahead log each request is a single record, so a request that was cut short is never replayed.
+	switch {
+	case db.options.InMemory:
+	case db.options.UseWAL:
+		if err := db.writeAheadLog.write(requests); err != nil {
+			done(err)
+			return z.Wrapf(err, "failed to write to write-ahead log")
+		}
+		defer db.writeAheadLog.written()
+	default:
+		if err := db.valueLog.write(requests); err != nil {
+			done(err)
+			return z.Wrapf(err, "failed to write to value log")
+		}
+	}
+
+	db.eventLog.Printf("Writing to memory table")
+	for _, req := range requests {
+		if len(req.Entries) == 0 {
+			continue
+		}
+
+		if err := db.writeToLSM(req); err != nil {
+			done(err)
+			return z.Wrapf(err, "writeRequests")
+		}
+	}
+
+	// A single sync covers every request in the batch, so syncs are only paid for when at least one request needs it.
+	if requestsNeedSync(requests) && !db.options.InMemory {
+		if err := db.syncLog(); err != nil {
+			done(err)
+			return err
+		}
+
+		if err := db.manifest.sync(); err != nil {
+			done(err)
+			return z.Wrapf(err, "failed to sync manifest")
+		}
+	}
+
+	// The entries are only published once they have been written, so subscribers never see a write that failed.
+	db.publisher.sendUpdates(requests)
+
+	done(nil)
+	db.eventLog.Printf("%d entries written", len(requests))
+
+	return nil
+}
+
+// requestsNeedSync returns true if any of the requests must be synced to disk before they are done.
+func requestsNeedSync(requests []*request) bool {
+	for _, req := range requests {
+		if req.sync {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeToLSM writes the entries in the request into the active memory table for their partition. The value log is only
+// used to recover writes that were not flushed, so every value is stored inline regardless of the threshold.
+func (db *DB) writeToLSM(req *request) error {
+	// The partitions dropped by the request are dropped together, before anything else in the request is written.
+	if partitionIds := droppedPartitions(req.Entries); len(partitionIds) > 0 {
+		if err := db.dropPartitions(partitionIds); err != nil {
+			return err
+		}
+	}
+
+	for i, entry := range req.Entries {
+		// The transaction marker only exists in the value log to indicate the end of a transaction, and dropped
+		// partitions are only recorded in the value log so that they are dropped again when it is replayed.
+		if entry.meta&bitFinTxn != 0 || isDropPartitionEntry(entry) {
+			continue
+		}
+
+		partition, err := db.ensureRoomForWrite(entry.partitionId)
+		if err != nil {
+			return err
+		}
+
+		partition.active.Put(entry.Key, z.ValueStruct{
+			Value:     entry.Value,
+			Meta:      entry.meta &^ bitValuePointer,
+			UserMeta:  entry.UserMeta,
+			ExpiresAt: entry.ExpiresAt,
+		})
+
+		// Range deletes are visible to reads once their commit is done, which is after they are written here.
+		if rangeDelete, ok := parseRangeDelete(entry.Key, z.ValueStruct{
+			Meta:  entry.meta,
+			Value: entry.Value,
+		}); ok {
+			db.rangeDeletes.add(entry.partitionId, rangeDelete)
+		}
+
+		// Only the goroutine writing requests changes the head, the partition is locked exclusively to read it.
+		if i < len(req.Pointers) {
+			partition.activeHead = req.Pointers[i]
+			if partition.activeFirst.IsZero() {
+				partition.activeFirst = req.Pointers[i]
+			}
+		}
+		if partition.activeLogFileId == 0 {
+			partition.activeLogFileId = req.logFileId
+		}
+		partition.RUnlock()
+	}
+
+	return nil
+}
+
+// ensureRoomForWrite makes sure that the active memory table for the provided partition has enough room for the next
+// write. If it does not then the active table is moved to the flushed tables and a new active table is created. The
+// partition is returned read locked, the caller must unlock it once the write is done.
+func (db *DB) ensureRoomForWrite(partitionId PartitionId) (*partitionMemoryTables, error) {
+	partition := db.getPartition(partitionId)
+
+	for i := 0; ; i++ {
+		partition.RLock()
+		if partition.dropped {
+			// The partition was dropped after it was looked up, the write goes to the partition that replaces it.
+			partition.RUnlock()
+			partition = db.getPartition(partitionId)
+			continue
+		}
+
+		if partition.active.MemSize() < partition.activeLimit() {
+			return partition, nil
+		}
+		partition.RUnlock()
+
+		partition.Lock()
+		if partition.dropped || partition.active.MemSize() < partition.activeLimit() {
+			// Another writer already rotated the active table.
+			partition.Unlock()
+			continue
+		}
+
+		if partition.activeFilledAt.IsZero() {
+			partition.activeFilledAt = db.options.clock.Now()
+		}
+
+		if !partition.isFull() {
+			db.eventLog.Printf("Rotating memory table for partition %d. Size: %d", partitionId,
+				partition.active.MemSize())
+			partition.adaptTableSize(db.options)
+			partition.rotate(db.options)
+			partition.Unlock()
+
+			// The flush goroutine never waits on writes, so this can only block until it has caught up. The table is
+			// kept in memory instead in read only mode, see makeRoomForReplay.
+			if !db.options.ReadOnly {
+				db.flushChannel <- flushRequest{partitionId: partitionId}
+			}
+			continue
+		}
+		partition.Unlock()
+
+		if i%100 == 0 {
+			db.eventLog.Printf("Making room for writes")
+
+			// Ask for the flush again in case the last one failed, it is dropped if a flush is already pending.
+			select {
+			case db.flushChannel <- flushRequest{partitionId: partitionId}:
+			default:
+			}
+		}
+
+		// We need to poll a bit because both the flushed tables and the active table are full. This will be resolved
+		// once a flushed table has been written to level 0.
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// handleFlushTask must be run serially.
+func (db *DB) handleFlushTask(task flushTask) error {
+	// There can be a scenario, when an empty memory table is flushed. For example, when the memory
+	// table is empty and after writing the request to the value log, the rotation count exceeds
+	// db.LogRotatesToFlush.
+	if task.memoryTable.Empty() {
+		return nil
+	}
+
+	// Once the table is written its entries are durable, so the log is synced first. Otherwise the entries of a
+	// transaction that was written to more than one partition could be durable here while the rest of the transaction
+	// is lost from the log, and it would not be replayed.
+	if !db.options.InMemory {
+		if err := db.syncLog(); err != nil {
+			return err
+		}
+	}
+
+	// TODO (elliotcourant) Add Option logging.
+	db.eventLog.Printf("storing offset: %+v\n", task.valuePointer)
+	value := task.valuePointer.Encode()
+
+	// Pick the max commit ts, so in case of crash, our read ts would be higher than all the commits
+	headTimestamp := z.KeyWithTs(head, db.oracle.nextTimestamp())
+
+	task.memoryTable.Put(headTimestamp, z.ValueStruct{
+		Value: value,
+	})
+
+	// The replay start only moves forward, so the newest one stored in any partition is used when the database is
+	// opened. It covers the memory tables of every partition, so it can't be stored when level 0 tables are kept in
+	// memory, the tables of the other partitions that it covers could be lost in a crash.
+	if !task.replayStart.IsZero() && !db.options.KeepL0InMemory {
+		task.memoryTable.Put(z.KeyWithTs(replayHead, db.oracle.nextTimestamp()), z.ValueStruct{
+			Value: task.replayStart.Encode(),
+		})
+	}
+
+	dataKey, err := db.registry.latestDataKey(task.partitionId)
+	if err != nil {
+		return z.Wrapf(err, "failed to retrieve data key for level 0 table")
+	}
+
+	tableOptions := buildLevelTableOptions(db.options, 0)
+	tableOptions.DataKey = dataKey
+	tableOptions.Cache = db.blockCache
+	build, err := db.levelsController.newTableBuild(task.partitionId, 0, tableOptions)
+	if err != nil {
+		return z.Wrapf(err, "failed to create level 0 table")
+	}
+
+	// Don't block just to sync the directory entry.
+	var directorySyncChannel chan error
+	if build.file != nil {
+		directorySyncChannel = make(chan error, 1)
+		go func() { directorySyncChannel <- syncDir(db.options.Directory) }()
+	}
+
+	if err = buildLevel0Table(task, build.builder); err != nil {
+		db.levelsController.abandonTable(build)
+		return z.Wrapf(err, "failed to build level 0 table")
+	}
+
+	t, err := db.levelsController.finishTable(build)
+	if err != nil {
+		return z.Wrapf(err, "failed to finish level 0 table")
+	}
+
+	if directorySyncChannel != nil {
+		if err = <-directorySyncChannel; err != nil {
+			// Do dir sync as best effort. No need to return due to an error there.
+			db.eventLog.Errorf("failed to sync directory for level 0 table %q: %v", build.file.Name(), err)
+		}
+	}
+
+	// We own a reference to the table, and the levels controller takes its own if the table is added to level 0.
+	err = db.levelsController.addLevel0Table(task.partitionId, t)
+	_ = t.DecrementReference()
+	return err
+}
+
+// Flush writes the memory tables of the provided partition to level 0, including the active table, and waits until
+// they have been written. Every write that was committed before Flush was called is included. In InMemory mode the
+// level 0 tables are kept in memory.
+func (db *DB) Flush(partitionId PartitionId) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if atomic.LoadInt32(&db.blockWrites) == 1 {
+		return ErrBlockedWrites
+	}
+
+	// The flush goroutine handles requests in the order they are received, so the tables that were rotated before this
+	// are written first.
+	done := make(chan error, 1)
+	db.flushChannel <- flushRequest{
+		partitionId:   partitionId,
+		includeActive: true,
+		done:          done,
+	}
+
+	return <-done
+}
+
+// doFlushes writes the memory tables of the partitions received on the flush channel to level 0, one partition at a
+// time. Writes wait in ensureRoomForWrite while a partition has too many flushed tables, so this is what lets them carry
+// on. The requests that are still pending when the database is closed are handled before this returns.
+func (db *DB) doFlushes(closer *z.Closer) {
+	defer closer.Done()
+
+	for {
+		select {
+		case req := <-db.flushChannel:
+			db.handleFlushRequest(req)
+		case <-closer.HasBeenClosed():
+			for {
+				select {
+				case req := <-db.flushChannel:
+					db.handleFlushRequest(req)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// handleFlushRequest flushes the partition of the request and reports the result to the caller that is waiting on it,
+// or logs it if nothing is waiting. A failed flush leaves the tables in memory, writes ask for it again while they wait.
+func (db *DB) handleFlushRequest(req flushRequest) {
+	err := db.flushPartition(req.partitionId, req.includeActive)
+	if req.done != nil {
+		req.done <- err
+		return
+	}
+
+	if err != nil {
+		timber.Errorf("flushPartition: %v", err)
+	}
+}
+
+// flushPartition writes the flushed memory tables of the provided partition to level 0, oldest first. When
+// includeActive is set the active table is rotated first so that it is written as well. Nothing is done if the
+// partition does not exist, it might have been dropped since it was asked to be flushed.
+func (db *DB) flushPartition(partitionId PartitionId, includeActive bool) error {
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+
+	db.partitionsReadLock.RLock()
+	partition, ok := db.partitions[partitionId]
+	db.partitionsReadLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	partition.Lock()
+	if includeActive && !partition.active.Empty() {
+		db.eventLog.Printf("Flushing memory table for partition %d. Size: %d", partitionId,
+			partition.active.MemSize())
+		partition.rotate(db.options)
+	}
+	memoryTables := append([]*skiplist.SkipList{}, partition.flushed...)
+	heads := append([]valuePointer{}, partition.flushedHeads...)
+	partition.Unlock()
+
+	var replayStart valuePointer
+	for i, memoryTable := range memoryTables {
+		db.partitionsReadLock.RLock()
+		replayStart = db.replayStart()
+		db.partitionsReadLock.RUnlock()
+
+		if err := db.handleFlushTask(flushTask{
+			partitionId:  partitionId,
+			memoryTable:  memoryTable,
+			valuePointer: heads[i],
+			replayStart:  replayStart,
+		}); err != nil {
+			return z.Wrapf(err, "failed to flush partition %d", partitionId)
+		}
+
+		// The table can be read from level 0 now. Writers only ever append to the flushed tables, so the table that
+		// was just written is still the oldest one.
+		partition.Lock()
+		partition.removeOldest()
+		partition.Unlock()
+		memoryTable.DecrementReferences()
+	}
+
+	if len(memoryTables) > 0 {
+		if err := db.removeObsoleteLogFiles(replayStart); err != nil {
+			return err
+		}
+	}
+
+	// The head key is only read from the default partition when the database is opened, so it needs to be written
+	// there as well so that the versions that were just flushed are not reused.
+	if partitionId != 0 && len(memoryTables) > 0 {
+		defaultPartition := db.getPartition(0)
+		defaultPartition.RLock()
+		defaultPartition.active.Put(z.KeyWithTs(head, db.oracle.nextTimestamp()), z.ValueStruct{})
+		defaultPartition.RUnlock()
+	}
+
+	return nil
+}
+
+// syncLog syncs the log that writes are appended to, which is the write-ahead log when UseWAL is set and the value log
+// otherwise.
+func (db *DB) syncLog() error {
+	if db.options.UseWAL {
+		return z.Wrapf(db.writeAheadLog.sync(), "failed to sync write-ahead log")
+	}
+
+	return z.Wrapf(db.valueLog.sync(), "failed to sync value log")
+}
+
+// removeObsoleteLogFiles removes the files of the log that writes are appended to that are no longer needed to recover
+// the memory tables. The files of the write-ahead log are removed once they don't have entries in any of the memory
+// tables. The value log is replayed from the newest replay start stored with the tables of any partition, so the files
+// before the replay start that was stored by the last flush are never read again. When level 0 tables are kept in
+// memory a flushed table is not durable, so the files of either log are only removed when the database is closed.
+func (db *DB) removeObsoleteLogFiles(replayStart valuePointer) error {
+	if db.options.KeepL0InMemory || db.options.InMemory {
+		return nil
+	}
+
+	if !db.options.UseWAL {
+		return db.valueLog.removeBefore(replayStart.Fid)
+	}
+
+	// The files are removed while the partitions are read locked, so a new partition can't be created with entries
+	// from a file that is being removed.
+	db.partitionsReadLock.RLock()
+	defer db.partitionsReadLock.RUnlock()
+
+	first := db.writeAheadLog.nextFileId()
+	for _, partition := range db.partitions {
+		partition.Lock()
+		if fileId := partition.firstLogFileId(); fileId != 0 && fileId < first {
+			first = fileId
+		}
+		partition.Unlock()
+	}
+
+	return db.writeAheadLog.removeBefore(first)
+}
+
+// replayStart returns the first entry in the value log that is in a memory table and has not been flushed to a level 0
+// table yet, which is where replay of the value log can start when the database is opened. Entries are written to the
+// memory tables in the same order as they are written to the value log, so every entry that is still being written comes
+// after it. A zero pointer is returned if none of the memory tables have entries. The caller must hold the
+// partitionsReadLock and must not hold the lock of any partition.
+func (db *DB) replayStart() valuePointer {
+	var start valuePointer
+	for _, partition := range db.partitions {
+		partition.Lock()
+		first := partition.firstPointer()
+		partition.Unlock()
+
+		if !first.IsZero() && (start.IsZero() || first.Less(start)) {
+			start = first
+		}
+	}
+
+	return start
+}
+
+// flushMemoryTables writes the memory tables of every partition to level 0, oldest first. This is used when the
+// database is closed so that the writes in the memory tables are not lost. Writes must be stopped before calling this.
+func (db *DB) flushMemoryTables() error {
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+
+	db.partitionsReadLock.RLock()
+	defer db.partitionsReadLock.RUnlock()
+
+	// Nothing is written while the tables are flushed, so the replay start found before the first table is flushed is
+	// before every entry that is still in a memory table.
+	replayStart := db.replayStart()
+
+	flush := func(partitionId PartitionId, partition *partitionMemoryTables) (flushed bool, err error) {
+		partition.Lock()
+		defer partition.Unlock()
+
+		memoryTables := append(partition.flushed[:len(partition.flushed):len(partition.flushed)], partition.active)
+		heads := append(partition.flushedHeads[:len(partition.flushedHeads):len(partition.flushedHeads)],
+			partition.activeHead)
+		for i, memoryTable := range memoryTables {
+			flushed = flushed || !memoryTable.Empty()
+			if err := db.handleFlushTask(flushTask{
+				partitionId:  partitionId,
+				memoryTable:  memoryTable,
+				valuePointer: heads[i],
+				replayStart:  replayStart,
+			}); err != nil {
+				return flushed, err
+			}
+		}
+
+		return flushed, nil
+	}
+
+	var flushedAny bool
+	for partitionId, partition := range db.partitions {
+		if partitionId == 0 {
+			continue
+		}
+
+		flushed, err := flush(partitionId, partition)
+		if err != nil {
+			return z.Wrapf(err, "failed to flush partition %d", partitionId)
+		}
+		flushedAny = flushedAny || flushed
+	}
+
+	// The default partition is flushed last. The head key is only read from the default partition when the database is
+	// opened, so if any other partition was flushed the head needs to be written even if the default partition is
+	// empty.
+	defaultPartition := db.partitions[0]
+	if flushedAny && defaultPartition.active.Empty() {
+		defaultPartition.active.Put(z.KeyWithTs(head, db.oracle.nextTimestamp()), z.ValueStruct{})
+	}
+
+	_, err := flush(0, defaultPartition)
+	return z.Wrapf(err, "failed to flush partition %d", 0)
+}
+
+// buildLevel0Table adds the contents of the memory table in the flush task to the builder of a new table, excluding any
+// keys that have the dropped prefix.
+func buildLevel0Table(task flushTask, builder *table.Builder) error {
+	iterator := task.memoryTable.NewIterator()
+	defer iterator.Close()
+
+	for iterator.SeekToFirst(); iterator.Valid(); iterator.Next() {
+		if len(task.dropPrefix) > 0 && z.HasPrefix(iterator.Key(), task.dropPrefix) {
+			continue
+		}
+
+		value := iterator.Value()
+		var pointer valuePointer
+		if value.Meta&bitValuePointer > 0 {
+			if err := pointer.Decode(value.Value); err != nil {
+				return err
+			}
+		}
+		builder.Add(iterator.Key(), value, pointer.Len)
+	}
+
+	return nil
+}
+
+func (db *DB) updateSize(lc *z.Closer) {
+	defer lc.Done()
+	if db.options.InMemory {
+		return
+	}
+
+	metricsTicker := time.NewTicker(time.Minute)
+	defer metricsTicker.Stop()
+
+	for {
+		select {
+		case <-metricsTicker.C:
+			db.calculateSize()
+		case <-lc.HasBeenClosed():
+			return
+		}
+	}
+}
+
+// calculateSize does a file walk, calculates the size of the value log and stores it in the
+// z.LSMSize and z.ValueLogSize
+func (db *DB) calculateSize() {
+	if db.options.InMemory {
+		return
+	}
+
+	totalSize := func(dir string) (lsmSize, valueLogSize int64) {
+		if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			fileExtension := filepath.Ext(path)
+
+			switch fileExtension {
+			case tableFileExtension:
+				lsmSize += info.Size()
+			case valueLogFileExtension:
+				valueLogSize += info.Size()
+			default:
+				timber.Warningf(
+					"unknown file extension '%s' for file %s/%s",
+					fileExtension,
+					dir,
+					info.Name(),
+				)
+			}
+
+			return nil
+		}); err != nil {
+			db.eventLog.Printf("error while calculating total size of directory: %s", dir)
+		}
+
+		return
+	}
+
+	lsmSize, valueLogSize := totalSize(db.options.Directory)
+
+	// Value log files in the primary directory have already been counted, every other value directory needs its own
+	// walk.
+	for _, directory := range db.options.valueDirectories() {
+		if directory != db.options.Directory {
+			_, size := totalSize(directory)
+			valueLogSize += size
+		}
+	}
+
+	atomic.StoreInt64(&db.size.LSMSize, lsmSize)
+	atomic.StoreInt64(&db.size.ValueLogSize, valueLogSize)
+}
+
+// arenaSize returns the size of the arena for a memory table that can grow to maxTableSize. There is room for one more
+// batch of writes after the memory table reaches the max size, since the size is only checked before each batch.
+func arenaSize(options Options, maxTableSize int64) int64 {
+	return maxTableSize + options.maxBatchSize + options.maxBatchCount*
+		int64(skiplist.MaxNodeSize)
+}
+
+// checkArenaSize makes sure that a memory table with the provided max table size can always accept a write. Batches are
+// limited to maxBatchSize bytes and maxBatchCount entries, and a single entry can be as large as ValueThreshold plus
+// the node that indexes it before its value is moved to the value log. If the largest entry does not fit in a batch it
+// can never be committed, and if the arena cannot hold a full batch plus one spare node it could overflow mid batch.
+func checkArenaSize(options Options, maxTableSize int64) error {
+	largestEntry := int64(options.ValueThreshold) + int64(skiplist.MaxNodeSize)
+	if options.maxBatchCount < 1 || options.maxBatchSize < largestEntry {
+		return errors.Errorf("Invalid MaxTableSize %d, a batch of at most %d bytes cannot hold an entry of %d bytes "+
+			"with ValueThreshold %d", options.MaxTableSize, options.maxBatchSize, largestEntry, options.ValueThreshold)
+	}
+
+	required := options.maxBatchSize + options.maxBatchCount*int64(skiplist.MaxNodeSize) + int64(skiplist.MaxNodeSize)
+	if size := arenaSize(options, maxTableSize); size < required {
+		return errors.Errorf("Invalid max table size %d, memory table arena of %d bytes cannot hold a batch of %d bytes",
+			maxTableSize, size, required)
+	}
+
+	return nil
 }
 
-func exists(path string) (bool, error) {
-	if _, err := os.Stat(path); err == nil {
+func exists(fs z.FileSystem, path string) (bool, error) {
+	if _, err := fs.Stat(path); err == nil {
 		return true, nil
 	} else if os.IsNotExist(err) {
 		return false, nil
@@ -385,8 +2030,8 @@ func exists(path string) (bool, error) {
 }
 
 func createDirs(opt Options) error {
-	for _, path := range []string{opt.Directory, opt.ValueDirectory} {
-		dirExists, err := exists(path)
+	for _, path := range append([]string{opt.Directory}, opt.valueDirectories()...) {
+		dirExists, err := exists(opt.FileSystem, path)
 		if err != nil {
 			return z.Wrapf(err, "invalid dir: %q", path)
 		}
@@ -396,7 +2041,7 @@ func createDirs(opt Options) error {
 				return errors.Errorf("cannot find directory %q for read-only open", path)
 			}
 			// Try to create the directory
-			if err = os.Mkdir(path, 0700); err != nil {
+			if err = opt.FileSystem.Mkdir(path, 0700); err != nil {
 				return z.Wrapf(err, "error creating dir: %q", path)
 			}
 		}
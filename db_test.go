@@ -0,0 +1,1294 @@
+package notbadger
+
+import (
+	"context"
+	"fmt"
+	"github.com/elliotcourant/notbadger/skiplist"
+	"github.com/elliotcourant/notbadger/table"
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClock is a clock that only moves when it is told to, so tests can decide when entries expire.
+type testClock struct {
+	unixNano int64 // accessed via atomics.
+}
+
+func newTestClock(now time.Time) *testClock {
+	return &testClock{unixNano: now.UnixNano()}
+}
+
+func (c *testClock) Now() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.unixNano))
+}
+
+func (c *testClock) advance(duration time.Duration) {
+	atomic.AddInt64(&c.unixNano, int64(duration))
+}
+
+func TestDB_Sync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	key, value := []byte("key"), []byte("value")
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		return txn.Set(1, key, value)
+	}))
+	require.NoError(t, db.Sync())
+	require.NoError(t, db.Close())
+
+	// Reopen the database, the write should have survived.
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		item, err := txn.Get(1, key)
+		require.NoError(t, err)
+		require.Equal(t, value, item.value)
+		return nil
+	}))
+
+	// New transactions must read at or above the version that was written before the database was closed.
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		require.True(t, txn.readTimestamp >= 1)
+		return txn.Set(1, key, []byte("updated"))
+	}))
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		item, err := txn.Get(1, key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("updated"), item.value)
+		return nil
+	}))
+}
+
+func TestDB_Flush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	key, value := []byte("key"), []byte("value")
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		return txn.Set(1, key, value)
+	}))
+	require.NoError(t, db.Flush(1))
+
+	// The write should be in a level 0 table and no longer in any of the memory tables.
+	levels := db.Tables()
+	require.Len(t, levels, 2*int(db.options.MaxLevels))
+	levelZero := levels[db.options.MaxLevels]
+	require.Equal(t, PartitionId(1), levelZero.PartitionId)
+	require.Len(t, levelZero.Tables, 1)
+	memoryTables, release := db.getMemoryTables(1)
+	require.Len(t, memoryTables, 1)
+	require.True(t, memoryTables[0].Empty())
+	release()
+
+	// Flushing a partition with nothing in memory does nothing.
+	require.NoError(t, db.Flush(1))
+	require.Len(t, db.Tables()[db.options.MaxLevels].Tables, 1)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		item, err := txn.Get(1, key)
+		require.NoError(t, err)
+		require.Equal(t, value, item.value)
+		return nil
+	}))
+
+	// The version of the flushed write must not be reused once the database is reopened.
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		require.True(t, txn.readTimestamp >= 1)
+		return nil
+	}))
+}
+
+func TestDB_PreallocateTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir).WithKeepL0InMemory(false).WithPreallocateTables(true)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	key, value := []byte("key"), []byte("value")
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		return txn.Set(1, key, value)
+	}))
+	require.NoError(t, db.Flush(1))
+
+	// The space that was preallocated past the end of the table is trimmed once the table has been written.
+	levelZero := db.Tables()[db.options.MaxLevels]
+	require.Len(t, levelZero.Tables, 1)
+	info, err := os.Stat(table.NewFilename(1, levelZero.Tables[0].FileId, dir))
+	require.NoError(t, err)
+	require.Equal(t, levelZero.Tables[0].Size, info.Size())
+	require.True(t, info.Size() < opts.MaxTableSize)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		item, err := txn.Get(1, key)
+		require.NoError(t, err)
+		require.Equal(t, value, item.value)
+		return nil
+	}))
+}
+
+// TestDB_ReplayStart copies the files of a database that is still open, which is what a crash leaves behind, and makes
+// sure the writes that were only in the memory tables are replayed from the value log when the copy is opened.
+func TestDB_ReplayStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	crashDir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(crashDir)
+
+	// Level 0 tables that are kept in memory are lost in a crash, so they never store a replay start.
+	opts := getTestOptions(dir).WithKeepL0InMemory(false).WithCompactL0OnClose(false)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	set := func(partitionId PartitionId, key string) {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(partitionId, []byte(key), []byte("value-"+key))
+		}))
+	}
+
+	// Partition 2 is never flushed, so replay has to start at its write even though partition 1 is flushed after it.
+	set(1, "a")
+	require.NoError(t, db.Flush(1))
+	set(2, "b")
+	set(1, "c")
+	require.NoError(t, db.Flush(1))
+	set(1, "d")
+	require.NoError(t, db.Sync())
+
+	file, err := os.Open(db.valueLog.filePath(0))
+	require.NoError(t, err)
+	var pointerOfB valuePointer
+	_, err = iterateEntries(file, 0, 0, func(e *Entry, pointer valuePointer) error {
+		if e.partitionId == 2 && string(z.ParseKey(e.Key)) == "b" {
+			pointerOfB = pointer
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.False(t, pointerOfB.IsZero())
+
+	replayValue, err := db.get(1, z.KeyWithTs(replayHead, math.MaxUint64))
+	require.NoError(t, err)
+	var replayStart valuePointer
+	require.NoError(t, replayStart.Decode(replayValue.Value))
+	require.Equal(t, pointerOfB, replayStart)
+
+	fileIds, err := db.valueLog.fileIds()
+	require.NoError(t, err)
+	require.True(t, db.valueLog.isValidReplayStart(replayStart, fileIds))
+	require.False(t, db.valueLog.isValidReplayStart(valuePointer{Fid: 0, Offset: replayStart.Offset + 1}, fileIds))
+	require.False(t, db.valueLog.isValidReplayStart(valuePointer{Fid: 7, Offset: replayStart.Offset}, fileIds))
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(crashDir, file.Name()), data, file.Mode()))
+	}
+	require.NoError(t, db.Close())
+
+	db, err = Open(getTestOptions(crashDir).WithKeepL0InMemory(false).WithCompactL0OnClose(false))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	for _, write := range []struct {
+		partitionId PartitionId
+		key         string
+	}{{1, "a"}, {2, "b"}, {1, "c"}, {1, "d"}} {
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			item, err := txn.Get(write.partitionId, []byte(write.key))
+			require.NoError(t, err)
+			require.Equal(t, "value-"+write.key, string(item.value))
+			return nil
+		}))
+	}
+}
+
+// TestDB_ReplayStall replays a value log that flushes more tables than level 0 can hold before it stalls. The
+// compactors are only started once the value log has been replayed, so the replay has to compact level 0 itself.
+func TestDB_ReplayStall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	crashDir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(crashDir)
+
+	// The level 0 tables are kept in memory, so all of the writes are lost in the crash except for the value log.
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	for i := 0; i < 2000; i += 20 {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			for j := i; j < i+20; j++ {
+				key := []byte(fmt.Sprintf("key%04d", j))
+				if err := txn.Set(1, key, make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	require.NoError(t, db.Sync())
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(crashDir, file.Name()), data, file.Mode()))
+	}
+	require.NoError(t, db.Close())
+
+	opts := getTestOptions(crashDir).
+		WithKeepL0InMemory(false).
+		WithNumMemoryTables(1).
+		WithNumLevelZeroTables(1).
+		WithNumLevelZeroTablesStall(2)
+	result := make(chan error, 1)
+	go func() {
+		db, err = Open(opts)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("replaying the value log stalled on level 0")
+	}
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	for i := 0; i < 2000; i++ {
+		_, err := db.Get(1, []byte(fmt.Sprintf("key%04d", i)), ReadOptions{})
+		require.NoError(t, err)
+	}
+}
+
+func TestDB_KeepL0InMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir).WithKeepL0InMemory(true)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	key, value := []byte("key"), []byte("value")
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		return txn.Set(1, key, value)
+	}))
+	require.NoError(t, db.Flush(1))
+
+	// The level 0 table can be read, but it has not been written to disk.
+	require.Len(t, db.Tables()[db.options.MaxLevels].Tables, 1)
+	require.Empty(t, getFileIdMap(z.OSFileSystem, dir)[1])
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		item, err := txn.Get(1, key)
+		require.NoError(t, err)
+		require.Equal(t, value, item.value)
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	// Once the database is closed the table is on disk.
+	require.Len(t, getFileIdMap(z.OSFileSystem, dir)[1], 1)
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		item, err := txn.Get(1, key)
+		require.NoError(t, err)
+		require.Equal(t, value, item.value)
+		return nil
+	}))
+}
+
+func TestDB_CompactL0OnClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// Without any compactors level 0 can only be compacted when the database is closed.
+	opts := getTestOptions(dir).
+		WithKeepL0InMemory(false).
+		WithCompactL0OnClose(true).
+		withoutCompactors()
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	key, value := []byte("key"), []byte("value")
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		return txn.Set(1, key, value)
+	}))
+	require.NoError(t, db.Flush(1))
+	require.Len(t, db.Tables()[db.options.MaxLevels].Tables, 1)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	levels := db.Tables()
+	levelZero, levelOne := levels[db.options.MaxLevels], levels[db.options.MaxLevels+1]
+	require.Equal(t, PartitionId(1), levelZero.PartitionId)
+	require.Empty(t, levelZero.Tables)
+	require.Len(t, levelOne.Tables, 1)
+
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		item, err := txn.Get(1, key)
+		require.NoError(t, err)
+		require.Equal(t, value, item.value)
+		return nil
+	}))
+}
+
+func TestDB_Tables(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		createTestLevel0Table(t, db, 0, []string{"a", "b", "c"}, 1)
+		createTestLevel0Table(t, db, 2, []string{"x", "y"}, 1)
+
+		levels := db.Tables()
+		require.Len(t, levels, 2*int(db.options.MaxLevels))
+
+		// Partitions are ordered, and every level of a partition is returned even if it is empty.
+		partitionZero, partitionTwo := levels[0], levels[db.options.MaxLevels]
+		require.Equal(t, PartitionId(0), partitionZero.PartitionId)
+		require.Equal(t, uint8(0), partitionZero.Level)
+		require.Equal(t, PartitionId(2), partitionTwo.PartitionId)
+		require.Equal(t, uint8(0), partitionTwo.Level)
+		require.Empty(t, levels[1].Tables)
+		require.Equal(t, db.options.LevelOneSize, levels[1].MaxTotalSize)
+
+		require.Len(t, partitionZero.Tables, 1)
+		info := partitionZero.Tables[0]
+		require.Equal(t, uint32(3), info.KeyCount)
+		require.Equal(t, "a", string(z.ParseKey(info.Smallest)))
+		require.Equal(t, "c", string(z.ParseKey(info.Largest)))
+		require.Equal(t, info.Size, partitionZero.TotalSize)
+
+		require.Len(t, partitionTwo.Tables, 1)
+		require.Equal(t, uint32(2), partitionTwo.Tables[0].KeyCount)
+	})
+}
+
+func TestDB_CompactionStats(t *testing.T) {
+	opts := getTestOptions("").
+		withoutCompactors(). // Compactions are run manually.
+		WithNumCompactionBuilds(1)
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		createTestLevel0Table(t, db, 0, []string{"a", "b", "c"}, 1)
+		createTestLevel0Table(t, db, 0, []string{"b", "d"}, 2)
+
+		stats := db.CompactionStats()
+		require.Len(t, stats, int(db.options.MaxLevels))
+		require.Equal(t, CompactionStats{PartitionId: 0, Level: 0}, stats[0])
+
+		// Hold the only build that is allowed, so the compaction can be seen while it is running.
+		require.NoError(t, db.levelsController.buildThrottle.Do())
+		compacted := make(chan error, 1)
+		go func() {
+			compacted <- db.levelsController.doCompact(compactionPriority{level: 0})
+		}()
+
+		var running CompactionStats
+		for i := 0; i < 1000 && running.ActiveCompactions == 0; i++ {
+			time.Sleep(time.Millisecond)
+			running = db.CompactionStats()[0]
+		}
+		require.Equal(t, 1, running.ActiveCompactions)
+		require.True(t, running.CompactingBytes > 0)
+		require.Zero(t, running.CompactedBytes)
+
+		db.levelsController.buildThrottle.Done(nil)
+		require.NoError(t, <-compacted)
+
+		done := db.CompactionStats()[0]
+		require.Zero(t, done.ActiveCompactions)
+		require.Zero(t, done.CompactingBytes)
+		require.Equal(t, running.CompactingBytes, done.CompactedBytes)
+	})
+}
+
+func TestDB_SetPartitionOptions(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.Error(t, db.SetPartitionOptions(1, 0, 1))
+		require.Error(t, db.SetPartitionOptions(1, 1<<10, 0))
+		require.Error(t, db.SetPartitionOptions(1, 1, 1))
+
+		// Partition 1 rotates its memory tables far sooner than partition 2, which uses the default options.
+		require.NoError(t, db.SetPartitionOptions(1, 1<<10, 100))
+
+		value := make([]byte, 64)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.Update(func(txn *Transaction) error {
+				key := []byte(fmt.Sprintf("key%03d", i))
+				require.NoError(t, txn.Set(1, key, value))
+				return txn.Set(2, key, value)
+			}))
+		}
+
+		// The rotated memory tables are flushed in the background, so they are either still in memory or in the levels.
+		tables := map[PartitionId]int{}
+		for _, level := range db.Tables() {
+			tables[level.PartitionId] += len(level.Tables)
+		}
+
+		busy, idle := db.getPartition(1), db.getPartition(2)
+		busy.RLock()
+		require.Equal(t, int64(1<<10), busy.maxTableSize)
+		require.True(t, len(busy.flushed)+tables[1] > 0, "partition 1 should have rotated its memory tables")
+		busy.RUnlock()
+
+		idle.RLock()
+		require.Equal(t, db.options.MaxTableSize, idle.maxTableSize)
+		require.Equal(t, db.options.NumMemoryTables, idle.numMemoryTables)
+		require.Empty(t, idle.flushed)
+		require.Zero(t, tables[2])
+		idle.RUnlock()
+
+		// Every key should still be readable from both partitions.
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("key%03d", i))
+				for _, partitionId := range []PartitionId{1, 2} {
+					_, err := txn.Get(partitionId, key)
+					require.NoError(t, err)
+				}
+			}
+			return nil
+		}))
+	})
+}
+
+func TestDB_AdaptiveTableSize(t *testing.T) {
+	clock := newTestClock(time.Unix(1000, 0))
+	opts := getTestOptions("").
+		WithAdaptiveMaxTableSize(1 << 17).
+		withoutCompactors() // Level 0 is left alone.
+	opts.clock = clock
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		partition := db.getPartition(1)
+		tableSize := func() int64 {
+			partition.RLock()
+			defer partition.RUnlock()
+			return partition.tableSize()
+		}
+		active := func() *skiplist.SkipList {
+			partition.RLock()
+			defer partition.RUnlock()
+			return partition.active
+		}
+
+		// Each batch is much smaller than a memory table, so it can't rotate more than one of them.
+		var written int
+		writeUntilRotated := func(rotations int) {
+			for i := 0; i < rotations; i++ {
+				for current := active(); current == active(); {
+					require.NoError(t, db.Update(func(txn *Transaction) error {
+						for i := 0; i < 20; i++ {
+							key := []byte(fmt.Sprintf("key%06d", written))
+							written++
+							if err := txn.Set(1, key, make([]byte, 100)); err != nil {
+								return err
+							}
+						}
+						return nil
+					}))
+				}
+			}
+		}
+
+		// level0 returns the sizes of the level 0 tables of the partition, oldest first.
+		level0 := func() []int64 {
+			var tables []TableInfo
+			for _, level := range db.Tables() {
+				if level.PartitionId == 1 && level.Level == 0 {
+					tables = level.Tables
+				}
+			}
+			sort.Slice(tables, func(i, j int) bool {
+				return tables[i].FileId < tables[j].FileId
+			})
+
+			sizes := make([]int64, len(tables))
+			for i, table := range tables {
+				sizes[i] = table.Size
+			}
+			return sizes
+		}
+
+		// The clock doesn't move during the burst, so every memory table fills up within the interval and the next one
+		// is twice as large, up to the adaptive max table size.
+		writeUntilRotated(3)
+		require.Equal(t, int64(1<<17), tableSize())
+
+		// The rotated tables are written to level 0 in the background.
+		sizes := level0()
+		for deadline := time.Now().Add(5 * time.Second); len(sizes) < 3; sizes = level0() {
+			require.True(t, time.Now().Before(deadline), "the rotated tables were not flushed, sizes %v", sizes)
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.True(t, sizes[0] < opts.MaxTableSize+db.options.maxBatchSize, "sizes %v", sizes)
+		require.True(t, sizes[1] > opts.MaxTableSize, "sizes %v", sizes)
+		require.True(t, sizes[2] > 2*opts.MaxTableSize, "sizes %v", sizes)
+
+		// Once the partition is idle the memory tables shrink back down to the max table size.
+		for _, expected := range []int64{1 << 16, 1 << 15, 1 << 15} {
+			clock.advance(5 * time.Second)
+			writeUntilRotated(1)
+			require.Equal(t, expected, tableSize())
+		}
+	})
+}
+
+func TestDB_AdaptiveTableSize_Stalled(t *testing.T) {
+	clock := newTestClock(time.Unix(1000, 0))
+	fs := &blockingFileSystem{FileSystem: z.OSFileSystem, release: make(chan struct{})}
+	opts := getTestOptions("").
+		WithAdaptiveMaxTableSize(1 << 17).
+		WithNumMemoryTables(1).
+		WithKeepL0InMemory(false)
+	opts.clock = clock
+	opts.FileSystem = fs
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				require.NoError(t, db.Update(func(txn *Transaction) error {
+					return txn.Set(1, []byte(fmt.Sprintf("key%06d", i)), make([]byte, 100))
+				}))
+			}
+		}()
+
+		// The first table can't be flushed, so the writes stall once the second table has filled up as well.
+		partition := db.getPartition(1)
+		var stalled *skiplist.SkipList
+		for deadline := time.Now().Add(5 * time.Second); stalled == nil; {
+			require.True(t, time.Now().Before(deadline), "the writes did not stall")
+			time.Sleep(10 * time.Millisecond)
+
+			partition.RLock()
+			if partition.isFull() && !partition.activeFilledAt.IsZero() {
+				stalled = partition.active
+				require.Equal(t, int64(1<<16), partition.tableSize())
+			}
+			partition.RUnlock()
+		}
+
+		// The time the writes wait for the flush is not part of the time the table took to fill up, so the partition
+		// is still busy and the next table is twice as large.
+		clock.advance(10 * time.Second)
+		close(fs.release)
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			require.True(t, time.Now().Before(deadline), "the writes did not resume after the flush")
+			time.Sleep(10 * time.Millisecond)
+
+			partition.RLock()
+			active, tableSize := partition.active, partition.tableSize()
+			partition.RUnlock()
+			if active != stalled {
+				require.Equal(t, int64(1<<17), tableSize)
+				break
+			}
+		}
+
+		close(stop)
+		<-done
+	})
+}
+
+// blockingFileSystem passes every operation through to the os package, except for creating table files which waits
+// until release is closed.
+type blockingFileSystem struct {
+	z.FileSystem
+	release chan struct{}
+}
+
+func (fs *blockingFileSystem) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	if flag&os.O_CREATE != 0 && strings.HasSuffix(name, table.FileExtension) {
+		<-fs.release
+	}
+
+	return fs.FileSystem.OpenFile(name, flag, perm)
+}
+
+// failingReplayFileSystem passes every operation through to the os package, except for opening value log files for
+// reading which is what replaying the value log does.
+type failingReplayFileSystem struct {
+	z.FileSystem
+}
+
+func (fs failingReplayFileSystem) Open(name string) (*os.File, error) {
+	if strings.HasSuffix(name, ".vlog") {
+		return nil, errors.New("failed to open value log")
+	}
+
+	return fs.FileSystem.Open(name)
+}
+
+func TestOpen_ReplayFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Set(1, []byte("key"), []byte("value"), WriteOptions{}))
+	require.NoError(t, db.Close())
+
+	// Everything that was started before the value log was replayed is stopped again, including the compactors and
+	// the goroutine that flushes memory tables.
+	goroutines := runtime.NumGoroutine()
+	failing := opts
+	failing.FileSystem = failingReplayFileSystem{FileSystem: z.OSFileSystem}
+	_, err = Open(failing)
+	require.Error(t, err)
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > goroutines; {
+		require.True(t, time.Now().Before(deadline), "%d goroutines are still running after the failed open, "+
+			"there were %d before it", runtime.NumGoroutine(), goroutines)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The directories are unlocked and the files are closed, so the database can be opened again.
+	db, err = Open(opts)
+	require.NoError(t, err)
+	value, err := db.Get(1, []byte("key"), ReadOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "value", string(value))
+	require.NoError(t, db.Close())
+}
+
+func TestDB_MemoryTableBackpressure(t *testing.T) {
+	fs := &blockingFileSystem{FileSystem: z.OSFileSystem, release: make(chan struct{})}
+	opts := getTestOptions("").WithNumMemoryTables(2).WithKeepL0InMemory(false)
+	opts.FileSystem = fs
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		var written int64
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				require.NoError(t, db.Update(func(txn *Transaction) error {
+					return txn.Set(1, []byte(fmt.Sprintf("key%06d", i)), make([]byte, 100))
+				}))
+				atomic.AddInt64(&written, 1)
+			}
+		}()
+
+		// waitForStall waits until the writes have stopped making progress.
+		waitForStall := func() int64 {
+			last := atomic.LoadInt64(&written)
+			for {
+				time.Sleep(200 * time.Millisecond)
+				current := atomic.LoadInt64(&written)
+				if current == last {
+					return current
+				}
+				last = current
+			}
+		}
+
+		// Level 0 tables can't be created, so the writes stop once both flushed tables and the active table are full.
+		stalled := waitForStall()
+		partition := db.getPartition(1)
+		partition.RLock()
+		require.Len(t, partition.flushed, 2)
+		require.True(t, partition.isFull())
+		require.True(t, partition.active.MemSize() >= partition.activeLimit())
+		partition.RUnlock()
+
+		// Once the flushed tables can be written to level 0 the writes carry on without anything else being done.
+		close(fs.release)
+		for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&written) < stalled+1000; {
+			require.True(t, time.Now().Before(deadline), "writes did not resume after the flush")
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(stop)
+		<-done
+
+		var tables int
+		for _, level := range db.Tables() {
+			if level.PartitionId == 1 {
+				tables += len(level.Tables)
+			}
+		}
+		require.True(t, tables > 0, "the rotated memory tables should have been flushed")
+
+		// Flush writes the rest of the partition, including the active table.
+		require.NoError(t, db.Flush(1))
+		partition.RLock()
+		require.Empty(t, partition.flushed)
+		require.True(t, partition.active.Empty())
+		partition.RUnlock()
+	})
+}
+
+func TestDB_CreatePartition(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		// Partition 0 is always created when the database is opened.
+		require.Equal(t, []PartitionId{0}, db.Partitions())
+		require.Equal(t, ErrPartitionExists, db.CreatePartition(0))
+
+		require.NoError(t, db.CreatePartition(5))
+		require.NoError(t, db.CreatePartition(2))
+		require.Equal(t, []PartitionId{0, 2, 5}, db.Partitions())
+		require.Equal(t, ErrPartitionExists, db.CreatePartition(5))
+
+		// The levels should be set up along with the memory tables.
+		_, ok := db.levelsController.getPartition(5)
+		require.True(t, ok)
+
+		// Partitions that are created by writing to them should be listed too, and cannot be created again.
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			require.NoError(t, txn.Set(5, []byte("key"), []byte("value")))
+			return txn.Set(3, []byte("key"), []byte("value"))
+		}))
+		require.Equal(t, []PartitionId{0, 2, 3, 5}, db.Partitions())
+		require.Equal(t, ErrPartitionExists, db.CreatePartition(3))
+	})
+}
+
+func TestDB_DropPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+
+	set := func(partitionId PartitionId, key string) {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(partitionId, []byte(key), []byte("value"))
+		}))
+	}
+	exists := func(partitionId PartitionId, key string) bool {
+		err := db.View(func(txn *Transaction) error {
+			_, err := txn.Get(partitionId, []byte(key))
+			return err
+		})
+		if err == ErrKeyNotFound {
+			return false
+		}
+		require.NoError(t, err)
+		return true
+	}
+
+	// Partition 1 has keys in a table and in its memory table, partition 2 only in its memory table.
+	set(1, "flushed")
+	require.NoError(t, db.Flush(1))
+	set(1, "active")
+	set(2, "active")
+	set(3, "kept")
+	require.Equal(t, []PartitionId{0, 1, 2, 3}, db.Partitions())
+
+	require.Equal(t, ErrInvalidRequest, db.DropPartitions(2, 0))
+	require.NoError(t, db.DropPartitions(2, 1, 2))
+	require.Equal(t, []PartitionId{0, 3}, db.Partitions())
+	require.False(t, exists(1, "flushed"))
+	require.False(t, exists(1, "active"))
+	require.False(t, exists(2, "active"))
+	require.True(t, exists(3, "kept"))
+
+	// A dropped partition can be written to again, and the partition's new tables don't reuse the old file names.
+	set(1, "recreated")
+	require.NoError(t, db.Flush(1))
+	require.True(t, exists(1, "recreated"))
+	require.False(t, exists(1, "flushed"))
+	require.NoError(t, db.Close())
+
+	db, err = Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.Equal(t, []PartitionId{0, 1, 3}, db.Partitions())
+	require.True(t, exists(1, "recreated"))
+	require.False(t, exists(1, "flushed"))
+	require.False(t, exists(2, "active"))
+	require.True(t, exists(3, "kept"))
+}
+
+// TestDB_PartitionOperationsConcurrently creates, drops, writes to and flushes the same partitions from many goroutines
+// at once. Run with -race to check the lock ordering of the partition operations.
+func TestDB_PartitionOperationsConcurrently(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		const numberOfPartitions, iterations = 4, 50
+		partitionId := func(i int) PartitionId {
+			return PartitionId(i%numberOfPartitions + 1)
+		}
+
+		var wg sync.WaitGroup
+		run := func(operation func(i int) error) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < iterations; i++ {
+					require.NoError(t, operation(i))
+				}
+			}()
+		}
+
+		run(func(i int) error {
+			if err := db.CreatePartition(partitionId(i)); err != ErrPartitionExists {
+				return err
+			}
+			return nil
+		})
+		run(func(i int) error {
+			return db.DropPartitions(partitionId(i), partitionId(i+1))
+		})
+		run(func(i int) error {
+			return db.DropPartitions(partitionId(i+3), partitionId(i+2))
+		})
+		run(func(i int) error {
+			return db.Update(func(txn *Transaction) error {
+				for j := 0; j < numberOfPartitions; j++ {
+					if err := txn.Set(partitionId(i+j), []byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
+		run(func(i int) error {
+			return db.Flush(partitionId(i))
+		})
+		run(func(i int) error {
+			return db.SetPartitionOptions(partitionId(i), db.options.MaxTableSize, db.options.NumMemoryTables)
+		})
+		run(func(i int) error {
+			return db.View(func(txn *Transaction) error {
+				if _, err := txn.Get(partitionId(i), []byte(fmt.Sprintf("key%d", i-1))); err != ErrKeyNotFound {
+					return err
+				}
+				return nil
+			})
+		})
+		wg.Wait()
+
+		// Once everything has been dropped the partitions only have the keys that are written after the drop.
+		require.NoError(t, db.DropPartitions(1, 2, 3, 4))
+		require.Equal(t, []PartitionId{0}, db.Partitions())
+		for i := 1; i <= numberOfPartitions; i++ {
+			require.NoError(t, db.Update(func(txn *Transaction) error {
+				return txn.Set(PartitionId(i), []byte("key"), []byte(fmt.Sprintf("value%d", i)))
+			}))
+			require.NoError(t, db.Flush(PartitionId(i)))
+		}
+
+		require.Equal(t, []PartitionId{0, 1, 2, 3, 4}, db.Partitions())
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			for i := 1; i <= numberOfPartitions; i++ {
+				itr := txn.NewIterator(PartitionId(i), DefaultIteratorOptions)
+				var keys []string
+				for itr.Rewind(); itr.Valid(); itr.Next() {
+					value, err := itr.Item().ValueCopy(nil)
+					require.NoError(t, err)
+					require.Equal(t, fmt.Sprintf("value%d", i), string(value))
+					keys = append(keys, string(itr.Item().Key()))
+				}
+				itr.Close()
+				require.Equal(t, []string{"key"}, keys)
+			}
+			return nil
+		}))
+	})
+}
+
+func TestDB_KeySplits(t *testing.T) {
+	opts := getTestOptions("")
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		require.Empty(t, db.KeySplits(1, nil))
+
+		var keys []string
+		for _, prefix := range []string{"a", "b"} {
+			for i := 0; i < 1000; i += 20 {
+				require.NoError(t, db.Update(func(txn *Transaction) error {
+					for j := i; j < i+20; j++ {
+						key := fmt.Sprintf("%s-key%04d", prefix, j)
+						keys = append(keys, key)
+						if err := txn.Set(1, []byte(key), make([]byte, 100)); err != nil {
+							return err
+						}
+					}
+					return nil
+				}))
+
+				// Nothing else flushes the memory tables, writes would wait for them once they are all full.
+				if (i+20)%500 == 0 {
+					require.NoError(t, db.Flush(1))
+				}
+			}
+		}
+		require.NoError(t, db.levelsController.compactLevel0())
+
+		for _, prefix := range []string{"", "b"} {
+			splits := db.KeySplits(1, []byte(prefix))
+			require.True(t, len(splits) > 1, "prefix %q has splits %q", prefix, splits)
+			for i, split := range splits {
+				require.True(t, strings.HasPrefix(string(split), prefix))
+				if i > 0 {
+					require.True(t, string(splits[i-1]) < string(split), "splits %q are not ascending", splits)
+				}
+			}
+
+			// Every key with the prefix is in exactly one of the ranges, and none of the ranges are empty.
+			counts := make([]int, len(splits)+1)
+			for _, key := range keys {
+				if !strings.HasPrefix(key, prefix) {
+					continue
+				}
+
+				matched := 0
+				for i := range counts {
+					left, right := prefix, ""
+					if i > 0 {
+						left = string(splits[i-1])
+					}
+					if i < len(splits) {
+						right = string(splits[i])
+					}
+					if key >= left && (right == "" || key < right) {
+						counts[i]++
+						matched++
+					}
+				}
+				require.Equal(t, 1, matched, "key %s", key)
+			}
+			for i, count := range counts[:len(splits)] {
+				require.True(t, count > 0, "range %d of prefix %q is empty", i, prefix)
+			}
+		}
+	})
+}
+
+func TestDB_Flatten(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		// Every round overwrites the same keys, so the tables of every level overlap.
+		write := func(round int) {
+			for partitionId := PartitionId(0); partitionId < 2; partitionId++ {
+				for i := 0; i < 300; i += 30 {
+					require.NoError(t, db.Update(func(txn *Transaction) error {
+						for j := i; j < i+30; j++ {
+							key, value := fmt.Sprintf("key%04d", j), fmt.Sprintf("value%d-%d", j, round)
+							if err := txn.Set(partitionId, []byte(key), []byte(value)); err != nil {
+								return err
+							}
+						}
+						return nil
+					}))
+				}
+				require.NoError(t, db.Flush(partitionId))
+			}
+		}
+		levelsWithTables := func(partitionId PartitionId) (levels []uint8) {
+			for _, level := range db.Tables() {
+				if level.PartitionId == partitionId && len(level.Tables) > 0 {
+					levels = append(levels, level.Level)
+				}
+			}
+			return levels
+		}
+
+		write(0)
+		require.NoError(t, db.levelsController.compactLevel0())
+		write(1)
+		write(2)
+		require.Equal(t, []uint8{0, 1}, levelsWithTables(1))
+
+		require.NoError(t, db.Flatten(2))
+		for partitionId := PartitionId(0); partitionId < 2; partitionId++ {
+			require.Len(t, levelsWithTables(partitionId), 1, partitionId)
+		}
+
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			for partitionId := PartitionId(0); partitionId < 2; partitionId++ {
+				for i := 0; i < 300; i++ {
+					item, err := txn.Get(partitionId, []byte(fmt.Sprintf("key%04d", i)))
+					require.NoError(t, err)
+					value, err := item.ValueCopy(nil)
+					require.NoError(t, err)
+					require.Equal(t, fmt.Sprintf("value%d-2", i), string(value))
+				}
+			}
+			return nil
+		}))
+
+		// Flattening a flat tree does nothing.
+		require.NoError(t, db.Flatten(1))
+	})
+}
+
+func TestDB_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// Level 0 tables are written to disk so the keys are read from tables that are opened read only.
+	opts := getTestOptions(dir).WithKeepL0InMemory(false)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Set(1, []byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)),
+			WriteOptions{}))
+	}
+	require.NoError(t, db.Flush(1))
+	require.NoError(t, db.Close())
+
+	// The directory lock is shared, so more than one process can open the database read only at the same time.
+	opts = opts.WithReadOnly(true)
+	db, err = Open(opts)
+	require.NoError(t, err)
+	other, err := Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		iterator := txn.NewIterator(1, DefaultIteratorOptions)
+		defer iterator.Close()
+		count := 0
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			value, err := iterator.Item().ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("value%03d", count), string(value))
+			count++
+		}
+		require.Equal(t, 100, count)
+		return nil
+	}))
+	value, err := db.Get(1, []byte("key042"), ReadOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "value042", string(value))
+
+	require.Equal(t, ErrReadOnly, db.Set(1, []byte("key"), []byte("value"), WriteOptions{}))
+	require.Equal(t, ErrReadOnly, db.Update(func(txn *Transaction) error {
+		return txn.Delete(1, []byte("key000"))
+	}))
+	require.Equal(t, ErrReadOnly, db.DeleteRange(1, []byte("key000"), []byte("key050")))
+	require.Equal(t, ErrReadOnly, db.DropPartitions(1))
+	require.Equal(t, ErrReadOnly, db.SplitPartition(1, []byte("key050"), 2))
+	require.Equal(t, ErrReadOnly, db.Flatten(1))
+	require.Equal(t, ErrReadOnly, db.Flush(1))
+	require.NoError(t, db.Close())
+
+	// Nothing was changed by the database that was opened read only.
+	db, err = Open(opts.WithReadOnly(false))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	value, err = db.Get(1, []byte("key000"), ReadOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "value000", string(value))
+}
+
+func TestDB_ValidatePartitionId(t *testing.T) {
+	opts := getTestOptions("").WithMaxPartitionId(100)
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		for _, partitionId := range []PartitionId{0, 1, 100} {
+			require.NoError(t, db.Update(func(txn *Transaction) error {
+				return txn.Set(partitionId, []byte("key"), []byte("value"))
+			}), partitionId)
+			require.NoError(t, db.View(func(txn *Transaction) error {
+				_, err := txn.Get(partitionId, []byte("key"))
+				return err
+			}), partitionId)
+		}
+		require.NoError(t, db.CreatePartition(50))
+
+		require.Equal(t, ErrInvalidPartitionId, db.CreatePartition(101))
+		require.Equal(t, ErrInvalidPartitionId, db.Update(func(txn *Transaction) error {
+			return txn.Set(101, []byte("key"), []byte("value"))
+		}))
+		require.Equal(t, ErrInvalidPartitionId, db.View(func(txn *Transaction) error {
+			_, err := txn.Get(101, []byte("key"))
+			return err
+		}))
+		require.Equal(t, []PartitionId{0, 1, 50, 100}, db.Partitions())
+	})
+
+	// The partitions at the top of the range are reserved regardless of MaxPartitionId.
+	opts = getTestOptions("").WithReservedPartitions(10)
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		require.NoError(t, db.CreatePartition(math.MaxUint32-10))
+		require.Equal(t, ErrInvalidPartitionId, db.CreatePartition(math.MaxUint32-9))
+		require.Equal(t, ErrInvalidPartitionId, db.CreatePartition(math.MaxUint32))
+	})
+}
+
+func TestDB_Metrics(t *testing.T) {
+	// Level 0 tables can't be created until the test is done, so the rotated memory tables stay in memory.
+	fs := &blockingFileSystem{FileSystem: z.OSFileSystem, release: make(chan struct{})}
+	opts := getTestOptions("").WithKeepL0InMemory(false)
+	opts.FileSystem = fs
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		defer close(fs.release)
+
+		// Only partition 0 exists when the database is opened.
+		metrics := db.Metrics()
+		require.Equal(t, 1, metrics.MemoryTables)
+		require.Equal(t, 0, metrics.PendingWrites)
+
+		// Rotating the memory tables of a partition should count both the active and flushed tables.
+		require.NoError(t, db.SetPartitionOptions(1, 1<<10, 100))
+		value := make([]byte, 64)
+		for i := 0; i < 50; i++ {
+			require.NoError(t, db.Update(func(txn *Transaction) error {
+				return txn.Set(1, []byte(fmt.Sprintf("key%03d", i)), value)
+			}))
+		}
+
+		partition := db.getPartition(1)
+		partition.RLock()
+		flushed := len(partition.flushed)
+		partition.RUnlock()
+		require.True(t, flushed > 0)
+		require.Equal(t, 2+flushed, db.Metrics().MemoryTables)
+
+		// The sizes are only updated periodically, so force them to be calculated.
+		db.calculateSize()
+		metrics = db.Metrics()
+		require.True(t, metrics.LSMSize >= 0)
+		require.True(t, metrics.ValueLogSize >= 0)
+		require.True(t, metrics.CacheHitRatio >= 0 && metrics.CacheHitRatio <= 1)
+	})
+}
+
+func TestDB_ExpiredEntries(t *testing.T) {
+	clock := newTestClock(time.Unix(1000, 0))
+	opts := getTestOptions("").withoutCompactors() // Compactions are run manually.
+	opts.clock = clock
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			expiring := NewEntry([]byte("expiring"), []byte("value"))
+			expiring.ExpiresAt = 1010
+			require.NoError(t, txn.SetEntry(1, expiring))
+			return txn.Set(1, []byte("kept"), []byte("value"))
+		}))
+
+		keys := func() (keys []string) {
+			require.NoError(t, db.View(func(txn *Transaction) error {
+				iterator := txn.NewIterator(1, DefaultIteratorOptions)
+				defer iterator.Close()
+				for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+					keys = append(keys, string(iterator.Item().Key()))
+				}
+				return nil
+			}))
+			return keys
+		}
+
+		var version uint64
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			item, err := txn.Get(1, []byte("expiring"))
+			require.NoError(t, err)
+			require.False(t, item.IsDeletedOrExpired())
+			version = item.Version()
+			return nil
+		}))
+		require.Equal(t, []string{"expiring", "kept"}, keys())
+
+		// The entry expires once the clock reaches its expiration.
+		clock.advance(10 * time.Second)
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			_, err := txn.Get(1, []byte("expiring"))
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		}))
+		require.Equal(t, []string{"kept"}, keys())
+
+		// Compacting the entry out of level 0 drops it from the tables. The reads are marked as done in the background,
+		// so wait for them before compacting.
+		require.NoError(t, db.oracle.readMark.WaitForMark(context.Background(), version))
+		require.NoError(t, db.Flush(1))
+		require.NoError(t, db.levelsController.compactLevel0())
+
+		partition, ok := db.levelsController.getPartition(1)
+		require.True(t, ok)
+		var tableKeys []string
+		for _, level := range partition.levels {
+			for _, tbl := range level.tables {
+				iterator := tbl.NewIterator(false)
+				for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+					tableKeys = append(tableKeys, string(z.ParseKey(iterator.Key())))
+				}
+				_ = iterator.Close()
+			}
+		}
+		require.Contains(t, tableKeys, "kept")
+		require.NotContains(t, tableKeys, "expiring")
+	})
+}
@@ -5,8 +5,9 @@ import (
 )
 
 const (
-	lockFileName          = "LOCK"
-	keyRegistryFileName   = "KEYREGISTRY"
-	valueLogFileExtension = ".vlog"
-	tableFileExtension    = table.FileExtension
+	lockFileName               = "LOCK"
+	keyRegistryFileName        = "KEYREGISTRY"
+	keyRegistryRewriteFileName = "REWRITE-KEYREGISTRY"
+	valueLogFileExtension      = ".vlog"
+	tableFileExtension         = table.FileExtension
 )
@@ -15,6 +15,10 @@ var (
 	// range.
 	ErrValueLogSize = errors.New("Invalid ValueLogFileSize, must be between 1MB and 2GB")
 
+	// ErrValueThreshold is returned when opt.ValueThreshold is larger than the largest value that can be stored in
+	// the LSM tree.
+	ErrValueThreshold = errors.Errorf("Invalid ValueThreshold, must be less or equal to %d", maxValueThreshold)
+
 	// ErrKeyNotFound is returned when key isn't found on a txn.Get.
 	ErrKeyNotFound = errors.New("Key not found")
 
@@ -34,6 +38,13 @@ var (
 	// ErrEmptyKey is returned if an empty key is passed on an update function.
 	ErrEmptyKey = errors.New("Key cannot be empty")
 
+	// ErrKeyTooLarge is returned if a key is too large to be stored with a timestamp appended to it.
+	ErrKeyTooLarge = errors.Errorf("Key cannot be larger than %d bytes", maxKeySize)
+
+	// ErrValueTooLarge is returned if a value is too large to be stored in a single value log file, see
+	// WithValueLogFileSize.
+	ErrValueTooLarge = errors.New("Value is too large to fit into a value log file")
+
 	// ErrInvalidKey is returned if the key has a special !badger! prefix,
 	// reserved for internal usage.
 	ErrInvalidKey = errors.New("Key is using a reserved !badger! prefix")
@@ -81,6 +92,9 @@ var (
 	// ErrWindowsNotSupported is returned when opt.ReadOnly is used on Windows
 	ErrWindowsNotSupported = errors.New("Read-only mode is not supported on Windows")
 
+	// ErrReadOnly is returned if the user tries to change the database when it was opened with ReadOnly set.
+	ErrReadOnly = errors.New("No changes are allowed to a database that was opened in read-only mode")
+
 	// ErrTruncateNeeded is returned when the value log gets corrupt, and requires truncation of
 	// corrupt data to allow Badger to run properly.
 	ErrTruncateNeeded = errors.New(
@@ -103,8 +117,36 @@ var (
 	// ErrInvalidDataKeyID is returned if the datakey id is invalid.
 	ErrInvalidDataKeyID = errors.New("Invalid datakey id")
 
-	ErrInvalidEncryptionKey = errors.New("Encryption key's length should be" +
-		"either 16, 24, or 32 bytes")
+	// ErrEncryptionKeyLength is returned when opt.EncryptionKey is not empty and is not an AES-128, AES-192 or
+	// AES-256 key.
+	ErrEncryptionKeyLength = errors.New("Encryption key's length should be either 16, 24, or 32 bytes")
 
 	ErrGCInMemoryMode = errors.New("Cannot run value log GC when DB is opened in InMemory mode")
+
+	// ErrPartitionExists is returned when creating a partition that already exists.
+	ErrPartitionExists = errors.New("Partition already exists")
+
+	// ErrInvalidPartitionId is returned when a partition is greater than MaxPartitionId or is reserved for internal
+	// use.
+	ErrInvalidPartitionId = errors.New("Partition Id is greater than MaxPartitionId or is reserved")
+
+	// ErrPartitionNotEmpty is returned when splitting a partition into a partition that already contains data.
+	ErrPartitionNotEmpty = errors.New("Partition is not empty")
+
+	// ErrVersionDiscarded is returned when reading at a timestamp whose versions may have been discarded by compaction.
+	ErrVersionDiscarded = errors.New("Version at the read timestamp may have been discarded")
+
+	// ErrManagedTransaction is returned when a transaction that does not provide its own timestamps is used on a
+	// database that was opened with OpenManaged.
+	ErrManagedTransaction = errors.New("Timestamps are managed by the user, use NewTransactionAt and CommitAt instead")
+
+	// ErrNotManaged is returned when a commit timestamp is provided to a database that manages its own timestamps.
+	ErrNotManaged = errors.New("Timestamps can only be provided when the database is opened with OpenManaged")
+
+	// ErrCommitTimestamp is returned when a commit timestamp provided to CommitAt is not greater than the read
+	// timestamp of the transaction and the timestamp of every commit before it.
+	ErrCommitTimestamp = errors.New("Commit timestamp must be greater than the read timestamp and previous commits")
+
+	// ErrLoadNotEmpty is returned when a backup is loaded into a database that already contains data.
+	ErrLoadNotEmpty = errors.New("Backups can only be loaded into an empty database")
 )
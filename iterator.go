@@ -0,0 +1,545 @@
+package notbadger
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+
+	"github.com/elliotcourant/notbadger/skiplist"
+	"github.com/elliotcourant/notbadger/z"
+)
+
+type (
+	// Item is returned during iteration. Both the Key() and Value() output is only valid until iterator.Next() is
+	// called.
+	Item struct {
+		partitionId PartitionId
+		key         []byte
+		value       []byte
+		version     uint64
+		expiresAt   uint64
+		meta        byte // We need to store meta to know about bitValuePointer.
+		userMeta    byte
+
+		// clock decides whether the item has expired.
+		clock z.Clock
+	}
+)
+
+// PartitionId returns the partition that the item belongs to.
+func (item *Item) PartitionId() PartitionId {
+	return item.partitionId
+}
+
+// Key returns the key.
+//
+// Key is only valid as long as item is valid, or transaction is valid. If you need to use it outside its validity,
+// please use KeyCopy.
+func (item *Item) Key() []byte {
+	return item.key
+}
+
+// KeyCopy returns a copy of the key of the item, writing it to dst slice. If nil is passed, or capacity of dst isn't
+// sufficient, a new slice would be allocated and returned.
+func (item *Item) KeyCopy(dst []byte) []byte {
+	return append(dst[:0], item.key...)
+}
+
+// Version returns the commit timestamp of the item.
+func (item *Item) Version() uint64 {
+	return item.version
+}
+
+// Value retrieves the value of the item and calls the provided function with it. The value is only valid within the
+// provided function, if you need to use it outside of the function please use ValueCopy.
+//
+// If the item was returned by an iterator with NoPrefetchValues then the value is only valid until the iterator moves,
+// so this must be called before Next.
+func (item *Item) Value(fn func(value []byte) error) error {
+	return fn(item.value)
+}
+
+// ValueCopy returns a copy of the value of the item, writing it to dst slice. If nil is passed, or capacity of dst
+// isn't sufficient, a new slice would be allocated and returned.
+func (item *Item) ValueCopy(dst []byte) ([]byte, error) {
+	return append(dst[:0], item.value...), nil
+}
+
+// ValueSize returns the size of the value.
+func (item *Item) ValueSize() int64 {
+	return int64(len(item.value))
+}
+
+// IsDeletedOrExpired returns true if item contains deleted or expired value.
+func (item *Item) IsDeletedOrExpired() bool {
+	return isDeletedOrExpired(item.meta, item.expiresAt, item.clock)
+}
+
+// UserMeta returns the user metadata (if any) that was set with the entry.
+func (item *Item) UserMeta() byte {
+	return item.userMeta
+}
+
+// ExpiresAt returns a Unix time value indicating when the item will be considered expired. 0 indicates that the item
+// will never expire.
+func (item *Item) ExpiresAt() uint64 {
+	return item.expiresAt
+}
+
+// DiscardEarlierVersions returns whether the item was created with the option to discard earlier versions of a key when
+// multiple are available.
+func (item *Item) DiscardEarlierVersions() bool {
+	return item.meta&bitDiscardEarlierVersions > 0
+}
+
+// isDeletedOrExpired returns true if the value has been deleted, or if it has an expiration that is not after the
+// current time of the provided clock.
+func isDeletedOrExpired(meta byte, expiresAt uint64, clock z.Clock) bool {
+	if meta&bitDelete > 0 {
+		return true
+	}
+
+	if expiresAt == 0 {
+		return false
+	}
+
+	return expiresAt <= uint64(clock.Now().Unix())
+}
+
+// DefaultIteratorOptions contains default options when iterating over NotBadger key-value stores.
+var DefaultIteratorOptions = IteratorOptions{
+	Reverse: false,
+}
+
+type (
+	// IteratorOptions is used to set options when iterating over NotBadger key-value stores.
+	//
+	// This package provides DefaultIteratorOptions which contains options that should work for most applications.
+	// Consider using that as a starting point before customizing it for your own needs.
+	IteratorOptions struct {
+		Reverse     bool   // Direction of iteration. False is forward, true is backward.
+		AllVersions bool   // Fetch all valid versions of the same key, including deleted and expired versions.
+		Prefix      []byte // Only iterate over this given prefix.
+
+		// NoPrefetchValues skips copying the value of every item as the iterator moves. The items point at the values
+		// where the iterator read them instead, so a value is only valid until Next is called. Values are always stored
+		// next to their keys, so this never reads more than a scan that copies the values, it saves copying the values
+		// of scans that only need the keys.
+		NoPrefetchValues bool
+
+		// InternalAccess includes the keys that are used internally by the database, these are hidden by default.
+		InternalAccess bool
+
+		// ReadOptions apply to every table that the iterator reads.
+		ReadOptions
+	}
+
+	// Iterator helps iterating over the KV pairs in a lexicographically sorted order within a single partition.
+	Iterator struct {
+		internalIterator z.Iterator
+		txn              *Transaction
+		readTimestamp    uint64
+		partitionId      PartitionId
+
+		options IteratorOptions
+		item    *Item
+
+		// Used to skip over multiple versions of the same key.
+		lastKey []byte
+
+		// rangeDeletes are the range deletes of the partition that are visible at the read timestamp.
+		rangeDeletes []rangeDelete
+
+		// Set for iterators created by DB.NewIterator, these iterators own their transaction.
+		ownsTransaction bool
+	}
+
+	// pendingWritesIterator iterates over the writes of a transaction that have not been committed yet. The keys are
+	// presented with the transaction's read timestamp so they sort ahead of any committed version of the same key.
+	pendingWritesIterator struct {
+		entries       []*Entry
+		nextIdx       int
+		readTimestamp uint64
+		reversed      bool
+	}
+
+	// memoryTableIterator adapts a skiplist iterator to the z.Iterator interface in either direction.
+	memoryTableIterator struct {
+		iterator *skiplist.Iterator
+		reversed bool
+	}
+)
+
+// NewIterator returns a new iterator over the provided partition. The iterator presents the transaction's pending
+// writes merged with the committed data as of the transaction's read timestamp. The keys are returned in
+// lexicographically sorted order.
+//
+// NOTE: If a transaction is read-write, only one iterator can be active at one time.
+func (txn *Transaction) NewIterator(partitionId PartitionId, options IteratorOptions) *Iterator {
+	if txn.err != nil {
+		panic(txn.err)
+	} else if txn.discarded {
+		panic("Transaction has already been discarded")
+	}
+
+	// Do not change the order of the next if. We must track the number of running iterators.
+	if atomic.AddInt32(&txn.numberOfIterators, 1) > 1 && txn.update {
+		atomic.AddInt32(&txn.numberOfIterators, -1)
+		panic("Only one iterator can be active at one time, for a RW transaction.")
+	}
+
+	// The range deletes are read before the tables, like in Get.
+	rangeDeletes := txn.db.rangeDeletes.get(partitionId, txn.readTimestamp)
+
+	tables, decrement := txn.db.getMemoryTables(partitionId)
+	defer decrement()
+
+	var iterators []z.Iterator
+	if iterator := txn.newPendingWritesIterator(partitionId, options.Reverse); iterator != nil {
+		iterators = append(iterators, iterator)
+	}
+
+	for _, memoryTable := range tables {
+		iterators = append(iterators, &memoryTableIterator{
+			iterator: memoryTable.NewIterator(),
+			reversed: options.Reverse,
+		})
+	}
+
+	// This will increment the references of the tables.
+	iterators = txn.db.levelsController.appendIterators(partitionId, iterators, options.Reverse, options.ReadOptions)
+
+	return &Iterator{
+		internalIterator: z.NewMergeIterator(iterators, options.Reverse),
+		txn:              txn,
+		readTimestamp:    txn.readTimestamp,
+		partitionId:      partitionId,
+		options:          options,
+		rangeDeletes:     rangeDeletes,
+	}
+}
+
+// NewIterator returns an iterator over a snapshot of the provided partition as of now, without needing a transaction.
+// This also works when the database is opened in InMemory mode, where the data only exists in memory tables. The
+// iterator must be closed once it is no longer needed.
+func (db *DB) NewIterator(partitionId PartitionId) *Iterator {
+	txn := db.newLatestTransaction()
+	iterator := txn.NewIterator(partitionId, DefaultIteratorOptions)
+	iterator.ownsTransaction = true
+	return iterator
+}
+
+// Item returns pointer to the current key-value pair. This item is only valid until it.Next() gets called. In an update
+// transaction the key of the item is tracked as read, so the transaction conflicts with commits to it after it started.
+func (it *Iterator) Item() *Item {
+	if it.item != nil {
+		it.txn.addReadKey(it.partitionId, it.item.key)
+	}
+
+	return it.item
+}
+
+// Valid returns false when iteration is done.
+func (it *Iterator) Valid() bool {
+	if it.item == nil {
+		return false
+	}
+
+	return bytes.HasPrefix(it.item.key, it.options.Prefix)
+}
+
+// Err returns the error that stopped the iteration, or nil if the iterator is valid or has gone past the last key. A
+// table that can't be read makes the iterator invalid, so Err must be checked once Valid returns false to tell a scan
+// that failed apart from one that is complete.
+func (it *Iterator) Err() error {
+	return it.internalIterator.Err()
+}
+
+// ValidForPrefix returns false when iteration is done or when the current key is not prefixed by the specified
+// prefix.
+func (it *Iterator) ValidForPrefix(prefix []byte) bool {
+	return it.Valid() && bytes.HasPrefix(it.item.key, prefix)
+}
+
+// Close would close the iterator. It is important to call this when you're done with iteration.
+func (it *Iterator) Close() {
+	z.Check(it.internalIterator.Close())
+	atomic.AddInt32(&it.txn.numberOfIterators, -1)
+
+	if it.ownsTransaction {
+		it.txn.Discard()
+	}
+}
+
+// Next would advance the iterator by one. Always check it.Valid() after a Next() to ensure you have access to a valid
+// it.Item().
+func (it *Iterator) Next() {
+	it.item = nil
+	for it.internalIterator.Valid() {
+		if it.parseItem() {
+			break
+		}
+	}
+}
+
+// Seek would seek to the provided key if present. If absent, it would seek to the next smallest key greater than the
+// provided key if iterating in the forward direction. Behavior would be reversed if iterating backwards.
+func (it *Iterator) Seek(key []byte) {
+	it.lastKey = it.lastKey[:0]
+	if len(key) == 0 {
+		key = it.options.Prefix
+
+		// When iterating in reverse we want to start after every key with the prefix.
+		if len(key) > 0 && it.options.Reverse {
+			key = append(z.Copy(key), 0xFF)
+		}
+	}
+
+	if len(key) == 0 {
+		it.internalIterator.Rewind()
+		it.Next()
+		return
+	}
+
+	if !it.options.Reverse {
+		key = z.KeyWithTs(key, it.readTimestamp)
+	} else {
+		key = z.KeyWithTs(key, 0)
+	}
+
+	it.internalIterator.Seek(key)
+	it.Next()
+}
+
+// Rewind would rewind the iterator cursor all the way to zero-th position, which would be the smallest key if
+// iterating forward, and largest if iterating backward. It does not keep track of whether the cursor started with a
+// Seek().
+func (it *Iterator) Rewind() {
+	it.Seek(nil)
+}
+
+// parseItem is a complex function because it needs to handle both forward and reverse iteration implementation. We
+// store keys such that their versions are sorted in descending order. This makes forward iteration efficient, but
+// reverse iteration complicated. This tradeoff is better because forward iteration is more common than reverse.
+//
+// This function advances the iterator.
+func (it *Iterator) parseItem() bool {
+	mi := it.internalIterator
+	key := mi.Key()
+
+	// Skip any versions which are beyond the read timestamp.
+	version := z.ParseTs(key)
+	if version > it.readTimestamp {
+		mi.Next()
+		return false
+	}
+
+	if !it.options.InternalAccess && isInternalKey(key) {
+		mi.Next()
+		return false
+	}
+
+	// Versions deleted by a range delete are skipped even when iterating over all versions. Every older version of the
+	// key is deleted as well, so they are skipped one at a time.
+	if isRangeDeleted(it.rangeDeletes, z.ParseKey(key), version) {
+		mi.Next()
+		return false
+	}
+
+	if it.options.AllVersions {
+		// Return deleted or expired values also, otherwise the user can't figure out whether the key was deleted.
+		it.item = it.newItem(key, mi.Value())
+		mi.Next()
+		return true
+	}
+
+	// If iterating in forward direction, then just checking the last key against current key would be sufficient.
+	if !it.options.Reverse {
+		if z.SameKey(it.lastKey, key) {
+			mi.Next()
+			return false
+		}
+
+		// Only track in forward direction. We should update lastKey as soon as we find a different key in our
+		// snapshot. Consider keys: a 5, b 7 (del), b 5. When iterating, lastKey = a. Then we see b 7, which is
+		// deleted. If we don't store lastKey = b, we'll then return b 5, which is wrong. Therefore, update lastKey
+		// here.
+		it.lastKey = append(it.lastKey[:0], key...)
+	}
+
+FILL:
+	// If deleted, advance and return.
+	value := mi.Value()
+	if isDeletedOrExpired(value.Meta, value.ExpiresAt, it.txn.db.options.clock) ||
+		isRangeDeleted(it.rangeDeletes, z.ParseKey(mi.Key()), z.ParseTs(mi.Key())) {
+		mi.Next()
+		return false
+	}
+
+	item := it.newItem(mi.Key(), value)
+
+	// Advance but do not fill the item yet.
+	mi.Next()
+	if !it.options.Reverse || !mi.Valid() { // Forward direction, or invalid.
+		it.item = item
+		return true
+	}
+
+	// Reverse direction.
+	nextTs := z.ParseTs(mi.Key())
+	nextKey := z.ParseKey(mi.Key())
+	if nextTs <= it.readTimestamp && bytes.Equal(nextKey, item.key) {
+		// This is a valid potential candidate.
+		goto FILL
+	}
+
+	// Ignore the next candidate. Return the current one.
+	it.item = item
+	return true
+}
+
+// newItem creates an item from the key and value at the current position of the internal iterator. The key and value
+// are copied since the internal iterator may reuse its buffers. With NoPrefetchValues the value is not copied, the
+// tables that it was read from stay open until the iterator is closed.
+func (it *Iterator) newItem(key []byte, value z.ValueStruct) *Item {
+	item := &Item{
+		partitionId: it.partitionId,
+		key:         z.Copy(z.ParseKey(key)),
+		version:     z.ParseTs(key),
+		expiresAt:   value.ExpiresAt,
+		meta:        value.Meta,
+		userMeta:    value.UserMeta,
+		clock:       it.txn.db.options.clock,
+	}
+
+	if it.options.NoPrefetchValues {
+		item.value = value.Value
+	} else {
+		item.value = z.Copy(value.Value)
+	}
+
+	return item
+}
+
+// newPendingWritesIterator returns an iterator over the pending writes of the transaction for the provided partition,
+// or nil if there are no pending writes.
+func (txn *Transaction) newPendingWritesIterator(partitionId PartitionId, reversed bool) *pendingWritesIterator {
+	if !txn.update || len(txn.pendingWrites[partitionId]) == 0 {
+		return nil
+	}
+
+	entries := make([]*Entry, 0, len(txn.pendingWrites[partitionId]))
+	for _, e := range txn.pendingWrites[partitionId] {
+		entries = append(entries, e)
+	}
+
+	// Number of pending writes per transaction shouldn't be too big in general.
+	sort.Slice(entries, func(i, j int) bool {
+		cmp := bytes.Compare(entries[i].Key, entries[j].Key)
+		if !reversed {
+			return cmp < 0
+		}
+		return cmp > 0
+	})
+
+	return &pendingWritesIterator{
+		readTimestamp: txn.readTimestamp,
+		entries:       entries,
+		reversed:      reversed,
+	}
+}
+
+func (pi *pendingWritesIterator) Next() {
+	pi.nextIdx++
+}
+
+func (pi *pendingWritesIterator) Rewind() {
+	pi.nextIdx = 0
+}
+
+func (pi *pendingWritesIterator) Seek(key []byte) {
+	key = z.ParseKey(key)
+	pi.nextIdx = sort.Search(len(pi.entries), func(idx int) bool {
+		cmp := bytes.Compare(pi.entries[idx].Key, key)
+		if !pi.reversed {
+			return cmp >= 0
+		}
+		return cmp <= 0
+	})
+}
+
+func (pi *pendingWritesIterator) Key() []byte {
+	z.AssertTrue(pi.Valid())
+	entry := pi.entries[pi.nextIdx]
+	return z.KeyWithTs(entry.Key, pi.readTimestamp)
+}
+
+func (pi *pendingWritesIterator) Value() z.ValueStruct {
+	z.AssertTrue(pi.Valid())
+	entry := pi.entries[pi.nextIdx]
+	return z.ValueStruct{
+		Value:     entry.Value,
+		Meta:      entry.meta,
+		UserMeta:  entry.UserMeta,
+		ExpiresAt: entry.ExpiresAt,
+		Version:   pi.readTimestamp,
+	}
+}
+
+func (pi *pendingWritesIterator) Valid() bool {
+	return pi.nextIdx < len(pi.entries)
+}
+
+// Err always returns nil, the pending writes are already in memory.
+func (pi *pendingWritesIterator) Err() error {
+	return nil
+}
+
+func (pi *pendingWritesIterator) Close() error {
+	return nil
+}
+
+func (mi *memoryTableIterator) Next() {
+	if !mi.reversed {
+		mi.iterator.Next()
+	} else {
+		mi.iterator.Prev()
+	}
+}
+
+func (mi *memoryTableIterator) Rewind() {
+	if !mi.reversed {
+		mi.iterator.SeekToFirst()
+	} else {
+		mi.iterator.SeekToLast()
+	}
+}
+
+func (mi *memoryTableIterator) Seek(key []byte) {
+	if !mi.reversed {
+		mi.iterator.Seek(key)
+	} else {
+		mi.iterator.SeekForPrev(key)
+	}
+}
+
+func (mi *memoryTableIterator) Key() []byte {
+	return mi.iterator.Key()
+}
+
+func (mi *memoryTableIterator) Value() z.ValueStruct {
+	return mi.iterator.Value()
+}
+
+func (mi *memoryTableIterator) Valid() bool {
+	return mi.iterator.Valid()
+}
+
+// Err always returns nil, a memory table can't fail to be read.
+func (mi *memoryTableIterator) Err() error {
+	return nil
+}
+
+func (mi *memoryTableIterator) Close() error {
+	return mi.iterator.Close()
+}
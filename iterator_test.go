@@ -0,0 +1,255 @@
+package notbadger
+
+import (
+	"fmt"
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"testing"
+)
+
+func TestTransaction_NewIterator(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		// Commit some keys in the first partition, and a key in another partition that should never be seen.
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			for _, key := range []string{"a1", "a3", "a5", "b1"} {
+				if err := txn.Set(0, []byte(key), []byte("committed "+key)); err != nil {
+					return err
+				}
+			}
+			return txn.Set(1, []byte("a2"), []byte("other partition"))
+		}))
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+
+		// Mix pending writes in with the committed keys. a3 is overwritten and a5 is deleted by the transaction.
+		require.NoError(t, txn.Set(0, []byte("a2"), []byte("pending a2")))
+		require.NoError(t, txn.Set(0, []byte("a3"), []byte("pending a3")))
+		require.NoError(t, txn.Set(0, []byte("a4"), []byte("pending a4")))
+		require.NoError(t, txn.Delete(0, []byte("a5")))
+
+		collect := func(options IteratorOptions) []string {
+			iterator := txn.NewIterator(0, options)
+			defer iterator.Close()
+
+			var result []string
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+				item := iterator.Item()
+				value, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				result = append(result, fmt.Sprintf("%s=%s", item.Key(), value))
+			}
+			return result
+		}
+
+		expected := []string{
+			"a1=committed a1",
+			"a2=pending a2",
+			"a3=pending a3",
+			"a4=pending a4",
+			"b1=committed b1",
+		}
+		require.Equal(t, expected, collect(DefaultIteratorOptions))
+
+		reversed := make([]string, 0, len(expected))
+		for i := len(expected) - 1; i >= 0; i-- {
+			reversed = append(reversed, expected[i])
+		}
+		require.Equal(t, reversed, collect(IteratorOptions{Reverse: true}))
+
+		// The prefix should exclude b1 in both directions.
+		require.Equal(t, expected[:4], collect(IteratorOptions{Prefix: []byte("a")}))
+		require.Equal(t, reversed[1:], collect(IteratorOptions{Prefix: []byte("a"), Reverse: true}))
+
+		iterator := txn.NewIterator(0, DefaultIteratorOptions)
+		iterator.Seek([]byte("a25"))
+		require.True(t, iterator.Valid())
+		require.Equal(t, []byte("a3"), iterator.Item().Key())
+		iterator.Close()
+	})
+}
+
+func TestDB_NewIterator_InMemory(t *testing.T) {
+	db, err := Open(DefaultOptions("").WithInMemory(true))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		for _, key := range []string{"d", "b", "a", "c", "e"} {
+			require.NoError(t, txn.Set(0, []byte(key), []byte(key+"1")))
+		}
+		return txn.Set(1, []byte("other"), []byte("partition"))
+	}))
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		require.NoError(t, txn.Set(0, []byte("b"), []byte("b2")))
+		return txn.Delete(0, []byte("e"))
+	}))
+
+	// Internal keys should never be returned.
+	partition := db.getPartition(0)
+	partition.RLock()
+	partition.active.Put(z.KeyWithTs(head, 1), z.ValueStruct{Value: []byte("head")})
+	partition.RUnlock()
+
+	iterator := db.NewIterator(0)
+
+	// Writes after the iterator was created should not be visible.
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		return txn.Set(0, []byte("f"), []byte("f3"))
+	}))
+
+	var items []string
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		item := iterator.Item()
+		value, err := item.ValueCopy(nil)
+		require.NoError(t, err)
+		items = append(items, fmt.Sprintf("%s=%s@%d", item.Key(), value, item.Version()))
+	}
+	iterator.Close()
+
+	require.Equal(t, []string{"a=a1@1", "b=b2@2", "c=c1@1", "d=d1@1"}, items)
+}
+
+func TestTransaction_NewIterator_InternalAccess(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(0, []byte("a"), []byte("a1"))
+		}))
+
+		partition := db.getPartition(0)
+		partition.RLock()
+		partition.active.Put(z.KeyWithTs(head, 1), z.ValueStruct{Value: []byte("head")})
+		partition.RUnlock()
+
+		keys := func(options IteratorOptions) (keys []string) {
+			require.NoError(t, db.View(func(txn *Transaction) error {
+				iterator := txn.NewIterator(0, options)
+				defer iterator.Close()
+				for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+					keys = append(keys, string(iterator.Item().KeyCopy(nil)))
+				}
+				return nil
+			}))
+			return keys
+		}
+
+		require.Equal(t, []string{"a"}, keys(DefaultIteratorOptions))
+		require.Equal(t, []string{string(head), "a"}, keys(IteratorOptions{InternalAccess: true}))
+		require.Empty(t, keys(IteratorOptions{Prefix: notBadgerPrefix}))
+	})
+}
+
+func TestTransaction_NewIterator_WithoutPrefetch(t *testing.T) {
+	opts := getTestOptions("").WithKeepL0InMemory(false)
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		// One of the keys is in a table and the other is in a memory table.
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(0, []byte("a"), []byte("a1"))
+		}))
+		require.NoError(t, db.Flush(0))
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(0, []byte("b"), []byte("b1"))
+		}))
+
+		// The values are read by the iterator itself, so a scan with NoCache does not touch the cache when it reads
+		// them.
+		before := db.Metrics()
+		var items []string
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			iterator := txn.NewIterator(0, IteratorOptions{
+				NoPrefetchValues: true,
+				ReadOptions:      ReadOptions{NoCache: true},
+			})
+			defer iterator.Close()
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+				item := iterator.Item()
+				require.Equal(t, int64(2), item.ValueSize())
+				require.NoError(t, item.Value(func(value []byte) error {
+					items = append(items, fmt.Sprintf("%s=%s", item.Key(), value))
+					return nil
+				}))
+			}
+			return nil
+		}))
+		require.Equal(t, []string{"a=a1", "b=b1"}, items)
+
+		after := db.Metrics()
+		require.Equal(t, before.CacheHits, after.CacheHits)
+		require.Equal(t, before.CacheMisses, after.CacheMisses)
+
+		// Without NoCache the same scan goes through the cache.
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			iterator := txn.NewIterator(0, IteratorOptions{NoPrefetchValues: true})
+			defer iterator.Close()
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			}
+			return nil
+		}))
+		cached := db.Metrics()
+		require.Greater(t, cached.CacheHits+cached.CacheMisses, after.CacheHits+after.CacheMisses)
+
+		// The zero value of the options copies the values, so they can be used after the iterator has moved on.
+		var copied []*Item
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			iterator := txn.NewIterator(0, IteratorOptions{})
+			defer iterator.Close()
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+				copied = append(copied, iterator.Item())
+			}
+			return nil
+		}))
+		require.Len(t, copied, 2)
+		for i, expected := range []string{"a1", "b1"} {
+			value, err := copied[i].ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, expected, string(value))
+		}
+	})
+}
+
+func BenchmarkIterator_NoPrefetchValues(b *testing.B) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(b, err)
+	defer removeDir(dir)
+
+	db, err := Open(DefaultOptions(dir))
+	require.NoError(b, err)
+	defer func() {
+		require.NoError(b, db.Close())
+	}()
+
+	value := make([]byte, 1<<10)
+	for i := 0; i < 10; i++ {
+		require.NoError(b, db.Update(func(txn *Transaction) error {
+			for j := 0; j < 1000; j++ {
+				if err := txn.Set(0, []byte(fmt.Sprintf("key%02d%04d", i, j)), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+
+	scan := func(b *testing.B, prefetch bool) {
+		for n := 0; n < b.N; n++ {
+			require.NoError(b, db.View(func(txn *Transaction) error {
+				iterator := txn.NewIterator(0, IteratorOptions{NoPrefetchValues: !prefetch})
+				defer iterator.Close()
+				for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+					_ = iterator.Item().Key()
+				}
+				return nil
+			}))
+		}
+	}
+
+	b.Run("keys", func(b *testing.B) {
+		scan(b, false)
+	})
+	b.Run("values", func(b *testing.B) {
+		scan(b, true)
+	})
+}
@@ -1,47 +1,93 @@
 package notbadger
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/aes"
+	"crypto/rand"
 	"encoding/binary"
 	"github.com/OneOfOne/xxhash"
 	"github.com/elliotcourant/notbadger/pb"
 	"github.com/elliotcourant/notbadger/z"
+	"github.com/pkg/errors"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 )
 
+const (
+	// maxDataKeySize is the largest data key record that is read from the key registry. A data key is only a few dozen
+	// bytes, so a larger length read from the file means the registry is corrupt.
+	maxDataKeySize = 1 << 16
+)
+
 var (
 	sanityText = []byte("not badger")
+
+	// errBadKeyRegistryChecksum is returned when a data key read from the key registry does not match the checksum that
+	// was written alongside it. This is usually an indication that the key registry is corrupted.
+	errBadKeyRegistryChecksum = errors.New("KEYREGISTRY has bad checksum")
 )
 
 type (
 	// KeyRegistry used to maintain all the data keys.
+	// Every partition has its own data keys that are rotated independently of the other partitions. Key Ids are unique
+	// across all of the partitions.
 	KeyRegistry struct {
 		sync.RWMutex
-		// Might need to be separated by partition.
-		dataKeys    map[PartitionId]map[uint64]*pb.DataKey
-		lastCreated int64 // lastCreated is the timestamp(seconds) of the last data key generated.
+		dataKeys map[PartitionId]map[uint64]*pb.DataKey
+
+		// latestKeys is the most recently created data key of each partition, and lastCreated is the timestamp
+		// (seconds) it was created at.
+		latestKeys  map[PartitionId]*pb.DataKey
+		lastCreated map[PartitionId]int64
 		nextKeyId   uint64
 		file        *os.File
 		options     KeyRegistryOptions
 	}
 
+	// keyRegistryIterator reads the data keys from a key registry file one at a time. validOffset is the end of the last
+	// complete data key that was read, and size is the size of the file.
+	keyRegistryIterator struct {
+		encryptionKey []byte
+		reader        *bufio.Reader
+		lenSumBuf     [8]byte
+		validOffset   int64
+		size          int64
+	}
+
 	KeyRegistryOptions struct {
 		Directory                     string
 		ReadOnly                      bool
 		EncryptionKey                 []byte
 		EncryptionKeyRotationDuration time.Duration
 		InMemory                      bool
+
+		// FileSystem is used to create, open and rename the key registry file. The os package is used when this is
+		// nil.
+		FileSystem z.FileSystem
 	}
 )
 
+// fileSystem returns the file system that the key registry file is created and opened with.
+func (opts KeyRegistryOptions) fileSystem() z.FileSystem {
+	if opts.FileSystem == nil {
+		return z.OSFileSystem
+	}
+
+	return opts.FileSystem
+}
+
 // newKeyRegistry just creates a very basic registry and initializes its variables.
 func newKeyRegistry(opts KeyRegistryOptions) *KeyRegistry {
 	return &KeyRegistry{
-		dataKeys:  map[PartitionId]map[uint64]*pb.DataKey{},
-		nextKeyId: 0,
+		dataKeys:    map[PartitionId]map[uint64]*pb.DataKey{},
+		latestKeys:  map[PartitionId]*pb.DataKey{},
+		lastCreated: map[PartitionId]int64{},
+		// A key id of 0 is used to represent plain text, so the first key that is generated will be 1.
+		nextKeyId: 1,
 		options:   opts,
 	}
 }
@@ -49,14 +95,11 @@ func newKeyRegistry(opts KeyRegistryOptions) *KeyRegistry {
 // OpenKeyRegistry opens key registry if it exists, otherwise it'll create key registry and returns
 // key registry.
 func OpenKeyRegistry(opts KeyRegistryOptions) (*KeyRegistry, error) {
-	// Make sure the encryption key length is actually valid.
-	if len(opts.EncryptionKey) > 0 {
-		switch len(opts.EncryptionKey) {
-		default:
-			return nil, z.Wrapf(ErrInvalidEncryptionKey, "during OpenKeyRegistry")
-		case 16, 24, 32:
-			break
-		}
+	// Make sure the encryption key length is actually valid. The error is returned as is so callers can compare it.
+	switch len(opts.EncryptionKey) {
+	case 0, 16, 24, 32:
+	default:
+		return nil, ErrEncryptionKeyLength
 	}
 
 	// If the database is opened in memory only mode then we don't need to write the key registry to
@@ -74,7 +117,7 @@ func OpenKeyRegistry(opts KeyRegistryOptions) (*KeyRegistry, error) {
 	}
 
 	// Try to open an existing the key registry file.
-	_, err := z.OpenExistingFile(path, flags)
+	file, err := z.OpenExistingFile(opts.fileSystem(), path, flags)
 
 	// If the file does not exist then we need to create it.
 	if os.IsNotExist(err) {
@@ -86,12 +129,186 @@ func OpenKeyRegistry(opts KeyRegistryOptions) (*KeyRegistry, error) {
 		}
 
 		// If its not read only though then we can use this fresh registry to write a clean file to
-		// the disk.
+		// the disk. Once it has been written the registry will have the new file open.
+		if err := WriteKeyRegistry(registry, opts); err != nil {
+			return nil, z.Wrapf(err, "failed to write new key registry")
+		}
+
+		return registry, nil
+	}
+
+	if err != nil {
+		return nil, z.Wrapf(err, "failed to open key registry file")
+	}
+
+	registry, validOffset, err := readKeyRegistry(file, opts)
+	if err != nil {
+		// Its fine to ignore the error here because we have only read from the file.
+		_ = file.Close()
+		return nil, err
+	}
+
+	// If the database is read only then there is no reason for us to keep the file open. We will never write any new
+	// data keys to the registry.
+	if opts.ReadOnly {
+		return registry, file.Close()
+	}
+
+	// A data key that was only partially written is removed, otherwise the data keys appended after it would be lost
+	// the next time the registry is read.
+	if err := file.Truncate(validOffset); err != nil {
+		_ = file.Close()
+		return nil, z.Wrapf(err, "failed to truncate the key registry to offset %d", validOffset)
+	}
+
+	// New data keys will be appended to the end of the registry, so make sure the file is positioned at the end.
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		_ = file.Close()
+		return nil, z.Wrapf(err, "failed to seek to the end of the key registry")
+	}
+
+	registry.file = file
+
+	return registry, nil
+}
+
+// readKeyRegistry will read all of the data keys from the provided file into a new registry. The file must be positioned
+// at the very start, as the IV and the sanity text are validated against the encryption key before any keys are read.
+// The offset after the last complete data key in the file is returned along with the registry.
+func readKeyRegistry(file *os.File, opts KeyRegistryOptions) (*KeyRegistry, int64, error) {
+	iterator, err := newKeyRegistryIterator(file, opts.EncryptionKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	registry := newKeyRegistry(opts)
+	for {
+		dataKey, err := iterator.next()
+		if err == io.EOF {
+			// We have reached the end of the registry and there are no more keys to read.
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		// Keep track of the newest key id so that new keys are always assigned a unique id.
+		if dataKey.KeyId >= registry.nextKeyId {
+			registry.nextKeyId = dataKey.KeyId + 1
+		}
+
+		// Keep track of the most recently created key of each partition, this is used to determine when we need to
+		// rotate the keys of the partition.
+		partitionId := PartitionId(dataKey.PartitionId)
+		if latest, ok := registry.latestKeys[partitionId]; !ok || dataKey.KeyId > latest.KeyId {
+			registry.latestKeys[partitionId] = dataKey
+			registry.lastCreated[partitionId] = dataKey.CreatedAt
+		}
+
+		if _, ok := registry.dataKeys[partitionId]; !ok {
+			registry.dataKeys[partitionId] = map[uint64]*pb.DataKey{}
+		}
+
+		registry.dataKeys[partitionId][dataKey.KeyId] = dataKey
+	}
+
+	return registry, iterator.validOffset, nil
+}
+
+// newKeyRegistryIterator creates an iterator over the data keys in the provided file. It will validate the header of
+// the registry before returning, if the encryption key provided does not match the one the registry was written with
+// then ErrEncryptionKeyMismatch will be returned.
+func newKeyRegistryIterator(file *os.File, encryptionKey []byte) (*keyRegistryIterator, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, z.Wrapf(err, "failed to stat key registry")
+	}
+
+	iterator := &keyRegistryIterator{
+		encryptionKey: encryptionKey,
+		reader:        bufio.NewReader(file),
+		validOffset:   int64(aes.BlockSize + len(sanityText)),
+		size:          info.Size(),
+	}
+
+	return iterator, iterator.validate()
+}
+
+// validate reads the IV and the sanity text from the start of the registry. The sanity text is decrypted using the
+// encryption key, if the result does not match the sanity text then the wrong encryption key was provided.
+func (k *keyRegistryIterator) validate() error {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(k.reader, iv); err != nil {
+		return z.Wrapf(err, "failed to read IV from key registry")
 	}
 
-	return nil, nil
+	eSanity := make([]byte, len(sanityText))
+	if _, err := io.ReadFull(k.reader, eSanity); err != nil {
+		return z.Wrapf(err, "failed to read sanity text from key registry")
+	}
+
+	if len(k.encryptionKey) > 0 {
+		var err error
+		eSanity, err = z.XORBlock(eSanity, k.encryptionKey, iv)
+		if err != nil {
+			return z.Wrapf(err, "failed to decrypt sanity text from key registry")
+		}
+	}
+
+	if !bytes.Equal(eSanity, sanityText) {
+		return ErrEncryptionKeyMismatch
+	}
+
+	return nil
 }
 
+// next reads the next data key from the registry. When there are no more keys to be read io.EOF is returned. If the
+// last key in the file was only partially written then it is treated as the end of the file, validOffset is left at
+// the start of it.
+func (k *keyRegistryIterator) next() (*pb.DataKey, error) {
+	if _, err := io.ReadFull(k.reader, k.lenSumBuf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+
+		return nil, err
+	}
+
+	// The length is checked before anything is allocated for the data key. A length past the end of the file is what a
+	// partially written data key looks like.
+	length := binary.BigEndian.Uint32(k.lenSumBuf[0:4])
+	if length > maxDataKeySize {
+		return nil, errors.Errorf("data key of %d bytes in the key registry is larger than %d bytes",
+			length, maxDataKeySize)
+	}
+
+	if k.validOffset+int64(len(k.lenSumBuf))+int64(length) > k.size {
+		return nil, io.EOF
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(k.reader, data); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+
+		return nil, err
+	}
+
+	if xxhash.Checksum32(data) != binary.BigEndian.Uint32(k.lenSumBuf[4:8]) {
+		return nil, errBadKeyRegistryChecksum
+	}
+
+	dataKey := &pb.DataKey{}
+	if err := dataKey.Unmarshall(data, k.encryptionKey); err != nil {
+		return nil, z.Wrapf(err, "failed to unmarshal data key")
+	}
+	k.validOffset += int64(len(k.lenSumBuf)) + int64(length)
+
+	return dataKey, nil
+}
+
+// WriteKeyRegistry will rewrite the entire key registry to the disk atomically. The registry's file will be replaced with
+// a handle to the newly written file.
 func WriteKeyRegistry(registry *KeyRegistry, opts KeyRegistryOptions) error {
 	buf := &bytes.Buffer{}
 	iv, err := z.GenerateIV()
@@ -127,6 +344,65 @@ func WriteKeyRegistry(registry *KeyRegistry, opts KeyRegistryOptions) error {
 
 	}
 
+	// The registry is written to a temporary file first and then renamed over the existing registry. This way if the
+	// database crashes while we are writing the registry, the old registry will still be intact.
+	rewritePath := filepath.Join(opts.Directory, keyRegistryRewriteFileName)
+
+	// We don't need to enable sync here because we will explicitly be calling the sync method.
+	file, err := z.OpenTruncFile(opts.fileSystem(), rewritePath, false)
+	if err != nil {
+		return z.Wrapf(err, "failed to create key registry rewrite file")
+	}
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		_ = file.Close()
+		return z.Wrapf(err, "failed to write key registry rewrite file")
+	}
+
+	if err := z.FileSync(file); err != nil {
+		_ = file.Close()
+		return z.Wrapf(err, "failed to sync key registry rewrite file")
+	}
+
+	// In windows the files should be closed before doing a rename. This includes the existing registry file if the
+	// registry currently has one open.
+	if err := file.Close(); err != nil {
+		return z.Wrapf(err, "failed to close key registry rewrite file")
+	}
+
+	if registry.file != nil {
+		if err := registry.file.Close(); err != nil {
+			return z.Wrapf(err, "failed to close existing key registry file")
+		}
+		registry.file = nil
+	}
+
+	path := filepath.Join(opts.Directory, keyRegistryFileName)
+	if err := z.RenameWithRetry(opts.fileSystem(), rewritePath, path); err != nil {
+		return z.Wrapf(err, "failed to rename key registry rewrite file")
+	}
+
+	if err := syncDir(opts.Directory); err != nil {
+		return err
+	}
+
+	// If the registry is read only then there is no reason to keep the file open, we will never append keys to it.
+	if opts.ReadOnly {
+		return nil
+	}
+
+	if file, err = z.OpenExistingFile(opts.fileSystem(), path, z.Sync); err != nil {
+		return z.Wrapf(err, "failed to open key registry file")
+	}
+
+	// New data keys will be appended to the end of the registry, so make sure the file is positioned at the end.
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		_ = file.Close()
+		return z.Wrapf(err, "failed to seek to the end of the key registry")
+	}
+
+	registry.file = file
+
 	return nil
 }
 
@@ -142,7 +418,7 @@ func storeDataKey(
 
 	data, err = key.Marshall(encryptionKey)
 	if err != nil {
-		return nil
+		return z.Wrapf(err, "failed to marshal data key")
 	}
 
 	var lenSumBuf [8]byte
@@ -156,48 +432,138 @@ func storeDataKey(
 
 // Close closes the key registry and the file.
 func (k *KeyRegistry) Close() error {
-	if !(k.options.ReadOnly || k.options.InMemory) {
-		return k.file.Close()
+	if !(k.options.ReadOnly || k.options.InMemory) && k.file != nil {
+		err := k.file.Close()
+		k.file = nil
+		return err
 	}
 
 	return nil
 }
 
+// dataKey returns the data key for the provided partition and key id. A key id of 0 represents plain text and will
+// always return a nil data key.
 func (k *KeyRegistry) dataKey(partitionId PartitionId, keyId uint64) (*pb.DataKey, error) {
 	k.RLock()
 	defer k.RUnlock()
 	if keyId == 0 {
 		// nil represents plain text.
-		// TODO (elliotcourant) more comments.
 		return nil, nil
 	}
 
-	partition, ok := k.dataKeys[partitionId]
-	if !ok {
-		// TODO (elliotcourant) add a real error.
-		panic("invalid partition id")
+	if partition, ok := k.dataKeys[partitionId]; ok {
+		if dataKey, ok := partition[keyId]; ok {
+			return dataKey, nil
+		}
 	}
 
-	dataKey, ok := partition[keyId]
-	if !ok {
-		// TODO (elliotcourant) add a real error.
-		panic("invalid key id")
+	// Keys that were generated before data keys were scoped to partitions are owned by the default partition and are
+	// shared by all of the other partitions. So if the partition does not have the key itself we can check the default
+	// partition.
+	if dataKey, ok := k.dataKeys[0][keyId]; ok {
+		return dataKey, nil
 	}
 
-	return dataKey, nil
+	return nil, ErrInvalidDataKeyID
 }
 
-// latestDataKey will give you the latest generated dataKey based on the rotation period. If the
-// last generated dataKey lifetime exceeds the rotation period. It'll create new dataKey.
-func (k *KeyRegistry) latestDataKey() (*pb.DataKey, error) {
+// latestDataKey will give you the latest generated dataKey of the provided partition based on the rotation period.
+// If the last generated dataKey of the partition lifetime exceeds the rotation period. It'll create new dataKey for
+// the partition.
+func (k *KeyRegistry) latestDataKey(partitionId PartitionId) (*pb.DataKey, error) {
 	// If there is no encryption key then there is nothing to do here.
 	if len(k.options.EncryptionKey) == 0 {
 		return nil, nil
 	}
 
-	panic("encryption not implemented")
+	// validKey will return the most recently created key as long as it has not exceeded the rotation duration.
+	validKey := func() (*pb.DataKey, bool) {
+		if time.Since(time.Unix(k.lastCreated[partitionId], 0)) < k.options.EncryptionKeyRotationDuration {
+			dataKey, ok := k.latestKeys[partitionId]
+			return dataKey, ok
+		}
+
+		return nil, false
+	}
+
+	// Most of the time the latest key will still be valid, so we only need to take a read lock to check.
+	k.RLock()
+	dataKey, valid := validKey()
+	k.RUnlock()
+	if valid {
+		return dataKey, nil
+	}
 
-	// TODO (elliotcourant) Implement latestDataKey.
+	k.Lock()
+	defer k.Unlock()
+
+	// Another caller might have generated a new key while we were waiting for the write lock, so we need to check
+	// again before we generate a new one.
+	if dataKey, valid = validKey(); valid {
+		return dataKey, nil
+	}
 
-	return nil, nil
+	return k.generateDataKey(partitionId)
+}
+
+// rotateDataKey creates a new data key for the provided partition, regardless of the rotation period. Tables of the
+// partition that are written after this are encrypted with the new key, the tables that were already written keep
+// using the key they were written with.
+func (k *KeyRegistry) rotateDataKey(partitionId PartitionId) (*pb.DataKey, error) {
+	// If there is no encryption key then there is nothing to do here.
+	if len(k.options.EncryptionKey) == 0 {
+		return nil, nil
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	return k.generateDataKey(partitionId)
+}
+
+// generateDataKey creates a new data key for the provided partition and makes it the latest key of the partition. The
+// registry must be locked.
+func (k *KeyRegistry) generateDataKey(partitionId PartitionId) (*pb.DataKey, error) {
+	// The data key needs to be the same length as the encryption key so that it uses the same type of AES.
+	data := make([]byte, len(k.options.EncryptionKey))
+	if _, err := rand.Read(data); err != nil {
+		return nil, z.Wrapf(err, "failed to generate data key")
+	}
+
+	iv, err := z.GenerateIV()
+	if err != nil {
+		return nil, z.Wrapf(err, "failed to generate IV for data key")
+	}
+
+	dataKey := &pb.DataKey{
+		PartitionId: uint32(partitionId),
+		KeyId:       k.nextKeyId,
+		Data:        data,
+		Iv:          iv,
+		CreatedAt:   time.Now().Unix(),
+	}
+
+	// If the registry is not in memory then the new key needs to be appended to the file before we can use it.
+	// Otherwise we could write tables with a key that would be lost if the database crashed.
+	if !k.options.InMemory {
+		buf := &bytes.Buffer{}
+		if err := storeDataKey(buf, k.options.EncryptionKey, dataKey); err != nil {
+			return nil, err
+		}
+
+		if _, err := k.file.Write(buf.Bytes()); err != nil {
+			return nil, z.Wrapf(err, "failed to write data key to key registry")
+		}
+	}
+
+	if _, ok := k.dataKeys[partitionId]; !ok {
+		k.dataKeys[partitionId] = map[uint64]*pb.DataKey{}
+	}
+
+	k.dataKeys[partitionId][dataKey.KeyId] = dataKey
+	k.latestKeys[partitionId] = dataKey
+	k.lastCreated[partitionId] = dataKey.CreatedAt
+	k.nextKeyId++
+
+	return dataKey, nil
 }
@@ -0,0 +1,344 @@
+package notbadger
+
+import (
+	"github.com/elliotcourant/notbadger/pb"
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getRegistryTestOptions(dir string, key []byte) KeyRegistryOptions {
+	return KeyRegistryOptions{
+		Directory:                     dir,
+		EncryptionKey:                 key,
+		EncryptionKeyRotationDuration: 10 * 24 * time.Hour,
+		ReadOnly:                      false,
+	}
+}
+
+func TestOpenKeyRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	encryptionKey := make([]byte, 32)
+	for i := range encryptionKey {
+		encryptionKey[i] = byte(i)
+	}
+
+	opts := getRegistryTestOptions(dir, encryptionKey)
+
+	// The first open should create the registry file since it does not exist yet.
+	registry, err := OpenKeyRegistry(opts)
+	require.NoError(t, err)
+	require.Empty(t, registry.dataKeys)
+	require.NoError(t, registry.Close())
+
+	iv, err := z.GenerateIV()
+	require.NoError(t, err)
+
+	dataKey := &pb.DataKey{
+		PartitionId: 3,
+		KeyId:       1,
+		Data:        []byte("0123456789abcdef0123456789abcdef"),
+		Iv:          iv,
+		CreatedAt:   time.Now().Unix(),
+	}
+	registry.dataKeys[3] = map[uint64]*pb.DataKey{
+		dataKey.KeyId: dataKey,
+	}
+	require.NoError(t, WriteKeyRegistry(registry, opts))
+
+	// Reopen the registry, the data key that we wrote should be read back.
+	registry, err = OpenKeyRegistry(opts)
+	require.NoError(t, err)
+	defer registry.Close()
+
+	result, err := registry.dataKey(3, dataKey.KeyId)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, result)
+	require.Equal(t, uint64(2), registry.nextKeyId)
+	require.Equal(t, dataKey.CreatedAt, registry.lastCreated[3])
+	require.Equal(t, dataKey, registry.latestKeys[3])
+}
+
+func TestOpenKeyRegistry_Mismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	encryptionKey := make([]byte, 32)
+	registry, err := OpenKeyRegistry(getRegistryTestOptions(dir, encryptionKey))
+	require.NoError(t, err)
+	require.NoError(t, registry.Close())
+
+	// Opening the registry with a different key should fail the sanity check.
+	encryptionKey[0] = 0xFF
+	_, err = OpenKeyRegistry(getRegistryTestOptions(dir, encryptionKey))
+	require.Equal(t, ErrEncryptionKeyMismatch, err)
+}
+
+func TestKeyRegistry_LatestDataKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	encryptionKey := make([]byte, 32)
+	opts := getRegistryTestOptions(dir, encryptionKey)
+	opts.EncryptionKeyRotationDuration = time.Second
+
+	registry, err := OpenKeyRegistry(opts)
+	require.NoError(t, err)
+
+	first, err := registry.latestDataKey(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first.KeyId)
+	require.Len(t, first.Data, len(encryptionKey))
+
+	// Asking for the latest key again within the rotation duration should give us the same key.
+	again, err := registry.latestDataKey(0)
+	require.NoError(t, err)
+	require.Equal(t, first, again)
+
+	// Pretend the first key was created long enough ago that it needs to be rotated.
+	registry.lastCreated[0] -= 2
+	second, err := registry.latestDataKey(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), second.KeyId)
+	require.NotEqual(t, first.Data, second.Data)
+	require.NoError(t, registry.Close())
+
+	// Both of the keys should have been appended to the registry file.
+	registry, err = OpenKeyRegistry(opts)
+	require.NoError(t, err)
+	defer registry.Close()
+
+	for _, dataKey := range []*pb.DataKey{first, second} {
+		result, err := registry.dataKey(0, dataKey.KeyId)
+		require.NoError(t, err)
+		require.Equal(t, dataKey, result)
+	}
+
+	// Keys of the default partition are usable by every partition.
+	result, err := registry.dataKey(7, second.KeyId)
+	require.NoError(t, err)
+	require.Equal(t, second, result)
+
+	_, err = registry.dataKey(0, 10)
+	require.Equal(t, ErrInvalidDataKeyID, err)
+}
+
+func TestWriteKeyRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	encryptionKey := make([]byte, 16)
+	opts := getRegistryTestOptions(dir, encryptionKey)
+
+	registry, err := OpenKeyRegistry(opts)
+	require.NoError(t, err)
+
+	first, err := registry.latestDataKey(0)
+	require.NoError(t, err)
+
+	// Force the rotation of the key so that the registry has two keys.
+	registry.lastCreated[0] = 0
+	second, err := registry.latestDataKey(0)
+	require.NoError(t, err)
+
+	require.NoError(t, WriteKeyRegistry(registry, opts))
+
+	// The rewrite file should have been renamed over the registry file.
+	_, err = os.Stat(filepath.Join(dir, keyRegistryRewriteFileName))
+	require.True(t, os.IsNotExist(err))
+
+	// The registry should still be able to append new keys to the rewritten file.
+	registry.lastCreated[0] = 0
+	third, err := registry.latestDataKey(0)
+	require.NoError(t, err)
+	require.NoError(t, registry.Close())
+
+	registry, err = OpenKeyRegistry(opts)
+	require.NoError(t, err)
+	defer registry.Close()
+
+	require.Len(t, registry.dataKeys[0], 3)
+	for _, dataKey := range []*pb.DataKey{first, second, third} {
+		result, err := registry.dataKey(0, dataKey.KeyId)
+		require.NoError(t, err)
+		require.Equal(t, dataKey, result)
+	}
+}
+
+func TestOpenKeyRegistry_PartialDataKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getRegistryTestOptions(dir, make([]byte, 16))
+	registry, err := OpenKeyRegistry(opts)
+	require.NoError(t, err)
+	first, err := registry.latestDataKey(0)
+	require.NoError(t, err)
+	require.NoError(t, registry.Close())
+
+	// A crash left the length and the checksum of a data key behind, but only part of the data key.
+	path := filepath.Join(dir, keyRegistryFileName)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 0, 100, 1, 2, 3, 4, 5, 6})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// The partial data key is removed before new data keys are appended, so they are read back.
+	registry, err = OpenKeyRegistry(opts)
+	require.NoError(t, err)
+	partial, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), partial.Size())
+
+	registry.lastCreated[0] = 0
+	second, err := registry.latestDataKey(0)
+	require.NoError(t, err)
+	require.NoError(t, registry.Close())
+
+	registry, err = OpenKeyRegistry(opts)
+	require.NoError(t, err)
+	for _, dataKey := range []*pb.DataKey{first, second} {
+		result, err := registry.dataKey(0, dataKey.KeyId)
+		require.NoError(t, err)
+		require.Equal(t, dataKey, result)
+	}
+	require.NoError(t, registry.Close())
+
+	// A length that no data key could have is corruption, even if the file is large enough to hold it.
+	file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = file.Write(append([]byte{0, 0xff, 0xff, 0xff, 1, 2, 3, 4}, make([]byte, 1<<20)...))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	_, err = OpenKeyRegistry(opts)
+	require.Error(t, err)
+}
+
+func TestKeyRegistry_PartitionDataKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getRegistryTestOptions(dir, make([]byte, 32))
+	registry, err := OpenKeyRegistry(opts)
+	require.NoError(t, err)
+
+	first, err := registry.latestDataKey(1)
+	require.NoError(t, err)
+	second, err := registry.latestDataKey(2)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), first.PartitionId)
+	require.Equal(t, uint32(2), second.PartitionId)
+	require.NotEqual(t, first.KeyId, second.KeyId)
+	require.NotEqual(t, first.Data, second.Data)
+
+	// Rotating the key of one partition does not change the key of the other.
+	rotated, err := registry.rotateDataKey(1)
+	require.NoError(t, err)
+	require.NotEqual(t, first.KeyId, rotated.KeyId)
+	result, err := registry.latestDataKey(1)
+	require.NoError(t, err)
+	require.Equal(t, rotated, result)
+	result, err = registry.latestDataKey(2)
+	require.NoError(t, err)
+	require.Equal(t, second, result)
+	require.NoError(t, registry.Close())
+
+	registry, err = OpenKeyRegistry(opts)
+	require.NoError(t, err)
+	defer registry.Close()
+
+	require.Equal(t, rotated, registry.latestKeys[1])
+	require.Equal(t, second, registry.latestKeys[2])
+	result, err = registry.dataKey(1, first.KeyId)
+	require.NoError(t, err)
+	require.Equal(t, first, result)
+
+	// The keys of a partition can't be used by another partition.
+	_, err = registry.dataKey(2, first.KeyId)
+	require.Equal(t, ErrInvalidDataKeyID, err)
+}
+
+func TestDB_PartitionDataKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir).WithEncryptionKey(make([]byte, 32)).WithKeepL0InMemory(false)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	write := func(partitionId PartitionId, key string) {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(partitionId, []byte(key), []byte("value-"+key))
+		}))
+		require.NoError(t, db.Flush(partitionId))
+	}
+
+	keyIds := func(partitionId PartitionId) []uint64 {
+		var ids []uint64
+		for _, info := range db.Tables() {
+			if info.PartitionId != partitionId {
+				continue
+			}
+			for _, table := range info.Tables {
+				ids = append(ids, table.KeyId)
+			}
+		}
+		return ids
+	}
+
+	write(1, "a")
+	write(2, "b")
+	require.NoError(t, db.RotateDataKey(1))
+	write(1, "c")
+
+	// Both tables of partition 2 share a key, the second table of partition 1 was written after its key was rotated.
+	partition1, partition2 := keyIds(1), keyIds(2)
+	require.Len(t, partition1, 2)
+	require.Len(t, partition2, 1)
+	require.NotEqual(t, partition1[0], partition1[1])
+	for _, keyId := range partition1 {
+		require.NotZero(t, keyId)
+		require.NotEqual(t, partition2[0], keyId)
+		dataKey, err := db.registry.dataKey(1, keyId)
+		require.NoError(t, err)
+		require.Equal(t, uint32(1), dataKey.PartitionId)
+	}
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		for _, read := range []struct {
+			partitionId PartitionId
+			key         string
+		}{{1, "a"}, {2, "b"}, {1, "c"}} {
+			item, err := txn.Get(read.partitionId, []byte(read.key))
+			require.NoError(t, err)
+			value, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, "value-"+read.key, string(value))
+		}
+		return nil
+	}))
+}
@@ -25,11 +25,17 @@ func (l *levelHandler) initTables(tables []*table.Table) {
 	l.tables = tables
 
 	// Now that we have the tables setup,
-	l.totalSize = 0
+	l.totalSize, l.estimatedSize = 0, 0
 	for _, t := range tables {
 		l.totalSize += t.Size()
+		l.estimatedSize += t.EstimatedSize()
 	}
 
+	l.sortTables()
+}
+
+// sortTables sorts the tables of the level, the level must be locked.
+func (l *levelHandler) sortTables() {
 	if l.level == 0 {
 		// Key range will overlap. Just sort by fileID in ascending order because newer tables are at the end of
 		// level 0.
@@ -44,6 +50,48 @@ func (l *levelHandler) initTables(tables []*table.Table) {
 	}
 }
 
+// hasSizeTieredGroup returns true if the level has a group of tables that are about the same size that can be merged
+// together, see sizeTieredGroup.
+func (l *levelHandler) hasSizeTieredGroup() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return len(sizeTieredGroup(l.tables, l.db.options.MaxTableSize)) > 0
+}
+
+// isLevel0Compactable returns true if level 0 has enough tables that it should be compacted.
+func (l *levelHandler) isLevel0Compactable() bool {
+	return l.numberOfTables() >= l.db.options.NumLevelZeroTables
+}
+
+// isCompactable returns true if the level is larger than the max size of the level once the size of the tables that
+// are already being compacted has been excluded. The estimated size of the tables is used so that values stored in
+// the value log are accounted for.
+func (l *levelHandler) isCompactable(deleteSize int64) bool {
+	return l.getEstimatedSize()-deleteSize >= l.maxTotalSize
+}
+
+// numberOfTables returns the number of tables in the level.
+func (l *levelHandler) numberOfTables() int {
+	l.RLock()
+	defer l.RUnlock()
+	return len(l.tables)
+}
+
+// getTotalSize returns the total size of all of the tables in the level.
+func (l *levelHandler) getTotalSize() int64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.totalSize
+}
+
+// getEstimatedSize returns the total estimated size of all of the tables in the level, including the size of their
+// values in the value log.
+func (l *levelHandler) getEstimatedSize() int64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.estimatedSize
+}
+
 func (l *levelHandler) close() error {
 	l.RLock()
 	defer l.RUnlock()
@@ -88,3 +136,222 @@ func (l *levelHandler) validate() error {
 	}
 	return nil
 }
+
+// getTableForKey acquires a read-lock to access the tables in the level. It returns a list of tables that might contain
+// the provided key along with a function to release the references to those tables.
+func (l *levelHandler) getTableForKey(key []byte) ([]*table.Table, func() error) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if l.level == 0 {
+		// For level 0, we need to check every table. Remember to make a copy as l.tables may change once we exit this
+		// function, and we don't want to lock l.tables while seeking in tables.
+		// CAUTION: Reverse the tables.
+		out := make([]*table.Table, 0, len(l.tables))
+		for i := len(l.tables) - 1; i >= 0; i-- {
+			out = append(out, l.tables[i])
+			l.tables[i].IncrementReference()
+		}
+
+		return out, func() error {
+			for _, t := range out {
+				if err := t.DecrementReference(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	// For level >= 1, we can do a binary search as key range does not overlap.
+	idx := sort.Search(len(l.tables), func(i int) bool {
+		return z.CompareKeys(l.tables[i].Largest(), key) >= 0
+	})
+
+	if idx >= len(l.tables) {
+		// Given key is strictly > than every element we have.
+		return nil, func() error { return nil }
+	}
+
+	t := l.tables[idx]
+	t.IncrementReference()
+
+	return []*table.Table{t}, t.DecrementReference
+}
+
+// get returns the value for the given key in this level, or an empty value if the key is not present.
+func (l *levelHandler) get(key []byte, opts ReadOptions) (z.ValueStruct, error) {
+	tables, decrement := l.getTableForKey(key)
+
+	var maxValue z.ValueStruct
+	for _, t := range tables {
+		// The table checks its bloom filter first, so tables that do not have the key are skipped without reading any
+		// of their blocks.
+		get := t.Get
+		if opts.NoCache {
+			get = t.GetNoCache
+		}
+
+		value, err := get(key)
+		if err != nil {
+			_ = decrement()
+			return z.ValueStruct{}, err
+		}
+
+		if maxValue.Version < value.Version {
+			maxValue = value
+		}
+	}
+
+	return maxValue, decrement()
+}
+
+// appendIterators appends iterators to an array of iterators, for merging. Note: This obtains references for the
+// table handlers. Remember to close these iterators.
+func (l *levelHandler) appendIterators(iterators []z.Iterator, reversed bool, opts ReadOptions) []z.Iterator {
+	l.RLock()
+	defer l.RUnlock()
+
+	newIterator := func(t *table.Table) z.Iterator {
+		if opts.NoCache {
+			return t.NewNoCacheIterator(reversed)
+		}
+
+		return t.NewIterator(reversed)
+	}
+
+	if l.level == 0 {
+		// Remember to add in reverse order! The newer table at the end of level 0 should come first, as it should
+		// override the older table at the start of level 0.
+		for i := len(l.tables) - 1; i >= 0; i-- {
+			iterators = append(iterators, newIterator(l.tables[i]))
+		}
+		return iterators
+	}
+
+	// TODO (elliotcourant) The tables in levels >= 1 do not overlap, so these could be concatenated into a single
+	//  iterator rather than being merged.
+	for _, t := range l.tables {
+		iterators = append(iterators, newIterator(t))
+	}
+
+	return iterators
+}
+
+// overlappingTables returns the span [left, right) of the tables in the level that overlap with the provided key
+// range. Tables in level 0 overlap arbitrarily so the span of every table is returned for level 0. The caller must hold
+// at least a read lock on the level.
+func (l *levelHandler) overlappingTables(kr keyRange) (left, right int) {
+	if l.level == 0 || kr.infinite {
+		return 0, len(l.tables)
+	}
+
+	if len(kr.left) == 0 || len(kr.right) == 0 {
+		return 0, 0
+	}
+
+	// For levels >= 1 the tables are sorted and do not overlap, so the first table whose largest key is >= the left of
+	// the range is the start, and the first table whose smallest key is > the right of the range is the end.
+	left = sort.Search(len(l.tables), func(i int) bool {
+		return z.CompareKeys(kr.left, l.tables[i].Largest()) <= 0
+	})
+	right = sort.Search(len(l.tables), func(i int) bool {
+		return z.CompareKeys(kr.right, l.tables[i].Smallest()) < 0
+	})
+
+	return left, right
+}
+
+// tryAddLevel0Table appends the table to level 0. If level 0 already has NumLevelZeroTablesStall tables then the
+// table is not added and false is returned.
+func (l *levelHandler) tryAddLevel0Table(t *table.Table) bool {
+	z.AssertTrue(l.level == 0)
+	// Need lock as we may be deleting the first table during a level 0 compaction.
+	l.Lock()
+	defer l.Unlock()
+
+	// Stall (by returning false) if we are above the specified stall setting for level 0. Zero disables the stall.
+	if stall := l.db.options.NumLevelZeroTablesStall; stall > 0 && len(l.tables) >= stall {
+		return false
+	}
+
+	l.tables = append(l.tables, t)
+	t.IncrementReference()
+	l.totalSize += t.Size()
+	l.estimatedSize += t.EstimatedSize()
+
+	return true
+}
+
+// replaceTables removes the tables in toDelete from the level and adds the tables in toAdd. This is used to swap the
+// output of a compaction into the next level.
+func (l *levelHandler) replaceTables(toDelete, toAdd []*table.Table) error {
+	// Need to re-search the range of tables in this level to be replaced as other goroutines might be changing it as
+	// well. (They can't touch our tables, but if they add/remove other tables, the indices get shifted around.)
+	l.Lock() // We l.Unlock() below.
+
+	toDeleteMap := make(map[uint64]struct{}, len(toDelete))
+	for _, t := range toDelete {
+		toDeleteMap[t.FileId()] = struct{}{}
+	}
+
+	var newTables []*table.Table
+	for _, t := range l.tables {
+		if _, found := toDeleteMap[t.FileId()]; !found {
+			newTables = append(newTables, t)
+			continue
+		}
+		l.totalSize -= t.Size()
+		l.estimatedSize -= t.EstimatedSize()
+	}
+
+	for _, t := range toAdd {
+		l.totalSize += t.Size()
+		l.estimatedSize += t.EstimatedSize()
+		t.IncrementReference()
+		newTables = append(newTables, t)
+	}
+
+	l.tables = newTables
+	l.sortTables()
+	l.Unlock() // Unlock before we decrement the references of the tables, that can be slow.
+
+	return decrementReferences(toDelete)
+}
+
+// deleteTables removes the provided tables from the level.
+func (l *levelHandler) deleteTables(toDelete []*table.Table) error {
+	l.Lock() // We l.Unlock() below.
+
+	toDeleteMap := make(map[uint64]struct{}, len(toDelete))
+	for _, t := range toDelete {
+		toDeleteMap[t.FileId()] = struct{}{}
+	}
+
+	// Make a copy as iterators might be keeping a slice of tables.
+	var newTables []*table.Table
+	for _, t := range l.tables {
+		if _, found := toDeleteMap[t.FileId()]; !found {
+			newTables = append(newTables, t)
+			continue
+		}
+		l.totalSize -= t.Size()
+		l.estimatedSize -= t.EstimatedSize()
+	}
+
+	l.tables = newTables
+	l.Unlock() // Unlock before we decrement the references of the tables, that can be slow.
+
+	return decrementReferences(toDelete)
+}
+
+// decrementReferences releases a reference on every one of the provided tables.
+func decrementReferences(tables []*table.Table) error {
+	for _, t := range tables {
+		if err := t.DecrementReference(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package notbadger
+
+import (
+	"github.com/elliotcourant/notbadger/options"
+	"github.com/elliotcourant/notbadger/table"
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"testing"
+)
+
+// buildTestLevelTables creates a table for every pair of keys, each table contains just its smallest and largest key.
+func buildTestLevelTables(t *testing.T, dir string, keys ...[2]string) []*table.Table {
+	tableOptions := table.Options{
+		BlockSize:          4 * 1024,
+		BloomFalsePositive: 0.01,
+		LoadingMode:        options.LoadToRAM,
+	}
+
+	tables := make([]*table.Table, 0, len(keys))
+	for i, pair := range keys {
+		builder := table.NewBuilder(tableOptions)
+		for _, key := range pair {
+			builder.Add(z.KeyWithTs([]byte(key), 1), z.ValueStruct{Value: []byte(key)}, 0)
+		}
+
+		file, err := z.CreateSyncedFile(z.OSFileSystem, table.NewFilename(0, uint64(i+1), dir), true)
+		require.NoError(t, err)
+		_, err = file.Write(builder.Finish())
+		require.NoError(t, err)
+
+		tbl, err := table.OpenTable(file, tableOptions)
+		require.NoError(t, err)
+		tables = append(tables, tbl)
+	}
+
+	return tables
+}
+
+func TestLevelHandler_OverlappingTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	tables := buildTestLevelTables(t, dir,
+		[2]string{"a", "c"},
+		[2]string{"e", "g"},
+		[2]string{"i", "k"},
+		[2]string{"m", "o"},
+	)
+	defer func() {
+		require.NoError(t, decrementReferences(tables))
+	}()
+
+	handler := &levelHandler{level: 1, tables: tables}
+
+	tests := []struct {
+		name        string
+		kr          keyRange
+		left, right int
+	}{
+		{"before every table", newTestKeyRange("0", "1"), 0, 0},
+		{"after every table", newTestKeyRange("x", "z"), 4, 4},
+		{"between tables", newTestKeyRange("d", "d"), 1, 1},
+		{"within a single table", newTestKeyRange("f", "f"), 1, 2},
+		{"touching the edges of tables", newTestKeyRange("c", "e"), 0, 2},
+		{"spanning several tables", newTestKeyRange("b", "j"), 0, 3},
+		{"spanning every table", newTestKeyRange("a", "z"), 0, 4},
+		{"infinite", infiniteRange, 0, 4},
+		{"empty", keyRange{}, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			left, right := handler.overlappingTables(test.kr)
+			require.Equal(t, test.left, left)
+			require.Equal(t, test.right, right)
+		})
+	}
+
+	// Tables in level 0 overlap arbitrarily so every table is always returned.
+	levelZero := &levelHandler{level: 0, tables: tables}
+	left, right := levelZero.overlappingTables(newTestKeyRange("0", "1"))
+	require.Equal(t, 0, left)
+	require.Equal(t, 4, right)
+}
@@ -0,0 +1,217 @@
+package notbadger
+
+import (
+	"sort"
+
+	"github.com/elliotcourant/notbadger/table"
+	"github.com/elliotcourant/notbadger/z"
+)
+
+const (
+	// summarySampleRate is how many keys of a level of the summary there are for every key that is cascaded into the
+	// level above it. A lower rate means fewer keys are compared when moving down a level, but more memory is used.
+	summarySampleRate = 2
+)
+
+type (
+	// levelSummary is a simplified fractional cascading index over the tables of every level of a partition below
+	// level 0. Each level of the summary has the largest keys of its tables, merged with every summarySampleRate'th key
+	// of the level below it. A single binary search in the top level finds the position of a key, and the position in
+	// every level below is found from the position in the level above with only a few comparisons.
+	//
+	// The summary holds a reference to every table in it, so the tables stay open until the summary is released even
+	// if they are compacted away in the meantime.
+	levelSummary struct {
+		levels []summaryLevel
+	}
+
+	// summaryLevel is a single level of a levelSummary.
+	summaryLevel struct {
+		tables []*table.Table
+
+		// keys is sorted. tableIndex has the index of the first table whose largest key is greater than or equal to
+		// each of the keys, and nextIndex has the index of the first key in the level below that is greater than or
+		// equal to each of the keys.
+		keys       [][]byte
+		tableIndex []int
+		nextIndex  []int
+	}
+)
+
+// newLevelSummary builds a summary of the tables of the provided levels, which are sorted by their keys and do not
+// overlap. The summary takes over the references to the tables.
+func newLevelSummary(levels [][]*table.Table) *levelSummary {
+	s := &levelSummary{
+		levels: make([]summaryLevel, len(levels)),
+	}
+
+	// The levels are built from the bottom up, because every level has some of the keys of the level below it.
+	for i := len(levels) - 1; i >= 0; i-- {
+		var next [][]byte
+		if i+1 < len(levels) {
+			next = s.levels[i+1].keys
+		}
+
+		level := &s.levels[i]
+		level.tables = levels[i]
+		size := len(level.tables) + len(next)/summarySampleRate
+		level.keys = make([][]byte, 0, size)
+		level.tableIndex = make([]int, 0, size)
+		level.nextIndex = make([]int, 0, size)
+
+		tableIdx, sampleIdx, nextIdx := 0, summarySampleRate-1, 0
+		for tableIdx < len(level.tables) || sampleIdx < len(next) {
+			// A sampled key that is equal to the largest key of a table is added first, so that it points to the table.
+			sampled := sampleIdx < len(next) &&
+				(tableIdx == len(level.tables) || z.CompareKeys(next[sampleIdx], level.tables[tableIdx].Largest()) <= 0)
+
+			var key []byte
+			if sampled {
+				key = next[sampleIdx]
+			} else {
+				key = level.tables[tableIdx].Largest()
+			}
+
+			for nextIdx < len(next) && z.CompareKeys(next[nextIdx], key) < 0 {
+				nextIdx++
+			}
+
+			level.keys = append(level.keys, key)
+			level.tableIndex = append(level.tableIndex, tableIdx)
+			level.nextIndex = append(level.nextIndex, nextIdx)
+
+			if sampled {
+				sampleIdx += summarySampleRate
+			} else {
+				tableIdx++
+			}
+		}
+	}
+
+	return s
+}
+
+// find returns the table that could have the key in every level of the summary, from the top level down. Levels
+// without such a table are skipped. No references are taken to the tables.
+func (s *levelSummary) find(key []byte) []*table.Table {
+	if len(s.levels) == 0 {
+		return nil
+	}
+
+	tables := make([]*table.Table, 0, len(s.levels))
+	top := s.levels[0].keys
+	position := sort.Search(len(top), func(i int) bool {
+		return z.CompareKeys(top[i], key) >= 0
+	})
+
+	for i := range s.levels {
+		level := &s.levels[i]
+
+		// The position from the level above is at most a few keys past the first key that is greater than or equal to
+		// the key.
+		for position > 0 && z.CompareKeys(level.keys[position-1], key) >= 0 {
+			position--
+		}
+
+		if position < len(level.keys) && level.tableIndex[position] < len(level.tables) {
+			tables = append(tables, level.tables[level.tableIndex[position]])
+		}
+
+		if i+1 < len(s.levels) {
+			if position < len(level.keys) {
+				position = level.nextIndex[position]
+			} else {
+				position = len(s.levels[i+1].keys)
+			}
+		}
+	}
+
+	return tables
+}
+
+// release releases the references of the summary to its tables.
+func (s *levelSummary) release() error {
+	var firstErr error
+	for _, level := range s.levels {
+		if err := decrementReferences(level.tables); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// updateSummary rebuilds the summary of the partition from the tables that are currently in its levels, if
+// Options.LevelSummary is set. This must be called after the tables of any level below level 0 have changed, and
+// before the tables of the level above it are removed, so that reads never miss data that is being moved.
+func (l *levelsController) updateSummary(partition *partitionLevels) error {
+	if !l.db.options.LevelSummary {
+		return nil
+	}
+
+	partition.summaryLock.Lock()
+
+	// Every level is locked at once so that the summary never has some levels before a change and others after it.
+	handlers := partition.levels[1:]
+	for _, handler := range handlers {
+		handler.RLock()
+	}
+
+	levels := make([][]*table.Table, len(handlers))
+	for i, handler := range handlers {
+		levels[i] = make([]*table.Table, len(handler.tables))
+		copy(levels[i], handler.tables)
+		for _, t := range levels[i] {
+			t.IncrementReference()
+		}
+	}
+
+	for i := len(handlers) - 1; i >= 0; i-- {
+		handlers[i].RUnlock()
+	}
+
+	old := partition.summary
+	partition.summary = newLevelSummary(levels)
+	partition.summaryLock.Unlock()
+
+	if old == nil {
+		return nil
+	}
+
+	return old.release()
+}
+
+// releaseSummary removes the summary of the partition and releases its references to the tables.
+func (p *partitionLevels) releaseSummary() error {
+	p.summaryLock.Lock()
+	old := p.summary
+	p.summary = nil
+	p.summaryLock.Unlock()
+
+	if old == nil {
+		return nil
+	}
+
+	return old.release()
+}
+
+// summaryTables returns the table that could have the key in every level below level 0, from the top level down, and a
+// function that releases the references that were taken to them. False is returned if the partition does not have a
+// summary.
+func (p *partitionLevels) summaryTables(key []byte) ([]*table.Table, func() error, bool) {
+	p.summaryLock.RLock()
+	defer p.summaryLock.RUnlock()
+
+	if p.summary == nil {
+		return nil, nil, false
+	}
+
+	tables := p.summary.find(key)
+	for _, t := range tables {
+		t.IncrementReference()
+	}
+
+	return tables, func() error {
+		return decrementReferences(tables)
+	}, true
+}
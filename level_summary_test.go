@@ -0,0 +1,156 @@
+package notbadger
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/elliotcourant/notbadger/table"
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// summaryTestKeys is the number of keys in every level that is built by buildSummaryTestLevels.
+	summaryTestKeys = 6400
+)
+
+// buildSummaryTestLevels fills every level of partition 0 below level 0 with in memory tables. Every level has the
+// same keys, level n is split into 2<<n tables, and the value of a key is its level.
+func buildSummaryTestLevels(tb testing.TB, db *DB) {
+	levels := db.levelsController
+	partition := levels.partitions[0]
+	for _, handler := range partition.levels[1:] {
+		numberOfTables := 2 << handler.level
+		tables := make([]*table.Table, 0, numberOfTables)
+		for i := 0; i < numberOfTables; i++ {
+			builder := table.NewBuilder(buildTableOptions(db.options))
+			for j := i * summaryTestKeys / numberOfTables; j < (i+1)*summaryTestKeys/numberOfTables; j++ {
+				builder.Add(z.KeyWithTs([]byte(fmt.Sprintf("key%06d", j)), 1), z.ValueStruct{
+					Value:   []byte{handler.level},
+					Version: 1,
+				}, 0)
+			}
+
+			tableOptions := buildLevelTableOptions(db.options, handler.level)
+			fileId := levels.reserveFileId(0)
+			tbl, err := table.OpenInMemoryTable(builder.Finish(), 0, fileId, &tableOptions)
+			require.NoError(tb, err)
+			tables = append(tables, tbl)
+		}
+		handler.initTables(tables)
+	}
+}
+
+func TestLevelSummary(t *testing.T) {
+	db, err := Open(DefaultOptions("").WithInMemory(true).WithLevelSummary(true).WithMaxLevels(6))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	buildSummaryTestLevels(t, db)
+	partition := db.levelsController.partitions[0]
+	require.NoError(t, db.levelsController.updateSummary(partition))
+
+	// The summary must find the same table in every level as a binary search of the level does, including for keys
+	// that are before or after every table.
+	for i := -10; i < summaryTestKeys+10; i++ {
+		key := z.KeyWithTs([]byte(fmt.Sprintf("key%06d", i)), math.MaxUint64)
+		if i < 0 {
+			key = z.KeyWithTs([]byte(fmt.Sprintf("a%d", i)), math.MaxUint64)
+		}
+
+		expected := make([]*table.Table, 0, len(partition.levels)-1)
+		for _, handler := range partition.levels[1:] {
+			tables, decrement := handler.getTableForKey(key)
+			expected = append(expected, tables...)
+			require.NoError(t, decrement())
+		}
+
+		tables, release, ok := partition.summaryTables(key)
+		require.True(t, ok)
+		require.Equal(t, expected, tables, "key %d", i)
+		require.NoError(t, release())
+	}
+
+	// The newest version of a key is read from level 1.
+	value, err := db.levelsController.get(0, z.KeyWithTs([]byte("key000042"), math.MaxUint64), nil, ReadOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, value.Value)
+}
+
+func TestDB_LevelSummary(t *testing.T) {
+	opts := getTestOptions("").
+		WithLevelSummary(true).
+		WithKeepL0InMemory(false).
+		WithTrackTableReferences(true)
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		for i := 0; i < 2000; i += 100 {
+			for partitionId := PartitionId(0); partitionId < 2; partitionId++ {
+				for k := i; k < i+100; k += 20 {
+					require.NoError(t, db.Update(func(txn *Transaction) error {
+						for j := k; j < k+20; j++ {
+							key, value := fmt.Sprintf("key%04d", j), fmt.Sprintf("value%d-%04d", partitionId, j)
+							if err := txn.Set(partitionId, []byte(key), []byte(value)); err != nil {
+								return err
+							}
+						}
+						return nil
+					}))
+				}
+				require.NoError(t, db.Flush(partitionId))
+			}
+		}
+		require.NoError(t, db.Flatten(1))
+
+		// Every key is read through the summary, which has been rebuilt by the compactions.
+		partition, ok := db.levelsController.getPartition(1)
+		require.True(t, ok)
+		require.NotNil(t, partition.summary)
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			for j := 0; j < 2000; j++ {
+				item, err := txn.Get(1, []byte(fmt.Sprintf("key%04d", j)))
+				require.NoError(t, err)
+				value, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("value1-%04d", j), string(value))
+			}
+			return nil
+		}))
+
+		// The references of the summary of a dropped partition are released, closing the database fails otherwise.
+		require.NoError(t, db.DropPartitions(1))
+		require.Nil(t, partition.summary)
+	})
+}
+
+func BenchmarkLevelSummary(b *testing.B) {
+	for _, summary := range []bool{false, true} {
+		b.Run(fmt.Sprintf("summary=%v", summary), func(b *testing.B) {
+			opts := DefaultOptions("").WithInMemory(true).WithLevelSummary(summary).WithMaxLevels(6)
+			db, err := Open(opts)
+			require.NoError(b, err)
+			defer func() {
+				require.NoError(b, db.Close())
+			}()
+
+			buildSummaryTestLevels(b, db)
+			require.NoError(b, db.levelsController.updateSummary(db.levelsController.partitions[0]))
+
+			// Every key is read from the bottom level, so every level is searched.
+			keys := make([][]byte, 1024)
+			for i := range keys {
+				keys[i] = z.KeyWithTs([]byte(fmt.Sprintf("key%06d", rand.Intn(summaryTestKeys))), 0)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.levelsController.get(0, keys[i%len(keys)], nil, ReadOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
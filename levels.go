@@ -1,19 +1,43 @@
 package notbadger
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"github.com/elliotcourant/notbadger/options"
+	"github.com/elliotcourant/notbadger/pb"
 	"github.com/elliotcourant/notbadger/table"
 	"github.com/elliotcourant/notbadger/z"
 	"github.com/elliotcourant/timber"
+	"github.com/pkg/errors"
 	"golang.org/x/net/trace"
+	"io"
 	"math/rand"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	// sizeTieredMinTables and sizeTieredMaxTables are the smallest and largest number of level 0 tables that are merged
+	// together by a single compaction when CompactionStrategy is options.SizeTiered.
+	sizeTieredMinTables = 4
+	sizeTieredMaxTables = 32
+
+	// sizeTieredRatio is how much larger than the average size of a group of level 0 tables a table can be and still
+	// be merged with them.
+	sizeTieredRatio = 1.5
+)
+
+var (
+	// errFillTables is returned by doCompact when no tables could be picked for the compaction. This usually means that
+	// the tables are already being compacted by another worker.
+	errFillTables = errors.New("unable to fill tables")
+)
+
 type (
 	// compactionPriority represents a unit of work that needs to be performed by the compactor.
 	compactionPriority struct {
@@ -21,18 +45,87 @@ type (
 		level       uint8
 		score       float64
 		dropPrefix  []byte
+
+		// sizeTiered is set when a group of level 0 tables that are about the same size should be merged into fewer
+		// level 0 tables, rather than level 0 being compacted into level 1.
+		sizeTiered bool
 	}
 
 	levelsController struct {
-		eventLog   trace.EventLog
-		partitions map[PartitionId]*partitionLevels
-		db         *DB
+		eventLog trace.EventLog
+		db       *DB
+
+		// partitionsLock guards the partitions map, partitions are created when their first table is added to level 0.
+		partitionsLock sync.RWMutex
+		partitions     map[PartitionId]*partitionLevels
+
+		// droppedFileIds holds the next file Id of the partitions that have been dropped. The files of the dropped tables
+		// are only deleted once they are no longer being read, so a partition that is created again continues from the
+		// same file Id rather than reusing their file names. It is guarded by the partitionsLock.
+		droppedFileIds map[PartitionId]uint64
+
+		// lastUnstalled is the last time that writes to level 0 were unstalled.
+		lastUnstalled time.Time
+
+		// compactorsStarted is set once the compactors have been started, it must be accessed via atomics. Until then
+		// writes that are stalled on level 0 compact it themselves.
+		compactorsStarted int32
+
+		// buildThrottle limits the number of tables that are built by compactions at the same time, it is shared by
+		// the compactions of every partition.
+		buildThrottle *z.Throttle
+
+		// compactionLimiter limits the number of bytes that are written by compactions per second, it is shared by the
+		// compactions of every partition. It is nil when CompactionBytesPerSecond is not set.
+		compactionLimiter *z.RateLimiter
+	}
+
+	// tableBuild is a table that is being built for a level of a partition. Tables that are written to disk are streamed
+	// to their file while they are built, so only the current block and the index are kept in memory. Tables that are
+	// kept in memory don't have a file.
+	tableBuild struct {
+		partitionId PartitionId
+		fileId      uint64
+		options     table.Options
+		builder     *table.Builder
+		file        *os.File
+		writer      *bufio.Writer
+	}
+
+	// TableInfo describes a single table within a level of a partition.
+	TableInfo struct {
+		FileId   uint64
+		Smallest []byte // Smallest key in the table, including the timestamp.
+		Largest  []byte // Largest key in the table, including the timestamp.
+		Size     int64
+		KeyCount uint32 // Number of entries in the table, every version of a key is counted.
+		KeyId    uint64 // Data key the table is encrypted with, zero if it is not encrypted.
+	}
+
+	// LevelInfo describes a single level of a partition and the tables within it.
+	LevelInfo struct {
+		PartitionId  PartitionId
+		Level        uint8
+		TotalSize    int64
+		MaxTotalSize int64
+		Tables       []TableInfo
 	}
 
 	partitionLevels struct {
-		nextFileId       uint64
+		nextFileId uint64
+
+		// discardTimestamp is the highest timestamp at or below which compactions of the partition may have discarded
+		// versions of keys, it must be accessed via atomics. Reads below it might not find the version they are
+		// looking for.
+		discardTimestamp uint64
+
 		levels           []*levelHandler
 		compactionStatus compactionStatus
+
+		// summary indexes the tables of every level below level 0 when Options.LevelSummary is set, see levelSummary.
+		// It is nil otherwise.
+		summaryLock sync.RWMutex
+		summary     *levelSummary
 	}
 
 	levelHandler struct {
@@ -44,6 +137,10 @@ type (
 		tables    []*table.Table
 		totalSize int64
 
+		// estimatedSize is the sum of the estimated sizes of the tables, which includes the size of the values that
+		// are stored in the value log. This is used to decide when the level needs to be compacted.
+		estimatedSize int64
+
 		// The following are initialized once and are constant.
 		level        uint8
 		strLevel     string
@@ -53,11 +150,27 @@ type (
 )
 
 func newLevelsController(db *DB, manifest *Manifest) (*levelsController, error) {
-	z.AssertTrue(db.options.NumLevelZeroTablesStall > db.options.NumLevelZeroTables)
+	if stall := db.options.NumLevelZeroTablesStall; stall != 0 && stall <= db.options.NumLevelZeroTables {
+		return nil, errors.Errorf("NumLevelZeroTablesStall %d must be greater than NumLevelZeroTables %d",
+			db.options.NumLevelZeroTablesStall, db.options.NumLevelZeroTables)
+	}
+
+	// There are no compactors in read only mode, but at least one table is always allowed to build.
+	numberOfBuilds := db.options.NumCompactionBuilds
+	if numberOfBuilds == 0 {
+		numberOfBuilds = db.options.NumCompactors
+	}
+	if numberOfBuilds == 0 {
+		numberOfBuilds = 1
+	}
+
 	s := &levelsController{
-		db:         db,
-		eventLog:   db.eventLog,
-		partitions: map[PartitionId]*partitionLevels{},
+		db:                db,
+		eventLog:          db.eventLog,
+		partitions:        map[PartitionId]*partitionLevels{},
+		droppedFileIds:    map[PartitionId]uint64{},
+		buildThrottle:     z.NewThrottle(numberOfBuilds),
+		compactionLimiter: z.NewRateLimiter(db.options.CompactionBytesPerSecond),
 	}
 
 	// Setup the initial partition.
@@ -70,7 +183,8 @@ func newLevelsController(db *DB, manifest *Manifest) (*levelsController, error)
 
 	// Compare the manifest to the directory. If there are partition missing we need to throw an error and if there are
 	// extra file that should not exist (that are table partition) they will be removed.
-	if err := revertToManifest(db, manifest, getFileIdMap(db.options.Directory)); err != nil {
+	idMap := getFileIdMap(db.options.FileSystem, db.options.Directory)
+	if _, err := revertToManifest(db, manifest, idMap, false); err != nil {
 		return nil, err
 	}
 
@@ -97,10 +211,14 @@ func newLevelsController(db *DB, manifest *Manifest) (*levelsController, error)
 
 	for partitionId, partition := range manifest.Partitions {
 		// If this is the first time we have seen a partition then setup the tables and maxFileIds map.
+		// The tables of the partitions that were seen before are still being opened.
+		mutex.Lock()
 		if _, ok := tables[partitionId]; !ok {
 			maxFileIds[partitionId] = 0
 			tables[partitionId] = make([][]*table.Table, db.options.MaxLevels)
+			s.setupPartition(partitionId)
 		}
+		mutex.Unlock()
 
 		for fileId, tableManifest := range partition.Tables {
 			fileName := table.NewFilename(uint32(partitionId), fileId, db.options.Directory)
@@ -134,7 +252,7 @@ func newLevelsController(db *DB, manifest *Manifest) (*levelsController, error)
 					atomic.AddInt32(&numberOpened, 1)
 				}()
 
-				file, e := z.OpenExistingFile(fileName, flags)
+				file, e := z.OpenExistingFile(db.options.FileSystem, fileName, flags)
 				if e != nil {
 					err = z.Wrapf(e, "opening file: %q", fileName)
 					return
@@ -146,7 +264,7 @@ func newLevelsController(db *DB, manifest *Manifest) (*levelsController, error)
 					return
 				}
 
-				tableOptions := buildTableOptions(db.options)
+				tableOptions := buildLevelTableOptions(db.options, tableManifest.Level)
 
 				// Set compression from the table manifest.
 				tableOptions.Compression = tableManifest.Compression
@@ -159,7 +277,7 @@ func newLevelsController(db *DB, manifest *Manifest) (*levelsController, error)
 						timber.Errorf("ignoring table %s", file.Name())
 						// We don't want to set the error here, we will just skip this table.
 					} else {
-						err = z.Wrapf(err, "opening table: %q", fileName)
+						err = z.Wrapf(e, "opening table: %q", fileName)
 					}
 					return
 				}
@@ -182,6 +300,20 @@ func newLevelsController(db *DB, manifest *Manifest) (*levelsController, error)
 		s.partitions[partitionId].nextFileId = maxFileId + 1
 	}
 
+	// The files that revertToManifest kept without them being in the manifest must not be overwritten by new tables.
+	for partitionId, files := range idMap {
+		partition, ok := s.partitions[partitionId]
+		if !ok {
+			continue
+		}
+
+		for fileId := range files {
+			if fileId >= partition.nextFileId {
+				partition.nextFileId = fileId + 1
+			}
+		}
+	}
+
 	for partitionId, partition := range tables {
 		for i, partitionTables := range partition {
 			s.partitions[partitionId].levels[i].initTables(partitionTables)
@@ -194,6 +326,13 @@ func newLevelsController(db *DB, manifest *Manifest) (*levelsController, error)
 		return nil, z.Wrapf(err, "failed to validate levels")
 	}
 
+	for _, partition := range s.partitions {
+		if err := s.updateSummary(partition); err != nil {
+			_ = s.cleanupLevels()
+			return nil, z.Wrapf(err, "failed to build level summary")
+		}
+	}
+
 	if err := syncDir(db.options.Directory); err != nil {
 		_ = s.close()
 		return nil, err
@@ -214,49 +353,178 @@ func closeAllTables(tables map[PartitionId][][]*table.Table) {
 	}
 }
 
-// revertToManifest checks that all necessary table files exist and removes all table files not referenced by the
-// manifest. idMap is a set of table file id's that were read from the directory listing.
-func revertToManifest(db *DB, manifest *Manifest, idMap map[PartitionId]map[uint64]struct{}) error {
+// revertToManifest checks that all necessary table files exist and removes the table files of the partitions that are
+// not in the manifest. idMap is a set of table file id's that were read from the directory listing. A partition that is
+// in the manifest keeps its files even when the manifest does not have any tables for it, as does the default
+// partition which always exists even if it has never been added to the manifest. If dryRun is true then no files are
+// removed. The names of the files that were removed, or would have been removed, are returned.
+func revertToManifest(
+	db *DB,
+	manifest *Manifest,
+	idMap map[PartitionId]map[uint64]struct{},
+	dryRun bool,
+) ([]string, error) {
 	// 1. Make sure all of the files in the manifest exist.
-	for partitionId, partition := range manifest.Partitions {
-		for id := range partition.Tables {
-			if _, ok := idMap[partitionId][id]; !ok {
-				return fmt.Errorf("file does not exist for table %d", id)
-			}
-		}
+	if missing := checkManifestFiles(manifest, idMap); len(missing) > 0 {
+		return nil, missing[0]
 	}
 
 	// 2. Delete any files that shouldn't exist.
+	var removed []string
 	for partitionId, files := range idMap {
+		// The files of a partition that is in the manifest are kept even if the manifest does not have any tables for
+		// it, only the files of partitions that are missing from the manifest entirely are removed.
+		if _, ok := manifest.Partitions[partitionId]; ok || partitionId == 0 {
+			continue
+		}
+
 		for fileId := range files {
-			if _, ok := manifest.Partitions[partitionId]; !ok {
-				db.eventLog.Printf("table file %d/%d not referenced in manifest\n", partitionId, fileId)
-				fileName := table.NewFilename(uint32(partitionId), fileId, db.options.Directory)
-				if err := os.Remove(fileName); err != nil {
-					return z.Wrapf(
-						err,
-						"failed to remove excess table file %d/%d - %s",
-						partitionId,
-						fileId,
-						fileName,
-					)
-				}
+			fileName := table.NewFilename(uint32(partitionId), fileId, db.options.Directory)
+			removed = append(removed, fileName)
+			if dryRun {
+				db.eventLog.Printf("table file %d/%d not referenced in manifest, would be removed\n", partitionId, fileId)
+				continue
+			}
+
+			db.eventLog.Printf("table file %d/%d not referenced in manifest\n", partitionId, fileId)
+			if err := db.options.FileSystem.Remove(fileName); err != nil {
+				return nil, z.Wrapf(
+					err,
+					"failed to remove excess table file %d/%d - %s",
+					partitionId,
+					fileId,
+					fileName,
+				)
 			}
 		}
 	}
 
-	return nil
+	return removed, nil
+}
+
+// checkManifestFiles returns an error for every table in the manifest that does not have a file in idMap.
+func checkManifestFiles(manifest *Manifest, idMap map[PartitionId]map[uint64]struct{}) []error {
+	var missing []error
+	for partitionId, partition := range manifest.Partitions {
+		for id := range partition.Tables {
+			if _, ok := idMap[partitionId][id]; !ok {
+				missing = append(missing, fmt.Errorf("file does not exist for table %d in partition %d", id, partitionId))
+			}
+		}
+	}
+
+	return missing
 }
 
 // close will cleanup all of the levels and partitions within this level controller.
 func (l *levelsController) close() error {
+	// Check the references before the tables are closed, the tables are closed either way.
+	var leakErr error
+	for _, partition := range l.partitions {
+		if err := partition.releaseSummary(); err != nil && leakErr == nil {
+			leakErr = err
+		}
+	}
+
+	if l.db.options.TrackTableReferences && leakErr == nil {
+		leakErr = l.checkReferences()
+	}
+
 	if err := l.cleanupLevels(); err != nil {
 		return z.Wrapf(err, "failed to close levels controller")
 	}
 
+	return leakErr
+}
+
+// checkReferences returns an error if any table has references other than the one held by its level, logging where
+// the references to each of those tables were taken. Tables that are no longer in a level should not have any.
+func (l *levelsController) checkReferences() error {
+	l.partitionsLock.RLock()
+	defer l.partitionsLock.RUnlock()
+
+	levelTables := map[*table.Table]struct{}{}
+	for _, partition := range l.partitions {
+		for _, handler := range partition.levels {
+			handler.RLock()
+			for _, t := range handler.tables {
+				levelTables[t] = struct{}{}
+			}
+			handler.RUnlock()
+		}
+	}
+
+	var leaked int
+	for _, t := range l.db.options.tableReferences.Tables() {
+		expected := int32(0)
+		if _, ok := levelTables[t]; ok {
+			expected = 1
+		}
+
+		if references := t.References(); references != expected {
+			leaked++
+			timber.Warningf("table %d in partition %d has %d references, expected %d: %s",
+				t.FileId(), t.PartitionId(), references, expected, t.ReferenceCallers())
+		}
+	}
+
+	if leaked > 0 {
+		return errors.Errorf("%d tables have leaked references", leaked)
+	}
+
 	return nil
 }
 
+// getPartition returns the levels for the provided partition if the partition has been setup.
+func (l *levelsController) getPartition(partitionId PartitionId) (*partitionLevels, bool) {
+	l.partitionsLock.RLock()
+	defer l.partitionsLock.RUnlock()
+	partition, ok := l.partitions[partitionId]
+	return partition, ok
+}
+
+// discardTimestamp returns the timestamp at or below which versions of keys in the partition may have been discarded.
+func (l *levelsController) discardTimestamp(partitionId PartitionId) uint64 {
+	partition, ok := l.getPartition(partitionId)
+	if !ok {
+		return 0
+	}
+
+	return atomic.LoadUint64(&partition.discardTimestamp)
+}
+
+// initDiscardTimestamps raises the discard timestamp of every partition that has been compacted before the database was
+// opened to the provided timestamp. The timestamps used by those compactions are not known, but none of them could
+// have been greater than the latest commit.
+func (l *levelsController) initDiscardTimestamps(timestamp uint64) {
+	l.partitionsLock.RLock()
+	defer l.partitionsLock.RUnlock()
+
+	for _, partition := range l.partitions {
+		for _, handler := range partition.levels[1:] {
+			if handler.numberOfTables() > 0 {
+				partition.raiseDiscardTimestamp(timestamp)
+				break
+			}
+		}
+	}
+}
+
+// getOrSetupPartition returns the levels for the provided partition, setting the partition up if it does not exist
+// yet.
+func (l *levelsController) getOrSetupPartition(partitionId PartitionId) *partitionLevels {
+	if partition, ok := l.getPartition(partitionId); ok {
+		return partition
+	}
+
+	l.partitionsLock.Lock()
+	defer l.partitionsLock.Unlock()
+	l.setupPartition(partitionId)
+	return l.partitions[partitionId]
+}
+
+// setupPartition creates the levels for the provided partition. The caller must hold the partitionsLock unless the
+// levels controller is still being created.
 func (l *levelsController) setupPartition(partitionId PartitionId) {
 	// If the partition is already setup then do nothing.
 	if _, ok := l.partitions[partitionId]; ok {
@@ -264,7 +532,8 @@ func (l *levelsController) setupPartition(partitionId PartitionId) {
 	}
 
 	l.partitions[partitionId] = &partitionLevels{
-		levels: make([]*levelHandler, l.db.options.MaxLevels),
+		nextFileId: l.droppedFileIds[partitionId],
+		levels:     make([]*levelHandler, l.db.options.MaxLevels),
 		compactionStatus: compactionStatus{
 			levels: make([]*levelCompactionStatus, l.db.options.MaxLevels),
 		},
@@ -311,8 +580,13 @@ func (l *levelsController) cleanupLevels() error {
 }
 
 func (l *levelsController) startCompaction(closer *z.Closer) {
+	atomic.StoreInt32(&l.compactorsStarted, 1)
+
 	n := l.db.options.NumCompactors
-	closer.AddRunning(n - 1)
+	if l.db.options.noCompactors {
+		n = 0
+	}
+	closer.AddRunning(n)
 	for i := 0; i < n; i++ {
 		go l.runWorker(closer)
 	}
@@ -331,23 +605,1116 @@ func (l *levelsController) runWorker(closer *z.Closer) {
 		return
 	}
 
-	ticker := time.NewTimer(time.Second)
+	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			// Gather the levels that need compaction.
-			priorities := l.pickCompactionLevels()
+			// Gather the levels that need compaction, and run the first one that can actually be compacted.
+			for _, priority := range l.pickCompactionLevels() {
+				// Don't start another compaction if the database is being closed.
+				select {
+				case <-closer.HasBeenClosed():
+					return
+				default:
+				}
+
+				if err := l.doCompact(priority); err == nil {
+					break
+				} else if err != errFillTables {
+					timber.Warningf("failed to compact partition %d level %d: %v",
+						priority.partitionId, priority.level, err)
+				}
+			}
+		case <-closer.HasBeenClosed():
+			return
+		}
+	}
+}
+
+// doCompact picks the tables for the provided compaction priority and compacts them into the next level, or merges them
+// within level 0 if the priority is size-tiered. If no tables could be picked then errFillTables is returned.
+func (l *levelsController) doCompact(priority compactionPriority) error {
+	partition, ok := l.getPartition(priority.partitionId)
+	if !ok {
+		return errFillTables
+	}
+
+	level := priority.level
+	z.AssertTrue(int(level)+1 < len(partition.levels)) // Sanity check.
+
+	cd := compactDef{
+		partitionId: priority.partitionId,
+		thisLevel:   partition.levels[level],
+		nextLevel:   partition.levels[level+1],
+		dropPrefix:  priority.dropPrefix,
+	}
+
+	// While picking tables to be compacted, both levels' tables are expected to remain unchanged.
+	switch {
+	case level == 0 && priority.sizeTiered:
+		cd.nextLevel = cd.thisLevel
+		if !l.fillTablesSizeTiered(partition, &cd) {
+			return errFillTables
+		}
+	case level == 0:
+		if !l.fillTablesLevel0(partition, &cd) {
+			return errFillTables
+		}
+	default:
+		if !l.fillTables(partition, &cd) {
+			return errFillTables
+		}
+	}
+	defer partition.compactionStatus.delete(cd) // Remove the ranges from compaction status.
+
+	timber.Debugf("running compaction for partition %d level %d", cd.partitionId, level)
+	writtenSize, err := l.runCompactDef(cd)
+	if err != nil {
+		// This compaction couldn't be done successfully.
+		return z.Wrapf(err, "failed to compact partition %d level %d", cd.partitionId, level)
+	}
+	partition.compactionStatus.compacted(cd, writtenSize)
+	timber.Debugf("compaction for partition %d level %d done", cd.partitionId, level)
+
+	return nil
+}
+
+// fillTablesLevel0 picks every table in level 0 to be compacted along with any overlapping tables in level 1.
+func (l *levelsController) fillTablesLevel0(partition *partitionLevels, cd *compactDef) bool {
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	cd.top = make([]*table.Table, len(cd.thisLevel.tables))
+	copy(cd.top, cd.thisLevel.tables)
+	if len(cd.top) == 0 {
+		return false
+	}
+	cd.thisRange = infiniteRange
+
+	keys := getKeyRange(cd.top...)
+	left, right := cd.nextLevel.overlappingTables(keys)
+	cd.bot = make([]*table.Table, right-left)
+	copy(cd.bot, cd.nextLevel.tables[left:right])
+	if len(cd.bot) == 0 {
+		cd.nextRange = keys
+	} else {
+		cd.nextRange = getKeyRange(cd.bot...)
+	}
+
+	return partition.compactionStatus.compareAndAdd(cd.partitionId, *cd)
+}
+
+// fillTablesSizeTiered picks a group of level 0 tables that are about the same size to be merged into fewer level 0
+// tables, see sizeTieredGroup. The tables are kept in the order they were added to level 0.
+func (l *levelsController) fillTablesSizeTiered(partition *partitionLevels, cd *compactDef) bool {
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	group := sizeTieredGroup(cd.thisLevel.tables, l.db.options.MaxTableSize)
+	if len(group) == 0 {
+		return false
+	}
+
+	grouped := make(map[uint64]struct{}, len(group))
+	for _, t := range group {
+		grouped[t.FileId()] = struct{}{}
+	}
+
+	cd.top = make([]*table.Table, 0, len(group))
+	for _, t := range cd.thisLevel.tables {
+		if _, ok := grouped[t.FileId()]; ok {
+			cd.top = append(cd.top, t)
+		}
+	}
+	cd.thisRange = infiniteRange
+
+	return partition.compactionStatus.compareAndAdd(cd.partitionId, *cd)
+}
+
+// sizeTieredGroup returns the group of the smallest tables that has at least sizeTieredMinTables tables which are all
+// about the same size, or nil if there is no such group. Tables are added to a group from smallest to largest until a
+// table is more than sizeTieredRatio times the average size of the group. Merging the smallest tables first keeps the
+// number of tables in level 0 down while rewriting as little as possible. The merged tables are still split at
+// maxTableSize, so tables that are already that large are never grouped, and a group is only returned if it fits into
+// fewer tables than it has. Otherwise the same tables would be rewritten over and over without level 0 shrinking.
+func sizeTieredGroup(tables []*table.Table, maxTableSize int64) []*table.Table {
+	sorted := make([]*table.Table, len(tables))
+	copy(sorted, tables)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Size() < sorted[j].Size()
+	})
+
+	var group []*table.Table
+	var groupSize int64
+	for _, t := range sorted {
+		if t.Size() >= maxTableSize {
+			break
+		}
+
+		if len(group) > 0 && float64(t.Size()) > sizeTieredRatio*float64(groupSize)/float64(len(group)) {
+			if len(group) >= sizeTieredMinTables {
+				break
+			}
+			group, groupSize = nil, 0
+		}
+
+		group = append(group, t)
+		groupSize += t.Size()
+		if len(group) == sizeTieredMaxTables {
+			break
+		}
+	}
+
+	if len(group) < sizeTieredMinTables || groupSize > int64(len(group)-1)*maxTableSize {
+		return nil
+	}
+
+	return group
+}
+
+// fillTables picks a single table from a level above level 0 to be compacted along with any overlapping tables in the
+// next level. Tables whose key ranges are already being compacted are skipped.
+func (l *levelsController) fillTables(partition *partitionLevels, cd *compactDef) bool {
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	if len(cd.thisLevel.tables) == 0 {
+		return false
+	}
+
+	for _, t := range cd.thisLevel.tables {
+		cd.thisSize = t.EstimatedSize()
+		cd.thisRange = getKeyRange(t)
+		// If another worker is already compacting this key range then there is no need to look at the next level.
+		if partition.compactionStatus.overlapsWith(cd.thisLevel.level, cd.thisRange) {
+			continue
+		}
+
+		cd.top = []*table.Table{t}
+		left, right := cd.nextLevel.overlappingTables(cd.thisRange)
+		cd.bot = make([]*table.Table, right-left)
+		copy(cd.bot, cd.nextLevel.tables[left:right])
+		if len(cd.bot) == 0 {
+			cd.nextRange = cd.thisRange
+		} else {
+			cd.nextRange = getKeyRange(cd.bot...)
+			if partition.compactionStatus.overlapsWith(cd.nextLevel.level, cd.nextRange) {
+				continue
+			}
+		}
+
+		if partition.compactionStatus.compareAndAdd(cd.partitionId, *cd) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runCompactDef merges the tables of the compaction into new tables, records the change in the manifest and then swaps
+// the new tables into the next level. The total size of the new tables is returned.
+func (l *levelsController) runCompactDef(cd compactDef) (writtenSize int64, err error) {
+	start := time.Now()
+
+	// Tables should never be moved directly between levels, they are always rewritten to allow discarding invalid
+	// versions.
+	newTables, decrement, err := l.compactBuildTables(&cd)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		// Only assign to err, if it's not already nil.
+		if decrementErr := decrement(); err == nil {
+			err = decrementErr
+		}
+	}()
+
+	// We write to the manifest _before_ we delete files (and after we created files). This way if we crash the
+	// manifest will still reference every table that holds data.
+	if err := l.db.manifest.addChanges(buildChangeSet(&cd, newTables)); err != nil {
+		return 0, z.Wrapf(err, "failed to write compaction to manifest")
+	}
+
+	for _, t := range newTables {
+		writtenSize += t.Size()
+	}
+
+	partition, ok := l.getPartition(cd.partitionId)
+	z.AssertTruef(ok, "partition %d was removed while it was being compacted", cd.partitionId)
+
+	// Tables that were merged within a level are swapped for the new tables all at once.
+	if cd.withinLevel() {
+		if err := cd.thisLevel.replaceTables(cd.top, newTables); err != nil {
+			return 0, err
+		}
+	} else {
+		// The next level is updated before this level, this way reads (which go from level 0 upward) never miss the
+		// data that is being moved.
+		if err := cd.nextLevel.replaceTables(cd.bot, newTables); err != nil {
+			return 0, err
+		}
+
+		if err := l.updateSummary(partition); err != nil {
+			return 0, err
+		}
+
+		// Note: For level 0, while doCompact is running, it is possible that new tables are added. However, the tables
+		// are only added to the end, and deleteTables only removes the tables that were compacted.
+		if err := cd.thisLevel.deleteTables(cd.top); err != nil {
+			return 0, err
+		}
+	}
+
+	// Level 0 is not part of the summary.
+	if cd.thisLevel.level > 0 {
+		if err := l.updateSummary(partition); err != nil {
+			return 0, err
+		}
+	}
+
+	// The versions that the discarded range deletes deleted are no longer in any table that can be read.
+	for _, rangeDelete := range cd.collapsedRangeDeletes {
+		l.db.rangeDeletes.remove(cd.partitionId, rangeDelete)
+	}
+
+	timber.Infof("compacted partition %d level %d->%d, deleted %d tables, added %d tables, took %s",
+		cd.partitionId, cd.thisLevel.level, cd.nextLevel.level, len(cd.top)+len(cd.bot), len(newTables),
+		time.Since(start))
+
+	return writtenSize, nil
+}
+
+// compactBuildTables merges the tables of the compaction and writes the result into new tables for the next level.
+// The returned function must be called to release the references to the new tables once they have been added to the
+// next level.
+func (l *levelsController) compactBuildTables(cd *compactDef) ([]*table.Table, func() error, error) {
+	// If the key range of the compaction overlaps with any of the levels below the next level then deletion markers
+	// need to be kept, otherwise older versions of the keys in those levels would become visible again. Tables merged
+	// within a level could also overlap with the tables of the level that were not picked.
+	hasOverlap := cd.withinLevel()
+	if !hasOverlap {
+		keys := getKeyRange(cd.top...)
+		partition, _ := l.getPartition(cd.partitionId)
+		for _, handler := range partition.levels[cd.nextLevel.level+1:] {
+			handler.RLock()
+			left, right := handler.overlappingTables(keys)
+			handler.RUnlock()
+			if right-left > 0 {
+				hasOverlap = true
+				break
+			}
+		}
+	}
+
+	// The tables of the compaction are read from start to end, so let the kernel read ahead while they are compacted.
+	l.adviseTables(cd.top, true)
+	l.adviseTables(cd.bot, true)
+	defer func() {
+		l.adviseTables(cd.top, l.db.options.TableReadAhead)
+		l.adviseTables(cd.bot, l.db.options.TableReadAhead)
+	}()
+
+	// Create iterators across all the tables involved first.
+	var iterators []z.Iterator
+	if cd.thisLevel.level == 0 {
+		// The newest tables in level 0 are at the end, but they need to take precedence in the merge.
+		for i := len(cd.top) - 1; i >= 0; i-- {
+			iterators = append(iterators, cd.top[i].NewIterator(false))
+		}
+	} else {
+		for _, t := range cd.top {
+			iterators = append(iterators, t.NewIterator(false))
+		}
+	}
+
+	for _, t := range cd.bot {
+		// Tables that only contain keys with the dropped prefix don't need to be read at all.
+		if len(cd.dropPrefix) > 0 &&
+			z.HasPrefix(t.Smallest(), cd.dropPrefix) &&
+			z.HasPrefix(t.Largest(), cd.dropPrefix) {
+			continue
+		}
+		iterators = append(iterators, t.NewIterator(false))
+	}
+
+	iterator := z.NewMergeIterator(iterators, false)
+	defer iterator.Close() // Important to close the iterator to do reference counting.
+
+	type newTableResult struct {
+		table *table.Table
+		err   error
+	}
+	resultChannel := make(chan newTableResult)
+
+	// Pick a discard timestamp, so we can discard versions below this timestamp. We should never discard any versions
+	// starting from above this timestamp, because that would affect the snapshot view guarantee provided by
+	// transactions.
+	discardTimestamp := l.db.oracle.discardAtOrBelow()
+
+	// Readers of older timestamps must know that the versions they are looking for might be discarded, before any of
+	// the tables built below can be read.
+	l.getOrSetupPartition(cd.partitionId).raiseDiscardTimestamp(discardTimestamp)
+
+	// The versions deleted by the range deletes at or below the discard timestamp are discarded, along with the range
+	// deletes that have nothing left to delete outside of this compaction.
+	rangeDeletes := l.db.rangeDeletes.get(cd.partitionId, discardTimestamp)
+	collapsible := l.collapsibleRangeDeletes(cd, rangeDeletes)
+
+	closed := l.db.closers.compactors.HasBeenClosed()
+	var numberOfBuilds, numberOfVersions int
+	var lastKey, skipKey []byte
+	// readErr is the first value pointer that couldn't be decoded, table that couldn't be read or table file that
+	// couldn't be created. Tables that were built from a part of the key range would lose the rest of it, so the
+	// compaction fails.
+	var readErr error
+	for iterator.Rewind(); iterator.Valid(); {
+		dataKey, err := l.db.registry.latestDataKey(cd.partitionId)
+		if err != nil {
+			return nil, nil, z.Wrapf(err, "failed to retrieve data key for compaction")
+		}
+
+		tableOptions := buildLevelTableOptions(l.db.options, cd.nextLevel.level)
+		tableOptions.DataKey = dataKey
+		// The builder does not need the cache but the same options are used for opening the table.
+		tableOptions.Cache = l.db.blockCache
+		build, err := l.newTableBuild(cd.partitionId, cd.nextLevel.level, tableOptions)
+		if err != nil {
+			readErr = err
+			break
+		}
+		builder := build.builder
+
+		for ; iterator.Valid(); iterator.Next() {
+			// See if we need to skip the prefix.
+			if len(cd.dropPrefix) > 0 && z.HasPrefix(iterator.Key(), cd.dropPrefix) {
+				continue
+			}
+
+			if isRangeDeleted(rangeDeletes, z.ParseKey(iterator.Key()), z.ParseTs(iterator.Key())) {
+				continue
+			}
+
+			if rangeDelete, ok := parseRangeDelete(iterator.Key(), iterator.Value()); ok && len(collapsible) > 0 {
+				if collapsed, ok := collapsedBy(collapsible, rangeDelete); ok {
+					cd.collapsedRangeDeletes = append(cd.collapsedRangeDeletes, collapsed)
+					continue
+				}
+			}
+
+			// See if we need to skip this key.
+			if len(skipKey) > 0 {
+				if z.SameKey(iterator.Key(), skipKey) {
+					continue
+				}
+				skipKey = skipKey[:0]
+			}
+
+			if !z.SameKey(iterator.Key(), lastKey) {
+				if builder.ReachedCapacity(l.db.options.MaxTableSize) {
+					// Only break if we are on a different key, and have reached capacity. We want to ensure that all
+					// versions of the key are stored in the same table, and not divided across multiple tables at the
+					// same level. The builder finishes its current block, so each table ends on a block boundary.
+					break
+				}
+				lastKey = z.SafeCopy(lastKey, iterator.Key())
+				numberOfVersions = 0
+			}
+
+			value := iterator.Value()
+			version := z.ParseTs(iterator.Key())
+			// Do not discard entries inserted by the merge operator. These entries will be discarded once they're
+			// merged.
+			if version <= discardTimestamp && value.Meta&bitMergeEntry == 0 {
+				// Keep track of the number of versions encountered for this key. Only consider the versions which are
+				// below the discard timestamp, otherwise we might end up discarding the only valid version for a
+				// running transaction.
+				numberOfVersions++
+
+				// Keep the current version and discard all of the next versions if the discard earlier versions bit is
+				// set, or we've already processed NumVersionsToKeep versions (including the current one).
+				lastValidVersion := value.Meta&bitDiscardEarlierVersions > 0 ||
+					numberOfVersions == l.db.options.NumVersionsToKeep
+				isExpired := isDeletedOrExpired(value.Meta, value.ExpiresAt, l.db.options.clock)
+				if isExpired || lastValidVersion {
+					// If this version of the key is deleted or expired, skip all the rest of the versions. This only
+					// removes versions below the discard timestamp.
+					skipKey = z.SafeCopy(skipKey, iterator.Key())
+					switch {
+					case !isExpired && lastValidVersion:
+						// Add this key. We have set skipKey, so the following versions will be skipped.
+					case hasOverlap:
+						// If this key range has overlap with lower levels, then keep the deletion marker with the
+						// latest version, discarding the rest. We have set skipKey, so the following versions will be
+						// skipped.
+					default:
+						// If there is no overlap, we can skip all of the versions by continuing here.
+						continue
+					}
+				}
+			}
+
+			var pointer valuePointer
+			if value.Meta&bitValuePointer > 0 {
+				if readErr = pointer.Decode(value.Value); readErr != nil {
+					break
+				}
+			}
+			builder.Add(iterator.Key(), value, pointer.Len)
+
+			// Waiting stops once the compactors are being closed, so the compactions that are left finish quickly.
+			l.compactionLimiter.Wait(len(iterator.Key())+int(value.EncodedSize()), closed)
+		}
+
+		if readErr == nil {
+			readErr = iterator.Err()
+		}
+
+		if readErr != nil {
+			// Stop building tables, the tables that are already being built are cleaned up below.
+			l.abandonTable(build)
+			break
+		}
+
+		if builder.Empty() {
+			l.abandonTable(build)
+			continue
+		}
+
+		numberOfBuilds++
+		go func(build *tableBuild) {
+			// Wait until fewer than the maximum number of tables are being built by the compactions of every partition.
+			if err := l.buildThrottle.Do(); err != nil {
+				l.abandonTable(build)
+				resultChannel <- newTableResult{nil, err}
+				return
+			}
+			defer l.buildThrottle.Done(nil)
+
+			t, err := l.finishTable(build)
+			resultChannel <- newTableResult{t, err}
+		}(build)
+	}
+
+	// The iterator could have failed before anything was added to a builder.
+	if readErr == nil {
+		readErr = iterator.Err()
+	}
+
+	// Wait for all of the table builders to finish.
+	newTables := make([]*table.Table, 0, numberOfBuilds)
+	firstErr := readErr
+	for i := 0; i < numberOfBuilds; i++ {
+		result := <-resultChannel
+		if result.table != nil {
+			newTables = append(newTables, result.table)
+		}
+		if firstErr == nil {
+			firstErr = result.err
+		}
+	}
+
+	if firstErr == nil && !l.db.options.InMemory {
+		// Ensure the created files' directory entries are visible. We don't mind the extra latency from not doing this
+		// as soon as all of the files have been created because this is a background operation.
+		firstErr = syncDir(l.db.options.Directory)
+	}
+
+	if firstErr != nil {
+		// An error happened. Delete all of the newly created table files by decrementing their references, we're the
+		// only holders of a reference.
+		_ = decrementReferences(newTables)
+		return nil, nil, z.Wrapf(firstErr, "failed to build tables for compaction of partition %d level %d",
+			cd.partitionId, cd.thisLevel.level)
+	}
+
+	sort.Slice(newTables, func(i, j int) bool {
+		return z.CompareKeys(newTables[i].Largest(), newTables[j].Largest()) < 0
+	})
+
+	return newTables, func() error { return decrementReferences(newTables) }, nil
+}
+
+// newTableBuild starts building a new table for the provided level of the partition. Level 0 tables are kept in memory
+// in the same cases that flushed tables are, every other table is streamed to a new table file while it is built.
+func (l *levelsController) newTableBuild(
+	partitionId PartitionId,
+	level uint8,
+	tableOptions table.Options,
+) (*tableBuild, error) {
+	build := &tableBuild{
+		partitionId: partitionId,
+		fileId:      l.reserveFileId(partitionId),
+		options:     tableOptions,
+	}
+	if l.db.options.InMemory || (level == 0 && l.db.options.KeepL0InMemory) {
+		build.builder = table.NewBuilder(tableOptions)
+		return build, nil
+	}
+
+	fileName := table.NewFilename(uint32(partitionId), build.fileId, l.db.options.Directory)
+	file, err := z.CreateSyncedFile(l.db.options.FileSystem, fileName, true)
+	if err != nil {
+		return nil, z.Wrapf(err, "failed to create table file: %q", fileName)
+	}
+
+	// The size of the table isn't known until it is finished, so the space for a full table is allocated and whatever
+	// is left over is trimmed once the table has been written.
+	if l.db.options.PreallocateTables {
+		if err := z.Preallocate(file, l.db.options.MaxTableSize); err != nil {
+			_ = file.Close()
+			_ = l.db.options.FileSystem.Remove(fileName)
+			return nil, z.Wrapf(err, "failed to preallocate table file: %q", fileName)
 		}
 	}
+
+	// The file is synced on every write, so the blocks are buffered rather than written one at a time.
+	build.file = file
+	build.writer = bufio.NewWriterSize(file, 1<<20)
+	build.builder = table.NewStreamBuilder(build.writer, tableOptions)
+	return build, nil
+}
+
+// finishTable finishes the table that is being built and opens it.
+func (l *levelsController) finishTable(build *tableBuild) (*table.Table, error) {
+	defer build.builder.Close()
+
+	if build.file == nil {
+		return table.OpenInMemoryTable(build.builder.Finish(), uint32(build.partitionId), build.fileId, &build.options)
+	}
+
+	fileName := build.file.Name()
+	err := build.builder.FinishTo(build.writer)
+	if err == nil {
+		err = build.writer.Flush()
+	}
+	if err == nil && l.db.options.PreallocateTables {
+		var size int64
+		if size, err = build.file.Seek(0, io.SeekCurrent); err == nil {
+			err = build.file.Truncate(size)
+		}
+	}
+	if err != nil {
+		_ = build.file.Close()
+		return nil, z.Wrapf(err, "failed to write table file: %q", fileName)
+	}
+
+	t, err := table.OpenTable(build.file, build.options)
+	if err != nil {
+		return nil, z.Wrapf(err, "failed to open table: %q", fileName)
+	}
+
+	return t, nil
+}
+
+// abandonTable stops building a table that will not be finished and removes its table file.
+func (l *levelsController) abandonTable(build *tableBuild) {
+	build.builder.Close()
+
+	if build.file == nil {
+		return
+	}
+
+	fileName := build.file.Name()
+	_ = build.file.Close()
+	if err := l.db.options.FileSystem.Remove(fileName); err != nil {
+		l.eventLog.Errorf("failed to remove unfinished table file %q: %v", fileName, err)
+	}
+}
+
+// adviseTables changes how the kernel expects the memory maps of the tables to be read. This is only a hint, so a
+// failure is logged rather than returned.
+func (l *levelsController) adviseTables(tables []*table.Table, readAhead bool) {
+	for _, t := range tables {
+		if err := t.Advise(readAhead); err != nil {
+			l.eventLog.Errorf("failed to advise table %d: %v", t.FileId(), err)
+		}
+	}
+}
+
+// reserveFileId returns the next unused file Id for the provided partition.
+func (l *levelsController) reserveFileId(partitionId PartitionId) uint64 {
+	// The partition might not have any tables yet, so make sure its levels exist before reserving a file id.
+	partition := l.getOrSetupPartition(partitionId)
+	return atomic.AddUint64(&partition.nextFileId, 1) - 1
+}
+
+// buildChangeSet returns the manifest changes for a compaction, creating the new tables in the next level and deleting
+// all of the tables that were compacted.
+func buildChangeSet(cd *compactDef, newTables []*table.Table) []pb.ManifestChange {
+	changes := make([]pb.ManifestChange, 0, len(newTables)+len(cd.top)+len(cd.bot))
+	for _, t := range newTables {
+		// Tables merged within level 0 are kept in memory in the same cases that flushed tables are.
+		changes = appendCreateChange(changes, cd.partitionId, cd.nextLevel.level, t)
+	}
+
+	for _, t := range cd.top {
+		// Level 0 tables that are kept in memory were never added to the manifest.
+		if t.IsInMemory {
+			continue
+		}
+		changes = append(changes, newDeleteChange(cd.partitionId, t.FileId()))
+	}
+
+	for _, t := range cd.bot {
+		changes = append(changes, newDeleteChange(cd.partitionId, t.FileId()))
+	}
+
+	return changes
 }
 
 // pickCompactionLevels determines which levels in the database need compaction. This is based on the approach that
 // RocksDB takes, and is outlined here: https://github.com/facebook/rocksdb/wiki/Leveled-Compaction
 // This method must use the same exact criteria for guaranteeing compaction's progress that addLevel0Table uses.
 func (l *levelsController) pickCompactionLevels() (priorities []compactionPriority) {
+	l.partitionsLock.RLock()
+	defer l.partitionsLock.RUnlock()
 
+	for partitionId, partition := range l.partitions {
+		// All of level 0 is compacted at once, so if any of it is being compacted then it can't be picked again.
+		levelZeroInProgress := partition.compactionStatus.overlapsWith(0, infiniteRange)
+		if !levelZeroInProgress && partition.levels[0].isLevel0Compactable() {
+			// With the size-tiered strategy a group of similarly sized tables is merged within level 0 when there is
+			// one, this also lowers the number of tables in level 0 so writes that are stalled still make progress.
+			// Level 0 is only compacted into level 1 once its tables have grown too different in size to be merged.
+			priorities = append(priorities, compactionPriority{
+				partitionId: partitionId,
+				level:       0,
+				score: float64(partition.levels[0].numberOfTables()) /
+					float64(l.db.options.NumLevelZeroTables),
+				sizeTiered: l.db.options.CompactionStrategy == options.SizeTiered &&
+					partition.levels[0].hasSizeTieredGroup(),
+			})
+		}
+
+		for _, handler := range partition.levels[1:] {
+			// Don't consider those tables that are already being compacted right now.
+			deleteSize := partition.compactionStatus.deleteSize(handler.level)
+			if handler.isCompactable(deleteSize) {
+				priorities = append(priorities, compactionPriority{
+					partitionId: partitionId,
+					level:       handler.level,
+					score:       float64(handler.getEstimatedSize()-deleteSize) / float64(handler.maxTotalSize),
+				})
+			}
+		}
+	}
+
+	// Sort the priorities so that the levels with the highest score are compacted first.
+	sort.Slice(priorities, func(i, j int) bool {
+		return priorities[i].score > priorities[j].score
+	})
+
+	return priorities
+}
+
+// addLevel0Table adds the provided table to level 0 of the provided partition. If level 0 already has
+// NumLevelZeroTablesStall tables then this will block until compaction has made room in level 0, unless the stall is
+// disabled. Before the compactors have been started level 0 is compacted here instead.
+func (l *levelsController) addLevel0Table(partitionId PartitionId, t *table.Table) error {
+	partition := l.getOrSetupPartition(partitionId)
+
+	// Add the table to the manifest only if it is not opened in memory. We don't want to add a table to the manifest if
+	// it exists only in memory.
+	if !t.IsInMemory {
+		// We update the manifest _before_ the table becomes part of a levelHandler, because at that point it could get
+		// used in some compaction. This ensures the manifest file gets updated in the proper order. (That means this
+		// update happens before that of some compaction which deletes the table.)
+		if err := l.db.manifest.addChanges([]pb.ManifestChange{
+			newCreateChange(partitionId, t.FileId(), 0, t.KeyID(), t.CompressionType()),
+		}); err != nil {
+			return z.Wrapf(err, "failed to add level 0 table to manifest")
+		}
+	}
+
+	for !partition.levels[0].tryAddLevel0Table(t) {
+		// Stall. Make sure all levels are healthy before we unstall.
+		timber.Infof("writes to level 0 of partition %d stalled, last unstalled %s ago",
+			partitionId, time.Since(l.lastUnstalled))
+		start := time.Now()
+
+		// Before we unstall, we need to make sure that level 0 is healthy. Otherwise, we will very quickly fill up
+		// level 0 again.
+		for i := 0; ; i++ {
+			// It's crucial that this behavior replicates pickCompactionLevels' behavior in computing compactability in
+			// order to guarantee progress. Break the loop once level 0 has enough space to accommodate new tables.
+			if !partition.levels[0].isLevel0Compactable() {
+				break
+			}
+
+			// The compactors are only started once the logs have been replayed, so the flushes of the replay have to
+			// make room in level 0 themselves. Level 0 might already be being compacted by another flush.
+			if atomic.LoadInt32(&l.compactorsStarted) == 0 {
+				err := l.doCompact(compactionPriority{
+					partitionId: partitionId,
+					level:       0,
+					score:       1.0,
+				})
+				switch err {
+				case nil:
+					continue
+				case errFillTables:
+				default:
+					return z.Wrapf(err, "failed to compact level 0 of partition %d", partitionId)
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			if i%100 == 0 {
+				timber.Debugf("waiting to add level 0 table. compaction priorities: %+v", l.pickCompactionLevels())
+				i = 0
+			}
+		}
+
+		timber.Infof("writes to level 0 of partition %d unstalled after %s", partitionId, time.Since(start))
+		l.lastUnstalled = time.Now()
+	}
+
+	return nil
+}
+
+// compactLevel0 compacts level 0 of every partition into level 1. This is used when the database is closed with
+// CompactL0OnClose set, so it does not rely on the compactors which have already been stopped by then.
+func (l *levelsController) compactLevel0() error {
+	for _, partitionId := range l.partitionIds() {
+		// The score does not matter here, it is only used to order the compactions picked by the compactors.
+		err := l.doCompact(compactionPriority{
+			partitionId: partitionId,
+			level:       0,
+			score:       1.0,
+		})
+		switch err {
+		case nil:
+			timber.Infof("compacted level 0 of partition %d on close", partitionId)
+		case errFillTables:
+			// Level 0 of this partition is already empty.
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flatten compacts the partition until at most one of its levels has tables. The first level that has tables is
+// compacted into the next level by up to the provided number of workers at a time. The tables that are being compacted by the
+// background compactors can't be picked, when nothing could be picked this waits for those compactions to finish.
+func (l *levelsController) flatten(partitionId PartitionId, workers int) error {
+	for {
+		// The partition might have been dropped while it was being flattened.
+		partition, ok := l.getPartition(partitionId)
+		if !ok {
+			return nil
+		}
+
+		var levels []uint8
+		for _, handler := range partition.levels {
+			if handler.numberOfTables() > 0 {
+				levels = append(levels, handler.level)
+			}
+		}
+		if len(levels) <= 1 {
+			return nil
+		}
+
+		priority := compactionPriority{
+			partitionId: partitionId,
+			level:       levels[0],
+			score:       1.0,
+		}
+		errs := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			go func() {
+				errs <- l.doCompact(priority)
+			}()
+		}
+
+		var compacted int
+		var err error
+		for i := 0; i < workers; i++ {
+			switch compactErr := <-errs; compactErr {
+			case nil:
+				compacted++
+			case errFillTables:
+			default:
+				err = compactErr
+			}
+		}
+
+		switch {
+		case err != nil:
+			return err
+		case compacted > 0:
+			timber.Debugf("%d compactions of partition %d level %d done while flattening",
+				compacted, partitionId, priority.level)
+		case partition.compactionStatus.overlapsWith(priority.level, infiniteRange),
+			partition.compactionStatus.overlapsWith(priority.level+1, infiniteRange):
+			// Another compaction is using the tables, it will be done soon.
+			time.Sleep(10 * time.Millisecond)
+		default:
+			return z.Wrapf(errFillTables, "no tables could be compacted out of level %d", priority.level)
+		}
+	}
+}
+
+// partitionIds returns the Ids of every partition that has levels, in no particular order.
+func (l *levelsController) partitionIds() []PartitionId {
+	l.partitionsLock.RLock()
+	defer l.partitionsLock.RUnlock()
+
+	partitionIds := make([]PartitionId, 0, len(l.partitions))
+	for partitionId := range l.partitions {
+		partitionIds = append(partitionIds, partitionId)
+	}
+
+	return partitionIds
+}
+
+// persistLevel0Tables writes any level 0 tables that are only held in memory to disk and adds them to the manifest. This
+// is used when the database is closed with KeepL0InMemory set, otherwise the data in those tables would be lost. The
+// compactors must be stopped before calling this.
+func (l *levelsController) persistLevel0Tables() error {
+	l.partitionsLock.RLock()
+	defer l.partitionsLock.RUnlock()
+
+	persist := func(partitionId PartitionId, handler *levelHandler) error {
+		handler.Lock()
+		defer handler.Unlock()
+
+		for i, t := range handler.tables {
+			if !t.IsInMemory {
+				continue
+			}
+
+			dataKey, err := l.db.registry.dataKey(partitionId, t.KeyID())
+			if err != nil {
+				return z.Wrapf(err, "failed to read data key")
+			}
+
+			tableOptions := buildLevelTableOptions(l.db.options, 0)
+			tableOptions.Compression = t.CompressionType()
+			tableOptions.DataKey = dataKey
+			tableOptions.Cache = l.db.blockCache
+			persisted, err := t.Persist(l.db.options.Directory, tableOptions)
+			if err != nil {
+				return z.Wrapf(err, "failed to persist level 0 table %d", t.FileId())
+			}
+
+			if err := l.db.manifest.addChanges([]pb.ManifestChange{
+				newCreateChange(partitionId, persisted.FileId(), 0, persisted.KeyID(), persisted.CompressionType()),
+			}); err != nil {
+				_ = persisted.DecrementReference()
+				return z.Wrapf(err, "failed to add level 0 table to manifest")
+			}
+
+			// The level handler takes over our reference to the persisted table and releases its reference to the in
+			// memory table.
+			handler.tables[i] = persisted
+			if err := t.DecrementReference(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for partitionId, partition := range l.partitions {
+		if err := persist(partitionId, partition.levels[0]); err != nil {
+			return z.Wrapf(err, "failed to persist level 0 of partition %d", partitionId)
+		}
+	}
+
+	return nil
+}
+
+// getLevelInfo returns the live layout of every level in every partition, ordered by partition and then by level.
+func (l *levelsController) getLevelInfo() []LevelInfo {
+	l.partitionsLock.RLock()
+	partitionIds := make([]PartitionId, 0, len(l.partitions))
+	for partitionId := range l.partitions {
+		partitionIds = append(partitionIds, partitionId)
+	}
+	l.partitionsLock.RUnlock()
+
+	sort.Slice(partitionIds, func(i, j int) bool {
+		return partitionIds[i] < partitionIds[j]
+	})
+
+	result := make([]LevelInfo, 0, len(partitionIds)*int(l.db.options.MaxLevels))
+	for _, partitionId := range partitionIds {
+		// The partition might have been dropped since its Id was read.
+		partition, ok := l.getPartition(partitionId)
+		if !ok {
+			continue
+		}
+
+		for _, handler := range partition.levels {
+			handler.RLock()
+			info := LevelInfo{
+				PartitionId:  partitionId,
+				Level:        handler.level,
+				TotalSize:    handler.totalSize,
+				MaxTotalSize: handler.maxTotalSize,
+				Tables:       make([]TableInfo, 0, len(handler.tables)),
+			}
+
+			for _, t := range handler.tables {
+				info.Tables = append(info.Tables, TableInfo{
+					FileId:   t.FileId(),
+					Smallest: z.Copy(t.Smallest()),
+					Largest:  z.Copy(t.Largest()),
+					Size:     t.Size(),
+					KeyCount: t.KeyCount(),
+					KeyId:    t.KeyID(),
+				})
+			}
+			handler.RUnlock()
+
+			result = append(result, info)
+		}
+	}
+
+	return result
+}
+
+// getCompactionStats returns the compaction statistics of every level in every partition, ordered by partition and then
+// by level.
+func (l *levelsController) getCompactionStats() []CompactionStats {
+	l.partitionsLock.RLock()
+	partitionIds := make([]PartitionId, 0, len(l.partitions))
+	for partitionId := range l.partitions {
+		partitionIds = append(partitionIds, partitionId)
+	}
+	l.partitionsLock.RUnlock()
+
+	sort.Slice(partitionIds, func(i, j int) bool {
+		return partitionIds[i] < partitionIds[j]
+	})
+
+	result := make([]CompactionStats, 0, len(partitionIds)*int(l.db.options.MaxLevels))
+	for _, partitionId := range partitionIds {
+		partition, ok := l.getPartition(partitionId)
+		if !ok {
+			continue
+		}
+		result = append(result, partition.compactionStatus.stats(partitionId)...)
+	}
+
+	return result
+}
+
+// get returns the found value if any. If not found, we return nil. It's important that we iterate the levels from 0 on
+// upward. The reason is, if we iterated in opposite order, or in parallel (naively calling all the l.RLock() in some
+// order) we could read level L's tables post-compaction and level L+1's tables pre-compaction.
+func (l *levelsController) get(
+	partitionId PartitionId,
+	key []byte,
+	maxValue *z.ValueStruct,
+	opts ReadOptions,
+) (z.ValueStruct, error) {
+	partition, ok := l.getPartition(partitionId)
+	if !ok {
+		if maxValue != nil {
+			return *maxValue, nil
+		}
+
+		return z.ValueStruct{}, nil
+	}
+
+	// With a summary only level 0 is read from its level handler, the table of every level below it that could have
+	// the key is found by the summary.
+	handlers := partition.levels
+	summaryTables, release, ok := partition.summaryTables(key)
+	if ok {
+		handlers = handlers[:1]
+		defer func() {
+			_ = release()
+		}()
+	}
+
+	version := z.ParseTs(key)
+	for i := 0; i < len(handlers)+len(summaryTables); i++ {
+		var value z.ValueStruct
+		var err error
+		if i < len(handlers) {
+			value, err = handlers[i].get(key, opts) // Calls handler.RLock() and handler.RUnlock().
+		} else if opts.NoCache {
+			value, err = summaryTables[i-len(handlers)].GetNoCache(key)
+		} else {
+			value, err = summaryTables[i-len(handlers)].Get(key)
+		}
+		if err != nil {
+			return z.ValueStruct{}, z.Wrapf(err, "get key: %q", key)
+		}
+
+		if value.Value == nil && value.Meta == 0 {
+			continue
+		}
+
+		if maxValue == nil || value.Version == version {
+			return value, nil
+		}
+
+		if maxValue.Version < value.Version {
+			*maxValue = value
+		}
+	}
+
+	if maxValue != nil {
+		return *maxValue, nil
+	}
+
+	return z.ValueStruct{}, nil
+}
+
+// appendIterators appends iterators for every table in the provided partition to the provided array of iterators.
+// Note: This obtains references for the table handlers. Remember to close these iterators.
+func (l *levelsController) appendIterators(
+	partitionId PartitionId,
+	iterators []z.Iterator,
+	reversed bool,
+	opts ReadOptions,
+) []z.Iterator {
+	partition, ok := l.getPartition(partitionId)
+	if !ok {
+		return iterators
+	}
+
+	// Just like with get, it's important we iterate the levels from 0 on upward, to avoid missing data when there's a
+	// compaction.
+	for _, level := range partition.levels {
+		iterators = level.appendIterators(iterators, reversed, opts)
+	}
+
+	return iterators
+}
+
+// keySplits returns keys that split the partition into ranges of roughly equal size, in ascending order. The tables of
+// a level below level 0 do not overlap, so the largest key of every table in the level with the most tables is used.
+// Only keys with the provided prefix are returned.
+func (l *levelsController) keySplits(partitionId PartitionId, prefix []byte) [][]byte {
+	partition, ok := l.getPartition(partitionId)
+	if !ok {
+		return nil
+	}
+
+	var splits [][]byte
+	var numberOfTables int
+	for _, level := range partition.levels[1:] {
+		level.RLock()
+		if len(level.tables) > numberOfTables {
+			numberOfTables, splits = len(level.tables), splits[:0]
+			for _, t := range level.tables {
+				if key := z.ParseKey(t.Largest()); bytes.HasPrefix(key, prefix) {
+					splits = append(splits, z.Copy(key))
+				}
+			}
+		}
+		level.RUnlock()
+	}
+
+	return splits
 }
 
 func (p *partitionLevels) validate() error {
@@ -359,3 +1726,13 @@ func (p *partitionLevels) validate() error {
 
 	return nil
 }
+
+// raiseDiscardTimestamp raises the discard timestamp of the partition to the provided timestamp if it is greater.
+func (p *partitionLevels) raiseDiscardTimestamp(timestamp uint64) {
+	for {
+		current := atomic.LoadUint64(&p.discardTimestamp)
+		if timestamp <= current || atomic.CompareAndSwapUint64(&p.discardTimestamp, current, timestamp) {
+			return
+		}
+	}
+}
@@ -0,0 +1,697 @@
+package notbadger
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/elliotcourant/notbadger/options"
+	"github.com/elliotcourant/notbadger/pb"
+	"github.com/elliotcourant/notbadger/skiplist"
+	"github.com/elliotcourant/notbadger/table"
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildTestLevel0Table builds a table for a partition containing the provided keys at the provided version.
+func buildTestLevel0Table(
+	t *testing.T,
+	db *DB,
+	partitionId PartitionId,
+	keys []string,
+	version uint64,
+) *table.Table {
+	tableOptions := buildLevelTableOptions(db.options, 0)
+	tableOptions.Cache = db.blockCache
+	// The table is always written to a file, like a table of level 1, even when flushed tables are kept in memory.
+	build, err := db.levelsController.newTableBuild(partitionId, 1, tableOptions)
+	require.NoError(t, err)
+
+	for _, key := range keys {
+		build.builder.Add(z.KeyWithTs([]byte(key), version), z.ValueStruct{
+			Value:   []byte(fmt.Sprintf("%s@%d", key, version)),
+			Version: version,
+		}, 0)
+	}
+
+	tbl, err := db.levelsController.finishTable(build)
+	require.NoError(t, err)
+
+	return tbl
+}
+
+// createTestLevel0Table writes a table containing the provided keys at the provided version to level 0 of a partition.
+func createTestLevel0Table(t *testing.T, db *DB, partitionId PartitionId, keys []string, version uint64) {
+	tbl := buildTestLevel0Table(t, db, partitionId, keys, version)
+	require.NoError(t, db.levelsController.addLevel0Table(partitionId, tbl))
+	require.NoError(t, tbl.DecrementReference())
+}
+
+func TestLevelsController_PickCompactionLevels(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		levels := db.levelsController
+		require.Empty(t, levels.pickCompactionLevels())
+
+		partition := levels.partitions[0]
+
+		// Level 0 is scored by the number of tables rather than the size of the level.
+		partition.levels[0].tables = make([]*table.Table, db.options.NumLevelZeroTables)
+
+		// Level 2 is twice the size it should be, while level 1 is just over its limit. Levels are scored by their
+		// estimated size, the size of the files alone does not matter.
+		partition.levels[1].estimatedSize = partition.levels[1].maxTotalSize + 1
+		partition.levels[2].estimatedSize = partition.levels[2].maxTotalSize * 2
+		partition.levels[3].totalSize = partition.levels[3].maxTotalSize * 4
+
+		priorities := levels.pickCompactionLevels()
+		require.Len(t, priorities, 3)
+		require.Equal(t, uint8(2), priorities[0].level)
+		require.Equal(t, 2.0, priorities[0].score)
+		require.Equal(t, uint8(1), priorities[1].level)
+		require.Equal(t, uint8(0), priorities[2].level)
+		require.Equal(t, 1.0, priorities[2].score)
+
+		// Tables that are already being compacted out of a level should not count towards its score.
+		partition.compactionStatus.levels[2].deleteSize = partition.levels[2].maxTotalSize * 2
+		partition.compactionStatus.levels[0].ranges = []keyRange{infiniteRange}
+		priorities = levels.pickCompactionLevels()
+		require.Len(t, priorities, 1)
+		require.Equal(t, uint8(1), priorities[0].level)
+
+		// Reset the levels so that closing the database does not try to close fake tables.
+		partition.levels[0].tables = nil
+	})
+}
+
+func TestLevelsController_DoCompact(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		levels := db.levelsController
+		partition := levels.partitions[0]
+
+		createTestLevel0Table(t, db, 0, []string{"a", "b", "c"}, 1)
+		createTestLevel0Table(t, db, 0, []string{"b", "d"}, 2)
+
+		require.NoError(t, levels.doCompact(compactionPriority{level: 0}))
+		require.Equal(t, 0, partition.levels[0].numberOfTables())
+		require.Equal(t, 1, partition.levels[1].numberOfTables())
+
+		// The compaction should have released its hold on the key ranges.
+		require.Empty(t, partition.compactionStatus.levels[0].ranges)
+		require.Empty(t, partition.compactionStatus.levels[1].ranges)
+
+		// Every version of every key should still be readable from level 1.
+		for key, version := range map[string]uint64{"a": 1, "b": 2, "c": 1, "d": 2} {
+			value, err := levels.get(0, z.KeyWithTs([]byte(key), version), nil, ReadOptions{})
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("%s@%d", key, version), string(value.Value))
+		}
+
+		value, err := levels.get(0, z.KeyWithTs([]byte("b"), 1), nil, ReadOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "b@1", string(value.Value))
+
+		// The manifest should only reference the new table.
+		require.Len(t, db.manifest.manifest.Partitions[0].Tables, 1)
+
+		// With nothing left in level 0 there is nothing to compact.
+		require.Equal(t, errFillTables, levels.doCompact(compactionPriority{level: 0}))
+	})
+}
+
+func TestLevelsController_LevelLoadingModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir).
+		WithTableLoadingMode(options.MemoryMap).
+		WithLevelLoadingModes(options.LoadToRAM, options.FileIO).
+		WithKeepL0InMemory(false).
+		WithCompactL0OnClose(false)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	requireModes := func(db *DB, expected map[uint8]options.FileLoadingMode) {
+		partition, ok := db.levelsController.getPartition(0)
+		require.True(t, ok)
+		for level, mode := range expected {
+			handler := partition.levels[level]
+			require.NotZero(t, handler.numberOfTables(), level)
+			for _, tbl := range handler.tables {
+				require.Equal(t, mode, tbl.LoadingMode(), level)
+			}
+		}
+	}
+
+	createTestLevel0Table(t, db, 0, []string{"a", "b"}, 1)
+	require.NoError(t, db.levelsController.doCompact(compactionPriority{level: 0}))
+	require.NoError(t, db.levelsController.doCompact(compactionPriority{level: 1}))
+	createTestLevel0Table(t, db, 0, []string{"b", "c"}, 2)
+	require.NoError(t, db.levelsController.doCompact(compactionPriority{level: 0}))
+	createTestLevel0Table(t, db, 0, []string{"c", "d"}, 3)
+
+	// The level 0 table is loaded into RAM, the compacted tables use the mode of the level they were compacted into.
+	expected := map[uint8]options.FileLoadingMode{0: options.LoadToRAM, 1: options.FileIO, 2: options.MemoryMap}
+	requireModes(db, expected)
+
+	// Compactions release the tables of every mode.
+	require.NoError(t, db.levelsController.doCompact(compactionPriority{level: 0}))
+	require.NoError(t, db.levelsController.doCompact(compactionPriority{level: 1}))
+	createTestLevel0Table(t, db, 0, []string{"d", "e"}, 4)
+	createTestLevel0Table(t, db, 0, []string{"e"}, 5)
+	require.NoError(t, db.levelsController.doCompact(compactionPriority{level: 0}))
+	createTestLevel0Table(t, db, 0, []string{"f"}, 6)
+	requireModes(db, expected)
+	require.NoError(t, db.Close())
+
+	// The tables are opened with the mode of their level from the manifest.
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	requireModes(db, expected)
+	for key, version := range map[string]uint64{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5, "f": 6} {
+		value, err := db.levelsController.get(0, z.KeyWithTs([]byte(key), version), nil, ReadOptions{})
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("%s@%d", key, version), string(value.Value))
+	}
+}
+
+func TestLevelsController_DoCompact_BuildThrottle(t *testing.T) {
+	opts := getTestOptions("").
+		withoutCompactors(). // Compactions are run manually.
+		WithNumCompactionBuilds(1)
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		levels := db.levelsController
+		for _, partitionId := range []PartitionId{1, 2} {
+			createTestLevel0Table(t, db, partitionId, []string{"a", "b"}, 1)
+		}
+
+		// Take the only build that is allowed, the compactions of both partitions should wait for it.
+		require.NoError(t, levels.buildThrottle.Do())
+
+		compacted := make(chan error, 2)
+		for _, partitionId := range []PartitionId{1, 2} {
+			go func(partitionId PartitionId) {
+				compacted <- levels.doCompact(compactionPriority{partitionId: partitionId, level: 0})
+			}(partitionId)
+		}
+
+		select {
+		case <-compacted:
+			t.Fatal("compaction built a table while the build throttle was full")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		levels.buildThrottle.Done(nil)
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-compacted:
+				require.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("compaction did not finish after the build throttle was released")
+			}
+		}
+
+		for _, partitionId := range []PartitionId{1, 2} {
+			partition, ok := levels.getPartition(partitionId)
+			require.True(t, ok)
+			require.Equal(t, 0, partition.levels[0].numberOfTables())
+			require.Equal(t, 1, partition.levels[1].numberOfTables())
+		}
+	})
+}
+
+func TestLevelsController_DoCompact_CompactionBytesPerSecond(t *testing.T) {
+	const bytesPerSecond = 64 << 10
+	opts := getTestOptions("").
+		withoutCompactors(). // Compactions are run manually.
+		WithCompactionBytesPerSecond(bytesPerSecond)
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		keys := make([]string, 700)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("key%04d-%s", i, strings.Repeat("x", 100))
+		}
+		createTestLevel0Table(t, db, 1, keys, 1)
+
+		// The compaction writes every entry of the table once, the first second of bytes is allowed right away.
+		var written int
+		partition, _ := db.levelsController.getPartition(1)
+		iterator := partition.levels[0].tables[0].NewIterator(false)
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			value := iterator.Value()
+			written += len(iterator.Key()) + int(value.EncodedSize())
+		}
+		require.NoError(t, iterator.Close())
+		require.True(t, written > 2*bytesPerSecond, "only %d bytes are compacted", written)
+		expected := time.Duration(float64(written-bytesPerSecond) / bytesPerSecond * float64(time.Second))
+
+		start := time.Now()
+		require.NoError(t, db.levelsController.doCompact(compactionPriority{partitionId: 1, level: 0}))
+		elapsed := time.Since(start)
+		// Delays that are too short to sleep for are left until the next write, so the last of them is never slept.
+		require.True(t, elapsed >= expected-10*time.Millisecond, "compaction took %s, expected at least %s", elapsed,
+			expected)
+		require.Equal(t, 0, partition.levels[0].numberOfTables())
+	})
+}
+
+func TestLevelsController_DoCompact_SplitOutput(t *testing.T) {
+	opts := getTestOptions("").
+		withoutCompactors() // Compactions are run manually.
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		keys := make([]string, 700)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("key%04d-%s", i, strings.Repeat("x", 100))
+		}
+		// Every key has two versions, which must end up in the same table.
+		createTestLevel0Table(t, db, 1, keys, 1)
+		createTestLevel0Table(t, db, 1, keys, 2)
+
+		levels := db.levelsController
+		require.NoError(t, levels.doCompact(compactionPriority{partitionId: 1, level: 0}))
+		partition, _ := levels.getPartition(1)
+		require.Equal(t, 0, partition.levels[0].numberOfTables())
+
+		tables := partition.levels[1].tables
+		require.True(t, len(tables) > 1, "compaction built %d tables", len(tables))
+		var count int
+		for i, tbl := range tables {
+			// The size is only estimated while building, so a table can go over by the last key it was given.
+			require.True(t, tbl.Size() < 2*db.options.MaxTableSize, "table %d is %d bytes", i, tbl.Size())
+			if i > 0 {
+				previous := z.ParseKey(tables[i-1].Largest())
+				require.True(t, bytes.Compare(previous, z.ParseKey(tbl.Smallest())) < 0,
+					"tables %d and %d overlap", i-1, i)
+			}
+
+			iterator := tbl.NewIterator(false)
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+				count++
+			}
+			require.NoError(t, iterator.Close())
+
+			// Every table has its own entry in the manifest.
+			tableManifest, ok := db.manifest.manifest.Partitions[1].Tables[tbl.FileId()]
+			require.True(t, ok, "table %d is not in the manifest", tbl.FileId())
+			require.Equal(t, uint8(1), tableManifest.Level)
+		}
+		require.Len(t, db.manifest.manifest.Partitions[1].Tables, len(tables))
+		require.Equal(t, 2*len(keys), count)
+	})
+}
+
+func TestLevelsController_Close_LeakedReferences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := Open(getTestOptions(dir).WithTrackTableReferences(true))
+	require.NoError(t, err)
+
+	createTestLevel0Table(t, db, 0, []string{"a", "b"}, 1)
+	partition := db.levelsController.partitions[0]
+	require.Equal(t, 1, partition.levels[0].numberOfTables())
+
+	// Take a reference that is never released, closing the database should report it.
+	leaked := partition.levels[0].tables[0]
+	leaked.IncrementReference()
+	require.Contains(t, leaked.ReferenceCallers(), "levels_test.go")
+
+	err = db.Close()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "leaked references")
+}
+
+func TestLevelsController_AddLevel0Table_Stall(t *testing.T) {
+	opts := getTestOptions("").
+		withoutCompactors(). // Compactions are run manually.
+		WithNumLevelZeroTables(1)
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		// The stall can't be set when the database is opened without compactors, the compactions are run by the test.
+		db.options.NumLevelZeroTablesStall = 2
+		levels := db.levelsController
+		partition := levels.partitions[0]
+
+		createTestLevel0Table(t, db, 0, []string{"a"}, 1)
+		createTestLevel0Table(t, db, 0, []string{"b"}, 2)
+		require.Equal(t, 2, partition.levels[0].numberOfTables())
+
+		// Level 0 is full, so adding another table should stall until level 0 has been compacted.
+		tbl := buildTestLevel0Table(t, db, 0, []string{"c"}, 3)
+		added := make(chan error, 1)
+		go func() {
+			added <- levels.addLevel0Table(0, tbl)
+		}()
+
+		select {
+		case <-added:
+			t.Fatal("level 0 table was added while level 0 was full")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		require.NoError(t, levels.doCompact(compactionPriority{level: 0}))
+
+		select {
+		case err := <-added:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("level 0 table was not added after compaction")
+		}
+		require.NoError(t, tbl.DecrementReference())
+
+		require.Equal(t, 1, partition.levels[0].numberOfTables())
+		require.Len(t, db.manifest.manifest.Partitions[0].Tables, 2)
+	})
+}
+
+func TestLevelsController_AddLevel0Table_NoStall(t *testing.T) {
+	// Without the stall level 0 grows past the default stall instead of blocking when nothing compacts it.
+	opts := getTestOptions("").
+		withoutCompactors()
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		tables := 2 * DefaultOptions("").NumLevelZeroTablesStall
+		done := make(chan error, 1)
+		go func() {
+			for i := 0; i < tables; i++ {
+				if err := db.Update(func(txn *Transaction) error {
+					return txn.Set(1, []byte(fmt.Sprintf("key%03d", i)), []byte("value"))
+				}); err != nil {
+					done <- err
+					return
+				}
+
+				if err := db.Flush(1); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("writes stalled on level 0 without any compactors")
+		}
+
+		partition, ok := db.levelsController.getPartition(1)
+		require.True(t, ok)
+		require.Equal(t, tables, partition.levels[0].numberOfTables())
+	})
+}
+
+func TestLevelsController_DoCompact_DiscardVersions(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		levels := db.levelsController
+		partition := levels.partitions[0]
+
+		memoryTable := skiplist.NewSkiplist(arenaSize(db.options, db.options.MaxTableSize))
+		for version := uint64(1); version <= 3; version++ {
+			value := []byte(fmt.Sprintf("a@%d", version))
+			memoryTable.Put(z.KeyWithTs([]byte("a"), version), z.ValueStruct{Value: value})
+		}
+		memoryTable.Put(z.KeyWithTs([]byte("b"), 1), z.ValueStruct{Value: []byte("b@1")})
+		memoryTable.Put(z.KeyWithTs([]byte("b"), 2), z.ValueStruct{Meta: bitDelete})
+		memoryTable.Put(z.KeyWithTs([]byte("c"), 1), z.ValueStruct{Value: []byte("c@1"), ExpiresAt: 1})
+		memoryTable.Put(z.KeyWithTs([]byte("drop/a"), 1), z.ValueStruct{Value: []byte("drop/a@1")})
+		memoryTable.Put(z.KeyWithTs([]byte("drop/b"), 1), z.ValueStruct{Value: []byte("drop/b@1")})
+
+		// Keys with the dropped prefix should never make it into the level 0 table.
+		require.NoError(t, db.handleFlushTask(flushTask{
+			memoryTable: memoryTable,
+			dropPrefix:  []byte("drop/a"),
+		}))
+		require.Equal(t, 1, partition.levels[0].numberOfTables())
+
+		get := func(key string, version uint64) string {
+			value, err := levels.get(0, z.KeyWithTs([]byte(key), version), nil, ReadOptions{})
+			require.NoError(t, err)
+			return string(value.Value)
+		}
+		require.Empty(t, get("drop/a", 1))
+		require.Equal(t, "drop/b@1", get("drop/b", 1))
+		require.Equal(t, "a@2", get("a", 2))
+
+		// Pretend that every reader is done so that all of the versions can be discarded.
+		db.oracle.readMark.SetDoneUntil(10)
+		require.NoError(t, levels.doCompact(compactionPriority{level: 0, dropPrefix: []byte("drop/")}))
+		require.Equal(t, 1, partition.levels[1].numberOfTables())
+
+		// Only the latest version of a should survive, and the deleted, expired and dropped keys should be gone.
+		require.Equal(t, "a@3", get("a", 3))
+		require.Empty(t, get("a", 2))
+		require.Empty(t, get("b", 2))
+		require.Empty(t, get("b", 1))
+		require.Empty(t, get("c", 1))
+		require.Empty(t, get("drop/b", 1))
+	})
+}
+
+func TestLevelsController_CompactionStrategy(t *testing.T) {
+	// writtenBytes writes the same tables to level 0 of a partition, running every compaction that is picked after each
+	// table, and returns the total size of the tables written by the compactions.
+	writtenBytes := func(t *testing.T, strategy options.CompactionStrategy) int64 {
+		opts := getTestOptions("").
+			withoutCompactors(). // Compactions are run manually.
+			WithKeepL0InMemory(false).
+			WithCompactL0OnClose(false).
+			WithCompactionStrategy(strategy)
+
+		var written int64
+		runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+			levels := db.levelsController
+			latest := map[string]uint64{}
+			for version := uint64(1); version <= 60; version++ {
+				keys := make([]string, 0, 50)
+				for i := 0; i < 50; i++ {
+					key := fmt.Sprintf("key%04d", (int(version)*37+i*53)%1000)
+					keys = append(keys, key)
+					latest[key] = version
+				}
+				sort.Strings(keys)
+				createTestLevel0Table(t, db, 0, keys, version)
+
+				for priorities := levels.pickCompactionLevels(); len(priorities) > 0; priorities = levels.pickCompactionLevels() {
+					require.NoError(t, levels.doCompact(priorities[0]))
+				}
+			}
+
+			// Merging tables within level 0 should never lose the newest version of a key.
+			for key, version := range latest {
+				value, err := levels.get(0, z.KeyWithTs([]byte(key), version), nil, ReadOptions{})
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("%s@%d", key, version), string(value.Value))
+			}
+
+			for _, stats := range db.CompactionStats() {
+				written += stats.WrittenBytes
+			}
+		})
+
+		return written
+	}
+
+	leveled := writtenBytes(t, options.Leveled)
+	sizeTiered := writtenBytes(t, options.SizeTiered)
+	require.NotZero(t, sizeTiered)
+	require.Less(t, sizeTiered, leveled, "size-tiered compaction should write less than leveled compaction")
+}
+
+func TestSizeTieredGroup(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		keys := func(n int) []string {
+			out := make([]string, n)
+			for i := range out {
+				out[i] = fmt.Sprintf("key%04d", i)
+			}
+			return out
+		}
+
+		var tables []*table.Table
+		defer func() {
+			require.NoError(t, decrementReferences(tables))
+		}()
+		for _, n := range []int{400, 10, 400, 11, 10, 12} {
+			tables = append(tables, buildTestLevel0Table(t, db, 0, keys(n), 1))
+		}
+
+		// There are only two large tables, so the small tables are picked even though they are not next to each other.
+		group := sizeTieredGroup(tables, db.options.MaxTableSize)
+		require.Len(t, group, 4)
+		for _, tbl := range group {
+			require.Less(t, tbl.Size(), tables[0].Size())
+		}
+
+		// Without enough tables of about the same size there is nothing to merge.
+		require.Empty(t, sizeTieredGroup(tables[:4], db.options.MaxTableSize))
+
+		// Tables that would not fit into fewer tables once they are merged are not grouped either.
+		require.Empty(t, sizeTieredGroup(tables, tables[1].Size()))
+	})
+}
+
+func TestLevelsController_SizeTieredMaxTableSize(t *testing.T) {
+	opts := getTestOptions("").
+		withoutCompactors(). // Compactions are run manually.
+		WithKeepL0InMemory(false).
+		WithCompactL0OnClose(false).
+		WithCompactionStrategy(options.SizeTiered)
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		// Each table is about a third of the max table size, so the merged tables don't fit into a single table.
+		var keys []string
+		for i := 0; i < 4; i++ {
+			tableKeys := make([]string, 300)
+			for j := range tableKeys {
+				tableKeys[j] = fmt.Sprintf("key%d%04d", i, j)
+			}
+			createTestLevel0Table(t, db, 0, tableKeys, 1)
+			keys = append(keys, tableKeys...)
+		}
+
+		levels := db.levelsController
+		handler := levels.partitions[0].levels[0]
+		var size int64
+		for _, tbl := range handler.tables {
+			require.Less(t, tbl.Size(), db.options.MaxTableSize/2)
+			size += tbl.Size()
+		}
+		require.Greater(t, size, db.options.MaxTableSize)
+
+		require.NoError(t, levels.doCompact(compactionPriority{partitionId: 0, level: 0, sizeTiered: true}))
+
+		// The builder only checks its capacity between keys, so a table can go over by about a block.
+		require.Len(t, handler.tables, 2)
+		for _, tbl := range handler.tables {
+			require.LessOrEqual(t, tbl.Size(), db.options.MaxTableSize+int64(db.options.BlockSize))
+		}
+
+		for _, key := range keys {
+			value, err := levels.get(0, z.KeyWithTs([]byte(key), 1), nil, ReadOptions{})
+			require.NoError(t, err)
+			require.Equal(t, key+"@1", string(value.Value))
+		}
+	})
+}
+
+func TestRevertToManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// An orphan file of the default partition is kept when the database is opened, and new tables are not given its
+	// file Id.
+	orphan := table.NewFilename(0, 1, dir)
+	require.NoError(t, ioutil.WriteFile(orphan, []byte("orphan"), 0600))
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	_, err = os.Stat(orphan)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), db.levelsController.partitions[0].nextFileId)
+
+	// Partition 1 is in the manifest without any tables, partition 2 is not in the manifest at all.
+	manifest := createManifest()
+	require.NoError(t, applyChangeSet(&manifest, pb.ManifestChangeSet{
+		Changes: []pb.ManifestChange{
+			newCreateChange(1, 1, 0, 0, options.None),
+			newDeleteChange(1, 1),
+		},
+	}))
+	kept, removed := table.NewFilename(1, 2, dir), table.NewFilename(2, 3, dir)
+	for _, fileName := range []string{kept, removed} {
+		require.NoError(t, ioutil.WriteFile(fileName, []byte("orphan"), 0600))
+	}
+
+	// A dry run reports the file that would be removed without removing it.
+	files, err := revertToManifest(db, &manifest, getFileIdMap(z.OSFileSystem, dir), true)
+	require.NoError(t, err)
+	require.Equal(t, []string{removed}, files)
+	for _, fileName := range []string{orphan, kept, removed} {
+		_, err = os.Stat(fileName)
+		require.NoError(t, err)
+	}
+
+	files, err = revertToManifest(db, &manifest, getFileIdMap(z.OSFileSystem, dir), false)
+	require.NoError(t, err)
+	require.Equal(t, []string{removed}, files)
+	for _, fileName := range []string{orphan, kept} {
+		_, err = os.Stat(fileName)
+		require.NoError(t, err)
+	}
+	_, err = os.Stat(removed)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestNewLevelsController_UnsupportedCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// Closing the database flushes the write to a level 0 table.
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		return txn.Set(0, []byte("key"), []byte("value"))
+	}))
+	require.NoError(t, db.Close())
+
+	mf, m, err := helpOpenOrCreateManifestFile(z.OSFileSystem, dir, false, manifestDeletionsRewriteThreshold, opts.ChecksumType)
+	require.NoError(t, err)
+	var fileId uint64
+	for fileId = range m.Partitions[0].Tables {
+		break
+	}
+
+	// Replace the table in the manifest with one that claims to use a compression type that does not exist.
+	require.NoError(t, mf.addChanges([]pb.ManifestChange{
+		newDeleteChange(0, fileId),
+		newCreateChange(0, fileId, 0, 0, options.CompressionType(99)),
+	}))
+	require.NoError(t, mf.close())
+
+	_, err = Open(opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown compression type 99")
+	require.Contains(t, err.Error(), fmt.Sprintf("cannot open table %d in partition 0", fileId))
+}
+
+func BenchmarkFinishTable(b *testing.B) {
+	value := make([]byte, 256)
+	for _, preallocate := range []bool{false, true} {
+		b.Run(fmt.Sprintf("preallocate=%v", preallocate), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "badger-test")
+			require.NoError(b, err)
+			defer removeDir(dir)
+
+			db, err := Open(DefaultOptions(dir).WithPreallocateTables(preallocate))
+			require.NoError(b, err)
+			defer func() {
+				require.NoError(b, db.Close())
+			}()
+
+			tableOptions := buildLevelTableOptions(db.options, 1)
+			for i := 0; i < b.N; i++ {
+				build, err := db.levelsController.newTableBuild(0, 1, tableOptions)
+				require.NoError(b, err)
+				for j := 0; !build.builder.ReachedCapacity(db.options.MaxTableSize); j++ {
+					build.builder.Add(z.KeyWithTs([]byte(fmt.Sprintf("key%09d", j)), 1), z.ValueStruct{Value: value}, 0)
+				}
+
+				tbl, err := db.levelsController.finishTable(build)
+				require.NoError(b, err)
+				b.SetBytes(tbl.Size())
+				require.NoError(b, tbl.DecrementReference())
+			}
+		})
+	}
+}
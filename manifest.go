@@ -5,7 +5,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"github.com/OneOfOne/xxhash"
 	"github.com/elliotcourant/notbadger/options"
 	"github.com/elliotcourant/notbadger/pb"
 	"github.com/elliotcourant/notbadger/z"
@@ -14,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 const (
@@ -24,8 +24,20 @@ const (
 	manifestDeletionsRatio            = 10
 
 	// manifestVersion is included in the manifest file to indicate the version of the encoding and format that the
-	// database is using to create it's manifest files.
-	manifestVersion = 0x01092017
+	// database is using to create it's manifest files. Every change set is prefixed with its length, the type of its
+	// checksum and its checksum.
+	manifestVersion = 0x02092017
+
+	// manifestVersionXXHash is the version of manifest files where every change set is prefixed with only its length
+	// and its xxhash checksum. These files can still be read, but are rewritten with the current version when opened.
+	manifestVersionXXHash = 0x01092017
+
+	// changeSetHeaderSize is the size of the length, checksum type and checksum that prefix each change set.
+	changeSetHeaderSize = 4 + 1 + 4
+
+	// changeSetHeaderSizeXXHash is the size of the length and checksum that prefix each change set in manifest files
+	// with the manifestVersionXXHash version.
+	changeSetHeaderSizeXXHash = 4 + 4
 )
 
 var (
@@ -92,7 +104,8 @@ type (
 	manifestFile struct {
 		file *os.File
 
-		directory string
+		fileSystem z.FileSystem
+		directory  string
 
 		// TODO (elliotcourant) Add unit tests.
 		// We make this configurable so that unit tests can hit rewrite() code quickly.
@@ -106,6 +119,14 @@ type (
 
 		// Used to indicate whether or not the database was opened in InMemory mode.
 		inMemory bool
+
+		// The checksum algorithm used for new change sets.
+		checksumType options.ChecksumType
+
+		// syncGroup coalesces the syncs of concurrent changes, the first change waits for syncInterval so that others
+		// can share its sync.
+		syncGroup    z.SyncGroup
+		syncInterval time.Duration
 	}
 
 	// TODO (elliotcourant) Add meaningful comment.
@@ -158,6 +179,17 @@ func (mf *manifestFile) addChanges(manifestChanges []pb.ManifestChange) error {
 	changes := pb.ManifestChangeSet{Changes: manifestChanges}
 	buf := changes.Marshal()
 
+	if err := mf.appendChangeSet(changes, buf); err != nil {
+		return err
+	}
+
+	// The changes are only durable once the file has been synced, which is shared with the changes that are added at
+	// the same time.
+	return mf.sync()
+}
+
+// appendChangeSet applies the change set to the manifest and appends it to the file, without syncing the file.
+func (mf *manifestFile) appendChangeSet(changes pb.ManifestChangeSet, buf []byte) error {
 	mf.appendLock.Lock()
 	defer mf.appendLock.Unlock()
 	if err := applyChangeSet(&mf.manifest, changes); err != nil {
@@ -167,21 +199,30 @@ func (mf *manifestFile) addChanges(manifestChanges []pb.ManifestChange) error {
 	// Rewrite the manifest if it'd shrunk by 1/10 and it's big enough to matter.
 	if mf.manifest.Deletions > mf.deletionsRewriteThreshold &&
 		mf.manifest.Deletions > manifestDeletionsRatio*(mf.manifest.Creations-mf.manifest.Deletions) {
-		if err := mf.rewrite(); err != nil {
-			return err
-		}
-	} else {
-		// TODO (elliotcourant) Maybe the lenCrc buf could be broken into its own method?
-		var lenSumBuf [8]byte
-		binary.BigEndian.PutUint32(lenSumBuf[0:4], uint32(len(buf)))
-		binary.BigEndian.PutUint32(lenSumBuf[4:8], xxhash.Checksum32(buf))
-		buf = append(lenSumBuf[:], buf...)
-		if _, err := mf.file.Write(buf); err != nil {
-			return err
-		}
+		return mf.rewrite()
+	}
+
+	buf, err := encodeChangeSet(buf, mf.checksumType)
+	if err != nil {
+		return err
+	}
+
+	_, err = mf.file.Write(buf)
+	return err
+}
+
+// sync fsyncs the manifest file to make sure that every change that has been written is durable. Concurrent syncs are
+// coalesced into a single fsync.
+func (mf *manifestFile) sync() error {
+	if mf.inMemory {
+		return nil
 	}
 
-	return z.FileSync(mf.file)
+	return mf.syncGroup.Do(mf.syncInterval, func() error {
+		mf.appendLock.Lock()
+		defer mf.appendLock.Unlock()
+		return z.FileSync(mf.file)
+	})
 }
 
 // rewrite completely rebuilds the file, appendLock must be held to call this method.
@@ -191,7 +232,7 @@ func (mf *manifestFile) rewrite() error {
 		return err
 	}
 
-	file, netCreations, err := helpRewrite(mf.directory, &mf.manifest)
+	file, netCreations, err := helpRewrite(mf.fileSystem, mf.directory, &mf.manifest, mf.checksumType)
 	if err != nil {
 		return err
 	}
@@ -231,11 +272,31 @@ func (r *countingReader) ReadByte() (b byte, err error) {
 	return
 }
 
-func helpRewrite(dir string, m *Manifest) (*os.File, int, error) {
+// encodeChangeSet prefixes the encoded change set with its length, the checksum type and its checksum.
+func encodeChangeSet(changeBuf []byte, checksumType options.ChecksumType) ([]byte, error) {
+	checksum, err := z.Checksum32(changeBuf, checksumType)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, changeSetHeaderSize, changeSetHeaderSize+len(changeBuf))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(changeBuf)))
+	buf[4] = byte(checksumType)
+	binary.BigEndian.PutUint32(buf[5:9], checksum)
+
+	return append(buf, changeBuf...), nil
+}
+
+func helpRewrite(
+	fs z.FileSystem,
+	dir string,
+	m *Manifest,
+	checksumType options.ChecksumType,
+) (*os.File, int, error) {
 	rewritePath := filepath.Join(dir, manifestRewriteFilename)
 
 	// We don't need to enable sync here because we will explicitly be calling the sync method.
-	file, err := z.OpenTruncFile(rewritePath, false)
+	file, err := z.OpenTruncFile(fs, rewritePath, false)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -252,15 +313,12 @@ func helpRewrite(dir string, m *Manifest) (*os.File, int, error) {
 	changes := m.asChanges()
 	set := pb.ManifestChangeSet{Changes: changes}
 
-	changeBuf := set.Marshal()
-
-	// Build the size and checksum segment. This is 8 bytes and starts with the size of the the change buffer and ends
-	// with a checksum of the change set.
-	var lenCrcBuf [8]byte
-	binary.BigEndian.PutUint32(lenCrcBuf[0:4], uint32(len(changeBuf)))
-	binary.BigEndian.PutUint32(lenCrcBuf[4:8], xxhash.Checksum32(changeBuf))
+	changeBuf, err := encodeChangeSet(set.Marshal(), checksumType)
+	if err != nil {
+		_ = file.Close()
+		return nil, 0, err
+	}
 
-	buf = append(buf, lenCrcBuf[:]...)
 	buf = append(buf, changeBuf...)
 
 	// Write the data to the file.
@@ -285,11 +343,11 @@ func helpRewrite(dir string, m *Manifest) (*os.File, int, error) {
 	manifestPath := filepath.Join(dir, ManifestFilename)
 
 	// Rename the rewritten file to be the normal manifest file name.
-	if err := os.Rename(rewritePath, manifestPath); err != nil {
+	if err := z.RenameWithRetry(fs, rewritePath, manifestPath); err != nil {
 		return nil, 0, err
 	}
 
-	file, err = z.OpenExistingFile(manifestPath, 0)
+	file, err = z.OpenExistingFile(fs, manifestPath, 0)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -375,27 +433,40 @@ func applyManifestChange(build *Manifest, change pb.ManifestChange) error {
 	return nil
 }
 
+// ReplayManifestFile reads every change set in the manifest file and returns the resulting manifest, along with the
+// offset after the last complete change set.
 func ReplayManifestFile(file *os.File) (Manifest, int64, error) {
+	manifest, offset, _, err := replayManifestFile(file)
+	return manifest, offset, err
+}
+
+// replayManifestFile is ReplayManifestFile but also returns the version of the manifest file.
+func replayManifestFile(file *os.File) (Manifest, int64, uint32, error) {
 	r := countingReader{
 		wrapped: bufio.NewReader(file),
 	}
 
 	var magicalBuf [8]byte
 	if _, err := io.ReadFull(&r, magicalBuf[:]); err != nil {
-		return Manifest{}, 0, errors.Wrapf(errBadMagic, "could not read: %v", err)
+		return Manifest{}, 0, 0, errors.Wrapf(errBadMagic, "could not read: %v", err)
 	} else if !bytes.Equal(magicalBuf[0:4], magicalText[:]) {
-		return Manifest{}, 0, errors.Wrap(errBadMagic, "missing magic prefix")
+		return Manifest{}, 0, 0, errors.Wrap(errBadMagic, "missing magic prefix")
 	}
 
 	version := binary.BigEndian.Uint32(magicalBuf[4:8])
 
-	if version != manifestVersion {
-		return Manifest{}, 0, ErrBadManifestVersion
+	headerSize := changeSetHeaderSize
+	switch version {
+	case manifestVersion:
+	case manifestVersionXXHash:
+		headerSize = changeSetHeaderSizeXXHash
+	default:
+		return Manifest{}, 0, 0, ErrBadManifestVersion
 	}
 
 	stat, err := file.Stat()
 	if err != nil {
-		return Manifest{}, 0, errors.Wrap(err, "error while trying to read file stats")
+		return Manifest{}, 0, 0, errors.Wrap(err, "error while trying to read file stats")
 	}
 	fileSize := uint32(stat.Size())
 
@@ -404,8 +475,8 @@ func ReplayManifestFile(file *os.File) (Manifest, int64, error) {
 	for {
 		offset = r.count
 		// TODO (elliotcourant) break this into its own function.
-		var lenCrcBuf [8]byte
-		if _, err := io.ReadFull(&r, lenCrcBuf[:]); err != nil {
+		var lenCrcBuf [changeSetHeaderSize]byte
+		if _, err := io.ReadFull(&r, lenCrcBuf[:headerSize]); err != nil {
 			// If we hit either of these then we've reached the end of the file. There is either no more data to be read
 			// or the last entry was cut off and we cannot read it anyway.
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
@@ -413,14 +484,14 @@ func ReplayManifestFile(file *os.File) (Manifest, int64, error) {
 			}
 
 			// If it wasn't an EOF error though then there was an actual problem with the reader that we should return.
-			return Manifest{}, 0, errors.Wrap(err, "failed to replay manifest file")
+			return Manifest{}, 0, 0, errors.Wrap(err, "failed to replay manifest file")
 		}
 
 		length := binary.BigEndian.Uint32(lenCrcBuf[0:4])
 
 		// Sanity check to make sure we don't over-allocate memory.
 		if length > fileSize {
-			return Manifest{}, 0, errors.Wrapf(
+			return Manifest{}, 0, 0, errors.Wrapf(
 				errors.New("buffer length for change set greater than file size, manifest might be corrupted"),
 				"buffer length: %d file size: %d",
 				length,
@@ -440,24 +511,35 @@ func ReplayManifestFile(file *os.File) (Manifest, int64, error) {
 			}
 
 			// If it wasn't an EOF error though then there was an actual problem with the reader that we should return.
-			return Manifest{}, 0, errors.Wrap(err, "failed to replay manifest file")
+			return Manifest{}, 0, 0, errors.Wrap(err, "failed to replay manifest file")
 		}
 
-		if xxhash.Checksum32(buf) != binary.BigEndian.Uint32(lenCrcBuf[4:8]) {
-			return Manifest{}, 0, ErrBadManifestChecksum
+		// Manifest files with the older version always use xxhash and do not include the checksum type.
+		checksumType, expected := options.XXHash, binary.BigEndian.Uint32(lenCrcBuf[4:8])
+		if version == manifestVersion {
+			checksumType, expected = options.ChecksumType(lenCrcBuf[4]), binary.BigEndian.Uint32(lenCrcBuf[5:9])
+		}
+
+		checksum, err := z.Checksum32(buf, checksumType)
+		if err != nil {
+			return Manifest{}, 0, 0, errors.Wrapf(err, "failed to checksum change set at offset %d", offset)
+		}
+
+		if checksum != expected {
+			return Manifest{}, 0, 0, ErrBadManifestChecksum
 		}
 
 		var changeSet pb.ManifestChangeSet
 		if err := changeSet.Unmarshal(buf); err != nil {
-			return Manifest{}, 0, errors.Wrap(err, "failed to unmarshal change set from buffer")
+			return Manifest{}, 0, 0, errors.Wrap(err, "failed to unmarshal change set from buffer")
 		}
 
 		if err := applyChangeSet(&build, changeSet); err != nil {
-			return Manifest{}, 0, errors.Wrap(err, "failed to apply change set from manifest file")
+			return Manifest{}, 0, 0, errors.Wrap(err, "failed to apply change set from manifest file")
 		}
 	}
 
-	return build, offset, nil
+	return build, offset, version, nil
 }
 
 // openOrCreateManifestFile opens a database manifest file if it exists, or creates one if doesnt exists.
@@ -466,10 +548,28 @@ func openOrCreateManifestFile(options Options) (*manifestFile, Manifest, error)
 		return &manifestFile{inMemory: true}, Manifest{}, nil
 	}
 
-	return helpOpenOrCreateManifestFile(options.Directory, options.ReadOnly, manifestDeletionsRewriteThreshold)
+	mf, manifest, err := helpOpenOrCreateManifestFile(
+		options.FileSystem,
+		options.Directory,
+		options.ReadOnly,
+		manifestDeletionsRewriteThreshold,
+		options.ChecksumType,
+	)
+	if err != nil {
+		return nil, Manifest{}, err
+	}
+	mf.syncInterval = options.SyncInterval
+
+	return mf, manifest, nil
 }
 
-func helpOpenOrCreateManifestFile(directory string, readOnly bool, deletionsThreshold int) (
+func helpOpenOrCreateManifestFile(
+	fs z.FileSystem,
+	directory string,
+	readOnly bool,
+	deletionsThreshold int,
+	checksumType options.ChecksumType,
+) (
 	*manifestFile,
 	Manifest,
 	error,
@@ -479,7 +579,7 @@ func helpOpenOrCreateManifestFile(directory string, readOnly bool, deletionsThre
 	if readOnly {
 		flags |= z.ReadOnly
 	}
-	file, err := z.OpenExistingFile(path, flags)
+	file, err := z.OpenExistingFile(fs, path, flags)
 
 	// If we get an error then we need to check if the file does infact exist. Because if the file does
 	// exist then there is a larger problem here, like a permission issue. But if the file does not exist
@@ -497,7 +597,7 @@ func helpOpenOrCreateManifestFile(directory string, readOnly bool, deletionsThre
 		}
 
 		m := createManifest()
-		file, netCreations, err := helpRewrite(directory, &m)
+		file, netCreations, err := helpRewrite(fs, directory, &m, checksumType)
 		if err != nil {
 			return nil, Manifest{}, errors.Wrap(err, "failed to write new manifest file")
 		}
@@ -506,16 +606,18 @@ func helpOpenOrCreateManifestFile(directory string, readOnly bool, deletionsThre
 
 		mf := &manifestFile{
 			file:                      file,
+			fileSystem:                fs,
 			directory:                 directory,
 			deletionsRewriteThreshold: deletionsThreshold,
 			manifest:                  m.clone(),
 			inMemory:                  false,
+			checksumType:              checksumType,
 		}
 
 		return mf, m, nil
 	}
 
-	manifest, truncOffset, err := ReplayManifestFile(file)
+	manifest, truncOffset, version, err := replayManifestFile(file)
 	if err != nil {
 		_ = file.Close()
 		return nil, Manifest{}, err
@@ -536,10 +638,20 @@ func helpOpenOrCreateManifestFile(directory string, readOnly bool, deletionsThre
 
 	mf := &manifestFile{
 		file:                      file,
+		fileSystem:                fs,
 		directory:                 directory,
 		deletionsRewriteThreshold: deletionsThreshold,
 		manifest:                  manifest.clone(),
 		inMemory:                  false,
+		checksumType:              checksumType,
+	}
+
+	// Change sets cannot be appended to a manifest file with an older version, so it needs to be rewritten first.
+	if version != manifestVersion && !readOnly {
+		if err := mf.rewrite(); err != nil {
+			_ = file.Close()
+			return nil, Manifest{}, err
+		}
 	}
 
 	return mf, manifest, nil
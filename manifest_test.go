@@ -1,9 +1,16 @@
 package notbadger
 
 import (
+	"encoding/binary"
+	"github.com/OneOfOne/xxhash"
+	"github.com/elliotcourant/notbadger/options"
 	"github.com/elliotcourant/notbadger/pb"
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -12,7 +19,7 @@ func TestManifestRewrite(t *testing.T) {
 	require.NoError(t, err)
 	defer removeDir(dir)
 	deletionsThreshold := 10
-	mf, m, err := helpOpenOrCreateManifestFile(dir, false, deletionsThreshold)
+	mf, m, err := helpOpenOrCreateManifestFile(z.OSFileSystem, dir, false, deletionsThreshold, options.XXHash)
 	defer func() {
 		if mf != nil {
 			mf.close()
@@ -38,9 +45,163 @@ func TestManifestRewrite(t *testing.T) {
 	err = mf.close()
 	require.NoError(t, err)
 	mf = nil
-	mf, m, err = helpOpenOrCreateManifestFile(dir, false, deletionsThreshold)
+	mf, m, err = helpOpenOrCreateManifestFile(z.OSFileSystem, dir, false, deletionsThreshold, options.XXHash)
 	require.NoError(t, err)
 	require.Equal(t, map[uint64]TableManifest{
 		uint64(deletionsThreshold * 3): {Level: 0},
 	}, m.Partitions[0].Tables)
 }
+
+func TestManifest_ChecksumType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	mf, _, err := helpOpenOrCreateManifestFile(z.OSFileSystem, dir, false, 10, options.CRC32Castagnoli)
+	require.NoError(t, err)
+	require.NoError(t, mf.addChanges([]pb.ManifestChange{newCreateChange(0, 1, 0, 0, 0)}))
+	require.NoError(t, mf.close())
+
+	// The checksum type is stored with every change set, so the manifest can be read with a different checksum type.
+	mf, m, err := helpOpenOrCreateManifestFile(z.OSFileSystem, dir, false, 10, options.XXHash)
+	require.NoError(t, err)
+	require.NoError(t, mf.addChanges([]pb.ManifestChange{newCreateChange(0, 2, 0, 0, 0)}))
+	require.NoError(t, mf.close())
+	require.Equal(t, map[uint64]TableManifest{1: {Level: 0}}, m.Partitions[0].Tables)
+
+	mf, m, err = helpOpenOrCreateManifestFile(z.OSFileSystem, dir, false, 10, options.CRC32Castagnoli)
+	require.NoError(t, err)
+	require.NoError(t, mf.close())
+	require.Equal(t, map[uint64]TableManifest{1: {Level: 0}, 2: {Level: 0}}, m.Partitions[0].Tables)
+
+	path := filepath.Join(dir, ManifestFilename)
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	// The first change set starts after the magic text and version, its checksum type follows its length.
+	checksumTypeOffset := 8 + 4
+	require.Equal(t, byte(options.CRC32Castagnoli), data[checksumTypeOffset])
+
+	t.Run("unknown checksum type", func(t *testing.T) {
+		corrupt := append([]byte{}, data...)
+		corrupt[checksumTypeOffset] = 0xff
+		require.NoError(t, ioutil.WriteFile(path, corrupt, 0600))
+
+		_, _, err := helpOpenOrCreateManifestFile(z.OSFileSystem, dir, false, 10, options.XXHash)
+		require.Error(t, err)
+		require.Equal(t, z.ErrUnknownChecksumType, errors.Cause(err))
+	})
+
+	t.Run("different checksum type", func(t *testing.T) {
+		corrupt := append([]byte{}, data...)
+		corrupt[checksumTypeOffset] = byte(options.XXHash)
+		require.NoError(t, ioutil.WriteFile(path, corrupt, 0600))
+
+		_, _, err := helpOpenOrCreateManifestFile(z.OSFileSystem, dir, false, 10, options.XXHash)
+		require.Equal(t, ErrBadManifestChecksum, err)
+	})
+}
+
+func TestManifest_UpgradeXXHashVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// Write a manifest file with the older version, where change sets only have a length and an xxhash checksum.
+	changes := pb.ManifestChangeSet{Changes: []pb.ManifestChange{newCreateChange(0, 1, 0, 0, 0)}}
+	changeBuf := changes.Marshal()
+	buf := make([]byte, 8+changeSetHeaderSizeXXHash)
+	copy(buf[0:4], magicalText[:])
+	binary.BigEndian.PutUint32(buf[4:8], manifestVersionXXHash)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(changeBuf)))
+	binary.BigEndian.PutUint32(buf[12:16], xxhash.Checksum32(changeBuf))
+	path := filepath.Join(dir, ManifestFilename)
+	require.NoError(t, ioutil.WriteFile(path, append(buf, changeBuf...), 0600))
+
+	// Opening the manifest should rewrite it with the current version so new change sets can be appended.
+	mf, m, err := helpOpenOrCreateManifestFile(z.OSFileSystem, dir, false, 10, options.CRC32Castagnoli)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]TableManifest{1: {Level: 0}}, m.Partitions[0].Tables)
+	require.NoError(t, mf.addChanges([]pb.ManifestChange{newCreateChange(0, 2, 0, 0, 0)}))
+	require.NoError(t, mf.close())
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, uint32(manifestVersion), binary.BigEndian.Uint32(data[4:8]))
+
+	mf, m, err = helpOpenOrCreateManifestFile(z.OSFileSystem, dir, false, 10, options.XXHash)
+	require.NoError(t, err)
+	require.NoError(t, mf.close())
+	require.Equal(t, map[uint64]TableManifest{1: {Level: 0}, 2: {Level: 0}}, m.Partitions[0].Tables)
+}
+
+// faultyFileSystem passes every operation through to the os package, except for renames which fail with renameErr
+// while it is set.
+type faultyFileSystem struct {
+	z.FileSystem
+	renameErr error
+}
+
+func (fs *faultyFileSystem) Rename(oldPath, newPath string) error {
+	if fs.renameErr != nil {
+		return fs.renameErr
+	}
+
+	return fs.FileSystem.Rename(oldPath, newPath)
+}
+
+func TestManifest_RewriteRenameFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	fs := &faultyFileSystem{FileSystem: z.OSFileSystem}
+	deletionsThreshold := 10
+	mf, _, err := helpOpenOrCreateManifestFile(fs, dir, false, deletionsThreshold, options.XXHash)
+	require.NoError(t, err)
+	require.NoError(t, mf.addChanges([]pb.ManifestChange{newCreateChange(0, 0, 0, 0, 0)}))
+
+	// The change set with one more deletion than the threshold rewrites the manifest, and the rename of the rewritten
+	// manifest fails.
+	renameErr := errors.New("rename failed")
+	fs.renameErr = renameErr
+	for i := uint64(0); i <= uint64(deletionsThreshold); i++ {
+		err := mf.addChanges([]pb.ManifestChange{
+			newCreateChange(0, i+1, 0, 0, 0),
+			newDeleteChange(0, i),
+		})
+		if i < uint64(deletionsThreshold) {
+			require.NoError(t, err)
+			continue
+		}
+		require.Equal(t, renameErr, err)
+	}
+	_, err = os.Stat(filepath.Join(dir, manifestRewriteFilename))
+	require.NoError(t, err)
+
+	// The manifest that was not replaced still has every change set up to the one that failed.
+	fs.renameErr = nil
+	mf, m, err := helpOpenOrCreateManifestFile(fs, dir, false, deletionsThreshold, options.XXHash)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]TableManifest{
+		uint64(deletionsThreshold): {Level: 0},
+	}, m.Partitions[0].Tables)
+
+	// The next rewrite replaces the rewrite file that was left behind.
+	for i := uint64(deletionsThreshold); i <= uint64(deletionsThreshold*3); i++ {
+		require.NoError(t, mf.addChanges([]pb.ManifestChange{
+			newCreateChange(0, i+1, 0, 0, 0),
+			newDeleteChange(0, i),
+		}))
+	}
+	require.NoError(t, mf.close())
+	_, err = os.Stat(filepath.Join(dir, manifestRewriteFilename))
+	require.True(t, os.IsNotExist(err))
+
+	mf, m, err = helpOpenOrCreateManifestFile(fs, dir, false, deletionsThreshold, options.XXHash)
+	require.NoError(t, err)
+	require.NoError(t, mf.close())
+	require.Equal(t, map[uint64]TableManifest{
+		uint64(deletionsThreshold*3 + 1): {Level: 0},
+	}, m.Partitions[0].Tables)
+}
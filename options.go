@@ -3,7 +3,10 @@ package notbadger
 import (
 	"github.com/elliotcourant/notbadger/options"
 	"github.com/elliotcourant/notbadger/table"
+	"github.com/elliotcourant/notbadger/z"
 	"github.com/elliotcourant/timber"
+	"github.com/pkg/errors"
+	"math"
 	"time"
 )
 
@@ -19,13 +22,18 @@ import (
 type Options struct {
 	// Required options.
 
-	Directory      string
-	ValueDirectory string
+	Directory        string
+	ValueDirectory   string
+	ValueDirectories []string
 
 	// Usually modified options.
 
 	SyncWrites          bool
+	SyncInterval        time.Duration
+	UseWAL              bool
 	TableLoadingMode    options.FileLoadingMode
+	LevelLoadingModes   []options.FileLoadingMode
+	TableReadAhead      bool
 	ValueLogLoadingMode options.FileLoadingMode
 	NumVersionsToKeep   int
 	ReadOnly            bool
@@ -48,6 +56,14 @@ type Options struct {
 	BloomFalsePositive float64
 	KeepL0InMemory     bool
 	MaxCacheSize       int64
+	PreallocateTables  bool
+	LevelSummary       bool
+
+	MaxPartitionId     PartitionId
+	ReservedPartitions PartitionId
+
+	AdaptiveMaxTableSize     int64
+	AdaptiveRotationInterval time.Duration
 
 	NumLevelZeroTables      int
 	NumLevelZeroTablesStall int
@@ -57,13 +73,23 @@ type Options struct {
 	ValueLogMaxEntries uint32
 
 	NumCompactors        int
+	NumCompactionBuilds  int
+	CompactionStrategy   options.CompactionStrategy
 	CompactL0OnClose     bool
 	LogRotatesToFlush    int32
 	ZSTDCompressionLevel int
 
+	CompactionBytesPerSecond int64
+
 	// When set, checksum will be validated for each entry read from the value log file.
 	VerifyValueChecksum bool
 
+	// When set, references to tables are tracked and leaked references are reported when the DB is closed.
+	TrackTableReferences bool
+
+	// FileSystem is used to create, open, rename and remove the files of the DB.
+	FileSystem z.FileSystem
+
 	// Encryption related options.
 	EncryptionKey                 []byte        // encryption key
 	EncryptionKeyRotationDuration time.Duration // key rotation duration
@@ -71,15 +97,25 @@ type Options struct {
 	// ChecksumVerificationMode decides when db should verify checksums for SSTable blocks.
 	ChecksumVerificationMode options.ChecksumVerificationMode
 
+	// ChecksumType is the algorithm used to checksum the manifest and SSTable blocks.
+	ChecksumType options.ChecksumType
+
 	// Transaction start and commit timestamps are managed by end-user.
 	// This is only useful for databases built on top of Badger (like Dgraph).
 	// Not recommended for most users.
 	managedTransactions bool
 
+	// tableReferences tracks the references to the tables of the DB when TrackTableReferences is set.
+	tableReferences *table.ReferenceTracker
+
+	// clock is used to decide whether entries have expired, it is replaced in tests.
+	clock z.Clock
+
 	// 4. Flags for testing purposes
 	// ------------------------------
 	maxBatchCount int64 // max entries in batch
 	maxBatchSize  int64 // max batch size in bytes
+	noCompactors  bool  // compactions are only run by the test
 }
 
 // DefaultOptions sets a list of recommended options for good performance.
@@ -112,6 +148,8 @@ func DefaultOptions(path string) Options {
 		VerifyValueChecksum:     false,
 		Compression:             defaultCompression,
 		MaxCacheSize:            1 << 30, // 1 GB
+		MaxPartitionId:          math.MaxUint32,
+		ReservedPartitions:      256,
 		// Benchmarking compression level against performance showed that level 15 gives
 		// the best speed vs ratio tradeoff.
 		// For a data size of 4KB we get
@@ -134,20 +172,148 @@ func DefaultOptions(path string) Options {
 		EventLogging:                  true,
 		EncryptionKey:                 []byte{},
 		EncryptionKeyRotationDuration: 10 * 24 * time.Hour, // Default 10 days.
+		AdaptiveRotationInterval:      time.Second,
 	}
 }
 
+// validate checks that the options can be used to open a database, returning an error that describes the first invalid
+// option that is found.
+func (opt Options) validate() error {
+	if opt.InMemory && (opt.Directory != "" || opt.ValueDirectory != "" || len(opt.ValueDirectories) > 0) {
+		return errors.New("Cannot use badger in Disk-less mode with Directory, ValueDirectory or ValueDirectories set")
+	}
+
+	valueDirectories := make(map[string]struct{}, len(opt.ValueDirectories))
+	for _, directory := range opt.ValueDirectories {
+		if directory == "" {
+			return errors.New("Invalid ValueDirectories, directories must not be empty")
+		}
+
+		if _, ok := valueDirectories[directory]; ok {
+			return errors.Errorf("Invalid ValueDirectories, %q is provided more than once", directory)
+		}
+		valueDirectories[directory] = struct{}{}
+	}
+
+	// We are limiting opt.ValueThreshold to maxValueThreshold for now.
+	if opt.ValueThreshold > maxValueThreshold {
+		return ErrValueThreshold
+	}
+
+	if !(opt.ValueLogFileSize <= 2<<30 && opt.ValueLogFileSize >= 1<<20) {
+		return ErrValueLogSize
+	}
+
+	if !(opt.ValueLogLoadingMode == options.FileIO || opt.ValueLogLoadingMode == options.MemoryMap) {
+		return ErrInvalidLoadingMode
+	}
+
+	// An empty encryption key disables encryption.
+	switch len(opt.EncryptionKey) {
+	case 0, 16, 24, 32:
+	default:
+		return ErrEncryptionKeyLength
+	}
+
+	for level, mode := range opt.LevelLoadingModes {
+		switch {
+		case level >= int(opt.MaxLevels):
+			return errors.Errorf("Invalid LevelLoadingModes, %d modes for %d levels", len(opt.LevelLoadingModes),
+				opt.MaxLevels)
+		case mode != options.FileIO && mode != options.LoadToRAM && mode != options.MemoryMap:
+			return errors.Errorf("Invalid LevelLoadingModes, unknown loading mode %d for level %d", mode, level)
+		}
+	}
+
+	if err := table.ValidateCompression(opt.Compression); err != nil {
+		return errors.Wrapf(err, "Invalid Compression")
+	}
+
+	if !(opt.ChecksumType == options.XXHash || opt.ChecksumType == options.CRC32Castagnoli) {
+		return errors.Errorf("Invalid ChecksumType %d, must be XXHash or CRC32Castagnoli", opt.ChecksumType)
+	}
+
+	// A false positive probability of zero disables the bloom filters, see WithBloomFalsePositive.
+	if opt.BloomFalsePositive < 0 || opt.BloomFalsePositive >= 1 {
+		return errors.Errorf("Invalid BloomFalsePositive %v, must be at least 0 and less than 1", opt.BloomFalsePositive)
+	}
+
+	// Compactors are not started in read only mode, so the number of compactors only matters when writes are allowed.
+	if opt.NumCompactors < 1 && !opt.ReadOnly {
+		return errors.Errorf("Invalid NumCompactors %d, must be at least 1", opt.NumCompactors)
+	}
+
+	// Zero compaction builds uses the number of compactors, see WithNumCompactionBuilds.
+	if opt.NumCompactionBuilds < 0 {
+		return errors.Errorf("Invalid NumCompactionBuilds %d, must not be negative", opt.NumCompactionBuilds)
+	}
+
+	// Zero does not limit the rate of compactions, see WithCompactionBytesPerSecond.
+	if opt.CompactionBytesPerSecond < 0 {
+		return errors.Errorf("Invalid CompactionBytesPerSecond %d, must not be negative", opt.CompactionBytesPerSecond)
+	}
+
+	if !(opt.CompactionStrategy == options.Leveled || opt.CompactionStrategy == options.SizeTiered) {
+		return errors.Errorf("Invalid CompactionStrategy %d, must be Leveled or SizeTiered", opt.CompactionStrategy)
+	}
+
+	// Level 0 is always compacted into a lower level, so there must be at least one level below it.
+	if opt.MaxLevels < 2 {
+		return errors.Errorf("Invalid MaxLevels %d, must be at least 2", opt.MaxLevels)
+	}
+
+	// Zero disables adaptive memory table sizing, see WithAdaptiveMaxTableSize.
+	if opt.AdaptiveMaxTableSize < 0 {
+		return errors.Errorf("Invalid AdaptiveMaxTableSize %d, must not be negative", opt.AdaptiveMaxTableSize)
+	}
+
+	if opt.AdaptiveRotationInterval < 0 {
+		return errors.Errorf("Invalid AdaptiveRotationInterval %s, must not be negative", opt.AdaptiveRotationInterval)
+	}
+
+	// Zero disables the level 0 stall, see WithNumLevelZeroTablesStall.
+	if opt.NumLevelZeroTablesStall < 0 ||
+		(opt.NumLevelZeroTablesStall != 0 && opt.NumLevelZeroTablesStall <= opt.NumLevelZeroTables) {
+		return errors.Errorf("Invalid NumLevelZeroTablesStall %d, must be 0 or greater than NumLevelZeroTables %d",
+			opt.NumLevelZeroTablesStall, opt.NumLevelZeroTables)
+	}
+
+	return nil
+}
+
 func buildTableOptions(opt Options) table.Options {
 	return table.Options{
 		BlockSize:            opt.BlockSize,
 		BloomFalsePositive:   opt.BloomFalsePositive,
 		LoadingMode:          opt.TableLoadingMode,
+		ReadAhead:            opt.TableReadAhead,
+		ReferenceTracker:     opt.tableReferences,
+		FileSystem:           opt.FileSystem,
 		ChkMode:              opt.ChecksumVerificationMode,
+		ChecksumType:         opt.ChecksumType,
 		Compression:          opt.Compression,
 		ZSTDCompressionLevel: opt.ZSTDCompressionLevel,
 	}
 }
 
+// buildLevelTableOptions returns the options for the tables of the provided level, which are loaded with the loading
+// mode of the level.
+func buildLevelTableOptions(opt Options, level uint8) table.Options {
+	tableOptions := buildTableOptions(opt)
+	tableOptions.LoadingMode = opt.tableLoadingMode(level)
+	return tableOptions
+}
+
+// tableLoadingMode returns the loading mode of the tables in the provided level. The levels that are not in
+// LevelLoadingModes use TableLoadingMode.
+func (opt Options) tableLoadingMode(level uint8) options.FileLoadingMode {
+	if int(level) < len(opt.LevelLoadingModes) {
+		return opt.LevelLoadingModes[level]
+	}
+
+	return opt.TableLoadingMode
+}
+
 const (
 	maxValueThreshold = 1 << 20 // 1 MB
 )
@@ -190,10 +356,38 @@ func (opt Options) WithValueDir(val string) Options {
 	return opt
 }
 
+// WithValueDirectories returns a new Options value with ValueDirectories set to the given value.
+//
+// ValueDirectories are the paths of the directories that value log files are spread across, which allows the value
+// log to use the bandwidth of several disks. New value log files are assigned to the directories round-robin by their
+// file Id, so the directories must be provided in the same order every time the database is opened. When set this is
+// used instead of ValueDirectory. Each directory is created if it doesn't exist.
+//
+// The default value of ValueDirectories is empty, which stores every value log file in ValueDirectory.
+func (opt Options) WithValueDirectories(val ...string) Options {
+	opt.ValueDirectories = val
+	return opt
+}
+
+// maxValueSize returns the largest value that can be written with a key of the provided size. An entry is written to a
+// single value log file along with its header, timestamp and checksum.
+func (opt Options) maxValueSize(keySize int) int64 {
+	return opt.ValueLogFileSize - int64(maxHeaderSize+keySize+8+crc32Size)
+}
+
+// valueDirectories returns the directories that value log files are stored in.
+func (opt Options) valueDirectories() []string {
+	if len(opt.ValueDirectories) > 0 {
+		return opt.ValueDirectories
+	}
+
+	return []string{opt.ValueDirectory}
+}
+
 // WithSyncWrites returns a new Options value with SyncWrites set to the given value.
 //
 // When SyncWrites is true all writes are synced to disk. Setting this to false would achieve better
-// performance, but may cause data loss in case of crash.
+// performance, but may cause data loss in case of crash. Individual writes can override this with WriteOptions.
 //
 // The default value of SyncWrites is true.
 func (opt Options) WithSyncWrites(val bool) Options {
@@ -201,6 +395,32 @@ func (opt Options) WithSyncWrites(val bool) Options {
 	return opt
 }
 
+// WithSyncInterval returns a new Options value with SyncInterval set to the given value.
+//
+// SyncInterval is how long a write that needs to be synced waits for other writes before the log is synced, so that
+// concurrent synced writes share a single sync instead of each paying for their own. Concurrent changes to the manifest
+// wait the same way. A write still only returns once it has been synced, so this trades the latency of each synced
+// write for the throughput of many of them.
+//
+// The default value of SyncInterval is 0, writes are only batched with the writes that are already waiting.
+func (opt Options) WithSyncInterval(val time.Duration) Options {
+	opt.SyncInterval = val
+	return opt
+}
+
+// WithUseWAL returns a new Options value with UseWAL set to the given value.
+//
+// When UseWAL is true the writes to the memory tables are appended to a write-ahead log instead of the value log.
+// Each write is appended as a single record with a checksum, and a file of the log is removed once every memory table
+// with writes from it has been flushed, or when the database is closed if KeepL0InMemory is set. The log is replayed
+// into the memory tables when the database is opened. It has no effect in InMemory mode.
+//
+// The default value of UseWAL is false.
+func (opt Options) WithUseWAL(val bool) Options {
+	opt.UseWAL = val
+	return opt
+}
+
 // WithTableLoadingMode returns a new Options value with TableLoadingMode set to the given value.
 //
 // TableLoadingMode indicates which file loading mode should be used for the LSM tree data files.
@@ -211,6 +431,78 @@ func (opt Options) WithTableLoadingMode(val options.FileLoadingMode) Options {
 	return opt
 }
 
+// WithLevelLoadingModes returns a new Options value with LevelLoadingModes set to the given value.
+//
+// LevelLoadingModes sets the file loading mode of the tables in each level, starting with level 0. This allows the
+// levels that are read the most to be memory mapped or loaded into RAM while the large levels at the bottom of the tree
+// are read with standard I/O. The levels that come after the provided modes use TableLoadingMode. There can't be more
+// modes than MaxLevels.
+//
+// The default value of LevelLoadingModes is empty, which uses TableLoadingMode for every level.
+func (opt Options) WithLevelLoadingModes(val ...options.FileLoadingMode) Options {
+	opt.LevelLoadingModes = val
+	return opt
+}
+
+// WithTableReadAhead returns a new Options value with TableReadAhead set to the given value.
+//
+// TableReadAhead tells the kernel that memory mapped tables will be read sequentially, so it can read pages ahead.
+// Leave it false if most reads are point reads, the pages are then expected to be read in a random order. Tables are
+// always read ahead while they are being compacted. This is only used when TableLoadingMode is options.MemoryMap.
+//
+// The default value of TableReadAhead is false.
+func (opt Options) WithTableReadAhead(val bool) Options {
+	opt.TableReadAhead = val
+	return opt
+}
+
+// WithMaxPartitionId returns a new Options value with MaxPartitionId set to the given value.
+//
+// MaxPartitionId is the largest partition Id that can be written to or read from. Every partition has its own memory
+// tables and levels, so this can be lowered to stop sparse partition Ids from allocating a large number of partitions.
+// Partition 0 is the default partition and can always be used.
+//
+// The default value of MaxPartitionId is math.MaxUint32.
+func (opt Options) WithMaxPartitionId(val PartitionId) Options {
+	opt.MaxPartitionId = val
+	return opt
+}
+
+// WithReservedPartitions returns a new Options value with ReservedPartitions set to the given value.
+//
+// ReservedPartitions is the number of partition Ids at the top of the range of partition Ids that are reserved for
+// internal use. These partitions can't be written to or read from, regardless of MaxPartitionId.
+//
+// The default value of ReservedPartitions is 256.
+func (opt Options) WithReservedPartitions(val PartitionId) Options {
+	opt.ReservedPartitions = val
+	return opt
+}
+
+// WithTrackTableReferences returns a new Options value with TrackTableReferences set to the given value.
+//
+// TrackTableReferences records where every reference to a table is taken and released. When the DB is closed every
+// table that still has references other than the one held by its level is logged, and Close returns an error. Tables
+// that are released more times than they were referenced return an error instead of deleting a file that is still in
+// use. This is meant for debugging and tests, it slows down every read.
+//
+// The default value of TrackTableReferences is false.
+func (opt Options) WithTrackTableReferences(val bool) Options {
+	opt.TrackTableReferences = val
+	return opt
+}
+
+// WithFileSystem returns a new Options value with FileSystem set to the given value.
+//
+// FileSystem is used for the files of the tables, the value log, the manifest and the key registry, so it can be
+// replaced to inject faults in tests. Locking the directory and syncing it always go through the os package.
+//
+// The default value of FileSystem is z.OSFileSystem.
+func (opt Options) WithFileSystem(val z.FileSystem) Options {
+	opt.FileSystem = val
+	return opt
+}
+
 // WithValueLogLoadingMode returns a new Options value with ValueLogLoadingMode set to the given
 // value.
 //
@@ -239,6 +531,7 @@ func (opt Options) WithNumVersionsToKeep(val int) Options {
 // Multiple processes can open the same Badger DB.
 // Note: if the DB being opened had crashed before and has vlog data to be replayed,
 // ReadOnly will cause Open to fail with an appropriate message.
+// Every call that would change the database returns ErrReadOnly.
 //
 // The default value of ReadOnly is false.
 func (opt Options) WithReadOnly(val bool) Options {
@@ -281,12 +574,41 @@ func (opt Options) WithEventLogging(enabled bool) Options {
 //
 // MaxTableSize sets the maximum size in bytes for each LSM table or file.
 //
+// MaxTableSize also bounds writes. A single batch may use at most 15% of MaxTableSize, and the arena of each memory
+// table is sized to hold MaxTableSize plus one full batch. Open returns an error if that batch could not hold even one
+// entry whose value is as large as ValueThreshold, so small tables may require a lower ValueThreshold.
+//
 // The default value of MaxTableSize is 64MB.
 func (opt Options) WithMaxTableSize(val int64) Options {
 	opt.MaxTableSize = val
 	return opt
 }
 
+// WithAdaptiveMaxTableSize returns a new Options value with AdaptiveMaxTableSize set to the given value.
+//
+// AdaptiveMaxTableSize is the size that the memory tables of a partition can grow to when the partition is written to
+// heavily. A memory table that fills up within AdaptiveRotationInterval is followed by one that is twice as large, so
+// bursts of writes are flushed as fewer and larger level 0 tables. Once a memory table takes longer than four intervals
+// to fill up the next one is half as large again, until it is back to the max table size of the partition. This has no
+// effect when it is not larger than MaxTableSize, or the max table size set with SetPartitionOptions.
+//
+// The default value of AdaptiveMaxTableSize is 0, memory tables are never larger than MaxTableSize.
+func (opt Options) WithAdaptiveMaxTableSize(val int64) Options {
+	opt.AdaptiveMaxTableSize = val
+	return opt
+}
+
+// WithAdaptiveRotationInterval returns a new Options value with AdaptiveRotationInterval set to the given value.
+//
+// AdaptiveRotationInterval is how quickly a memory table has to fill up for the next memory table of the partition to
+// be larger, see WithAdaptiveMaxTableSize.
+//
+// The default value of AdaptiveRotationInterval is 1 second.
+func (opt Options) WithAdaptiveRotationInterval(val time.Duration) Options {
+	opt.AdaptiveRotationInterval = val
+	return opt
+}
+
 // WithLevelSizeMultiplier returns a new Options value with LevelSizeMultiplier set to the given
 // value.
 //
@@ -337,7 +659,9 @@ func (opt Options) WithNumMemoryTables(val int) Options {
 // BloomFalsePositive sets the false positive probability of the bloom filter in any SSTable.
 // Before reading a key from table, the bloom filter is checked for key existence.
 // BloomFalsePositive might impact read performance of DB. Lower BloomFalsePositive value might
-// consume more memory.
+// consume more memory, a probability of 0.01 uses about 10 bits per key and every halving of it
+// adds about 1.44 bits per key. Setting this to zero disables bloom filters, which saves memory
+// when all reads are range scans.
 //
 // The default value of BloomFalsePositive is 0.01.
 func (opt Options) WithBloomFalsePositive(val float64) Options {
@@ -371,7 +695,8 @@ func (opt Options) WithNumLevelZeroTables(val int) Options {
 // given value.
 //
 // NumLevelZeroTablesStall sets the number of Level 0 tables that once reached causes the DB to
-// stall until compaction succeeds.
+// stall until compaction succeeds. Setting this to zero disables the stall, so level 0 can grow
+// without limit.
 //
 // The default value of NumLevelZeroTablesStall is 10.
 func (opt Options) WithNumLevelZeroTablesStall(val int) Options {
@@ -391,7 +716,9 @@ func (opt Options) WithLevelOneSize(val int64) Options {
 
 // WithValueLogFileSize returns a new Options value with ValueLogFileSize set to the given value.
 //
-// ValueLogFileSize sets the maximum size of a single value log file.
+// ValueLogFileSize sets the maximum size of a single value log file. Every write is stored in a single value log file,
+// so a value can be at most ValueLogFileSize minus the size of its key and 39 bytes for the header, timestamp and
+// checksum of the entry. Larger values are rejected with ErrValueTooLarge.
 //
 // The default value of ValueLogFileSize is 1GB.
 func (opt Options) WithValueLogFileSize(val int64) Options {
@@ -414,8 +741,8 @@ func (opt Options) WithValueLogMaxEntries(val uint32) Options {
 
 // WithNumCompactors returns a new Options value with NumCompactors set to the given value.
 //
-// NumCompactors sets the number of compaction workers to run concurrently.
-// Setting this to zero stops compactions, which could eventually cause writes to block forever.
+// NumCompactors sets the number of compaction workers to run concurrently. It must be at least 1 unless the database is
+// opened in read only mode.
 //
 // The default value of NumCompactors is 2.
 func (opt Options) WithNumCompactors(val int) Options {
@@ -423,6 +750,44 @@ func (opt Options) WithNumCompactors(val int) Options {
 	return opt
 }
 
+// WithNumCompactionBuilds returns a new Options value with NumCompactionBuilds set to the given value.
+//
+// NumCompactionBuilds sets the maximum number of tables that are built by compactions at the same time, across every
+// partition. This keeps compactions of many partitions from all writing to the disk at once.
+// Setting this to zero uses the value of NumCompactors.
+//
+// The default value of NumCompactionBuilds is 0.
+func (opt Options) WithNumCompactionBuilds(val int) Options {
+	opt.NumCompactionBuilds = val
+	return opt
+}
+
+// WithCompactionBytesPerSecond returns a new Options value with CompactionBytesPerSecond set to the given value.
+//
+// CompactionBytesPerSecond limits the number of bytes that compactions write per second, across every partition. This
+// keeps the background compactions from saturating the disk and slowing down reads and writes, at the cost of level 0
+// taking longer to compact, which can stall writes. Compactions are no longer limited once the DB is being closed.
+// Setting this to zero does not limit compactions.
+//
+// The default value of CompactionBytesPerSecond is 0.
+func (opt Options) WithCompactionBytesPerSecond(val int64) Options {
+	opt.CompactionBytesPerSecond = val
+	return opt
+}
+
+// WithCompactionStrategy returns a new Options value with CompactionStrategy set to the given value.
+//
+// CompactionStrategy decides how the tables of level 0 are compacted. options.Leveled compacts all of level 0 into
+// level 1 once it has NumLevelZeroTables tables. options.SizeTiered first merges groups of level 0 tables that are about
+// the same size into larger level 0 tables, which lowers the write amplification of write heavy workloads but leaves
+// more tables in level 0 for reads to check. The levels below level 0 are compacted the same way by both strategies.
+//
+// The default value of CompactionStrategy is options.Leveled.
+func (opt Options) WithCompactionStrategy(val options.CompactionStrategy) Options {
+	opt.CompactionStrategy = val
+	return opt
+}
+
 // WithCompactL0OnClose returns a new Options value with CompactL0OnClose set to the given value.
 //
 // CompactL0OnClose determines whether Level 0 should be compacted before closing the DB.
@@ -462,7 +827,8 @@ func (opt Options) WithEncryptionKey(key []byte) Options {
 // the given value.
 //
 // Key Registry will use this duration to create new keys. If the previous generated
-// key exceed the given duration. Then the key registry will create new key.
+// key exceed the given duration. Then the key registry will create new key. Every
+// partition has its own keys, which are rotated independently of the other partitions.
 func (opt Options) WithEncryptionKeyRotationDuration(d time.Duration) Options {
 	opt.EncryptionKeyRotationDuration = d
 	return opt
@@ -481,6 +847,31 @@ func (opt Options) WithKeepL0InMemory(val bool) Options {
 	return opt
 }
 
+// WithPreallocateTables returns a new Options value with PreallocateTables set to the given value.
+//
+// When PreallocateTables is true the disk space for a table file is allocated up front, before the table is written,
+// instead of growing the file as it is written. MaxTableSize bytes are allocated and whatever is left over is trimmed
+// once the table has been written. This reduces fragmentation on spinning disks and some filesystems.
+//
+// The default value of PreallocateTables is false.
+func (opt Options) WithPreallocateTables(val bool) Options {
+	opt.PreallocateTables = val
+	return opt
+}
+
+// WithLevelSummary returns a new Options value with LevelSummary set to the given value.
+//
+// When LevelSummary is true every partition keeps an index of the tables of all of its levels below level 0, which finds
+// the table that could have a key in every level with a single binary search instead of one per level. This makes
+// point reads of partitions with many levels faster. The index is rebuilt after every compaction, which costs a little
+// memory and time.
+//
+// The default value of LevelSummary is false.
+func (opt Options) WithLevelSummary(val bool) Options {
+	opt.LevelSummary = val
+	return opt
+}
+
 // WithCompression returns a new Options value with Compression set to the given value.
 //
 // When compression is enabled, every block will be compressed using the specified algorithm.
@@ -517,6 +908,17 @@ func (opt Options) WithChecksumVerificationMode(cvMode options.ChecksumVerificat
 	return opt
 }
 
+// WithChecksumType returns a new Options value with ChecksumType set to the given value.
+//
+// ChecksumType is the algorithm used to checksum changes written to the manifest and SSTable blocks. The algorithm is
+// stored with every checksum, so files written with a different algorithm can still be read.
+//
+// The default value of ChecksumType is options.XXHash.
+func (opt Options) WithChecksumType(checksumType options.ChecksumType) Options {
+	opt.ChecksumType = checksumType
+	return opt
+}
+
 // WithMaxCacheSize returns a new Options value with MaxCacheSize set to the given value.
 //
 // This value specifies how much data cache should hold in memory. A small size of cache means lower
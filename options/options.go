@@ -39,3 +39,54 @@ const (
 	// ZSTD mode indicates that a block is compressed using ZSTD algorithm.
 	ZSTD
 )
+
+// String returns the name of the compression algorithm.
+func (c CompressionType) String() string {
+	switch c {
+	case None:
+		return "None"
+	case Snappy:
+		return "Snappy"
+	case ZSTD:
+		return "ZSTD"
+	default:
+		return "Unknown"
+	}
+}
+
+// ChecksumType specifies the algorithm that is used to checksum the manifest and SSTable blocks.
+type ChecksumType uint8
+
+const (
+	// XXHash indicates that checksums are calculated using the xxhash algorithm.
+	XXHash ChecksumType = iota
+	// CRC32Castagnoli indicates that checksums are calculated using CRC32 with the Castagnoli polynomial, which is
+	// hardware accelerated on most platforms.
+	CRC32Castagnoli
+)
+
+// CompactionStrategy specifies how the tables of level 0 are picked for compaction.
+type CompactionStrategy uint8
+
+const (
+	// Leveled compacts every table in level 0 into level 1 once level 0 has enough tables, merging them with the
+	// tables of level 1 that they overlap.
+	Leveled CompactionStrategy = iota
+	// SizeTiered merges groups of level 0 tables that are about the same size into fewer, larger tables that stay in
+	// level 0. Each write is rewritten fewer times before it reaches level 1, at the cost of reads having to check more
+	// tables in level 0. Level 0 is still compacted into level 1 when it has enough tables and none of them can be
+	// grouped.
+	SizeTiered
+)
+
+// String returns the name of the compaction strategy.
+func (c CompactionStrategy) String() string {
+	switch c {
+	case Leveled:
+		return "Leveled"
+	case SizeTiered:
+		return "SizeTiered"
+	default:
+		return "Unknown"
+	}
+}
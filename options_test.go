@@ -0,0 +1,136 @@
+package notbadger
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/elliotcourant/notbadger/options"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultOptions(t *testing.T) {
+	opts := DefaultOptions("/tmp/badger")
+	require.NoError(t, opts.validate())
+	require.Equal(t, "/tmp/badger", opts.Directory)
+	require.Equal(t, "/tmp/badger", opts.ValueDirectory)
+	require.True(t, opts.NumLevelZeroTablesStall > opts.NumLevelZeroTables)
+	require.True(t, opts.ValueThreshold <= maxValueThreshold)
+
+	require.NoError(t, LSMOnlyOptions("/tmp/badger").validate())
+	require.NoError(t, DefaultOptions("").WithInMemory(true).validate())
+
+	t.Run("open", func(t *testing.T) {
+		opts := DefaultOptions("")
+		runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+			require.NoError(t, db.Update(func(txn *Transaction) error {
+				return txn.Set(0, []byte("key"), []byte("value"))
+			}))
+		})
+	})
+}
+
+// TestOpen_OptionErrors makes sure each misconfiguration is returned by Open as its own error, rather than an error
+// that only describes the problem in its message.
+func TestOpen_OptionErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir)
+	for _, test := range []struct {
+		name     string
+		opts     Options
+		expected error
+	}{
+		{"value log too small", opts.WithValueLogFileSize(1<<20 - 1), ErrValueLogSize},
+		{"value log too large", opts.WithValueLogFileSize(2<<30 + 1), ErrValueLogSize},
+		{"value log loading mode", opts.WithValueLogLoadingMode(options.LoadToRAM), ErrInvalidLoadingMode},
+		{"value threshold", opts.WithValueThreshold(maxValueThreshold + 1), ErrValueThreshold},
+		{"encryption key length", opts.WithEncryptionKey([]byte("too short")), ErrEncryptionKeyLength},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			db, err := Open(test.opts)
+			require.Nil(t, db)
+			require.Equal(t, test.expected, err)
+		})
+	}
+
+	// The key registry checks the length of the key on its own since it can be opened without a DB.
+	registry, err := OpenKeyRegistry(getRegistryTestOptions(dir, []byte("too short")))
+	require.Nil(t, registry)
+	require.Equal(t, ErrEncryptionKeyLength, err)
+}
+
+func TestOptions_Validate(t *testing.T) {
+	opts := DefaultOptions("/tmp/badger")
+
+	require.Error(t, opts.WithInMemory(true).validate())
+	require.Equal(t, ErrValueThreshold, opts.WithValueThreshold(maxValueThreshold+1).validate())
+	require.Equal(t, ErrValueLogSize, opts.WithValueLogFileSize(1<<20-1).validate())
+	require.Equal(t, ErrValueLogSize, opts.WithValueLogFileSize(2<<30+1).validate())
+	require.Equal(t, ErrInvalidLoadingMode, opts.WithValueLogLoadingMode(options.LoadToRAM).validate())
+
+	require.Error(t, opts.WithCompression(options.Snappy).validate())
+	require.Error(t, opts.WithCompression(options.CompressionType(99)).validate())
+
+	require.NoError(t, opts.WithBloomFalsePositive(0).validate())
+	require.Error(t, opts.WithBloomFalsePositive(-0.1).validate())
+	require.Error(t, opts.WithBloomFalsePositive(1).validate())
+
+	require.Error(t, opts.WithNumCompactors(0).validate())
+	require.NoError(t, opts.WithNumCompactors(0).WithReadOnly(true).validate())
+	require.Error(t, opts.WithNumCompactors(-1).validate())
+	require.NoError(t, opts.WithNumCompactionBuilds(0).validate())
+	require.Error(t, opts.WithNumCompactionBuilds(-1).validate())
+	require.NoError(t, opts.WithCompactionBytesPerSecond(0).validate())
+	require.Error(t, opts.WithCompactionBytesPerSecond(-1).validate())
+
+	require.NoError(t, opts.WithAdaptiveMaxTableSize(0).validate())
+	require.Error(t, opts.WithAdaptiveMaxTableSize(-1).validate())
+	require.Error(t, opts.WithAdaptiveRotationInterval(-time.Second).validate())
+
+	require.NoError(t, opts.WithMaxLevels(2).validate())
+	require.Error(t, opts.WithMaxLevels(1).validate())
+	require.Error(t, opts.WithMaxLevels(0).validate())
+
+	require.Error(t, opts.WithNumLevelZeroTables(10).WithNumLevelZeroTablesStall(10).validate())
+	require.Error(t, opts.WithNumLevelZeroTables(10).WithNumLevelZeroTablesStall(5).validate())
+	require.NoError(t, opts.WithNumLevelZeroTablesStall(0).validate())
+	require.Error(t, opts.WithNumLevelZeroTablesStall(-1).validate())
+
+	require.NoError(t, opts.WithLevelLoadingModes(options.LoadToRAM, options.MemoryMap, options.FileIO).validate())
+	require.Error(t, opts.WithMaxLevels(2).WithLevelLoadingModes(options.FileIO, options.FileIO, options.FileIO).validate())
+	require.Error(t, opts.WithLevelLoadingModes(options.FileLoadingMode(99)).validate())
+
+	require.NoError(t, opts.WithValueDirectories("/tmp/a", "/tmp/b").validate())
+	require.Error(t, opts.WithValueDirectories("/tmp/a", "").validate())
+	require.Error(t, opts.WithValueDirectories("/tmp/a", "/tmp/a").validate())
+	require.Error(t, DefaultOptions("").WithInMemory(true).WithValueDirectories("/tmp/a").validate())
+}
+
+func TestOpen_InvalidOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir)
+	for _, invalid := range []Options{
+		opts.WithNumCompactors(-1),
+		opts.WithNumCompactors(0),
+		opts.WithMaxLevels(1),
+		opts.WithNumLevelZeroTablesStall(opts.NumLevelZeroTables),
+		// A batch is limited to a fraction of the table size, so it would never fit a value at the threshold.
+		opts.WithMaxTableSize(1 << 12).WithValueThreshold(1 << 10),
+		opts.WithMaxTableSize(100),
+	} {
+		db, err := Open(invalid)
+		require.Error(t, err)
+		require.Nil(t, db)
+	}
+
+	// The directory should not have been locked by any of the failed attempts.
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
@@ -1,11 +1,16 @@
 package notbadger
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 
 	"github.com/elliotcourant/notbadger/z"
 )
 
+// commitsCleanupInterval is the number of commits between cleanups of the commits that can no longer cause a conflict.
+const commitsCleanupInterval = 1000
+
 type (
 	oracle struct {
 		// referenceCount used to see if there are still references to the oracle that are active.
@@ -35,9 +40,20 @@ type (
 		discardTimestamp uint64       // Used by ManagedDB.
 		readMark         *z.WaterMark // Used by DB.
 
-		// commits stores a key fingerprint and latest commit counter for it.
-		// refCount is used to clear out the commits map to avoid a memory blowup.
-		commits map[PartitionId]map[uint64]uint64
+		// commits stores the latest commit timestamp of every key fingerprint, for each partition so that the same key
+		// in different partitions never conflicts. Commits that can no longer cause a conflict are removed every
+		// commitsCleanupInterval commits by cleanupCommits, and the whole map is cleared once there are no update
+		// transactions left. trackedCommits is the number of fingerprints in the map.
+		commits        map[PartitionId]map[uint64]uint64
+		trackedCommits int
+
+		// commitsSinceCleanup is the number of commits since the last cleanup. cleanedUntil is the timestamp that
+		// commits have been removed up to, a transaction that reads below it can't be checked for conflicts.
+		commitsSinceCleanup int
+		cleanedUntil        uint64
+
+		// conflicts is the number of commits that were rejected because of a conflict.
+		conflicts uint64
 
 		// closer is used to stop watermarks.
 		closer *z.Closer
@@ -49,6 +65,9 @@ func newOracle(opts Options) *oracle {
 		isManaged: opts.managedTransactions,
 		commits:   map[PartitionId]map[uint64]uint64{},
 
+		// Timestamp 0 is never assigned to a commit so that the first read timestamp is 0.
+		nextTransactionTimestamp: 1,
+
 		readMark:        &z.WaterMark{Name: "notbadger.PendingReads"},
 		transactionMark: &z.WaterMark{Name: "notbadger.TransactionTimestamp"},
 		closer:          z.NewCloser(2),
@@ -60,6 +79,238 @@ func newOracle(opts Options) *oracle {
 	return orc
 }
 
+func (o *oracle) addReference() {
+	atomic.AddInt64(&o.referenceCount, 1)
+}
+
+func (o *oracle) decrementReference() {
+	if atomic.AddInt64(&o.referenceCount, -1) != 0 {
+		return
+	}
+
+	// Clear out the commits map to release memory.
+	o.Lock()
+	defer o.Unlock()
+
+	// Avoids the race where something new is added to the commits map after we check the reference count and before we
+	// take the lock.
+	if atomic.LoadInt64(&o.referenceCount) != 0 {
+		return
+	}
+
+	// If the map is still small then we can let it slide.
+	count := 0
+	for _, partitionCommits := range o.commits {
+		count += len(partitionCommits)
+	}
+
+	if count >= 1000 {
+		o.commits = map[PartitionId]map[uint64]uint64{}
+		o.trackedCommits = 0
+	}
+}
+
+// cleanupCommits removes the commits that can no longer cause a conflict. A commit only conflicts with transactions
+// that read before it, so once every transaction that is still open reads at or after a commit it can be removed.
+// This must be called while holding the lock.
+func (o *oracle) cleanupCommits() {
+	o.commitsSinceCleanup = 0
+
+	// Managed transactions don't use the read mark, versions at or below the discard timestamp can't be read anymore.
+	maxReadTimestamp := o.discardTimestamp
+	if !o.isManaged {
+		maxReadTimestamp = o.readMark.DoneUntil()
+	}
+
+	if maxReadTimestamp <= o.cleanedUntil {
+		return
+	}
+	o.cleanedUntil = maxReadTimestamp
+
+	for partitionId, partitionCommits := range o.commits {
+		for fingerprint, timestamp := range partitionCommits {
+			if timestamp <= maxReadTimestamp {
+				delete(partitionCommits, fingerprint)
+				o.trackedCommits--
+			}
+		}
+
+		if len(partitionCommits) == 0 {
+			delete(o.commits, partitionId)
+		}
+	}
+}
+
+// stats returns the number of commits that are tracked to detect conflicts and the number of commits that were
+// rejected because of a conflict.
+func (o *oracle) stats() (trackedCommits int, conflicts uint64) {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.trackedCommits, o.conflicts
+}
+
+// newReadTs returns the timestamp that a new transaction should read at. This is the timestamp of the most recent
+// commit. The read is tracked by the readMark so that versions that are still visible to this transaction will not be
+// discarded during compaction.
+func (o *oracle) newReadTs() uint64 {
+	if o.isManaged {
+		panic("read timestamp should not be retrieved for managed transactions")
+	}
+
+	o.Lock()
+	readTimestamp := o.nextTransactionTimestamp - 1
+	o.readMark.Begin(readTimestamp)
+	o.Unlock()
+
+	// Wait for all transactions which have no conflicts, have been assigned a commit timestamp and are going through
+	// the write to the value log and LSM tree process. Not waiting here could mean that some transactions which have
+	// been committed would not be read.
+	z.Check(o.transactionMark.WaitForMark(context.Background(), readTimestamp))
+
+	return readTimestamp
+}
+
+// hasConflict returns true if any of the keys that were read by the provided transaction have been committed by
+// another transaction after the transaction's read timestamp. This must be called while holding the lock.
+func (o *oracle) hasConflict(txn *Transaction) bool {
+	if len(txn.reads) == 0 {
+		return false
+	}
+
+	// The commits that this transaction could conflict with may have been removed, so it has to be treated as a
+	// conflict. Only transactions that read at an older timestamp with NewTransactionAt can read below it.
+	if txn.readTimestamp < o.cleanedUntil {
+		return true
+	}
+
+	for partitionId, reads := range txn.reads {
+		partitionCommits, ok := o.commits[partitionId]
+		if !ok {
+			continue
+		}
+
+		for _, fingerprint := range reads {
+			// A commit at the read timestamp is expected. But any commit after the read timestamp should cause a
+			// conflict.
+			if timestamp, has := partitionCommits[fingerprint]; has && timestamp > txn.readTimestamp {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// newCommitTs returns the timestamp that the provided transaction should be committed at. If the transaction conflicts
+// with another transaction that was committed after it started then conflict will be true and the transaction must not
+// be committed.
+func (o *oracle) newCommitTs(txn *Transaction) (timestamp uint64, conflict bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.hasConflict(txn) {
+		o.conflicts++
+		return 0, true
+	}
+
+	if !o.isManaged {
+		// This is the general case, when the user doesn't specify the read and commit timestamps.
+		timestamp = o.nextTransactionTimestamp
+		o.nextTransactionTimestamp++
+		o.transactionMark.Begin(timestamp)
+	} else {
+		// If commitTimestamp is set then the user is managing the timestamps. It has already been checked by
+		// checkCommitTs, so it is still greater than every commit before it.
+		timestamp = txn.commitTimestamp
+		o.nextTransactionTimestamp = timestamp + 1
+		o.transactionMark.Begin(timestamp)
+	}
+
+	for partitionId, writes := range txn.writes {
+		partitionCommits, ok := o.commits[partitionId]
+		if !ok {
+			partitionCommits = map[uint64]uint64{}
+			o.commits[partitionId] = partitionCommits
+		}
+
+		for _, fingerprint := range writes {
+			if _, ok := partitionCommits[fingerprint]; !ok {
+				o.trackedCommits++
+			}
+			partitionCommits[fingerprint] = timestamp // Update the commit timestamp.
+		}
+	}
+
+	o.commitsSinceCleanup++
+	if o.commitsSinceCleanup >= commitsCleanupInterval {
+		o.cleanupCommits()
+	}
+
+	return timestamp, false
+}
+
+// checkCommitTs returns ErrCommitTimestamp if the commit timestamp that the user provided for the managed transaction is
+// not greater than its read timestamp and the timestamp of every commit before it. The caller must hold the
+// writeChannelLock so that no other commit is given a timestamp before this one.
+func (o *oracle) checkCommitTs(txn *Transaction) error {
+	o.Lock()
+	defer o.Unlock()
+
+	if txn.commitTimestamp <= txn.readTimestamp || txn.commitTimestamp < o.nextTransactionTimestamp {
+		return ErrCommitTimestamp
+	}
+
+	return nil
+}
+
+// waitForCommits blocks until every commit at or below the provided read timestamp that has already been given a
+// timestamp has been written. This is used by managed transactions, which do not get their read timestamp from
+// newReadTs.
+func (o *oracle) waitForCommits(readTimestamp uint64) {
+	o.Lock()
+	lastCommit := o.nextTransactionTimestamp - 1
+	o.Unlock()
+
+	if readTimestamp > lastCommit {
+		readTimestamp = lastCommit
+	}
+
+	z.Check(o.transactionMark.WaitForMark(context.Background(), readTimestamp))
+}
+
+// setDiscardTimestamp sets the timestamp at or below which versions can be discarded for managed transactions.
+func (o *oracle) setDiscardTimestamp(timestamp uint64) {
+	o.Lock()
+	defer o.Unlock()
+	o.discardTimestamp = timestamp
+}
+
+// doneRead marks the read for the provided transaction as done. This is safe to call multiple times.
+func (o *oracle) doneRead(txn *Transaction) {
+	if !txn.doneRead {
+		txn.doneRead = true
+		o.readMark.Done(txn.readMarkTimestamp)
+	}
+}
+
+// doneCommit marks the provided commit timestamp as done once the transaction has been written.
+func (o *oracle) doneCommit(commitTimestamp uint64) {
+	o.transactionMark.Done(commitTimestamp)
+}
+
+// discardAtOrBelow returns the timestamp at or below which versions of keys can be discarded by compaction. No
+// transaction that is still open can read at or below this timestamp.
+func (o *oracle) discardAtOrBelow() uint64 {
+	if o.isManaged {
+		o.Lock()
+		defer o.Unlock()
+		return o.discardTimestamp
+	}
+
+	return o.readMark.DoneUntil()
+}
+
 func (o *oracle) nextTimestamp() uint64 {
 	o.Lock()
 	defer o.Unlock()
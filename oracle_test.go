@@ -0,0 +1,128 @@
+package notbadger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOracle_NewCommitTs(t *testing.T) {
+	orc := newOracle(DefaultOptions(""))
+
+	readTimestamp := orc.newReadTs()
+	require.Equal(t, uint64(0), readTimestamp)
+
+	txn := &Transaction{
+		readTimestamp: readTimestamp,
+		update:        true,
+		reads: map[PartitionId][]uint64{
+			0: {1, 2},
+		},
+		writes: map[PartitionId][]uint64{
+			0: {1},
+			1: {3},
+		},
+	}
+
+	commitTimestamp, conflict := orc.newCommitTs(txn)
+	require.False(t, conflict)
+	require.Equal(t, uint64(1), commitTimestamp)
+	require.Equal(t, uint64(1), orc.commits[0][1])
+	require.Equal(t, uint64(1), orc.commits[1][3])
+	orc.doneRead(txn)
+	orc.doneCommit(commitTimestamp)
+
+	// Timestamps must keep increasing for every commit.
+	next, conflict := orc.newCommitTs(&Transaction{readTimestamp: orc.newReadTs()})
+	require.False(t, conflict)
+	require.Equal(t, uint64(2), next)
+	require.Equal(t, uint64(3), orc.nextTimestamp())
+}
+
+func TestOracle_NewCommitTs_Conflict(t *testing.T) {
+	orc := newOracle(DefaultOptions(""))
+
+	first := &Transaction{
+		readTimestamp: orc.newReadTs(),
+		update:        true,
+		reads:         map[PartitionId][]uint64{0: {10}},
+		writes:        map[PartitionId][]uint64{0: {10}},
+	}
+	second := &Transaction{
+		readTimestamp: orc.newReadTs(),
+		update:        true,
+		reads:         map[PartitionId][]uint64{0: {10}},
+		writes:        map[PartitionId][]uint64{0: {10}},
+	}
+
+	// The first transaction commits the key that the second transaction read, so the second transaction must be
+	// rejected.
+	_, conflict := orc.newCommitTs(first)
+	require.False(t, conflict)
+
+	timestamp, conflict := orc.newCommitTs(second)
+	require.True(t, conflict)
+	require.Zero(t, timestamp)
+
+	// The same key in a different partition should not cause a conflict.
+	third := &Transaction{
+		readTimestamp: second.readTimestamp,
+		update:        true,
+		reads:         map[PartitionId][]uint64{1: {10}},
+	}
+	_, conflict = orc.newCommitTs(third)
+	require.False(t, conflict)
+}
+
+func TestOracle_CleanupCommits(t *testing.T) {
+	orc := newOracle(DefaultOptions(""))
+	begin := func(reads map[PartitionId][]uint64, writes map[PartitionId][]uint64) *Transaction {
+		txn := &Transaction{update: true, reads: reads, writes: writes}
+		txn.readTimestamp = orc.newReadTs()
+		txn.readMarkTimestamp = txn.readTimestamp
+		return txn
+	}
+
+	commit := func(fingerprint uint64) *Transaction {
+		txn := begin(nil, map[PartitionId][]uint64{1: {fingerprint}})
+		commitTimestamp, conflict := orc.newCommitTs(txn)
+		require.False(t, conflict)
+		orc.doneRead(txn)
+		orc.doneCommit(commitTimestamp)
+		return txn
+	}
+
+	// A transaction that is still open keeps every commit after its read timestamp from being removed. The read mark
+	// starts out done at timestamp 0, so the transaction reads after the first commit.
+	commit(0)
+	open := begin(map[PartitionId][]uint64{1: {1}}, nil)
+	var last *Transaction
+	for i := 1; i < commitsCleanupInterval; i++ {
+		last = commit(uint64(i))
+	}
+	trackedCommits, conflicts := orc.stats()
+	require.Equal(t, commitsCleanupInterval, trackedCommits)
+	require.Zero(t, conflicts)
+
+	_, conflict := orc.newCommitTs(open)
+	require.True(t, conflict)
+	orc.doneRead(open)
+
+	// Once every read is done the commits at or below the last read timestamp can't cause a conflict anymore.
+	require.NoError(t, orc.readMark.WaitForMark(context.Background(), last.readTimestamp))
+	orc.Lock()
+	orc.cleanupCommits()
+	orc.Unlock()
+	trackedCommits, conflicts = orc.stats()
+	require.Equal(t, 1, trackedCommits)
+	require.Equal(t, uint64(1), conflicts)
+
+	// A transaction that reads below the cleanup can't be checked, so it conflicts.
+	_, conflict = orc.newCommitTs(&Transaction{
+		readTimestamp: last.readTimestamp - 1,
+		update:        true,
+		reads:         map[PartitionId][]uint64{2: {42}},
+	})
+	require.True(t, conflict)
+}
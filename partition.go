@@ -1,5 +1,228 @@
 package notbadger
 
+import (
+	"bytes"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/elliotcourant/notbadger/pb"
+	"github.com/elliotcourant/notbadger/table"
+	"github.com/elliotcourant/notbadger/z"
+)
+
 type (
+	// PartitionId identifies a partition of the database. Every partition has its own memory tables and levels, keys
+	// in one partition are never visible in another. Partition 0 is the default partition, partitions are created
+	// automatically the first time they are written to.
 	PartitionId uint32
 )
+
+// validatePartitionId returns ErrInvalidPartitionId if the partition is greater than MaxPartitionId or is one of the
+// reserved partitions. The default partition is always valid.
+func (db *DB) validatePartitionId(partitionId PartitionId) error {
+	switch {
+	case partitionId == 0:
+		return nil
+	case partitionId > db.options.MaxPartitionId, partitionId > math.MaxUint32-db.options.ReservedPartitions:
+		return ErrInvalidPartitionId
+	default:
+		return nil
+	}
+}
+
+// DropPartitions removes every key of the provided partitions, along with their memory tables and levels. The
+// partitions are dropped together by the goroutine that writes commits, so a commit that was sent before the drop is
+// dropped with the partition and a commit that is sent after it creates the partition again. The drop is recorded in
+// the value log, so a drop that was interrupted by a crash is finished when the database is opened again. The default
+// partition can't be dropped.
+func (db *DB) DropPartitions(partitionIds ...PartitionId) error {
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	for _, partitionId := range partitionIds {
+		if partitionId == 0 {
+			return ErrInvalidRequest
+		}
+
+		if err := db.validatePartitionId(partitionId); err != nil {
+			return err
+		}
+	}
+
+	sorted := sortPartitionIds(partitionIds)
+	if len(sorted) == 0 {
+		return nil
+	}
+
+	// Holding the write channel lock keeps the version of the drop in order with the versions of the commits.
+	db.oracle.writeChannelLock.Lock()
+	defer db.oracle.writeChannelLock.Unlock()
+
+	version := db.oracle.nextTimestamp()
+	entries := make([]*Entry, len(sorted))
+	for i, partitionId := range sorted {
+		entries[i] = &Entry{
+			Key:         z.KeyWithTs(dropPartitionKey, version),
+			partitionId: partitionId,
+		}
+	}
+
+	req, err := db.sendToWriteChannel(entries, true)
+	if err != nil {
+		return err
+	}
+
+	return z.Wrapf(req.Wait(), "failed to drop partitions %v", sorted)
+}
+
+// sortPartitionIds returns a sorted copy of the partition Ids without any duplicates.
+func sortPartitionIds(partitionIds []PartitionId) []PartitionId {
+	sorted := append([]PartitionId{}, partitionIds...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	unique := sorted[:0]
+	for i, partitionId := range sorted {
+		if i == 0 || partitionId != sorted[i-1] {
+			unique = append(unique, partitionId)
+		}
+	}
+
+	return unique
+}
+
+// isDropPartitionEntry returns true if the entry records that its partition was dropped.
+func isDropPartitionEntry(e *Entry) bool {
+	return bytes.Equal(z.ParseKey(e.Key), dropPartitionKey)
+}
+
+// droppedPartitions returns the Ids of the partitions that are dropped by the provided entries.
+func droppedPartitions(entries []*Entry) []PartitionId {
+	var partitionIds []PartitionId
+	for _, e := range entries {
+		if isDropPartitionEntry(e) {
+			partitionIds = append(partitionIds, e.partitionId)
+		}
+	}
+
+	return partitionIds
+}
+
+// dropPartitions removes the memory tables and then the levels of the provided partitions. Flushes are stopped and the
+// memory tables of every partition are locked in ascending order, so the partitions are all removed at once. This must
+// only be called by the goroutine that writes commits, or while the value log is being replayed.
+func (db *DB) dropPartitions(partitionIds []PartitionId) error {
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+
+	db.partitionsWriteLock.Lock()
+	db.partitionsReadLock.Lock()
+	partitions, unlock := db.lockPartitions(partitionIds)
+	for partitionId, partition := range partitions {
+		partition.active.DecrementReferences()
+		for _, memoryTable := range partition.flushed {
+			memoryTable.DecrementReferences()
+		}
+
+		partition.active, partition.flushed = nil, nil
+		partition.activeHead, partition.flushedHeads = valuePointer{}, nil
+		partition.activeFirst, partition.flushedFirsts = valuePointer{}, nil
+		partition.dropped = true
+		delete(db.partitions, partitionId)
+	}
+	unlock()
+	db.partitionsReadLock.Unlock()
+	db.partitionsWriteLock.Unlock()
+	db.rangeDeletes.drop(partitionIds)
+
+	// The drop must be durable in the log before the tables are deleted, so that the rest of the drop happens again if
+	// the database crashes before every partition has been removed from the manifest.
+	if !db.options.InMemory {
+		if err := db.syncLog(); err != nil {
+			return err
+		}
+	}
+
+	return db.levelsController.dropPartitions(sortPartitionIds(partitionIds))
+}
+
+// dropPartitions removes the levels of the provided partitions and deletes their tables with a single change to the
+// manifest. The compactions of the partitions are waited for and then never released, so a compaction that looked up
+// one of the partitions before it was removed can't start.
+func (l *levelsController) dropPartitions(partitionIds []PartitionId) error {
+	var dropped []PartitionId
+	var changes []pb.ManifestChange
+	var tables []*table.Table
+	for _, partitionId := range partitionIds {
+		partition, ok := l.getPartition(partitionId)
+		if !ok {
+			continue
+		}
+
+		for !partition.compactionStatus.reserveAll() {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		dropped = append(dropped, partitionId)
+		for _, handler := range partition.levels {
+			handler.RLock()
+			for _, t := range handler.tables {
+				tables = append(tables, t)
+
+				// Level 0 tables that are kept in memory were never added to the manifest.
+				if !t.IsInMemory {
+					changes = append(changes, newDeleteChange(partitionId, t.FileId()))
+				}
+			}
+			handler.RUnlock()
+		}
+	}
+
+	release := func() {
+		for _, partitionId := range dropped {
+			partition, _ := l.getPartition(partitionId)
+			partition.compactionStatus.releaseAll()
+		}
+	}
+
+	if l.db.options.ReadOnly && len(changes) > 0 {
+		release()
+		return z.Wrapf(ErrInvalidRequest, "the tables of partitions %v can't be dropped in read only mode", dropped)
+	}
+
+	if len(changes) > 0 {
+		if err := l.db.manifest.addChanges(changes); err != nil {
+			release()
+			return z.Wrapf(err, "failed to write drop of partitions %v to manifest", dropped)
+		}
+	}
+
+	removed := make([]*partitionLevels, 0, len(dropped))
+	l.partitionsLock.Lock()
+	for _, partitionId := range dropped {
+		partition := l.partitions[partitionId]
+		partition.swapTables(make([][]*table.Table, len(partition.levels)))
+		l.droppedFileIds[partitionId] = atomic.LoadUint64(&partition.nextFileId)
+		delete(l.partitions, partitionId)
+		removed = append(removed, partition)
+	}
+	l.partitionsLock.Unlock()
+
+	var firstErr error
+	for _, partition := range removed {
+		if err := partition.releaseSummary(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// The files of the tables are deleted once the reads that are still using them are done.
+	if err := decrementReferences(tables); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
+}
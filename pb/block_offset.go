@@ -1,5 +1,10 @@
 package pb
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
 type (
 	BlockOffset struct {
 		Key    []byte
@@ -7,3 +12,60 @@ type (
 		Length uint32
 	}
 )
+
+// Size returns the number of bytes that the BlockOffset will consume once it has been marshalled.
+func (bo *BlockOffset) Size() int {
+	return 4 + // Length of the key (uint32 - 4 bytes)
+		len(bo.Key) +
+		4 + // Offset (uint32 - 4 bytes)
+		4 // Length (uint32 - 4 bytes)
+}
+
+// MarshalEx writes the block offset to the destination provided and returns the number of bytes written. The
+// destination must be at least Size() bytes.
+func (bo *BlockOffset) MarshalEx(dst []byte) int {
+	i := 0
+	binary.BigEndian.PutUint32(dst[i:i+4], uint32(len(bo.Key)))
+	i += 4
+
+	i += copy(dst[i:], bo.Key)
+
+	binary.BigEndian.PutUint32(dst[i:i+4], bo.Offset)
+	i += 4
+
+	binary.BigEndian.PutUint32(dst[i:i+4], bo.Length)
+	i += 4
+
+	return i
+}
+
+// Unmarshal decodes the block offset from the source bytes and returns the number of bytes that were read. The key
+// will reference the source bytes rather than being copied.
+func (bo *BlockOffset) Unmarshal(src []byte) (int, error) {
+	if len(src) < 4 {
+		return 0, fmt.Errorf("cannot unmarshal BlockOffset, buffer is too small. Got: %d", len(src))
+	}
+
+	i := 0
+	keyLength := int(binary.BigEndian.Uint32(src[i : i+4]))
+	i += 4
+
+	if len(src) < i+keyLength+8 {
+		return 0, fmt.Errorf(
+			"cannot unmarshal BlockOffset, source is too short. expected: %d got: %d",
+			i+keyLength+8,
+			len(src),
+		)
+	}
+
+	bo.Key = src[i : i+keyLength]
+	i += keyLength
+
+	bo.Offset = binary.BigEndian.Uint32(src[i : i+4])
+	i += 4
+
+	bo.Length = binary.BigEndian.Uint32(src[i : i+4])
+	i += 4
+
+	return i, nil
+}
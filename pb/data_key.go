@@ -2,6 +2,7 @@ package pb
 
 import (
 	"encoding/binary"
+	"fmt"
 	"github.com/elliotcourant/notbadger/z"
 )
 
@@ -50,3 +51,54 @@ func (d *DataKey) Marshall(encryptionKey []byte) ([]byte, error) {
 
 	return buf, err
 }
+
+// Unmarshall decodes the DataKey from the source bytes that were produced by Marshall. If an encryption key is provided
+// then the data of the key will be decrypted using the IV that was stored alongside it.
+func (d *DataKey) Unmarshall(src []byte, encryptionKey []byte) error {
+	// The smallest a data key can be is all of its fixed size fields with an empty data and IV segment.
+	if len(src) < 4+8+4+4+8 {
+		return fmt.Errorf("cannot unmarshal DataKey, buffer is too small. Got: %d", len(src))
+	}
+
+	i := uint32(0)
+	d.PartitionId = binary.BigEndian.Uint32(src[i : i+4])
+	i += 4
+
+	d.KeyId = binary.BigEndian.Uint64(src[i : i+8])
+	i += 8
+
+	dataSize := binary.BigEndian.Uint32(src[i : i+4])
+	i += 4
+
+	// Make sure that the data segment and the size of the IV fit within the source before we slice it.
+	if uint32(len(src)) < i+dataSize+4 {
+		return fmt.Errorf("cannot unmarshal DataKey, data segment of %d bytes exceeds buffer", dataSize)
+	}
+
+	data := make([]byte, dataSize)
+	copy(data, src[i:i+dataSize])
+	i += dataSize
+
+	ivSize := binary.BigEndian.Uint32(src[i : i+4])
+	i += 4
+
+	if uint32(len(src)) < i+ivSize+8 {
+		return fmt.Errorf("cannot unmarshal DataKey, IV segment of %d bytes exceeds buffer", ivSize)
+	}
+
+	d.Iv = make([]byte, ivSize)
+	copy(d.Iv, src[i:i+ivSize])
+	i += ivSize
+
+	d.CreatedAt = int64(binary.BigEndian.Uint64(src[i : i+8]))
+
+	// If there is no encryption key then the data was stored as plain text.
+	if len(encryptionKey) == 0 {
+		d.Data = data
+		return nil
+	}
+
+	var err error
+	d.Data, err = z.XORBlock(data, encryptionKey, d.Iv)
+	return err
+}
@@ -3,6 +3,10 @@ package pb
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"math"
+
+	"github.com/elliotcourant/notbadger/z"
 )
 
 const (
@@ -15,6 +19,14 @@ const (
 		8 + // KeyID (uint64 - 8 bytes)
 		1 + // EncryptionAlgorithm (uint8 - 1 byte)
 		1 // Compression (uint32 - 4 bytes)
+
+	// manifestChangeSetChecksumFlag is the first byte of change sets that have a 4 byte count and end with a checksum of
+	// their contents.
+	manifestChangeSetChecksumFlag = 0x80
+
+	// manifestChangeSetVarintFlag is the first byte of change sets that have a varint count and end with a checksum of
+	// their contents. Sets with fewer than 128 changes are 3 bytes smaller than with a 4 byte count.
+	manifestChangeSetVarintFlag = 0x81
 )
 
 type (
@@ -137,26 +149,47 @@ func (mc *ManifestChange) Unmarshal(src []byte) error {
 	return nil
 }
 
+// Marshal encodes the change set with a variable length count, which only takes a single byte for sets with fewer than
+// 128 changes.
 func (mcs *ManifestChangeSet) Marshal() []byte {
-	// A manifest change set requires a 4 byte prefix to indicate the number of changes that are being pushed in this
-	// set. This gives us a max of uint32 number of changes per set.
-	// TODO (elliotcourant) Find out if this could be reduced to a uint16 or if at all possible a uint8. This would
-	//  reduce the size on disk of change sets by a small margin but might pay off in read and write performance.
-	buf := make([]byte, 4+(ManifestChangeSize*len(mcs.Changes)))
+	return mcs.marshal(manifestChangeSetVarintFlag)
+}
+
+// marshal encodes the change set using the format indicated by the provided format flag. A manifest change set starts
+// with the format flag followed by the number of changes that are being pushed in this set, either as a 4 byte prefix
+// or as a varint. This gives us a max of uint32 number of changes per set. The changes are followed by a checksum of
+// everything before it so the set can be validated on its own.
+func (mcs *ManifestChangeSet) marshal(format byte) []byte {
+	var header [1 + binary.MaxVarintLen32]byte
+	header[0] = format
+	headerSize := 1 + 4
+	switch format {
+	case manifestChangeSetChecksumFlag:
+		binary.BigEndian.PutUint32(header[1:5], uint32(len(mcs.Changes)))
+	case manifestChangeSetVarintFlag:
+		headerSize = 1 + binary.PutUvarint(header[1:], uint64(len(mcs.Changes)))
+	default:
+		panic(fmt.Sprintf("unknown manifest change set format %x", format))
+	}
 
-	// Add the count prefix. Since changes are static in their size we can simply use a single integer to indicate how
-	// many records and how to read them.
-	binary.BigEndian.PutUint32(buf[0:4], uint32(len(mcs.Changes)))
+	// Since changes are static in their size the count alone tells us how many records there are and how to read them.
+	size := headerSize + (ManifestChangeSize * len(mcs.Changes))
+	buf := make([]byte, size+4)
+	copy(buf, header[:headerSize])
 
 	for i := 0; i < len(mcs.Changes); i++ {
 		// We don't need to worry about an error here. The only error that would be returned from the marshal would be
 		// the destination not being large enough. We've already guaranteed that it will be.
-		_ = mcs.Changes[i].MarshalEx(buf[4+(i*ManifestChangeSize):])
+		_ = mcs.Changes[i].MarshalEx(buf[headerSize+(i*ManifestChangeSize):])
 	}
 
+	binary.BigEndian.PutUint32(buf[size:], crc32.Checksum(buf[:size], z.CastagnoliCrcTable))
+
 	return buf
 }
 
+// Unmarshal decodes the change set from the source bytes. Change sets that were written with a checksum are validated
+// against it, change sets that were written before the checksum was added are still decoded without one.
 func (mcs *ManifestChangeSet) Unmarshal(src []byte) error {
 	// We need at least 4 bytes to grab the size of the set. It might be possible for the set to be 0. But we will also
 	// validate the size of the src once we know how many items should be present.
@@ -164,13 +197,32 @@ func (mcs *ManifestChangeSet) Unmarshal(src []byte) error {
 		return fmt.Errorf("invalid manifest change set source. must be at least 4 bytes")
 	}
 
-	count := binary.BigEndian.Uint32(src[0:4])
+	// Change sets without a format flag start with the 4 byte count, the first byte of the count would only match one of
+	// the flags if there were billions of changes in the set.
+	var count uint32
+	header, trailer := uint32(4), uint32(0)
+	switch src[0] {
+	case manifestChangeSetChecksumFlag:
+		header, trailer = 5, 4
+		if uint32(len(src)) < header+trailer {
+			return fmt.Errorf("invalid manifest change set source. must be at least %d bytes", header+trailer)
+		}
+		count = binary.BigEndian.Uint32(src[1:5])
+	case manifestChangeSetVarintFlag:
+		value, n := binary.Uvarint(src[1:])
+		if n <= 0 || value > math.MaxUint32 {
+			return fmt.Errorf("invalid manifest change set source. could not read the number of changes")
+		}
+		count, header, trailer = uint32(value), uint32(1+n), 4
+	default:
+		count = binary.BigEndian.Uint32(src[0:4])
+	}
 
-	expectedTotalSize := 4 + (ManifestChangeSize * count)
+	expectedTotalSize := uint64(header) + (ManifestChangeSize * uint64(count)) + uint64(trailer)
 
 	// Once we know the count we can assert how much space that many changes would actually take up, and thus we can
 	// assert whether or not we have enough data in our src to actually read that much.
-	if uint32(len(src)) < expectedTotalSize {
+	if uint64(len(src)) < expectedTotalSize {
 		return fmt.Errorf(
 			"cannot unmarshal manifest set, source is too short. expected: %d got: %d",
 			expectedTotalSize,
@@ -178,13 +230,26 @@ func (mcs *ManifestChangeSet) Unmarshal(src []byte) error {
 		)
 	}
 
+	if trailer > 0 {
+		size := expectedTotalSize - uint64(trailer)
+		expected := binary.BigEndian.Uint32(src[size:expectedTotalSize])
+		if actual := crc32.Checksum(src[:size], z.CastagnoliCrcTable); actual != expected {
+			return fmt.Errorf(
+				"cannot unmarshal manifest set, checksum mismatch for %d changes. expected: %d got: %d",
+				count,
+				expected,
+				actual,
+			)
+		}
+	}
+
 	// But if all the sizes meet the minimum then we can parse all of our changes.
 	mcs.Changes = make([]ManifestChange, count)
 
 	for i := uint32(0); i < count; i++ {
 		// We don't need to handle an error here, the only error that we could receive would be if the src was not large
 		// enough. But we've already guaranteed that it will be.
-		_ = mcs.Changes[i].Unmarshal(src[4+(i*ManifestChangeSize):])
+		_ = mcs.Changes[i].Unmarshal(src[header+(i*ManifestChangeSize):])
 	}
 
 	return nil
@@ -54,6 +54,67 @@ func TestManifestChangeSet_Marshal_Unmarshal(t *testing.T) {
 	assert.Equal(t, set, result)
 }
 
+func TestManifestChangeSet_Unmarshal_Corrupt(t *testing.T) {
+	set := ManifestChangeSet{
+		Changes: []ManifestChange{
+			{PartitionId: 1, TableId: 1, Operation: ManifestChangeCreate, Level: 0},
+			{PartitionId: 1, TableId: 2, Operation: ManifestChangeCreate, Level: 1},
+			{PartitionId: 1, TableId: 1, Operation: ManifestChangeDelete, Level: 0},
+		},
+	}
+	encoded := set.Marshal()
+
+	// Scramble the table Id of the middle change without changing the length of the set.
+	encoded[2+ManifestChangeSize+4] ^= 0xff
+
+	result := ManifestChangeSet{}
+	err := result.Unmarshal(encoded)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+}
+
+func TestManifestChangeSet_Unmarshal_Formats(t *testing.T) {
+	set := ManifestChangeSet{
+		Changes: make([]ManifestChange, 200),
+	}
+	for i := range set.Changes {
+		set.Changes[i] = ManifestChange{PartitionId: uint32(i), TableId: uint64(i), Level: uint8(i % 7)}
+	}
+
+	// Sets with a 4 byte count can still be read, and the varint count takes two bytes once there are 128 changes.
+	for format, headerSize := range map[byte]int{manifestChangeSetChecksumFlag: 5, manifestChangeSetVarintFlag: 3} {
+		encoded := set.marshal(format)
+		assert.Len(t, encoded, headerSize+(ManifestChangeSize*len(set.Changes))+4)
+
+		result := ManifestChangeSet{}
+		err := result.Unmarshal(encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, set, result)
+	}
+
+	// A varint that does not fit in the source should be reported instead of reading past it.
+	result := ManifestChangeSet{}
+	assert.Error(t, result.Unmarshal([]byte{manifestChangeSetVarintFlag, 0xff, 0xff, 0xff}))
+}
+
+func TestManifestChangeSet_Unmarshal_WithoutChecksum(t *testing.T) {
+	change := ManifestChange{
+		PartitionId: 12451,
+		TableId:     5324,
+		Operation:   ManifestChangeDelete,
+		Level:       3,
+		KeyID:       1858291421,
+	}
+
+	// Change sets written before the checksum was added only have the count followed by the changes.
+	encoded := append([]byte{0, 0, 0, 1}, change.Marshal()...)
+
+	result := ManifestChangeSet{}
+	err := result.Unmarshal(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, ManifestChangeSet{Changes: []ManifestChange{change}}, result)
+}
+
 // TODO (elliotcourant) Add comparison benchmark for protobuf marshal.
 func BenchmarkManifestChange_Marshal(b *testing.B) {
 	change := ManifestChange{
@@ -187,3 +248,46 @@ func BenchmarkManifestChangeSet_Unmarshal(b *testing.B) {
 		_ = result.Unmarshal(encoded)
 	}
 }
+
+// BenchmarkManifestChangeSet_Formats compares the size and throughput of small change sets with a 4 byte count and with
+// a varint count.
+func BenchmarkManifestChangeSet_Formats(b *testing.B) {
+	set := ManifestChangeSet{
+		Changes: []ManifestChange{
+			{
+				PartitionId: 12451,
+				TableId:     5324,
+				Operation:   ManifestChangeCreate,
+				Level:       0,
+				KeyID:       1858291421,
+			},
+		},
+	}
+
+	for _, format := range []struct {
+		name string
+		flag byte
+	}{
+		{name: "Fixed", flag: manifestChangeSetChecksumFlag},
+		{name: "Varint", flag: manifestChangeSetVarintFlag},
+	} {
+		encoded := set.marshal(format.flag)
+
+		b.Run(format.name+"/Marshal", func(b *testing.B) {
+			b.ReportAllocs()
+			b.ReportMetric(float64(len(encoded)), "bytes/set")
+			for i := 0; i < b.N; i++ {
+				set.marshal(format.flag)
+			}
+		})
+
+		b.Run(format.name+"/Unmarshal", func(b *testing.B) {
+			result := ManifestChangeSet{}
+			b.ReportAllocs()
+			b.ReportMetric(float64(len(encoded)), "bytes/set")
+			for i := 0; i < b.N; i++ {
+				_ = result.Unmarshal(encoded)
+			}
+		})
+	}
+}
@@ -1,9 +1,103 @@
 package pb
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
 type (
 	TableIndex struct {
 		Offsets       []BlockOffset
 		BloomFilter   []byte
 		EstimatedSize uint64
+		KeyCount      uint32
 	}
 )
+
+// Size returns the number of bytes that the TableIndex will consume once it has been marshalled.
+func (ti *TableIndex) Size() int {
+	size := 4 + // Number of offsets (uint32 - 4 bytes)
+		4 + len(ti.BloomFilter) + // Length of the bloom filter (uint32 - 4 bytes) followed by the filter itself
+		8 + // EstimatedSize (uint64 - 8 bytes)
+		4 // KeyCount (uint32 - 4 bytes)
+
+	for i := range ti.Offsets {
+		size += ti.Offsets[i].Size()
+	}
+
+	return size
+}
+
+// Marshal encodes the table index into a byte array. The offsets are written first, followed by the bloom filter, the
+// estimated size of the table and then the number of keys in the table.
+func (ti *TableIndex) Marshal() []byte {
+	buf := make([]byte, ti.Size())
+	i := 0
+
+	binary.BigEndian.PutUint32(buf[i:i+4], uint32(len(ti.Offsets)))
+	i += 4
+
+	for j := range ti.Offsets {
+		i += ti.Offsets[j].MarshalEx(buf[i:])
+	}
+
+	binary.BigEndian.PutUint32(buf[i:i+4], uint32(len(ti.BloomFilter)))
+	i += 4
+
+	i += copy(buf[i:], ti.BloomFilter)
+
+	binary.BigEndian.PutUint64(buf[i:i+8], ti.EstimatedSize)
+	i += 8
+
+	binary.BigEndian.PutUint32(buf[i:i+4], ti.KeyCount)
+
+	return buf
+}
+
+// Unmarshal decodes the table index from the source bytes. The offset keys and the bloom filter will reference the
+// source bytes rather than being copied.
+func (ti *TableIndex) Unmarshal(src []byte) error {
+	if len(src) < 4 {
+		return fmt.Errorf("cannot unmarshal TableIndex, buffer is too small. Got: %d", len(src))
+	}
+
+	*ti = TableIndex{}
+	i := 0
+
+	count := binary.BigEndian.Uint32(src[i : i+4])
+	i += 4
+
+	ti.Offsets = make([]BlockOffset, count)
+	for j := range ti.Offsets {
+		n, err := ti.Offsets[j].Unmarshal(src[i:])
+		if err != nil {
+			return err
+		}
+		i += n
+	}
+
+	if len(src) < i+4 {
+		return fmt.Errorf("cannot unmarshal TableIndex, missing bloom filter length")
+	}
+
+	bloomLength := int(binary.BigEndian.Uint32(src[i : i+4]))
+	i += 4
+
+	if len(src) < i+bloomLength+12 {
+		return fmt.Errorf(
+			"cannot unmarshal TableIndex, source is too short. expected: %d got: %d",
+			i+bloomLength+12,
+			len(src),
+		)
+	}
+
+	ti.BloomFilter = src[i : i+bloomLength]
+	i += bloomLength
+
+	ti.EstimatedSize = binary.BigEndian.Uint64(src[i : i+8])
+	i += 8
+
+	ti.KeyCount = binary.BigEndian.Uint32(src[i : i+4])
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package pb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTableIndex_Marshal_Unmarshal(t *testing.T) {
+	index := TableIndex{
+		Offsets: []BlockOffset{
+			{
+				Key:    []byte("first key"),
+				Offset: 0,
+				Length: 4096,
+			},
+			{
+				Key:    []byte("second key"),
+				Offset: 4096,
+				Length: 3021,
+			},
+		},
+		BloomFilter:   []byte{1, 2, 3, 4, 5, 6},
+		EstimatedSize: 7117,
+		KeyCount:      312,
+	}
+	encoded := index.Marshal()
+	assert.Len(t, encoded, index.Size())
+
+	result := TableIndex{}
+	err := result.Unmarshal(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, index, result)
+
+	// A truncated index should return an error rather than panicking.
+	err = result.Unmarshal(encoded[:len(encoded)-3])
+	assert.Error(t, err)
+}
@@ -0,0 +1,253 @@
+package notbadger
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/elliotcourant/notbadger/z"
+)
+
+const (
+	// publishChannelCapacity is the number of batches of written requests that can be queued for the publisher before
+	// the writes block.
+	publishChannelCapacity = 1000
+
+	// subscriberChannelCapacity is the number of batches of entries that can be queued for a subscriber before the
+	// publisher blocks.
+	subscriberChannelCapacity = 1000
+)
+
+type (
+	// publisher delivers the entries of every write to the subscribers whose prefixes match the entry's key.
+	publisher struct {
+		sync.Mutex
+		publishChannel chan []*request
+		subscribers    map[uint64]subscriber
+		nextId         uint64
+	}
+
+	subscriber struct {
+		prefixes    [][]byte
+		sendChannel chan<- []*Entry
+
+		// closer is signalled when the database is closed, ctx is done when the subscriber stops on its own.
+		closer *z.Closer
+		ctx    context.Context
+	}
+)
+
+func newPublisher() *publisher {
+	return &publisher{
+		publishChannel: make(chan []*request, publishChannelCapacity),
+		subscribers:    make(map[uint64]subscriber),
+	}
+}
+
+// listenForUpdates publishes the written requests to the subscribers until the closer is signalled. Every subscriber
+// is closed once it stops.
+func (p *publisher) listenForUpdates(closer *z.Closer) {
+	defer func() {
+		p.cleanSubscribers()
+		closer.Done()
+	}()
+
+	// Drain everything that is queued so the subscribers receive fewer, larger batches.
+	slurp := func(batch []*request) {
+		for {
+			select {
+			case requests := <-p.publishChannel:
+				batch = append(batch, requests...)
+			default:
+				p.publishUpdates(batch)
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-closer.HasBeenClosed():
+			// Publish whatever was written before the database was closed.
+			slurp(nil)
+			return
+		case requests := <-p.publishChannel:
+			slurp(requests)
+		}
+	}
+}
+
+// publishUpdates sends every entry in the requests to the subscribers with a matching prefix. Entries are sent in the
+// order they were written.
+func (p *publisher) publishUpdates(requests []*request) {
+	p.Lock()
+	defer p.Unlock()
+
+	batches := make(map[uint64][]*Entry)
+	for _, req := range requests {
+		for _, e := range req.Entries {
+			// The transaction marker and the internal keys are not user data.
+			if e.meta&bitFinTxn != 0 {
+				continue
+			}
+
+			key := z.ParseKey(e.Key)
+			if isInternalKey(key) {
+				continue
+			}
+
+			var published *Entry
+			for id, s := range p.subscribers {
+				if !s.matches(key) {
+					continue
+				}
+
+				if published == nil {
+					published = &Entry{
+						Key:         key,
+						Value:       e.Value,
+						UserMeta:    e.UserMeta,
+						ExpiresAt:   e.ExpiresAt,
+						meta:        e.meta,
+						partitionId: e.partitionId,
+						version:     z.ParseTs(e.Key),
+					}
+				}
+				batches[id] = append(batches[id], published)
+			}
+		}
+	}
+
+	for id, entries := range batches {
+		s := p.subscribers[id]
+		select {
+		case s.sendChannel <- entries:
+		case <-s.closer.HasBeenClosed():
+		case <-s.ctx.Done():
+		}
+	}
+}
+
+// newSubscriber registers a subscriber for the provided prefixes. The returned channel receives the matching entries.
+func (p *publisher) newSubscriber(
+	ctx context.Context,
+	closer *z.Closer,
+	prefixes [][]byte,
+) (<-chan []*Entry, uint64) {
+	p.Lock()
+	defer p.Unlock()
+
+	channel := make(chan []*Entry, subscriberChannelCapacity)
+	id := p.nextId
+	p.nextId++
+
+	p.subscribers[id] = subscriber{
+		prefixes:    prefixes,
+		sendChannel: channel,
+		closer:      closer,
+		ctx:         ctx,
+	}
+
+	return channel, id
+}
+
+// cleanSubscribers stops all the subscribers. Ideally, it should be called while closing the database.
+func (p *publisher) cleanSubscribers() {
+	p.Lock()
+	defer p.Unlock()
+
+	for id, s := range p.subscribers {
+		delete(p.subscribers, id)
+		s.closer.SignalAndWait()
+	}
+}
+
+// deleteSubscriber removes the subscriber so it no longer receives entries.
+func (p *publisher) deleteSubscriber(id uint64) {
+	p.Lock()
+	defer p.Unlock()
+
+	delete(p.subscribers, id)
+}
+
+// sendUpdates queues the written requests to be published if there are any subscribers.
+func (p *publisher) sendUpdates(requests []*request) {
+	if p.numberOfSubscribers() != 0 {
+		p.publishChannel <- requests
+	}
+}
+
+func (p *publisher) numberOfSubscribers() int {
+	p.Lock()
+	defer p.Unlock()
+
+	return len(p.subscribers)
+}
+
+func (s subscriber) matches(key []byte) bool {
+	for _, prefix := range s.prefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Subscribe calls the callback with the entries of every committed write whose key starts with one of the prefixes.
+// The prefixes are matched against the keys of every partition, Entry.PartitionId can be used to tell them apart.
+// Entries are delivered in the order they were committed, and may be batched together.
+//
+// Subscribe blocks until the context is cancelled, the database is closed or the callback returns an error. The error
+// from the callback or the context is returned.
+func (db *DB) Subscribe(ctx context.Context, cb func(kv []*Entry) error, prefixes [][]byte) error {
+	switch {
+	case cb == nil:
+		return ErrNilCallback
+	case len(prefixes) == 0:
+		return ErrNoPrefixes
+	}
+
+	// The context is cancelled when the callback fails, so the publisher stops waiting to send to this subscriber.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	closer := z.NewCloser(1)
+	receiveChannel, id := db.publisher.newSubscriber(ctx, closer, prefixes)
+
+	// Drain everything that is queued so the callback receives fewer, larger batches.
+	slurp := func(batch []*Entry) error {
+		for {
+			select {
+			case entries := <-receiveChannel:
+				batch = append(batch, entries...)
+			default:
+				if len(batch) > 0 {
+					return cb(batch)
+				}
+				return nil
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-closer.HasBeenClosed():
+			// The subscriber was removed when the database was closed, deliver what was published before then.
+			err := slurp(nil)
+			closer.Done()
+			return err
+		case <-ctx.Done():
+			closer.Done()
+			db.publisher.deleteSubscriber(id)
+			return ctx.Err()
+		case batch := <-receiveChannel:
+			if err := slurp(batch); err != nil {
+				cancel()
+				closer.Done()
+				db.publisher.deleteSubscriber(id)
+				return err
+			}
+		}
+	}
+}
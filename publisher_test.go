@@ -0,0 +1,106 @@
+package notbadger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// waitForSubscribers blocks until the provided number of subscribers have been registered with the database.
+func waitForSubscribers(t *testing.T, db *DB, count int) {
+	for i := 0; i < 1000 && db.publisher.numberOfSubscribers() != count; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, count, db.publisher.numberOfSubscribers())
+}
+
+func TestDB_Subscribe(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.Equal(t, ErrNilCallback, db.Subscribe(context.Background(), nil, [][]byte{[]byte("a")}))
+		require.Equal(t, ErrNoPrefixes, db.Subscribe(context.Background(), func([]*Entry) error {
+			return nil
+		}, nil))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		received := make(chan string, 10)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.Subscribe(ctx, func(entries []*Entry) error {
+				for _, e := range entries {
+					received <- fmt.Sprintf("%d:%s=%s deleted=%v", e.PartitionId(), e.Key, e.Value, e.IsDeleted())
+				}
+				return nil
+			}, [][]byte{[]byte("a"), []byte("c")})
+			require.Equal(t, context.Canceled, err)
+		}()
+		waitForSubscribers(t, db, 1)
+
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			require.NoError(t, txn.Set(0, []byte("a1"), []byte("one")))
+			require.NoError(t, txn.Set(0, []byte("b1"), []byte("two")))
+			return txn.Set(1, []byte("c1"), []byte("three"))
+		}))
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Delete(0, []byte("a1"))
+		}))
+
+		// Entries within a transaction are not ordered, but the transactions are delivered in the order they were
+		// committed.
+		first := []string{<-received, <-received}
+		require.ElementsMatch(t, []string{"0:a1=one deleted=false", "1:c1=three deleted=false"}, first)
+		require.Equal(t, "0:a1= deleted=true", <-received)
+
+		cancel()
+		wg.Wait()
+		require.Equal(t, 0, db.publisher.numberOfSubscribers())
+		require.Empty(t, received)
+	})
+}
+
+func TestDB_Subscribe_CallbackError(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		callbackErr := errors.New("callback failed")
+		result := make(chan error, 1)
+		go func() {
+			result <- db.Subscribe(context.Background(), func(entries []*Entry) error {
+				return callbackErr
+			}, [][]byte{[]byte("key")})
+		}()
+		waitForSubscribers(t, db, 1)
+
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(0, []byte("key"), []byte("value"))
+		}))
+		require.Equal(t, callbackErr, <-result)
+		require.Equal(t, 0, db.publisher.numberOfSubscribers())
+	})
+}
+
+func TestDB_Subscribe_Close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+
+	// Closing the database should stop the subscriber without an error.
+	result := make(chan error, 1)
+	go func() {
+		result <- db.Subscribe(context.Background(), func(entries []*Entry) error {
+			return nil
+		}, [][]byte{[]byte("key")})
+	}()
+	waitForSubscribers(t, db, 1)
+
+	require.NoError(t, db.Close())
+	require.NoError(t, <-result)
+}
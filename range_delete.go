@@ -0,0 +1,285 @@
+package notbadger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"github.com/elliotcourant/notbadger/table"
+	"github.com/elliotcourant/notbadger/z"
+)
+
+type (
+	// rangeDelete deletes every key of a partition in [start, end) that has a version below the version of the range
+	// delete.
+	rangeDelete struct {
+		start   []byte
+		end     []byte
+		version uint64
+	}
+
+	// rangeDeletes are the range deletes of every partition. Every range delete that is in the memory tables or the
+	// levels of a partition is kept here, so reads don't have to look for them. The slice of a partition is replaced
+	// rather than changed, so a slice that was returned by get can be read without the lock.
+	rangeDeletes struct {
+		lock       sync.RWMutex
+		partitions map[PartitionId][]rangeDelete
+	}
+)
+
+// DeleteRange deletes every key in the provided partition that is greater than or equal to start and less than end.
+// The range delete is committed like a transaction, reads at or after its commit timestamp do not see any version of
+// the keys in the range that was written before it, while keys that are written after it are not affected. The range
+// delete does not conflict with transactions that read keys in the range.
+//
+// Compactions discard the versions of the keys that were deleted, and the range delete itself is discarded once none
+// of those versions are left. A partition can't be split across a range delete until it has been discarded.
+func (db *DB) DeleteRange(partitionId PartitionId, start, end []byte) error {
+	return db.Update(func(txn *Transaction) error {
+		return txn.deleteRange(partitionId, start, end)
+	})
+}
+
+// deleteRange adds the range delete of [start, end) to the pending writes of the transaction. The range delete is
+// written under an internal key that holds both bounds, so range deletes with different bounds are never treated as
+// versions of the same key. The value is the end of the range.
+func (txn *Transaction) deleteRange(partitionId PartitionId, start, end []byte) error {
+	if len(end) == 0 || bytes.Compare(start, end) >= 0 {
+		return ErrInvalidRequest
+	}
+
+	return txn.modifyInternal(partitionId, &Entry{
+		Key:   rangeDeleteEntryKey(start, end),
+		Value: end,
+		meta:  bitRangeDelete,
+	})
+}
+
+// rangeDeleteEntryKey returns the internal key of a range delete, the prefix followed by the length of the start, the
+// start and the end.
+func rangeDeleteEntryKey(start, end []byte) []byte {
+	key := make([]byte, len(rangeDeleteKey)+2+len(start)+len(end))
+	n := copy(key, rangeDeleteKey)
+	binary.BigEndian.PutUint16(key[n:], uint16(len(start)))
+	n += 2
+	n += copy(key[n:], start)
+	copy(key[n:], end)
+
+	return key
+}
+
+// parseRangeDelete returns the range delete for the provided key with a version and value, or false if the key isn't
+// the key of a range delete.
+func parseRangeDelete(key []byte, value z.ValueStruct) (rangeDelete, bool) {
+	userKey := z.ParseKey(key)
+	if value.Meta&bitRangeDelete == 0 || !bytes.HasPrefix(userKey, rangeDeleteKey) {
+		return rangeDelete{}, false
+	}
+
+	rest := userKey[len(rangeDeleteKey):]
+	if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+		return rangeDelete{}, false
+	}
+
+	return rangeDelete{
+		start:   z.Copy(rest[2 : 2+int(binary.BigEndian.Uint16(rest))]),
+		end:     z.Copy(value.Value),
+		version: z.ParseTs(key),
+	}, true
+}
+
+// covers returns true if the range delete deletes the version of the key.
+func (r rangeDelete) covers(key []byte, version uint64) bool {
+	return version < r.version && bytes.Compare(key, r.start) >= 0 && bytes.Compare(key, r.end) < 0
+}
+
+// overlaps returns true if the table could have keys in the range.
+func (r rangeDelete) overlaps(t *table.Table) bool {
+	return bytes.Compare(z.ParseKey(t.Smallest()), r.end) < 0 && bytes.Compare(z.ParseKey(t.Largest()), r.start) >= 0
+}
+
+// add adds the range delete to the partition, unless it is already there.
+func (r *rangeDeletes) add(partitionId PartitionId, added rangeDelete) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	current := r.partitions[partitionId]
+	for _, existing := range current {
+		if existing.version == added.version &&
+			bytes.Equal(existing.start, added.start) &&
+			bytes.Equal(existing.end, added.end) {
+			return
+		}
+	}
+
+	if r.partitions == nil {
+		r.partitions = map[PartitionId][]rangeDelete{}
+	}
+
+	updated := make([]rangeDelete, len(current), len(current)+1)
+	copy(updated, current)
+	r.partitions[partitionId] = append(updated, added)
+}
+
+// remove removes the range delete from the partition, along with the older range deletes of the same range.
+func (r *rangeDeletes) remove(partitionId PartitionId, removed rangeDelete) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	current := r.partitions[partitionId]
+	updated := make([]rangeDelete, 0, len(current))
+	for _, existing := range current {
+		if existing.version <= removed.version &&
+			bytes.Equal(existing.start, removed.start) &&
+			bytes.Equal(existing.end, removed.end) {
+			continue
+		}
+		updated = append(updated, existing)
+	}
+
+	if len(updated) == 0 {
+		delete(r.partitions, partitionId)
+		return
+	}
+	r.partitions[partitionId] = updated
+}
+
+// drop removes every range delete of the provided partitions.
+func (r *rangeDeletes) drop(partitionIds []PartitionId) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, partitionId := range partitionIds {
+		delete(r.partitions, partitionId)
+	}
+}
+
+// get returns the range deletes of the partition with a version at or below the provided timestamp. These are the
+// range deletes that are visible to a read at that timestamp.
+func (r *rangeDeletes) get(partitionId PartitionId, timestamp uint64) []rangeDelete {
+	r.lock.RLock()
+	current := r.partitions[partitionId]
+	r.lock.RUnlock()
+
+	var visible []rangeDelete
+	for _, rangeDelete := range current {
+		if rangeDelete.version <= timestamp {
+			visible = append(visible, rangeDelete)
+		}
+	}
+
+	return visible
+}
+
+// isRangeDeleted returns true if any of the range deletes deletes the version of the key. Internal keys are never
+// deleted by a range delete.
+func isRangeDeleted(rangeDeletes []rangeDelete, key []byte, version uint64) bool {
+	if len(rangeDeletes) == 0 || isInternalKey(key) {
+		return false
+	}
+
+	for _, rangeDelete := range rangeDeletes {
+		if rangeDelete.covers(key, version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// collapsedBy returns the range delete that collapses the provided range delete, which is the range delete of the same
+// range with the same or a newer version.
+func collapsedBy(collapsible []rangeDelete, deleted rangeDelete) (rangeDelete, bool) {
+	for _, candidate := range collapsible {
+		if candidate.version >= deleted.version &&
+			bytes.Equal(candidate.start, deleted.start) &&
+			bytes.Equal(candidate.end, deleted.end) {
+			return candidate, true
+		}
+	}
+
+	return deleted, false
+}
+
+// loadRangeDeletes finds the range deletes in the levels of every partition. This must be done before compactions are
+// started, the range deletes in the memory tables are added when they are replayed.
+func (db *DB) loadRangeDeletes() error {
+	for _, partitionId := range db.levelsController.partitionIds() {
+		iterators := db.levelsController.appendIterators(partitionId, nil, false, ReadOptions{NoCache: true})
+		iterator := z.NewMergeIterator(iterators, false)
+		for iterator.Seek(z.KeyWithTs(rangeDeleteKey, math.MaxUint64)); iterator.Valid(); iterator.Next() {
+			if !bytes.HasPrefix(z.ParseKey(iterator.Key()), rangeDeleteKey) {
+				break
+			}
+
+			if rangeDelete, ok := parseRangeDelete(iterator.Key(), iterator.Value()); ok {
+				db.rangeDeletes.add(partitionId, rangeDelete)
+			}
+		}
+		if err := iterator.Err(); err != nil {
+			_ = iterator.Close()
+			return z.Wrapf(err, "failed to load range deletes of partition %d", partitionId)
+		}
+		if err := iterator.Close(); err != nil {
+			return z.Wrapf(err, "failed to load range deletes of partition %d", partitionId)
+		}
+	}
+
+	return nil
+}
+
+// collapsibleRangeDeletes returns the range deletes that can be discarded by the compaction. Every version that a
+// range delete deletes is discarded by a compaction once the range delete is at or below the discard timestamp, so
+// the range delete itself can be discarded by a compaction that includes every table that could have keys in its
+// range. Every level is locked while the tables are checked, since tables are added to the next level of a compaction
+// before they are removed from the level above it.
+func (l *levelsController) collapsibleRangeDeletes(cd *compactDef, rangeDeletes []rangeDelete) []rangeDelete {
+	if len(rangeDeletes) == 0 {
+		return nil
+	}
+
+	partition, ok := l.getPartition(cd.partitionId)
+	if !ok {
+		return nil
+	}
+
+	compacted := map[*table.Table]struct{}{}
+	for _, t := range cd.top {
+		compacted[t] = struct{}{}
+	}
+	for _, t := range cd.bot {
+		compacted[t] = struct{}{}
+	}
+
+	for _, handler := range partition.levels {
+		handler.RLock()
+	}
+	defer func() {
+		for i := len(partition.levels) - 1; i >= 0; i-- {
+			partition.levels[i].RUnlock()
+		}
+	}()
+
+	var collapsible []rangeDelete
+	for _, rangeDelete := range rangeDeletes {
+		overlaps := false
+		for _, handler := range partition.levels {
+			for _, t := range handler.tables {
+				if _, ok := compacted[t]; !ok && rangeDelete.overlaps(t) {
+					overlaps = true
+					break
+				}
+			}
+			if overlaps {
+				break
+			}
+		}
+
+		if !overlaps {
+			collapsible = append(collapsible, rangeDelete)
+		}
+	}
+
+	return collapsible
+}
@@ -0,0 +1,129 @@
+package notbadger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_DeleteRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// Level 0 tables are written to disk so the range delete is found in them when the database is opened again.
+	opts := getTestOptions(dir).WithKeepL0InMemory(false).WithCompactL0OnClose(false)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	const partitionId PartitionId = 1
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		for _, key := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+			if err := txn.Set(partitionId, []byte(key), []byte("old-"+key)); err != nil {
+				return err
+			}
+		}
+
+		// Keys in other partitions are not deleted.
+		return txn.Set(0, []byte("d"), []byte("old-d"))
+	}))
+
+	snapshot := db.NewTransaction(false)
+	require.NoError(t, db.DeleteRange(partitionId, []byte("c"), []byte("f")))
+	require.Equal(t, ErrInvalidRequest, db.DeleteRange(partitionId, []byte("f"), []byte("c")))
+
+	// Keys written after the range delete are not deleted by it.
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		return txn.Set(partitionId, []byte("d"), []byte("new-d"))
+	}))
+
+	check := func(db *DB) {
+		expected := map[string]string{"a": "old-a", "b": "old-b", "d": "new-d", "f": "old-f", "g": "old-g"}
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			for _, key := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+				item, err := txn.Get(partitionId, []byte(key))
+				value, ok := expected[key]
+				if !ok {
+					require.Equal(t, ErrKeyNotFound, err, "key %s", key)
+					continue
+				}
+				require.NoError(t, err, "key %s", key)
+				actual, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, value, string(actual))
+			}
+
+			item, err := txn.Get(0, []byte("d"))
+			require.NoError(t, err)
+			value, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, "old-d", string(value))
+
+			for _, options := range []IteratorOptions{
+				DefaultIteratorOptions,
+				{Reverse: true},
+				{AllVersions: true},
+			} {
+				iterator := txn.NewIterator(partitionId, options)
+				var keys []string
+				for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+					keys = append(keys, string(iterator.Item().Key()))
+				}
+				iterator.Close()
+
+				if options.Reverse {
+					require.Equal(t, []string{"g", "f", "d", "b", "a"}, keys)
+				} else {
+					require.Equal(t, []string{"a", "b", "d", "f", "g"}, keys)
+				}
+			}
+
+			return nil
+		}))
+	}
+	check(db)
+
+	// Reads before the range delete still see the keys in the range.
+	item, err := snapshot.Get(partitionId, []byte("c"))
+	require.NoError(t, err)
+	value, err := item.ValueCopy(nil)
+	require.NoError(t, err)
+	require.Equal(t, "old-c", string(value))
+	snapshot.Discard()
+
+	// A partition can't be split across the range delete.
+	require.Equal(t, ErrInvalidRequest, db.SplitPartition(partitionId, []byte("d"), 2))
+
+	require.NoError(t, db.Flush(partitionId))
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.Len(t, db.rangeDeletes.get(partitionId, math.MaxUint64), 1)
+	check(db)
+
+	// Every table of the partition is compacted together, so the range delete is discarded along with the versions
+	// it deleted.
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		return nil
+	}))
+	require.NoError(t, db.levelsController.compactLevel0())
+	require.Empty(t, db.rangeDeletes.get(partitionId, math.MaxUint64))
+	check(db)
+
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		iterator := txn.NewIterator(partitionId, IteratorOptions{AllVersions: true, InternalAccess: true})
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			item := iterator.Item()
+			require.False(t, bytes.HasPrefix(item.Key(), rangeDeleteKey))
+			require.NotContains(t, []string{"c", "e"}, string(item.Key()))
+		}
+		return nil
+	}))
+
+	require.NoError(t, db.Close())
+}
@@ -0,0 +1,134 @@
+package notbadger
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+type (
+	// Sequence hands out monotonically increasing integers that are stored under a key in the database. Integers are
+	// leased from the database in bulk, so at most bandwidth integers are lost if the database crashes before the
+	// sequence is released.
+	Sequence struct {
+		sync.Mutex
+		db          *DB
+		partitionId PartitionId
+		key         []byte
+		next        uint64
+		leased      uint64
+		bandwidth   uint64
+	}
+)
+
+// GetSequence returns a Sequence that stores its high-water mark under the provided key in the provided partition.
+// Every time the sequence runs out of leased integers, another bandwidth integers are leased by writing the new
+// high-water mark back to the key. The key must only be used by one sequence at a time.
+func (db *DB) GetSequence(partitionId PartitionId, key []byte, bandwidth uint64) (*Sequence, error) {
+	if db.options.managedTransactions {
+		panic("Cannot use GetSequence with managedDB=true.")
+	}
+
+	switch {
+	case len(key) == 0:
+		return nil, ErrEmptyKey
+	case bandwidth == 0:
+		return nil, ErrZeroBandwidth
+	}
+
+	seq := &Sequence{
+		db:          db,
+		partitionId: partitionId,
+		key:         key,
+		bandwidth:   bandwidth,
+	}
+	if err := seq.updateLease(); err != nil {
+		return nil, err
+	}
+
+	return seq, nil
+}
+
+// Next returns the next integer in the sequence, leasing more integers from the database if needed.
+func (seq *Sequence) Next() (uint64, error) {
+	seq.Lock()
+	defer seq.Unlock()
+
+	if seq.next >= seq.leased {
+		if err := seq.updateLease(); err != nil {
+			return 0, err
+		}
+	}
+
+	value := seq.next
+	seq.next++
+
+	return value, nil
+}
+
+// Release writes the next unused integer back to the database, so the integers that were leased but never handed out
+// are not lost. The sequence must not be used after it has been released.
+func (seq *Sequence) Release() error {
+	seq.Lock()
+	defer seq.Unlock()
+
+	err := seq.db.Update(func(txn *Transaction) error {
+		item, err := txn.Get(seq.partitionId, seq.key)
+		if err != nil {
+			return err
+		}
+
+		var leased uint64
+		if err := item.Value(func(value []byte) error {
+			leased = binary.BigEndian.Uint64(value)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		// Another sequence has leased integers since this one did, it is not safe to hand them back.
+		if leased != seq.leased {
+			return ErrConflict
+		}
+
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], seq.next)
+		return txn.Set(seq.partitionId, seq.key, buf[:])
+	})
+	if err != nil {
+		return err
+	}
+
+	seq.leased = seq.next
+
+	return nil
+}
+
+// updateLease reads the current high-water mark from the database and leases the next bandwidth integers.
+func (seq *Sequence) updateLease() error {
+	return seq.db.Update(func(txn *Transaction) error {
+		item, err := txn.Get(seq.partitionId, seq.key)
+		switch {
+		case err == ErrKeyNotFound:
+			seq.next = 0
+		case err != nil:
+			return err
+		default:
+			if err := item.Value(func(value []byte) error {
+				seq.next = binary.BigEndian.Uint64(value)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		leased := seq.next + seq.bandwidth
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], leased)
+		if err := txn.Set(seq.partitionId, seq.key, buf[:]); err != nil {
+			return err
+		}
+
+		seq.leased = leased
+		return nil
+	})
+}
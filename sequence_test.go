@@ -0,0 +1,88 @@
+package notbadger
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_GetSequence(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		_, err := db.GetSequence(0, nil, 10)
+		require.Equal(t, ErrEmptyKey, err)
+		_, err = db.GetSequence(0, []byte("seq"), 0)
+		require.Equal(t, ErrZeroBandwidth, err)
+
+		seq, err := db.GetSequence(1, []byte("seq"), 3)
+		require.NoError(t, err)
+
+		// Every integer should be handed out exactly once, including the ones on either side of a lease boundary.
+		for i := uint64(0); i < 10; i++ {
+			next, err := seq.Next()
+			require.NoError(t, err)
+			require.Equal(t, i, next)
+			require.Equal(t, (i/3+1)*3, seq.leased)
+		}
+		require.NoError(t, seq.Release())
+
+		// A sequence that uses the same key in another partition is independent.
+		other, err := db.GetSequence(2, []byte("seq"), 3)
+		require.NoError(t, err)
+		next, err := other.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), next)
+		require.NoError(t, other.Release())
+
+		// Once released the next sequence should pick up where the previous one stopped.
+		seq, err = db.GetSequence(1, []byte("seq"), 3)
+		require.NoError(t, err)
+		next, err = seq.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(10), next)
+		require.NoError(t, seq.Release())
+	})
+}
+
+func TestDB_GetSequence_Restart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	seq, err := db.GetSequence(0, []byte("seq"), 5)
+	require.NoError(t, err)
+	for i := uint64(0); i < 7; i++ {
+		next, err := seq.Next()
+		require.NoError(t, err)
+		require.Equal(t, i, next)
+	}
+
+	// Without releasing the sequence the rest of the current lease is lost, but nothing is handed out twice.
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+
+	seq, err = db.GetSequence(0, []byte("seq"), 5)
+	require.NoError(t, err)
+	next, err := seq.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), next)
+	require.NoError(t, seq.Release())
+
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	seq, err = db.GetSequence(0, []byte("seq"), 5)
+	require.NoError(t, err)
+	next, err = seq.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), next)
+}
@@ -1,5 +1,9 @@
 package notbadger
 
+import (
+	"sync/atomic"
+)
+
 type (
 	databaseSize struct {
 		// LSMSize stores the size of the LSM tree in bytes.
@@ -8,4 +12,65 @@ type (
 		// ValueLogSize stores the size of the value log in bytes.
 		ValueLogSize int64
 	}
+
+	// Metrics is a snapshot of the sizes and activity of the database.
+	Metrics struct {
+		// LSMSize is the size of the LSM tree on disk in bytes. This is updated every minute.
+		LSMSize int64
+
+		// ValueLogSize is the size of the value log on disk in bytes. This is updated every minute.
+		ValueLogSize int64
+
+		// CacheHits and CacheMisses are the number of block cache lookups that did and did not find the block.
+		CacheHits   uint64
+		CacheMisses uint64
+
+		// CacheHitRatio is the ratio of block cache lookups that found the block, or 0 if there have been no lookups.
+		CacheHitRatio float64
+
+		// MemoryTables is the number of memory tables across all partitions, this includes both the active memory
+		// tables and the memory tables that are waiting to be flushed.
+		MemoryTables int
+
+		// PendingWrites is the number of write requests that are waiting to be written.
+		PendingWrites int
+
+		// TrackedCommits is the number of keys whose latest commit is kept to detect conflicts between transactions.
+		// Commits are no longer tracked once every transaction that is still open has read after them.
+		TrackedCommits int
+
+		// Conflicts is the number of commits that were rejected with ErrConflict since the database was opened.
+		Conflicts uint64
+	}
 )
+
+// Metrics returns a snapshot of the sizes and activity of the database. This is safe to call concurrently with reads
+// and writes.
+func (db *DB) Metrics() Metrics {
+	metrics := Metrics{
+		LSMSize:       atomic.LoadInt64(&db.size.LSMSize),
+		ValueLogSize:  atomic.LoadInt64(&db.size.ValueLogSize),
+		PendingWrites: len(db.writeChannel),
+	}
+
+	if db.blockCache != nil && db.blockCache.Metrics != nil {
+		metrics.CacheHits = db.blockCache.Metrics.Hits()
+		metrics.CacheMisses = db.blockCache.Metrics.Misses()
+		metrics.CacheHitRatio = db.blockCache.Metrics.Ratio()
+	}
+
+	metrics.TrackedCommits, metrics.Conflicts = db.oracle.stats()
+
+	db.partitionsReadLock.RLock()
+	for _, partition := range db.partitions {
+		partition.RLock()
+		if partition.active != nil {
+			metrics.MemoryTables++
+		}
+		metrics.MemoryTables += len(partition.flushed)
+		partition.RUnlock()
+	}
+	db.partitionsReadLock.RUnlock()
+
+	return metrics
+}
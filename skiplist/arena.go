@@ -104,7 +104,8 @@ func (s *Arena) getKey(offset uint32, size uint16) []byte {
 // getVal returns byte slice at offset. The given size should be just the valueAddress
 // size and should NOT include the meta bytes.
 func (s *Arena) getVal(offset uint32, size uint32) (ret z.ValueStruct) {
-	ret.Unmarshal(s.buf[offset : offset+size])
+	// Values in the arena are always written by putVal, so a value that cannot be decoded means the arena is corrupt.
+	z.Check(ret.Unmarshal(s.buf[offset : offset+size]))
 	return
 }
 
@@ -31,6 +31,13 @@ type (
 		node     *node
 	}
 
+	// UniIterator is an iterator over a skiplist that only surfaces a single version of each key, the newest version
+	// that is visible at its read timestamp. It implements z.Iterator.
+	UniIterator struct {
+		iterator *Iterator
+		readTs   uint64
+	}
+
 	node struct {
 		// Multiple parts of the valueAddress are encoded as a single uint64 so that it
 		// can be atomically loaded and stored:
@@ -45,6 +52,11 @@ type (
 		// Height of the tower.
 		height uint16
 
+		// prevOffset is the offset of the node that preceded this one on the base level when it was last linked. It is
+		// only a hint used to make reverse iteration cheap; it is always verified against the predecessor's next
+		// pointer before it is trusted, since a concurrent insert may have placed another node in between.
+		prevOffset uint32
+
 		// Most nodes do not need to use the full height of the tower, since the
 		// probability of each successive level decreases exponentially. Because
 		// these elements are never accessed, they do not need to be allocated.
@@ -267,8 +279,15 @@ func (s *SkipList) Put(key []byte, value z.ValueStruct) {
 			}
 			nextOffset := s.arena.getNodeOffset(next[i])
 			x.tower[i] = nextOffset
+			if i == 0 {
+				x.setPrevOffset(s.arena.getNodeOffset(prev[i]))
+			}
 			if prev[i].casNextOffset(i, nextOffset, s.arena.getNodeOffset(x)) {
 				// Managed to insert x between prev[i] and next[i]. Go to the next level.
+				if i == 0 && next[i] != nil {
+					// Point the following node back at x so that Prev can step backwards without searching.
+					next[i].setPrevOffset(s.arena.getNodeOffset(x))
+				}
 				break
 			}
 			// CAS failed. We need to recompute prev and next.
@@ -284,6 +303,31 @@ func (s *SkipList) Put(key []byte, value z.ValueStruct) {
 	}
 }
 
+// getPrev returns the node immediately before the provided node on the base level, or nil if the node is the first
+// one in the list. The back pointer stored on the node is used when it can be verified, otherwise this falls back to a
+// search from the head of the list.
+func (s *SkipList) getPrev(n *node) *node {
+	nodeOffset := s.arena.getNodeOffset(n)
+	if prev := s.arena.getNode(n.getPrevOffset()); prev != nil && prev.getNextOffset(0) == nodeOffset {
+		// Nodes are never removed, so if the hinted node still links directly to this one then nothing has been
+		// inserted between them and the hint is accurate.
+		if prev == s.head {
+			return nil
+		}
+		return prev
+	}
+
+	// The hint is stale because of a concurrent insert, search for the predecessor instead and repair the hint so
+	// the next reverse scan over this node is cheap again.
+	prev, _ := s.findNear(n.key(s.arena), true, false) // find <. No equality allowed.
+	if prev == nil {
+		n.setPrevOffset(s.arena.getNodeOffset(s.head))
+	} else {
+		n.setPrevOffset(s.arena.getNodeOffset(prev))
+	}
+	return prev
+}
+
 // findSpliceForLevel returns (outBefore, outAfter) with outBefore.key <= key <= outAfter.key.
 // The input "before" tells us where to start looking.
 // If we found a node with the same key, then we return outBefore = outAfter.
@@ -353,7 +397,7 @@ func (s *Iterator) Next() {
 // Prev advances to the previous position.
 func (s *Iterator) Prev() {
 	z.AssertTrue(s.Valid())
-	s.node, _ = s.skipList.findNear(s.Key(), true, false) // find <. No equality allowed.
+	s.node = s.skipList.getPrev(s.node)
 }
 
 // Seek advances to the first entry with a key >= target.
@@ -378,6 +422,70 @@ func (s *Iterator) SeekToLast() {
 	s.node = s.skipList.findLast()
 }
 
+// NewUniIterator returns a skiplist iterator that yields only the highest version of each key that is less than or
+// equal to readTs. You have to Close() the iterator.
+func (s *SkipList) NewUniIterator(readTs uint64) *UniIterator {
+	return &UniIterator{
+		iterator: s.NewIterator(),
+		readTs:   readTs,
+	}
+}
+
+// Next advances past the remaining versions of the current key to the newest visible version of the next key.
+func (s *UniIterator) Next() {
+	key := s.iterator.Key()
+	for s.iterator.Next(); s.iterator.Valid() && z.SameKey(key, s.iterator.Key()); s.iterator.Next() {
+	}
+	s.skipInvisible()
+}
+
+// Rewind seeks to the newest visible version of the first key.
+func (s *UniIterator) Rewind() {
+	s.iterator.SeekToFirst()
+	s.skipInvisible()
+}
+
+// Seek advances to the first visible entry with a key >= target.
+func (s *UniIterator) Seek(key []byte) {
+	s.iterator.Seek(key)
+	s.skipInvisible()
+}
+
+// Key returns the key at the current position, including its version.
+func (s *UniIterator) Key() []byte {
+	return s.iterator.Key()
+}
+
+// Value returns the value at the current position with its version populated.
+func (s *UniIterator) Value() z.ValueStruct {
+	value := s.iterator.Value()
+	value.Version = z.ParseTs(s.iterator.Key())
+	return value
+}
+
+// Valid returns true iff the iterator is positioned at a visible entry.
+func (s *UniIterator) Valid() bool {
+	return s.iterator.Valid()
+}
+
+// Err always returns nil, the skiplist is in memory and can't fail to be read.
+func (s *UniIterator) Err() error {
+	return nil
+}
+
+// Close frees the resources held by the iterator.
+func (s *UniIterator) Close() error {
+	return s.iterator.Close()
+}
+
+// skipInvisible moves the iterator forward past any versions that were written after the read timestamp. Versions of
+// the same key are sorted newest first, so the first version that is not skipped is the newest visible one.
+func (s *UniIterator) skipInvisible() {
+	for s.iterator.Valid() && z.ParseTs(s.iterator.Key()) > s.readTs {
+		s.iterator.Next()
+	}
+}
+
 func newNode(arena *Arena, key []byte, value z.ValueStruct, height int) *node {
 	// The base level is already allocated in the node struct.
 	offset := arena.putNode(height)
@@ -418,6 +526,14 @@ func (s *node) getNextOffset(height int) uint32 {
 	return atomic.LoadUint32(&s.tower[height])
 }
 
+func (s *node) getPrevOffset() uint32 {
+	return atomic.LoadUint32(&s.prevOffset)
+}
+
+func (s *node) setPrevOffset(offset uint32) {
+	atomic.StoreUint32(&s.prevOffset, offset)
+}
+
 func (s *node) casNextOffset(height int, old, val uint32) bool {
 	return atomic.CompareAndSwapUint32(&s.tower[height], old, val)
 }
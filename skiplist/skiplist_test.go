@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/elliotcourant/notbadger/z"
 	"github.com/stretchr/testify/require"
+	"math"
 	"math/rand"
 	"strconv"
 	"sync"
@@ -370,6 +371,34 @@ func TestIteratorPrev(t *testing.T) {
 	require.False(t, it.Valid())
 }
 
+// TestIteratorPrevConcurrent makes sure that reverse iteration still visits every node in order after the back
+// pointers have been written by many concurrent inserts.
+func TestIteratorPrevConcurrent(t *testing.T) {
+	const n = 1000
+	l := NewSkiplist(arenaSize)
+	defer l.DecrementReferences()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l.Put(z.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 0),
+				z.ValueStruct{Value: newValue(i), Meta: 0, UserMeta: 0})
+		}(i)
+	}
+	wg.Wait()
+
+	it := l.NewIterator()
+	defer it.Close()
+	it.SeekToLast()
+	for i := n - 1; i >= 0; i-- {
+		require.True(t, it.Valid())
+		require.EqualValues(t, newValue(i), it.Value().Value)
+		it.Prev()
+	}
+	require.False(t, it.Valid())
+}
+
 // TestIteratorSeek tests Seek and SeekForPrev.
 func TestIteratorSeek(t *testing.T) {
 	const n = 100
@@ -436,6 +465,50 @@ func TestIteratorSeek(t *testing.T) {
 	require.EqualValues(t, "01990", v.Value)
 }
 
+// TestUniIterator tests that only the newest visible version of each key is surfaced.
+func TestUniIterator(t *testing.T) {
+	l := NewSkiplist(arenaSize)
+	defer l.DecrementReferences()
+
+	// Write the versions out of order so that they are interleaved by insertion.
+	for _, version := range []uint64{3, 1, 7, 5} {
+		for _, key := range []string{"a", "b", "c"} {
+			if key == "b" && version > 3 {
+				continue
+			}
+			l.Put(z.KeyWithTs([]byte(key), version),
+				z.ValueStruct{Value: []byte(fmt.Sprintf("%s%d", key, version))})
+		}
+	}
+	l.Put(z.KeyWithTs([]byte("d"), 9), z.ValueStruct{Value: []byte("d9")})
+
+	scan := func(readTs uint64, seek []byte) []string {
+		it := l.NewUniIterator(readTs)
+		defer it.Close()
+		if seek == nil {
+			it.Rewind()
+		} else {
+			it.Seek(seek)
+		}
+
+		var result []string
+		for ; it.Valid(); it.Next() {
+			value := it.Value()
+			require.Equal(t, z.ParseTs(it.Key()), value.Version)
+			result = append(result, string(value.Value))
+		}
+		return result
+	}
+
+	require.Empty(t, scan(0, nil))
+	require.Equal(t, []string{"a1", "b1", "c1"}, scan(1, nil))
+	require.Equal(t, []string{"a3", "b3", "c3"}, scan(4, nil))
+	require.Equal(t, []string{"a7", "b3", "c7"}, scan(8, nil))
+	require.Equal(t, []string{"a7", "b3", "c7", "d9"}, scan(math.MaxUint64, nil))
+	require.Equal(t, []string{"b3", "c5"}, scan(6, z.KeyWithTs([]byte("b"), 6)))
+	require.Equal(t, []string{"b1", "c5"}, scan(6, z.KeyWithTs([]byte("b"), 2)))
+}
+
 func randomKey(rng *rand.Rand) []byte {
 	b := make([]byte, 8)
 	key := rng.Uint32()
@@ -473,6 +546,42 @@ func BenchmarkReadWrite(b *testing.B) {
 	}
 }
 
+// BenchmarkIterate compares the throughput of a full forward scan, a full reverse scan and a full reverse scan that
+// searches for every predecessor from the head of the list.
+func BenchmarkIterate(b *testing.B) {
+	const n = 100000
+	l := NewSkiplist(int64((n + 1) * MaxNodeSize))
+	defer l.DecrementReferences()
+	rng := rand.New(rand.NewSource(0))
+	value := newValue(123)
+	for i := 0; i < n; i++ {
+		l.Put(randomKey(rng), z.ValueStruct{Value: value, Meta: 0, UserMeta: 0})
+	}
+
+	b.Run("forward", func(b *testing.B) {
+		it := l.NewIterator()
+		defer it.Close()
+		for i := 0; i < b.N; i++ {
+			for it.SeekToFirst(); it.Valid(); it.Next() {
+			}
+		}
+	})
+	b.Run("reverse", func(b *testing.B) {
+		it := l.NewIterator()
+		defer it.Close()
+		for i := 0; i < b.N; i++ {
+			for it.SeekToLast(); it.Valid(); it.Prev() {
+			}
+		}
+	})
+	b.Run("reverse_search", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for x := l.findLast(); x != nil; x, _ = l.findNear(x.key(l.arena), true, false) {
+			}
+		}
+	})
+}
+
 // Standard test. Some fraction is read. Some fraction is write. Writes have
 // to go through mutex lock.
 func BenchmarkReadWriteMap(b *testing.B) {
@@ -0,0 +1,330 @@
+package notbadger
+
+import (
+	"bytes"
+	"math"
+	"time"
+
+	"github.com/elliotcourant/notbadger/pb"
+	"github.com/elliotcourant/notbadger/table"
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/elliotcourant/timber"
+)
+
+// SplitPartition moves every key in the source partition that is greater than or equal to the split key into the
+// destination partition, which must be empty. The tables of every level are rewritten by a special compaction, the
+// tables that only hold keys below the split key are left alone. The manifest is updated with a single change set so
+// a crash leaves either the source partition untouched or the split complete.
+//
+// Commits and flushes wait for the split to finish and compactions of the source partition are paused. Reads of keys
+// below the split key are not affected. The moved keys are visible in the source partition until they have been added
+// to the destination partition.
+//
+// ErrInvalidRequest is returned if a range delete in the source partition deletes keys at or above the split key.
+func (db *DB) SplitPartition(src PartitionId, splitKey []byte, dst PartitionId) error {
+	switch {
+	case len(splitKey) == 0:
+		return ErrEmptyKey
+	case db.options.ReadOnly:
+		return ErrReadOnly
+	case src == dst:
+		return ErrInvalidRequest
+	}
+
+	if err := db.validatePartitionId(dst); err != nil {
+		return err
+	}
+
+	// Holding the write channel lock makes new commits wait, the writes that have already been sent are flushed below.
+	db.oracle.writeChannelLock.Lock()
+	defer db.oracle.writeChannelLock.Unlock()
+
+	if !db.isPartitionEmpty(dst) {
+		return ErrPartitionNotEmpty
+	}
+
+	// The moved keys would no longer be deleted by a range delete that is left in the source partition.
+	for _, rangeDelete := range db.rangeDeletes.get(src, math.MaxUint64) {
+		if bytes.Compare(rangeDelete.end, splitKey) > 0 {
+			return ErrInvalidRequest
+		}
+	}
+
+	if err := db.Flush(src); err != nil {
+		return z.Wrapf(err, "failed to flush partition %d", src)
+	}
+
+	// No other tables can be added to level 0 while the flush lock is held.
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+
+	return db.levelsController.splitPartition(src, splitKey, dst)
+}
+
+// isPartitionEmpty returns true if the partition does not have any data in its memory tables or its levels.
+func (db *DB) isPartitionEmpty(partitionId PartitionId) bool {
+	db.partitionsReadLock.RLock()
+	partition, ok := db.partitions[partitionId]
+	db.partitionsReadLock.RUnlock()
+	if ok {
+		partition.RLock()
+		empty := partition.dropped || (partition.active.Empty() && len(partition.flushed) == 0)
+		partition.RUnlock()
+		if !empty {
+			return false
+		}
+	}
+
+	if levels, ok := db.levelsController.getPartition(partitionId); ok {
+		for _, handler := range levels.levels {
+			if handler.numberOfTables() > 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// splitPartition rewrites the tables of the source partition that have keys greater than or equal to the split key,
+// moving those keys into the destination partition. Nothing else can add tables to the source partition while this
+// runs, compactions are waited for and then paused.
+func (l *levelsController) splitPartition(src PartitionId, splitKey []byte, dst PartitionId) error {
+	source, ok := l.getPartition(src)
+	if !ok {
+		return nil
+	}
+
+	// Wait for the compactions that are already running, and then make sure no others are started.
+	for !source.compactionStatus.reserveAll() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer source.compactionStatus.releaseAll()
+
+	start := time.Now()
+	destination := l.getOrSetupPartition(dst)
+
+	var changes []pb.ManifestChange
+	var sourceTables, destinationTables, newTables, oldTables [][]*table.Table
+	sourceTables = make([][]*table.Table, len(source.levels))
+	destinationTables = make([][]*table.Table, len(source.levels))
+	newTables = make([][]*table.Table, len(source.levels))
+	oldTables = make([][]*table.Table, len(source.levels))
+	for i, handler := range source.levels {
+		handler.RLock()
+		tables := make([]*table.Table, len(handler.tables))
+		copy(tables, handler.tables)
+		handler.RUnlock()
+
+		// The tables in level 0 are ordered by their file Id. If any of them is rewritten then every table after it
+		// has to be rewritten as well, so the order is the same when the database is opened again.
+		rewriteRest := false
+		for _, t := range tables {
+			hasMovedKeys := bytes.Compare(z.ParseKey(t.Largest()), splitKey) >= 0
+			rewriteRest = rewriteRest || (handler.level == 0 && hasMovedKeys)
+			if !hasMovedKeys && !rewriteRest {
+				sourceTables[i] = append(sourceTables[i], t)
+				continue
+			}
+
+			lower, upper, err := l.splitTable(t, handler.level, splitKey, src, dst)
+			if err != nil {
+				for _, built := range newTables {
+					_ = decrementReferences(built)
+				}
+				return z.Wrapf(err, "failed to split table %d in level %d", t.FileId(), handler.level)
+			}
+
+			oldTables[i] = append(oldTables[i], t)
+			if lower != nil {
+				sourceTables[i] = append(sourceTables[i], lower)
+				newTables[i] = append(newTables[i], lower)
+				changes = appendCreateChange(changes, src, handler.level, lower)
+			}
+			if upper != nil {
+				destinationTables[i] = append(destinationTables[i], upper)
+				newTables[i] = append(newTables[i], upper)
+				changes = appendCreateChange(changes, dst, handler.level, upper)
+			}
+
+			// Level 0 tables that are kept in memory were never added to the manifest.
+			if !t.IsInMemory {
+				changes = append(changes, newDeleteChange(src, t.FileId()))
+			}
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	if !l.db.options.InMemory {
+		if err := syncDir(l.db.options.Directory); err != nil {
+			for _, built := range newTables {
+				_ = decrementReferences(built)
+			}
+			return z.Wrapf(err, "failed to sync directory")
+		}
+	}
+
+	if err := l.db.manifest.addChanges(changes); err != nil {
+		for _, built := range newTables {
+			_ = decrementReferences(built)
+		}
+		return z.Wrapf(err, "failed to write split of partition %d to manifest", src)
+	}
+
+	// Add the keys to the destination before they are removed from the source, so they can always be read from one of
+	// the partitions. The levels take over the references to the new tables.
+	destination.swapTables(destinationTables)
+	destinationErr := l.updateSummary(destination)
+	source.swapTables(sourceTables)
+	if err := l.updateSummary(source); err != nil {
+		return err
+	}
+	if destinationErr != nil {
+		return destinationErr
+	}
+	for _, tables := range oldTables {
+		if err := decrementReferences(tables); err != nil {
+			return err
+		}
+	}
+
+	timber.Infof("split partition %d at %q into partition %d, took %s", src, splitKey, dst, time.Since(start))
+
+	return nil
+}
+
+// splitTable rewrites the table into a table for the keys below the split key in the source partition and a table for
+// the rest of the keys in the destination partition. Either table is nil if it would be empty.
+func (l *levelsController) splitTable(
+	t *table.Table,
+	level uint8,
+	splitKey []byte,
+	src, dst PartitionId,
+) (lower, upper *table.Table, err error) {
+	// Each table is encrypted with the data key of the partition it is written to.
+	lowerOptions, err := l.splitTableOptions(src, level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	upperOptions, err := l.splitTableOptions(dst, level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lowerBuild, err := l.newTableBuild(src, level, lowerOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	upperBuild, err := l.newTableBuild(dst, level, upperOptions)
+	if err != nil {
+		l.abandonTable(lowerBuild)
+		return nil, nil, err
+	}
+
+	if err := splitTableInto(t, splitKey, lowerBuild.builder, upperBuild.builder); err != nil {
+		l.abandonTable(lowerBuild)
+		l.abandonTable(upperBuild)
+		return nil, nil, err
+	}
+
+	if lowerBuild.builder.Empty() {
+		l.abandonTable(lowerBuild)
+	} else if lower, err = l.finishTable(lowerBuild); err != nil {
+		l.abandonTable(upperBuild)
+		return nil, nil, err
+	}
+
+	if upperBuild.builder.Empty() {
+		l.abandonTable(upperBuild)
+	} else if upper, err = l.finishTable(upperBuild); err != nil {
+		if lower != nil {
+			_ = lower.DecrementReference()
+		}
+		return nil, nil, err
+	}
+
+	return lower, upper, nil
+}
+
+// splitTableInto adds the keys of the table that are before the split key to the lower builder and the rest of the keys
+// to the upper builder.
+func splitTableInto(t *table.Table, splitKey []byte, lower, upper *table.Builder) error {
+	iterator := t.NewIterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value := iterator.Value()
+		var pointer valuePointer
+		if value.Meta&bitValuePointer > 0 {
+			if err := pointer.Decode(value.Value); err != nil {
+				_ = iterator.Close()
+				return err
+			}
+		}
+
+		builder := upper
+		if bytes.Compare(z.ParseKey(iterator.Key()), splitKey) < 0 {
+			builder = lower
+		}
+		builder.Add(iterator.Key(), value, pointer.Len)
+	}
+	if err := iterator.Err(); err != nil {
+		_ = iterator.Close()
+		return err
+	}
+
+	return iterator.Close()
+}
+
+// splitTableOptions returns the options of a table that is written to the provided level of the partition by a split.
+func (l *levelsController) splitTableOptions(partitionId PartitionId, level uint8) (table.Options, error) {
+	dataKey, err := l.db.registry.latestDataKey(partitionId)
+	if err != nil {
+		return table.Options{}, z.Wrapf(err, "failed to retrieve data key for split of partition %d", partitionId)
+	}
+
+	tableOptions := buildLevelTableOptions(l.db.options, level)
+	tableOptions.DataKey = dataKey
+	tableOptions.Cache = l.db.blockCache
+
+	return tableOptions, nil
+}
+
+// appendCreateChange adds a manifest change to create the table, unless the table is only kept in memory.
+func appendCreateChange(
+	changes []pb.ManifestChange,
+	partitionId PartitionId,
+	level uint8,
+	t *table.Table,
+) []pb.ManifestChange {
+	if t.IsInMemory {
+		return changes
+	}
+
+	return append(changes, newCreateChange(partitionId, t.FileId(), level, t.KeyID(), t.CompressionType()))
+}
+
+// swapTables replaces the tables of every level of the partition at once. Every level is locked for the swap so
+// readers never see some levels before the swap and others after it. The levels take over the references to the new
+// tables, the caller must release the references to the tables that were replaced.
+func (p *partitionLevels) swapTables(tables [][]*table.Table) {
+	for _, handler := range p.levels {
+		handler.Lock()
+	}
+
+	for i, handler := range p.levels {
+		handler.tables = tables[i]
+		handler.totalSize, handler.estimatedSize = 0, 0
+		for _, t := range handler.tables {
+			handler.totalSize += t.Size()
+			handler.estimatedSize += t.EstimatedSize()
+		}
+	}
+
+	for i := len(p.levels) - 1; i >= 0; i-- {
+		p.levels[i].Unlock()
+	}
+}
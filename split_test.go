@@ -0,0 +1,79 @@
+package notbadger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_SplitPartition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir).withoutCompactors() // Compactions are run manually.
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	set := func(partitionId PartitionId, key, value string) {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(partitionId, []byte(key), []byte(value))
+		}))
+	}
+
+	for i := 0; i < 20; i++ {
+		set(1, fmt.Sprintf("key%02d", i), "old")
+	}
+	require.NoError(t, db.Flush(1))
+	require.NoError(t, db.levelsController.compactLevel0())
+
+	// Newer versions of some keys on either side of the split key end up in level 0.
+	set(1, "key05", "new")
+	set(1, "key15", "new")
+	require.NoError(t, db.Flush(1))
+
+	set(3, "key", "value")
+	require.Equal(t, ErrEmptyKey, db.SplitPartition(1, nil, 2))
+	require.Equal(t, ErrInvalidRequest, db.SplitPartition(1, []byte("key10"), 1))
+	require.Equal(t, ErrPartitionNotEmpty, db.SplitPartition(1, []byte("key10"), 3))
+
+	require.NoError(t, db.SplitPartition(1, []byte("key10"), 2))
+
+	verify := func() {
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			for i := 0; i < 20; i++ {
+				key := fmt.Sprintf("key%02d", i)
+				from, to := PartitionId(1), PartitionId(2)
+				if i >= 10 {
+					from, to = to, from
+				}
+
+				item, err := txn.Get(from, []byte(key))
+				require.NoError(t, err, key)
+				value, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				expected := "old"
+				if i == 5 || i == 15 {
+					expected = "new"
+				}
+				require.Equal(t, expected, string(value), key)
+
+				_, err = txn.Get(to, []byte(key))
+				require.Equal(t, ErrKeyNotFound, err, key)
+			}
+			return nil
+		}))
+	}
+	verify()
+
+	// The split should have been written to the manifest.
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	verify()
+}
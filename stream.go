@@ -0,0 +1,286 @@
+package notbadger
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/elliotcourant/timber"
+)
+
+const (
+	// streamBatchSize is the size that a batch of KVs grows to before it is sent.
+	streamBatchSize = 4 << 20
+)
+
+type (
+	// KV is a single version of a key that was read by a Stream.
+	KV struct {
+		PartitionId PartitionId
+		Key         []byte
+		Value       []byte
+		UserMeta    byte
+		ExpiresAt   uint64
+		Version     uint64
+	}
+
+	// Stream reads the whole database, or only the keys with a prefix, using many goroutines at once. Every partition
+	// is split into ranges at the boundaries of its tables and each range is read by a single goroutine with its own
+	// iterator, so the versions of a key are always read in order by the same goroutine. Every range is read at the
+	// same read timestamp so the stream is consistent.
+	//
+	// The KVs are gathered into batches that are passed to Send. The batches of different ranges are sent in no
+	// particular order, but Send is never called concurrently.
+	Stream struct {
+		// Prefix limits the stream to the keys with the prefix.
+		Prefix []byte
+
+		// Partitions limits the stream to the provided partitions. Every partition is streamed by default.
+		Partitions []PartitionId
+
+		// NumGo is the number of goroutines that read ranges at the same time. The default value of NumGo is 16.
+		NumGo int
+
+		// LogPrefix is added to the start of the messages logged by the stream.
+		LogPrefix string
+
+		// ChooseKey is called with the first version of every key, and the key is skipped if it returns false. Every key
+		// is chosen when this is nil. This is called concurrently.
+		ChooseKey func(item *Item) bool
+
+		// KeyToList converts the versions of a key into KVs. The iterator is positioned at the newest version of the
+		// key and iterates every version of it, KeyToList must not move it past the versions of the key. The default
+		// returns the newest version of the key unless it has been deleted or has expired. This is called concurrently.
+		KeyToList func(key []byte, itr *Iterator) ([]*KV, error)
+
+		// Send is called with every batch of KVs. The KVs are only valid until Send returns.
+		Send func(list []*KV) error
+
+		db *DB
+	}
+
+	// streamRange is a range of keys of a partition that is read by a single goroutine of a stream. The left key is
+	// included in the range and the right key is not, an empty right key means the range goes to the end of the
+	// partition.
+	streamRange struct {
+		partitionId PartitionId
+		left, right []byte
+	}
+)
+
+// NewStream returns a new Stream over the database. Send must be set before Orchestrate is called.
+func (db *DB) NewStream() *Stream {
+	return &Stream{
+		NumGo:     16,
+		LogPrefix: "Stream",
+		db:        db,
+	}
+}
+
+// ToList returns the newest version of the key that the iterator is positioned at, unless it has been deleted or has
+// expired. It is the default KeyToList of a Stream.
+func (st *Stream) ToList(key []byte, itr *Iterator) ([]*KV, error) {
+	item := itr.Item()
+	if item.IsDeletedOrExpired() {
+		return nil, nil
+	}
+
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*KV{
+		{
+			PartitionId: item.PartitionId(),
+			Key:         key,
+			Value:       value,
+			UserMeta:    item.UserMeta(),
+			ExpiresAt:   item.ExpiresAt(),
+			Version:     item.Version(),
+		},
+	}, nil
+}
+
+// Orchestrate reads every range of the stream and sends the KVs to Send. It blocks until the stream is done, the
+// context is cancelled, or an error is returned by one of the callbacks.
+func (st *Stream) Orchestrate(ctx context.Context) error {
+	if st.Send == nil {
+		return ErrNilCallback
+	}
+
+	if st.KeyToList == nil {
+		st.KeyToList = st.ToList
+	}
+
+	numGo := st.NumGo
+	if numGo < 1 {
+		numGo = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	txn := st.db.newLatestTransaction()
+	defer txn.Discard()
+
+	partitions := st.Partitions
+	if len(partitions) == 0 {
+		partitions = st.db.Partitions()
+	}
+
+	ranges := make(chan streamRange, numGo)
+	go func() {
+		defer close(ranges)
+		for _, partitionId := range partitions {
+			left := st.Prefix
+			for _, split := range st.db.KeySplits(partitionId, st.Prefix) {
+				select {
+				case ranges <- streamRange{partitionId: partitionId, left: left, right: split}:
+				case <-ctx.Done():
+					return
+				}
+				left = split
+			}
+
+			select {
+			case ranges <- streamRange{partitionId: partitionId, left: left}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	batches := make(chan []*KV, numGo)
+	errs := make(chan error, numGo+1)
+	var numberOfKeys uint64
+	var wg sync.WaitGroup
+	for i := 0; i < numGo; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range ranges {
+				if err := st.produceKVs(ctx, txn, r, batches, &numberOfKeys); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(batches)
+	}()
+
+	start := time.Now()
+	for batch := range batches {
+		if ctx.Err() != nil {
+			continue
+		}
+
+		if err := st.Send(batch); err != nil {
+			errs <- err
+			cancel()
+		}
+	}
+
+	// The errors from the callbacks are returned before the error of a context that was cancelled because of them.
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	timber.Infof("%s streamed %d keys in %s", st.LogPrefix, atomic.LoadUint64(&numberOfKeys), time.Since(start))
+
+	return nil
+}
+
+// produceKVs reads every key in the range and sends the KVs to the batches channel, once a batch is full or the range
+// has been read.
+func (st *Stream) produceKVs(
+	ctx context.Context,
+	txn *Transaction,
+	r streamRange,
+	batches chan<- []*KV,
+	numberOfKeys *uint64,
+) error {
+	itr := txn.NewIterator(r.partitionId, IteratorOptions{
+		AllVersions: true,
+		Prefix:      st.Prefix,
+	})
+	defer itr.Close()
+
+	var batch []*KV
+	var batchSize int
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		select {
+		case batches <- batch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		batch, batchSize = nil, 0
+		return nil
+	}
+
+	var previousKey []byte
+	for itr.Seek(r.left); itr.Valid(); {
+		item := itr.Item()
+		if len(r.right) > 0 && bytes.Compare(item.Key(), r.right) >= 0 {
+			break
+		}
+
+		// The older versions of the key that KeyToList did not read are skipped.
+		if bytes.Equal(item.Key(), previousKey) {
+			itr.Next()
+			continue
+		}
+		previousKey = append(previousKey[:0], item.Key()...)
+
+		if st.ChooseKey != nil && !st.ChooseKey(item) {
+			itr.Next()
+			continue
+		}
+
+		list, err := st.KeyToList(item.KeyCopy(nil), itr)
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(numberOfKeys, 1)
+
+		for _, kv := range list {
+			batch = append(batch, kv)
+			batchSize += len(kv.Key) + len(kv.Value)
+		}
+
+		if batchSize >= streamBatchSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+
+		// KeyToList may have already moved the iterator past the key.
+		if itr.Valid() && bytes.Equal(itr.Item().Key(), previousKey) {
+			itr.Next()
+		}
+	}
+
+	if err := itr.Err(); err != nil {
+		return z.Wrapf(err, "failed to read partition %d for stream", r.partitionId)
+	}
+
+	return send()
+}
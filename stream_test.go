@@ -0,0 +1,101 @@
+package notbadger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// Every key is written twice so that the partitions have older versions, and the tables of the partitions are
+	// compacted so that they are split into more than one range.
+	expected := map[string]string{}
+	for version := 0; version < 2; version++ {
+		for partitionId := PartitionId(0); partitionId < 3; partitionId++ {
+			for i := 0; i < 500; i += 20 {
+				require.NoError(t, db.Update(func(txn *Transaction) error {
+					for j := i; j < i+20; j++ {
+						key := fmt.Sprintf("key%04d", j)
+						value := fmt.Sprintf("value%d-%d-%d-%s", partitionId, j, version, strings.Repeat("x", 100))
+						if err := txn.Set(partitionId, []byte(key), []byte(value)); err != nil {
+							return err
+						}
+						expected[fmt.Sprintf("%d/%s", partitionId, key)] = value
+					}
+					return nil
+				}))
+			}
+			require.NoError(t, db.Flush(partitionId))
+		}
+	}
+	require.NoError(t, db.levelsController.compactLevel0())
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		delete(expected, "1/key0100")
+		return txn.Delete(1, []byte("key0100"))
+	}))
+	require.Greater(t, len(db.KeySplits(1, nil)), 1)
+
+	stream := db.NewStream()
+	stream.NumGo = 4
+	received := map[string]string{}
+	stream.Send = func(list []*KV) error {
+		for _, kv := range list {
+			key := fmt.Sprintf("%d/%s", kv.PartitionId, kv.Key)
+			_, ok := received[key]
+			require.False(t, ok, "key %s was streamed twice", key)
+			received[key] = string(kv.Value)
+		}
+		return nil
+	}
+	require.NoError(t, stream.Orchestrate(context.Background()))
+	require.Equal(t, expected, received)
+
+	// Every version of a key is read by the same goroutine, newest first.
+	stream = db.NewStream()
+	stream.Prefix = []byte("key01")
+	stream.Partitions = []PartitionId{2}
+	stream.KeyToList = func(key []byte, itr *Iterator) ([]*KV, error) {
+		var list []*KV
+		for ; itr.Valid() && string(itr.Item().Key()) == string(key); itr.Next() {
+			list = append(list, &KV{Key: key, Version: itr.Item().Version()})
+		}
+		return list, nil
+	}
+	var numberOfKeys int
+	stream.Send = func(list []*KV) error {
+		for i, kv := range list {
+			if i > 0 && string(list[i-1].Key) == string(kv.Key) {
+				require.Greater(t, list[i-1].Version, kv.Version)
+				continue
+			}
+			require.Equal(t, "key01", string(kv.Key[:5]))
+			numberOfKeys++
+		}
+		return nil
+	}
+	require.NoError(t, stream.Orchestrate(context.Background()))
+	require.Equal(t, 100, numberOfKeys)
+
+	// An error from Send stops the stream.
+	sendErr := errors.New("send failed")
+	stream = db.NewStream()
+	stream.Send = func(list []*KV) error {
+		return sendErr
+	}
+	require.Equal(t, sendErr, stream.Orchestrate(context.Background()))
+}
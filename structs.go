@@ -1,9 +1,46 @@
 package notbadger
 
-import "unsafe"
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+	"unsafe"
+
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/pkg/errors"
+)
 
 const (
 	valuePointerSize = unsafe.Sizeof(valuePointer{})
+
+	// maxHeaderSize is the largest size an encoded entry header can be. Meta and user meta take a single byte each,
+	// the partition Id, key length and value length take at most 5 bytes each as uvarints and the expiration takes at
+	// most 10 bytes as a uvarint.
+	maxHeaderSize = 1 + 1 + binary.MaxVarintLen32*3 + binary.MaxVarintLen64
+
+	// crc32Size is the size of the checksum that follows every entry in the value log.
+	crc32Size = 4
+)
+
+// Values have their first byte being byteData or byteDelete. This helps us distinguish between a key that has never
+// been seen and a key that has been explicitly deleted.
+const (
+	bitDelete                 byte = 1 << 0 // Set if the key has been deleted.
+	bitValuePointer           byte = 1 << 1 // Set if the value is NOT stored directly next to key.
+	bitDiscardEarlierVersions byte = 1 << 2 // Set if earlier versions can be discarded.
+
+	// Set if item shouldn't be discarded via compactions (used by merge operator).
+	bitMergeEntry byte = 1 << 3
+
+	// Set if the entry is a range delete, the value is the end of the range.
+	bitRangeDelete byte = 1 << 4
+
+	// The MSB 2 bits are for transactions.
+	bitTxn    byte = 1 << 6 // Set if the entry is part of a txn.
+	bitFinTxn byte = 1 << 7 // Set if the entry is to indicate end of txn in value log.
 )
 
 type (
@@ -16,6 +53,8 @@ type (
 		meta      byte
 
 		// Fields maintained internally.
+		partitionId  PartitionId
+		version      uint64
 		offset       uint32
 		skipValueLog bool
 		headerLength int // Length of the header.
@@ -26,8 +65,64 @@ type (
 		Len    uint32
 		Offset uint32
 	}
+
+	// header is written before the key and value of every entry in the value log. The lengths of the key and value are
+	// stored in the header so a value log file can be read forward one entry at a time without an index.
+	//
+	// +------+----------+--------------+------------+--------------+------------+
+	// | meta | userMeta | partition Id | key length | value length | expires at |
+	// +------+----------+--------------+------------+--------------+------------+
+	//
+	// Everything after the meta bytes is encoded as a uvarint to keep the header small.
+	header struct {
+		meta        byte
+		userMeta    byte
+		partitionId PartitionId
+		keyLength   uint32
+		valueLength uint32
+		expiresAt   uint64
+	}
 )
 
+// NewEntry creates a new entry with the provided key and value. The user metadata and expiration of the entry can be set
+// with WithMeta and WithTTL before it is passed to Transaction.SetEntry.
+func NewEntry(key, value []byte) *Entry {
+	return &Entry{
+		Key:   key,
+		Value: value,
+	}
+}
+
+// WithMeta sets the user metadata of the entry. The user metadata is stored with the value and can be read back with
+// Item.UserMeta.
+func (e *Entry) WithMeta(meta byte) *Entry {
+	e.UserMeta = meta
+	return e
+}
+
+// WithTTL sets the entry to expire once the provided duration has passed. The expiration can be read back with
+// Item.ExpiresAt.
+func (e *Entry) WithTTL(duration time.Duration) *Entry {
+	e.ExpiresAt = uint64(time.Now().Add(duration).Unix())
+	return e
+}
+
+// PartitionId returns the partition that the entry was written to. This is only set for entries that have been
+// committed, such as the entries passed to a Subscribe callback.
+func (e *Entry) PartitionId() PartitionId {
+	return e.partitionId
+}
+
+// Version returns the commit timestamp of the entry. This is only set for entries that have been committed.
+func (e *Entry) Version() uint64 {
+	return e.version
+}
+
+// IsDeleted returns true if the entry marks its key as deleted.
+func (e *Entry) IsDeleted() bool {
+	return e.meta&bitDelete > 0
+}
+
 func (e *Entry) estimateSize(threshold int) int {
 	if len(e.Value) < threshold {
 		return len(e.Key) + len(e.Value) + 2 // Meta, UserMeta
@@ -36,6 +131,133 @@ func (e *Entry) estimateSize(threshold int) int {
 	return len(e.Key) + 12 + 2 // 12 for ValuePointer, 2 for metas.
 }
 
+// Encode writes the entry to the buffer in the value log format, the header is followed by the key, the value and then
+// a CRC32 checksum of all of them. The number of bytes written is returned.
+func (e *Entry) Encode(buf *bytes.Buffer) (int, error) {
+	h := header{
+		meta:        e.meta,
+		userMeta:    e.UserMeta,
+		partitionId: e.partitionId,
+		keyLength:   uint32(len(e.Key)),
+		valueLength: uint32(len(e.Value)),
+		expiresAt:   e.ExpiresAt,
+	}
+
+	hash := crc32.New(z.CastagnoliCrcTable)
+	writer := io.MultiWriter(buf, hash)
+
+	var headerEncoded [maxHeaderSize]byte
+	headerSize := h.Encode(headerEncoded[:])
+	if _, err := writer.Write(headerEncoded[:headerSize]); err != nil {
+		return 0, z.Wrapf(err, "failed to write entry header")
+	}
+
+	if _, err := writer.Write(e.Key); err != nil {
+		return 0, z.Wrapf(err, "failed to write entry key")
+	}
+
+	if _, err := writer.Write(e.Value); err != nil {
+		return 0, z.Wrapf(err, "failed to write entry value")
+	}
+
+	var crcBuf [crc32Size]byte
+	binary.BigEndian.PutUint32(crcBuf[:], hash.Sum32())
+	if _, err := buf.Write(crcBuf[:]); err != nil {
+		return 0, z.Wrapf(err, "failed to write entry checksum")
+	}
+
+	return headerSize + len(e.Key) + len(e.Value) + crc32Size, nil
+}
+
+// Encode encodes the header into the provided buffer and returns the number of bytes written. The buffer must be at
+// least maxHeaderSize bytes long.
+func (h header) Encode(out []byte) int {
+	out[0], out[1] = h.meta, h.userMeta
+	index := 2
+	index += binary.PutUvarint(out[index:], uint64(h.partitionId))
+	index += binary.PutUvarint(out[index:], uint64(h.keyLength))
+	index += binary.PutUvarint(out[index:], uint64(h.valueLength))
+	index += binary.PutUvarint(out[index:], h.expiresAt)
+
+	return index
+}
+
+// Decode decodes the header from the provided buffer and returns the number of bytes that were read. An error is
+// returned if the buffer does not contain a complete header.
+func (h *header) Decode(buf []byte) (int, error) {
+	if len(buf) < 2 {
+		return 0, errors.Errorf("entry header requires at least 2 bytes, but only %d bytes were provided", len(buf))
+	}
+
+	h.meta, h.userMeta = buf[0], buf[1]
+	index := 2
+
+	var values [4]uint64
+	for i := range values {
+		value, read := binary.Uvarint(buf[index:])
+		if read <= 0 {
+			return 0, errors.Errorf("entry header is truncated or corrupt at byte %d", index)
+		}
+		values[i] = value
+		index += read
+	}
+
+	if values[0] > math.MaxUint32 || values[1] > math.MaxUint32 || values[2] > math.MaxUint32 {
+		return 0, errors.New("entry header contains an invalid length")
+	}
+
+	h.partitionId = PartitionId(values[0])
+	h.keyLength = uint32(values[1])
+	h.valueLength = uint32(values[2])
+	h.expiresAt = values[3]
+
+	return index, nil
+}
+
+// DecodeFrom reads the header from the reader, the reader keeps track of the number of bytes that were read.
+func (h *header) DecodeFrom(reader *hashReader) (int, error) {
+	var err error
+	if h.meta, err = reader.ReadByte(); err != nil {
+		return 0, err
+	}
+
+	if h.userMeta, err = reader.ReadByte(); err != nil {
+		return 0, err
+	}
+
+	var values [4]uint64
+	for i := range values {
+		if values[i], err = binary.ReadUvarint(reader); err != nil {
+			return 0, err
+		}
+	}
+
+	if values[0] > math.MaxUint32 || values[1] > math.MaxUint32 || values[2] > math.MaxUint32 {
+		return 0, errors.New("entry header contains an invalid length")
+	}
+
+	h.partitionId = PartitionId(values[0])
+	h.keyLength = uint32(values[1])
+	h.valueLength = uint32(values[2])
+	h.expiresAt = values[3]
+
+	return reader.bytesRead, nil
+}
+
+// Less returns true if the value pointer points to an earlier position in the value log than the other value pointer.
+func (v valuePointer) Less(other valuePointer) bool {
+	if v.Fid != other.Fid {
+		return v.Fid < other.Fid
+	}
+
+	return v.Offset < other.Offset
+}
+
+// IsZero returns true if the value pointer does not point to anything in the value log.
+func (v valuePointer) IsZero() bool {
+	return v.Len == 0
+}
+
 // Encode encodes Pointer into byte buffer.
 func (v valuePointer) Encode() []byte {
 	b := make([]byte, valuePointerSize)
@@ -45,3 +267,17 @@ func (v valuePointer) Encode() []byte {
 
 	return b
 }
+
+// Decode decodes the value pointer from the provided byte buffer. An error is returned if the buffer is too small to
+// contain a value pointer.
+func (v *valuePointer) Decode(b []byte) error {
+	if len(b) < int(valuePointerSize) {
+		return errors.Errorf("value pointer requires %d bytes, but only %d bytes were provided",
+			valuePointerSize, len(b))
+	}
+
+	// Copy over data from b into v. The byte slice may not be aligned so this is done with copy.
+	copy((*[valuePointerSize]byte)(unsafe.Pointer(v))[:], b[:valuePointerSize])
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package notbadger
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValuePointer_Decode(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			pointer := valuePointer{
+				Fid:    rand.Uint32(),
+				Len:    rand.Uint32(),
+				Offset: rand.Uint32(),
+			}
+
+			var decoded valuePointer
+			require.NoError(t, decoded.Decode(pointer.Encode()))
+			require.Equal(t, pointer, decoded)
+		}
+	})
+
+	t.Run("unaligned buffer", func(t *testing.T) {
+		pointer := valuePointer{Fid: 1, Len: 2, Offset: 3}
+		buf := append([]byte{0}, pointer.Encode()...)
+
+		var decoded valuePointer
+		require.NoError(t, decoded.Decode(buf[1:]))
+		require.Equal(t, pointer, decoded)
+	})
+
+	t.Run("short buffer", func(t *testing.T) {
+		pointer := valuePointer{Fid: 1, Len: 2, Offset: 3}
+
+		var decoded valuePointer
+		require.Error(t, decoded.Decode(pointer.Encode()[:valuePointerSize-1]))
+		require.Error(t, decoded.Decode(nil))
+		require.Equal(t, valuePointer{}, decoded)
+	})
+}
@@ -2,9 +2,14 @@ package table
 
 import (
 	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"hash"
+	"io"
 	"math"
 	"unsafe"
 
+	b "github.com/dgraph-io/ristretto/z"
 	"github.com/dgryski/go-farm"
 	"github.com/elliotcourant/notbadger/pb"
 	"github.com/elliotcourant/notbadger/z"
@@ -25,6 +30,23 @@ type (
 		tableIndex   pb.TableIndex
 		keyHashes    []uint64 // Uses for building the bloom filter.
 		options      *Options
+
+		// baseIV is generated once per table when a data key is provided. Each block is encrypted with an IV derived
+		// from this one, see blockIV.
+		baseIV []byte
+
+		// writer is only set for stream builders, finished blocks are written to it instead of being kept in the
+		// buffer. flushed is the number of bytes that have been written to the writer, offsets in the buffer are
+		// relative to it. writeErr is the first error returned by the writer.
+		writer   io.Writer
+		flushed  uint32
+		writeErr error
+
+		// blockHash is the checksum of the current block, and tableHash is the checksum of every block and the index
+		// of the table. The data is added to both as it is written to the buffer so that finishing a block or the
+		// table never has to read the data again. Both are calculated before the data is encrypted.
+		blockHash hash.Hash
+		tableHash hash.Hash
 	}
 
 	// TODO (elliotcourant) this could probably be represented as a single uint32 that breaks itself into two uint16s.
@@ -35,12 +57,35 @@ type (
 )
 
 func NewBuilder(options Options) *Builder {
-	return &Builder{
+	builder := &Builder{
 		buffer:     newBuffer(1 << 20),
 		tableIndex: pb.TableIndex{},
 		keyHashes:  make([]uint64, 0, 1024),
 		options:    &options, // TODO (elliotcourant) Un-pointer-ify this if it's not needed
 	}
+
+	var err error
+	builder.blockHash, err = newChecksumHash(options.ChecksumType)
+	z.Check(z.Wrapf(err, "failed to create block checksum for table builder"))
+	builder.tableHash, err = newChecksumHash(options.ChecksumType)
+	z.Check(z.Wrapf(err, "failed to create table checksum for table builder"))
+
+	if builder.shouldEncrypt() {
+		iv, err := z.GenerateIV()
+		z.Check(z.Wrapf(err, "failed to generate base IV for table builder"))
+		builder.baseIV = iv
+	}
+
+	return builder
+}
+
+// NewStreamBuilder returns a builder that writes every block to the provided writer as soon as the block is finished,
+// so only the current block and the index are kept in memory. This should be used for tables that are too large to
+// build in memory. The table must be finished with FinishTo using the same writer.
+func NewStreamBuilder(writer io.Writer, options Options) *Builder {
+	builder := NewBuilder(options)
+	builder.writer = writer
+	return builder
 }
 
 // Close closes the table builder. This currently does nothing. Maybe it implements an interface somewhere, the world
@@ -49,7 +94,7 @@ func (t *Builder) Close() {}
 
 // Empty will return true if nothing has been written to the buffer yet.
 func (t *Builder) Empty() bool {
-	return t.buffer.Len() == 0
+	return t.flushed == 0 && t.buffer.Len() == 0
 }
 
 // keyDifference returns a suffix of the provided newKey that is different from the table builder's baseKey.
@@ -66,7 +111,10 @@ func (t *Builder) keyDifference(newKey []byte) []byte {
 
 func (t *Builder) addHelper(key []byte, value z.ValueStruct, valuePointerLength uint64) {
 	// TODO (elliotcourant) Benchmark farm hash against crc and xxhash.
-	t.keyHashes = append(t.keyHashes, farm.Fingerprint64(z.ParseKey(key)))
+	if t.options.BloomFalsePositive > 0 {
+		t.keyHashes = append(t.keyHashes, farm.Fingerprint64(z.ParseKey(key)))
+	}
+	t.tableIndex.KeyCount++
 
 	var diffKey []byte
 
@@ -89,13 +137,223 @@ func (t *Builder) addHelper(key []byte, value z.ValueStruct, valuePointerLength
 
 	// Store the current entry's offset.
 	z.AssertTrue(uint32(t.buffer.Len()) < math.MaxInt32)
-	t.entryOffsets = append(t.entryOffsets, uint32(t.buffer.Len())-t.baseOffset)
+	start := t.buffer.Len()
+	t.entryOffsets = append(t.entryOffsets, uint32(start)-t.baseOffset)
 
 	// Write the 4 byte (uint16 - uint16) header.
 	t.buffer.Write(h.Encode())
 
 	// Followed by the diff key. The length for the diff key is in the last 2 bytes of the header immediately before this
 	t.buffer.Write(diffKey)
+
+	// And then the value itself.
+	value.EncodeTo(t.buffer)
+
+	// The estimated size counts the value where it is actually stored, which is the value log if there is a pointer.
+	if valuePointerLength > 0 {
+		t.tableIndex.EstimatedSize += uint64(len(key)) + valuePointerLength
+	} else {
+		t.tableIndex.EstimatedSize += uint64(len(key)) + uint64(value.EncodedSize())
+	}
+
+	t.hashFrom(start)
+}
+
+// hashFrom adds everything that has been written to the buffer since the provided offset to the checksums of the
+// current block and the table. The entry was just written so it is still in the CPU cache.
+func (t *Builder) hashFrom(offset int) {
+	data := t.buffer.Bytes()[offset:]
+	_, _ = t.blockHash.Write(data)
+	_, _ = t.tableHash.Write(data)
+}
+
+// finishBlock writes the entry offsets and the checksum for the current block to the buffer. If the builder has a data
+// key then the block is encrypted in place once it is complete. The block is then added to the table index.
+//
+// Block layout: Entries | Entry Offsets | Entry Offsets Count (uint32) | Checksum | Checksum Size (uint32)
+func (t *Builder) finishBlock() {
+	start := t.buffer.Len()
+	t.buffer.Write(z.U32SliceToBytes(t.entryOffsets))
+
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(len(t.entryOffsets)))
+	t.buffer.Write(count[:])
+	t.hashFrom(start)
+
+	// The entries were added to the block checksum as they were written, so the block isn't read again here.
+	start = t.buffer.Len()
+	t.writeChecksum(hashChecksum(t.blockHash, t.options.ChecksumType))
+	_, _ = t.tableHash.Write(t.buffer.Bytes()[start:])
+	t.blockHash.Reset()
+
+	// AES-CTR does not change the length of the data, so the encrypted block can simply replace the plaintext one.
+	if t.shouldEncrypt() {
+		encrypted, err := t.encrypt(t.buffer.Bytes()[t.baseOffset:], t.flushed+t.baseOffset)
+		z.Check(z.Wrapf(err, "failed to encrypt block at offset %d", t.baseOffset))
+		t.buffer.Truncate(int(t.baseOffset))
+		t.buffer.Write(encrypted)
+	}
+
+	t.tableIndex.Offsets = append(t.tableIndex.Offsets, pb.BlockOffset{
+		Key:    z.Copy(t.baseKey),
+		Offset: t.flushed + t.baseOffset,
+		Length: uint32(t.buffer.Len()) - t.baseOffset,
+	})
+}
+
+// shouldFinishBlock returns true if adding the provided key and value to the current block would cause the block to
+// exceed the configured block size.
+func (t *Builder) shouldFinishBlock(key []byte, value z.ValueStruct) bool {
+	// If there are no entries in the current block then we can't finish it yet.
+	if len(t.entryOffsets) <= 0 {
+		return false
+	}
+
+	// Make sure the entry offsets will still fit into a uint32.
+	z.AssertTrue((uint32(len(t.entryOffsets))+1)*4+4+maxChecksumSize+4 < math.MaxUint32)
+	entriesOffsetsSize := uint32((len(t.entryOffsets)+1)*4 +
+		4 + // Size of the entry offsets count.
+		maxChecksumSize + // Size of the checksum.
+		4) // Size of the checksum length.
+	estimatedSize := uint32(t.buffer.Len()) - t.baseOffset + uint32(headerSize) +
+		uint32(len(key)) + value.EncodedSize() + entriesOffsetsSize
+
+	return estimatedSize > uint32(t.options.BlockSize)
+}
+
+// Add adds a key value pair to the table being built. Keys must be added in sorted order.
+func (t *Builder) Add(key []byte, value z.ValueStruct, valuePointerLength uint32) {
+	if t.shouldFinishBlock(key, value) {
+		t.finishBlock()
+		if t.writer != nil {
+			t.flushBuffer()
+		}
+
+		// Start a new block, everything from the previous block can be discarded.
+		t.baseKey = []byte{}
+		z.AssertTrue(uint32(t.buffer.Len()) < math.MaxUint32)
+		t.baseOffset = uint32(t.buffer.Len())
+		t.entryOffsets = t.entryOffsets[:0]
+	}
+
+	t.addHelper(key, value, uint64(valuePointerLength))
+}
+
+// ReachedCapacity returns true if the table being built is roughly the provided capacity. This is an estimate since
+// the current block and the index have not been written yet.
+func (t *Builder) ReachedCapacity(capacity int64) bool {
+	blocksSize := int(t.flushed) + // Length of the blocks that have already been written out.
+		t.buffer.Len() + // Length of the buffer.
+		len(t.entryOffsets)*4 + // Entry offsets in the current block.
+		4 + // Size of the entry offsets count.
+		maxChecksumSize + // Size of the checksum.
+		4 // Size of the checksum length.
+	estimatedSize := blocksSize +
+		4 + // Index length.
+		5*(len(t.tableIndex.Offsets)) // Approximate size of the index.
+
+	return int64(estimatedSize) > capacity
+}
+
+// Finish finishes the current block and writes the table index to the end of the buffer. The returned byte array is
+// the complete table and can be written to disk as is. Stream builders must use FinishTo instead.
+func (t *Builder) Finish() []byte {
+	z.AssertTruef(t.writer == nil, "a stream builder must be finished with FinishTo")
+	t.finish()
+	return t.buffer.Bytes()
+}
+
+// FinishTo finishes the table and writes whatever has not been written yet to the provided writer. For a stream builder
+// this must be the writer the builder was created with, any error from writing the earlier blocks is returned here.
+func (t *Builder) FinishTo(writer io.Writer) error {
+	z.AssertTruef(t.writer == nil || t.writer == writer, "a stream builder must be finished with its own writer")
+	t.writer = writer
+	t.finish()
+	t.flushBuffer()
+	return t.writeErr
+}
+
+// flushBuffer writes the contents of the buffer to the writer and then empties the buffer. After a write fails nothing
+// else is written, the error is kept so that it can be returned by FinishTo.
+func (t *Builder) flushBuffer() {
+	if t.writeErr == nil {
+		_, t.writeErr = t.writer.Write(t.buffer.Bytes())
+	}
+	t.flushed += uint32(t.buffer.Len())
+	t.buffer.Reset()
+}
+
+// finish finishes the current block and writes the table index to the end of the buffer.
+//
+// Table layout: Blocks | Index | Index Size (uint32) | Checksum | Checksum Size (uint32)
+//
+// If the builder has a data key then the index is encrypted and the base IV for the table is appended to the encrypted
+// index in plaintext. The index size includes the base IV.
+func (t *Builder) finish() {
+	// Without a false positive rate the table is built without a bloom filter.
+	if t.options.BloomFalsePositive > 0 {
+		bloom := b.NewBloomFilter(float64(len(t.keyHashes)), t.options.BloomFalsePositive)
+		for _, hash := range t.keyHashes {
+			bloom.Add(hash)
+		}
+		t.tableIndex.BloomFilter = bloom.JSONMarshal()
+	}
+
+	// This will never start a new block.
+	t.finishBlock()
+
+	index := t.tableIndex.Marshal()
+	_, _ = t.tableHash.Write(index)
+	if t.shouldEncrypt() {
+		var err error
+		index, err = t.encrypt(index, t.flushed+uint32(t.buffer.Len()))
+		z.Check(z.Wrapf(err, "failed to encrypt table index"))
+		index = append(index, t.baseIV...)
+	}
+
+	n, err := t.buffer.Write(index)
+	z.Check(err)
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(n))
+	_, err = t.buffer.Write(size[:])
+	z.Check(err)
+
+	// The index is small compared to the blocks, so its checksum is calculated from the stored index in one pass.
+	checksum, err := calculateChecksum(index, t.options.ChecksumType)
+	z.Check(z.Wrapf(err, "failed to calculate checksum of table index"))
+	t.writeChecksum(checksum)
+}
+
+// Checksum returns the checksum of every block of the table followed by the index, in the same format as the checksums
+// stored in the table. The blocks and the index are checksummed before they are encrypted. This is only complete once the
+// table has been finished.
+func (t *Builder) Checksum() []byte {
+	return hashChecksum(t.tableHash, t.options.ChecksumType)
+}
+
+// writeChecksum writes the checksum to the buffer followed by the length of the checksum.
+func (t *Builder) writeChecksum(checksum []byte) {
+	t.buffer.Write(checksum)
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(checksum)))
+	t.buffer.Write(size[:])
+}
+
+// DataKey returns the data key that is being used to encrypt the table, or nil if the table is not encrypted.
+func (t *Builder) DataKey() *pb.DataKey {
+	return t.options.DataKey
+}
+
+// shouldEncrypt returns true if a data key has been provided to the builder.
+func (t *Builder) shouldEncrypt() bool {
+	return t.options.DataKey != nil
+}
+
+// encrypt will encrypt the provided data using the builder's data key and an IV derived from the offset of the data.
+func (t *Builder) encrypt(data []byte, offset uint32) ([]byte, error) {
+	return z.XORBlock(data, t.DataKey().Data, blockIV(t.baseIV, offset))
 }
 
 // Encode returns the header in the form of a byte array. A more in depth explanation of this method is that it takes
@@ -109,6 +367,22 @@ func (h header) Encode() []byte {
 	return b[:]
 }
 
+// Decode reads the header from the provided byte array. This is the inverse of Encode.
+func (h *header) Decode(buf []byte) {
+	*h = *(*header)(unsafe.Pointer(&buf[0]))
+}
+
+// blockIV derives the IV for the data at the provided offset from the table's base IV. The last 4 bytes of the base IV
+// are replaced with the offset, this way every block in a table gets a unique IV without needing to store one for each
+// block. The offset is in bytes while each step of the AES-CTR counter covers 16 bytes, so the counters used for one
+// block can never reach the counters of the next block.
+func blockIV(baseIV []byte, offset uint32) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, baseIV[:aes.BlockSize-4])
+	binary.BigEndian.PutUint32(iv[aes.BlockSize-4:], offset)
+	return iv
+}
+
 // newBuffer is just a simple wrapper function to create a bytes.Buffer of a specific size easily.
 func newBuffer(size int) *bytes.Buffer {
 	b := new(bytes.Buffer)
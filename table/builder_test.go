@@ -1,8 +1,11 @@
 package table
 
 import (
-	"github.com/stretchr/testify/assert"
+	"fmt"
 	"testing"
+
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestHeader_Encode(t *testing.T) {
@@ -28,3 +31,27 @@ func BenchmarkHeader_Encode1(b *testing.B) {
 		_ = h.Encode()
 	}
 }
+
+// BenchmarkBuilder_Finish measures finishing a large table. The checksums of the blocks are calculated as the entries
+// are added, so finishing the table only has to write the last block and the index.
+func BenchmarkBuilder_Finish(b *testing.B) {
+	opts := getTestTableOptions()
+	value := z.ValueStruct{Value: make([]byte, 100)}
+	keys := make([][]byte, 200000)
+	for i := range keys {
+		keys[i] = z.KeyWithTs([]byte(fmt.Sprintf("key%08d", i)), 0)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		builder := NewBuilder(opts)
+		for _, key := range keys {
+			builder.Add(key, value, 0)
+		}
+		b.StartTimer()
+
+		_ = builder.Finish()
+	}
+}
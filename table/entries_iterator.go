@@ -0,0 +1,157 @@
+package table
+
+import (
+	"encoding/binary"
+
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/pkg/errors"
+)
+
+type (
+	// EntriesIterator walks the entries of the raw data of a table from the first block to the last without using the
+	// table's index. This allows entries to be salvaged from a table with a damaged index, as long as the blocks are
+	// intact. Since the index is not read, the blocks of encrypted tables can't be decrypted and nothing is found.
+	EntriesIterator struct {
+		data []byte
+
+		// offset is the offset of the current block within the data, and end is the offset right after it.
+		offset, end int
+
+		bi  blockIterator
+		err error
+	}
+)
+
+// NewEntriesIterator returns an iterator over the entries of the blocks in the provided table data.
+func NewEntriesIterator(data []byte) *EntriesIterator {
+	return &EntriesIterator{data: data}
+}
+
+// Rewind moves the iterator to the first entry of the first block.
+func (itr *EntriesIterator) Rewind() {
+	itr.offset, itr.end = 0, 0
+	itr.nextBlock()
+}
+
+// Next moves the iterator to the next entry. Once the entries of a block have been read the block after it is found.
+func (itr *EntriesIterator) Next() {
+	itr.bi.next()
+	if !itr.bi.Valid() {
+		itr.nextBlock()
+	}
+}
+
+// Valid returns true while the iterator is positioned on an entry.
+func (itr *EntriesIterator) Valid() bool {
+	return itr.err == nil && itr.bi.Valid()
+}
+
+// Key returns the key of the current entry, including the timestamp.
+func (itr *EntriesIterator) Key() []byte {
+	return itr.bi.key
+}
+
+// Value returns the value of the current entry.
+func (itr *EntriesIterator) Value() (ret z.ValueStruct) {
+	if err := ret.Unmarshal(itr.bi.value); err != nil {
+		itr.err = err
+	}
+	return
+}
+
+// Error returns the reason the iterator stopped. Once the last block of a table has been read the index follows it,
+// which is not a block, so an error is returned even for a table that is not damaged. Offset tells how much of the
+// data could be read.
+func (itr *EntriesIterator) Error() error {
+	return itr.err
+}
+
+// Offset returns the offset right after the last block that was found. For a table that is not damaged this is where
+// the index starts once every entry has been read.
+func (itr *EntriesIterator) Offset() int {
+	return itr.end
+}
+
+// nextBlock finds the block that starts where the current block ends and moves the iterator to its first entry. The
+// iteration stops at the first block that can't be found or read.
+func (itr *EntriesIterator) nextBlock() {
+	itr.offset = itr.end
+	blk, err := findBlock(itr.data, itr.offset)
+	if err != nil {
+		itr.err = err
+		return
+	}
+
+	itr.end = itr.offset + len(blk.data) + 4 + blk.checksumLength
+	itr.bi.setBlock(blk)
+	itr.bi.seekToFirst()
+	if err := itr.bi.Error(); err != nil {
+		itr.err = errors.Wrapf(err, "failed to read the block at offset %d", itr.offset)
+	}
+}
+
+// findBlock looks for a block that starts at the provided offset. Blocks do not store their length at the start, so
+// every possible end of the block is tried until the footer of the block is consistent and its checksum matches.
+//
+// Block layout: Entries | Entry Offsets | Entry Offsets Count (uint32) | Checksum | Checksum Size (uint32)
+func findBlock(data []byte, offset int) (*block, error) {
+	// The smallest block has a single entry with an empty key and value.
+	minimumSize := int(headerSize) + z.ValueStructHeaderSize + 4 + 4 + 1 + 4
+	for end := offset + minimumSize; end <= len(data); end++ {
+		checksumLength := int(binary.BigEndian.Uint32(data[end-4 : end]))
+		switch checksumLength {
+		case 1 + 4, 1 + 8, legacyChecksumSize:
+		default:
+			continue
+		}
+
+		checksumStart := end - 4 - checksumLength
+		countStart := checksumStart - 4
+		if countStart < offset {
+			continue
+		}
+
+		count := int64(binary.BigEndian.Uint32(data[countStart:checksumStart]))
+		entriesIndexStart := int64(countStart) - (count * 4)
+		if count == 0 || entriesIndexStart < int64(offset)+int64(headerSize) {
+			continue
+		}
+
+		// The first entry starts the block and every entry must start after the one before it.
+		entryOffsets := z.BytesToU32Slice(data[entriesIndexStart:countStart])
+		if !validEntryOffsets(entryOffsets, int(entriesIndexStart)-offset) {
+			continue
+		}
+
+		if verifyChecksum(data[offset:checksumStart], data[checksumStart:end-4]) != nil {
+			continue
+		}
+
+		return &block{
+			offset:            offset,
+			data:              data[offset:checksumStart],
+			checksum:          data[checksumStart : end-4],
+			entriesIndexStart: int(entriesIndexStart) - offset,
+			entryOffsets:      entryOffsets,
+			checksumLength:    checksumLength,
+		}, nil
+	}
+
+	return nil, errors.Errorf("no block could be found at offset %d", offset)
+}
+
+// validEntryOffsets returns true if the entry offsets start at the beginning of the block, are increasing and are all
+// within the entries of the block.
+func validEntryOffsets(entryOffsets []uint32, entriesSize int) bool {
+	if entryOffsets[0] != 0 {
+		return false
+	}
+
+	for i := 1; i < len(entryOffsets); i++ {
+		if entryOffsets[i] <= entryOffsets[i-1] {
+			return false
+		}
+	}
+
+	return int(entryOffsets[len(entryOffsets)-1]) < entriesSize
+}
@@ -0,0 +1,413 @@
+package table
+
+import (
+	"bytes"
+	"io"
+	"sort"
+
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/pkg/errors"
+)
+
+type (
+	blockIterator struct {
+		data         []byte
+		idx          int // Idx of the entry inside a block
+		err          error
+		baseKey      []byte
+		key          []byte
+		value        []byte
+		entryOffsets []uint32
+
+		// previousOverlap stores the overlap of the previous key with the base key. This avoids unnecessary copies of
+		// the base key when the overlap is the same for multiple keys.
+		previousOverlap uint16
+	}
+
+	// Iterator is an iterator for a Table.
+	Iterator struct {
+		t        *Table
+		blockPos int
+		bi       blockIterator
+		err      error
+
+		// Internally, Iterator is bidirectional. However, we only expose the unidirectional functionality for now.
+		reversed bool
+
+		// noCache is set when the blocks are neither read from nor added to the block cache.
+		noCache bool
+	}
+)
+
+func (itr *blockIterator) setBlock(b *block) {
+	itr.err = nil
+	itr.idx = 0
+	itr.baseKey = itr.baseKey[:0]
+	itr.previousOverlap = 0
+	itr.key = itr.key[:0]
+	itr.value = itr.value[:0]
+
+	// Drop the index from the block. We don't need it anymore.
+	itr.data = b.data[:b.entriesIndexStart]
+	itr.entryOffsets = b.entryOffsets
+}
+
+// setIdx sets the iterator to the entry at index i and sets its key and value.
+func (itr *blockIterator) setIdx(i int) {
+	itr.idx = i
+	if i >= len(itr.entryOffsets) || i < 0 {
+		itr.err = io.EOF
+		return
+	}
+	itr.err = nil
+	startOffset := int(itr.entryOffsets[i])
+
+	// Set base key.
+	if len(itr.baseKey) == 0 {
+		var baseHeader header
+		baseHeader.Decode(itr.data)
+		// The lengths are added as ints, the sum would overflow a uint16 for a key close to the maximum size.
+		itr.baseKey = itr.data[headerSize : int(headerSize)+int(baseHeader.diff)]
+	}
+
+	var endOffset int
+	// idx points to the last entry in the block.
+	if itr.idx+1 == len(itr.entryOffsets) {
+		endOffset = len(itr.data)
+	} else {
+		// idx point to some entry other than the last one in the block. EndOffset of the current entry would be the
+		// start offset of the next entry.
+		endOffset = int(itr.entryOffsets[itr.idx+1])
+	}
+
+	entryData := itr.data[startOffset:endOffset]
+	var h header
+	h.Decode(entryData)
+
+	// Header contains the length of key overlap and difference compared to the base key. If the key before this one
+	// had the same or better key overlap, we can avoid copying that part into key.
+	if h.overlap > itr.previousOverlap {
+		itr.key = append(itr.key[:itr.previousOverlap], itr.baseKey[itr.previousOverlap:h.overlap]...)
+	}
+	itr.previousOverlap = h.overlap
+
+	valueOffset := int(headerSize) + int(h.diff)
+	diffKey := entryData[headerSize:valueOffset]
+	itr.key = append(itr.key[:h.overlap], diffKey...)
+	itr.value = entryData[valueOffset:]
+	if len(itr.value) < z.ValueStructHeaderSize {
+		itr.err = errors.Errorf("value of entry %d in block is truncated, only %d bytes", i, len(itr.value))
+	}
+}
+
+func (itr *blockIterator) Valid() bool {
+	return itr != nil && itr.err == nil
+}
+
+func (itr *blockIterator) Error() error {
+	return itr.err
+}
+
+func (itr *blockIterator) Close() {}
+
+var (
+	origin  = 0
+	current = 1
+)
+
+// seek brings us to the first block element that is >= input key.
+func (itr *blockIterator) seek(key []byte, whence int) {
+	itr.err = nil
+	startIndex := 0 // This tells from which index we should start binary search.
+
+	switch whence {
+	case origin:
+		// We don't need to do anything. startIndex is already at 0
+	case current:
+		startIndex = itr.idx
+	}
+
+	foundEntryIdx := sort.Search(len(itr.entryOffsets), func(idx int) bool {
+		// If idx is less than start index then just return false.
+		if idx < startIndex {
+			return false
+		}
+		itr.setIdx(idx)
+		return z.CompareKeys(itr.key, key) >= 0
+	})
+	itr.setIdx(foundEntryIdx)
+}
+
+// seekToFirst brings us to the first element.
+func (itr *blockIterator) seekToFirst() {
+	itr.setIdx(0)
+}
+
+// seekToLast brings us to the last element.
+func (itr *blockIterator) seekToLast() {
+	itr.setIdx(len(itr.entryOffsets) - 1)
+}
+
+func (itr *blockIterator) next() {
+	itr.setIdx(itr.idx + 1)
+}
+
+func (itr *blockIterator) prev() {
+	itr.setIdx(itr.idx - 1)
+}
+
+// NewIterator returns a new iterator of the Table
+func (t *Table) NewIterator(reversed bool) *Iterator {
+	return t.newIterator(reversed, false)
+}
+
+// NewNoCacheIterator returns a new iterator of the Table like NewIterator, but the blocks it reads are neither read
+// from nor added to the block cache. This keeps large scans from evicting the blocks that other reads need.
+func (t *Table) NewNoCacheIterator(reversed bool) *Iterator {
+	return t.newIterator(reversed, true)
+}
+
+func (t *Table) newIterator(reversed, noCache bool) *Iterator {
+	t.IncrementReference() // Important.
+	ti := &Iterator{t: t, reversed: reversed, noCache: noCache}
+	ti.next()
+	return ti
+}
+
+// Close closes the iterator (and it must be called).
+func (itr *Iterator) Close() error {
+	return itr.t.DecrementReference()
+}
+
+func (itr *Iterator) reset() {
+	itr.blockPos = 0
+	itr.err = nil
+}
+
+// Valid follows the z.Iterator interface
+func (itr *Iterator) Valid() bool {
+	return itr.err == nil
+}
+
+// Err follows the z.Iterator interface. A block that could not be read, or an entry within a block that is corrupt,
+// stops the iteration with an error.
+func (itr *Iterator) Err() error {
+	if errors.Cause(itr.err) == io.EOF {
+		return nil
+	}
+
+	return itr.err
+}
+
+func (itr *Iterator) seekToFirst() {
+	numBlocks := len(itr.t.blockIndex)
+	if numBlocks == 0 {
+		itr.err = io.EOF
+		return
+	}
+	itr.blockPos = 0
+	block, err := itr.t.block(itr.blockPos, !itr.noCache)
+	if err != nil {
+		itr.err = err
+		return
+	}
+	itr.bi.setBlock(block)
+	itr.bi.seekToFirst()
+	itr.err = itr.bi.Error()
+}
+
+func (itr *Iterator) seekToLast() {
+	numBlocks := len(itr.t.blockIndex)
+	if numBlocks == 0 {
+		itr.err = io.EOF
+		return
+	}
+	itr.blockPos = numBlocks - 1
+	block, err := itr.t.block(itr.blockPos, !itr.noCache)
+	if err != nil {
+		itr.err = err
+		return
+	}
+	itr.bi.setBlock(block)
+	itr.bi.seekToLast()
+	itr.err = itr.bi.Error()
+}
+
+func (itr *Iterator) seekHelper(blockIdx int, key []byte) {
+	itr.blockPos = blockIdx
+	block, err := itr.t.block(blockIdx, !itr.noCache)
+	if err != nil {
+		itr.err = err
+		return
+	}
+	itr.bi.setBlock(block)
+	itr.bi.seek(key, origin)
+	itr.err = itr.bi.Error()
+}
+
+// seekFrom brings us to a key that is >= input key.
+func (itr *Iterator) seekFrom(key []byte, whence int) {
+	itr.err = nil
+	switch whence {
+	case origin:
+		itr.reset()
+	case current:
+	}
+
+	idx := sort.Search(len(itr.t.blockIndex), func(idx int) bool {
+		ko := itr.t.blockIndex[idx]
+		return z.CompareKeys(ko.Key, key) > 0
+	})
+	if idx == 0 {
+		// The smallest key in our table is already strictly > key. We can return that. This is like a SeekToFirst.
+		itr.seekHelper(0, key)
+		return
+	}
+
+	// block[idx].smallest is > key.
+	// Since idx>0, we know block[idx-1].smallest is <= key.
+	// There are two cases.
+	// 1) Everything in block[idx-1] is strictly < key. In this case, we should go to the first element of block[idx].
+	// 2) Some element in block[idx-1] is >= key. We should go to that element.
+	itr.seekHelper(idx-1, key)
+	if errors.Cause(itr.err) == io.EOF {
+		// Case 1. Need to visit block[idx].
+		if idx == len(itr.t.blockIndex) {
+			// If idx == len(itr.t.blockIndex), then input key is greater than ANY element of table. There's nothing we
+			// can do. Valid() should return false as we seek to end of table.
+			return
+		}
+		// Since block[idx].smallest is > key. This is essentially a block[idx].SeekToFirst.
+		itr.seekHelper(idx, key)
+	}
+	// Case 2: No need to do anything. We already did the seek in block[idx-1].
+}
+
+// seek will reset iterator and seek to >= key.
+func (itr *Iterator) seek(key []byte) {
+	itr.seekFrom(key, origin)
+}
+
+// seekForPrev will reset iterator and seek to <= key.
+func (itr *Iterator) seekForPrev(key []byte) {
+	// TODO: Optimize this. We shouldn't have to take a Prev step.
+	itr.seekFrom(key, origin)
+	if !bytes.Equal(itr.Key(), key) {
+		itr.prev()
+	}
+}
+
+func (itr *Iterator) next() {
+	itr.err = nil
+
+	if itr.blockPos >= len(itr.t.blockIndex) {
+		itr.err = io.EOF
+		return
+	}
+
+	if len(itr.bi.data) == 0 {
+		block, err := itr.t.block(itr.blockPos, !itr.noCache)
+		if err != nil {
+			itr.err = err
+			return
+		}
+		itr.bi.setBlock(block)
+		itr.bi.seekToFirst()
+		itr.err = itr.bi.Error()
+		return
+	}
+
+	itr.bi.next()
+	if !itr.bi.Valid() {
+		// Only the end of the block moves on to the next block.
+		if err := itr.bi.Error(); err != io.EOF {
+			itr.err = err
+			return
+		}
+		itr.blockPos++
+		itr.bi.data = nil
+		itr.next()
+		return
+	}
+}
+
+func (itr *Iterator) prev() {
+	itr.err = nil
+	if itr.blockPos < 0 {
+		itr.err = io.EOF
+		return
+	}
+
+	if len(itr.bi.data) == 0 {
+		block, err := itr.t.block(itr.blockPos, !itr.noCache)
+		if err != nil {
+			itr.err = err
+			return
+		}
+		itr.bi.setBlock(block)
+		itr.bi.seekToLast()
+		itr.err = itr.bi.Error()
+		return
+	}
+
+	itr.bi.prev()
+	if !itr.bi.Valid() {
+		if err := itr.bi.Error(); err != io.EOF {
+			itr.err = err
+			return
+		}
+		itr.blockPos--
+		itr.bi.data = nil
+		itr.prev()
+		return
+	}
+}
+
+// Key follows the z.Iterator interface. Returns the key with timestamp.
+func (itr *Iterator) Key() []byte {
+	return itr.bi.key
+}
+
+// Value follows the z.Iterator interface
+func (itr *Iterator) Value() (ret z.ValueStruct) {
+	if err := ret.Unmarshal(itr.bi.value); err != nil {
+		itr.err = err
+	}
+	return
+}
+
+// ValueCopy copies the current value and returns it as decoded ValueStruct.
+func (itr *Iterator) ValueCopy() (ret z.ValueStruct) {
+	dst := z.Copy(itr.bi.value)
+	if err := ret.Unmarshal(dst); err != nil {
+		itr.err = err
+	}
+	return
+}
+
+// Next follows the z.Iterator interface
+func (itr *Iterator) Next() {
+	if !itr.reversed {
+		itr.next()
+	} else {
+		itr.prev()
+	}
+}
+
+// Rewind follows the z.Iterator interface
+func (itr *Iterator) Rewind() {
+	if !itr.reversed {
+		itr.seekToFirst()
+	} else {
+		itr.seekToLast()
+	}
+}
+
+// Seek follows the z.Iterator interface
+func (itr *Iterator) Seek(key []byte) {
+	if !itr.reversed {
+		itr.seek(key)
+	} else {
+		itr.seekForPrev(key)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/dgraph-io/ristretto"
 	"github.com/elliotcourant/notbadger/options"
 	"github.com/elliotcourant/notbadger/pb"
+	"github.com/elliotcourant/notbadger/z"
 )
 
 type (
@@ -17,9 +18,23 @@ type (
 		// LoadingMode is the mode to be used for loading Table.
 		LoadingMode options.FileLoadingMode
 
+		// ReadAhead tells the kernel that a memory mapped table will be read sequentially, so pages can be read ahead.
+		// Otherwise the pages are expected to be read in a random order, which suits point reads. This is only used
+		// with options.MemoryMap.
+		ReadAhead bool
+
+		// ReferenceTracker records the tables that still have references and the callers that took and released
+		// them, so a reference that is leaked or released twice can be traced back to where it came from. This is
+		// meant for debugging and tests.
+		ReferenceTracker *ReferenceTracker
+
+		// FileSystem is used to create and remove the files of tables. The os package is used when this is nil.
+		FileSystem z.FileSystem
+
 		// Options for Table builder.
 
-		// BloomFalsePositive is the false positive probabiltiy of bloom filter.
+		// BloomFalsePositive is the false positive probabiltiy of bloom filter. Setting this to zero disables the
+		// bloom filter, tables are built without one and the filters of existing tables are not loaded.
 		BloomFalsePositive float64
 
 		// BlockSize is the size of each block inside SSTable in bytes.
@@ -28,6 +43,10 @@ type (
 		// DataKey is the key used to decrypt the encrypted text.
 		DataKey *pb.DataKey
 
+		// ChecksumType is the algorithm used to checksum blocks and the index. Tables record the algorithm with each
+		// checksum, so tables can always be read regardless of this option.
+		ChecksumType options.ChecksumType
+
 		// Compression indicates the compression algorithm used for block compression.
 		Compression options.CompressionType
 
@@ -37,3 +56,12 @@ type (
 		ZSTDCompressionLevel int
 	}
 )
+
+// fileSystem returns the file system the files of tables are created and removed with.
+func (o *Options) fileSystem() z.FileSystem {
+	if o.FileSystem == nil {
+		return z.OSFileSystem
+	}
+
+	return o.FileSystem
+}
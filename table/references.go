@@ -0,0 +1,107 @@
+package table
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	// ReferenceTracker keeps track of every table opened with it that still has references. A table is removed once
+	// all of its references have been released.
+	ReferenceTracker struct {
+		sync.Mutex
+		tables map[*Table]struct{}
+	}
+)
+
+// NewReferenceTracker creates an empty reference tracker.
+func NewReferenceTracker() *ReferenceTracker {
+	return &ReferenceTracker{
+		tables: map[*Table]struct{}{},
+	}
+}
+
+// add starts tracking a table once it has been opened, nothing is tracked if the reference tracker is nil.
+func (r *ReferenceTracker) add(t *Table) {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.tables[t] = struct{}{}
+}
+
+// remove stops tracking a table once it has no references left or has been closed.
+func (r *ReferenceTracker) remove(t *Table) {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	delete(r.tables, t)
+}
+
+// Tables returns the tables that have not released all of their references yet.
+func (r *ReferenceTracker) Tables() []*Table {
+	r.Lock()
+	defer r.Unlock()
+
+	tables := make([]*Table, 0, len(r.tables))
+	for t := range r.tables {
+		tables = append(tables, t)
+	}
+
+	return tables
+}
+
+// ReferenceCallers describes the callers that are holding references to the table. A caller that released more
+// references than it took is listed with a negative count, since references are often released somewhere other than
+// where they were taken. This is only available when the table was opened with a ReferenceTracker.
+func (t *Table) ReferenceCallers() string {
+	if t.options.ReferenceTracker == nil {
+		return "references are not tracked"
+	}
+
+	t.referenceCallersLock.Lock()
+	defer t.referenceCallersLock.Unlock()
+
+	callers := make([]string, 0, len(t.referenceCallers))
+	for caller, count := range t.referenceCallers {
+		if count != 0 {
+			callers = append(callers, fmt.Sprintf("%s (%d)", caller, count))
+		}
+	}
+	sort.Strings(callers)
+
+	return strings.Join(callers, ", ")
+}
+
+// trackReference records that the caller of the exported method that called this took or released a reference, and
+// removes the table from the reference tracker once it has no references left.
+func (t *Table) trackReference(delta int, references int32) {
+	tracker := t.options.ReferenceTracker
+	if tracker == nil {
+		return
+	}
+
+	caller := "unknown"
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = fmt.Sprintf("%s:%d", file, line)
+	}
+
+	t.referenceCallersLock.Lock()
+	if t.referenceCallers == nil {
+		t.referenceCallers = map[string]int{}
+	}
+	t.referenceCallers[caller] += delta
+	t.referenceCallersLock.Unlock()
+
+	if references <= 0 {
+		tracker.remove(t)
+	}
+}
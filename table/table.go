@@ -1,12 +1,19 @@
 package table
 
 import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
 	"fmt"
+	"github.com/OneOfOne/xxhash"
 	b "github.com/dgraph-io/ristretto/z"
+	"github.com/dgryski/go-farm"
 	"github.com/elliotcourant/notbadger/options"
 	"github.com/elliotcourant/notbadger/pb"
 	"github.com/elliotcourant/notbadger/z"
 	"github.com/pkg/errors"
+	"hash"
+	"hash/crc32"
 	"io"
 	"os"
 	"sync"
@@ -16,6 +23,13 @@ import (
 
 const (
 	intSize = int(unsafe.Sizeof(int(0)))
+
+	// legacyChecksumSize is the size of the xxhash checksums that were written before the checksum type was stored
+	// alongside the checksum.
+	legacyChecksumSize = 8
+
+	// maxChecksumSize is the largest size of a checksum, including the checksum type.
+	maxChecksumSize = 1 + 8
 )
 
 type (
@@ -43,10 +57,24 @@ type (
 		bloomFilter       *b.Bloom
 		Checksum          []byte // TODO Maybe xxhash this?
 
+		// baseIV is read from the end of the index when the table is encrypted. It is used to derive the IV for every
+		// block in the table.
+		baseIV []byte
+
 		// Stores the total size of key-values stored in this table (including the size on vlog).
 		estimatedSize uint64
+		keyCount      uint32
 		IsInMemory    bool
 		options       *Options
+
+		// blockReads is the number of blocks that have been read from the table's data rather than the cache. Must be
+		// accessed via atomics.
+		blockReads uint64
+
+		// referenceCallers counts the references taken and released by each caller when Options.ReferenceTracker is
+		// set, a reference taken is counted as 1 and a reference released as -1.
+		referenceCallersLock sync.Mutex
+		referenceCallers     map[string]int
 	}
 
 	block struct {
@@ -75,6 +103,11 @@ func OpenTable(file *os.File, opts Options) (*Table, error) {
 		return nil, errors.Errorf("invalid filename: %s", fileName)
 	}
 
+	if err := ValidateCompression(opts.Compression); err != nil {
+		_ = file.Close()
+		return nil, errors.Wrapf(err, "cannot open table %d in partition %d", fileId, partitionId)
+	}
+
 	table := &Table{
 		file:        file,
 		references:  1, // Caller is given one reference.
@@ -113,6 +146,12 @@ func OpenTable(file *os.File, opts Options) (*Table, error) {
 			_ = table.file.Close()
 			return nil, z.Wrapf(err, "unable to map file: %q", fileInfo.Name())
 		}
+
+		if err = z.Madvise(table.memoryMap, opts.ReadAhead); err != nil {
+			_ = z.Munmap(table.memoryMap)
+			_ = table.file.Close()
+			return nil, z.Wrapf(err, "unable to advise memory map of file: %q", fileInfo.Name())
+		}
 	case options.FileIO:
 		// If we are not loading the table into memory in any form then make sure the memory map table gets set to nil
 		// so that we don't use it.
@@ -121,9 +160,436 @@ func OpenTable(file *os.File, opts Options) (*Table, error) {
 		panic(fmt.Sprintf("invalid loading mode: %v", opts.LoadingMode))
 	}
 
-	// TODO (elliotcourant) build init head and tail.
+	if err := table.initBiggestAndSmallest(); err != nil {
+		return nil, errors.Wrapf(err, "failed to initialize table")
+	}
+
+	if opts.ChkMode == options.OnTableRead || opts.ChkMode == options.OnTableAndBlockRead {
+		if err := table.VerifyChecksum(); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	table.trackReference(1, 1)
+	table.options.ReferenceTracker.add(table)
+
+	return table, nil
+}
+
+// OpenInMemoryTable is similar to OpenTable but it opens a new table from the provided data. The table is not written
+// to disk, so it is used when the database is running in memory or when level 0 tables are kept in memory. An in
+// memory table can be written to disk later with Persist.
+func OpenInMemoryTable(data []byte, partitionId uint32, fileId uint64, opts *Options) (*Table, error) {
+	if err := ValidateCompression(opts.Compression); err != nil {
+		return nil, errors.Wrapf(err, "cannot open table %d in partition %d", fileId, partitionId)
+	}
+
+	opts.LoadingMode = options.LoadToRAM
+	table := &Table{
+		references:  1, // Caller is given one reference.
+		partitionId: partitionId,
+		fileId:      fileId,
+		IsInMemory:  true,
+		options:     opts,
+		memoryMap:   data,
+		tableSize:   len(data),
+	}
+
+	if err := table.initBiggestAndSmallest(); err != nil {
+		return nil, errors.Wrapf(err, "failed to initialize in memory table")
+	}
+	table.trackReference(1, 1)
+	table.options.ReferenceTracker.add(table)
+
+	return table, nil
+}
+
+// Persist writes the data of an in memory table to a new file in the provided directory and opens that file as a table
+// with the provided options. The in memory table is not changed, the caller still has to release its reference to it.
+func (t *Table) Persist(directory string, opts Options) (*Table, error) {
+	if !t.IsInMemory {
+		return nil, errors.Errorf("table %d in partition %d is already on disk", t.fileId, t.partitionId)
+	}
+
+	fileName := NewFilename(t.partitionId, t.fileId, directory)
+	file, err := z.CreateSyncedFile(opts.fileSystem(), fileName, true)
+	if err != nil {
+		return nil, z.Wrapf(err, "failed to create table file: %q", fileName)
+	}
+
+	if _, err := file.Write(t.memoryMap); err != nil {
+		_ = file.Close()
+		return nil, z.Wrapf(err, "failed to write table file: %q", fileName)
+	}
+
+	return OpenTable(file, opts)
+}
+
+// ValidateCompression returns an error if blocks compressed with the compression type cannot be read. Blocks are not
+// compressed by this build yet, so only options.None is supported.
+func ValidateCompression(compression options.CompressionType) error {
+	switch compression {
+	case options.None:
+		return nil
+	case options.Snappy, options.ZSTD:
+		return errors.Errorf("%s compression is not supported", compression)
+	default:
+		return errors.Errorf("unknown compression type %d", compression)
+	}
+}
+
+// initBiggestAndSmallest reads the index of the table and then sets the smallest and largest keys of the table.
+func (t *Table) initBiggestAndSmallest() error {
+	if err := t.initIndex(); err != nil {
+		return err
+	}
+
+	if len(t.blockIndex) == 0 {
+		return errors.Errorf("table %s does not have any blocks", t.Filename())
+	}
+	t.smallest = t.blockIndex[0].Key
+
+	iterator := t.NewIterator(true)
+	defer iterator.Close()
+	iterator.Rewind()
+	if !iterator.Valid() {
+		if err := iterator.Err(); err != nil {
+			return z.Wrapf(err, "failed to initialize biggest for table %s", t.Filename())
+		}
+		return errors.Errorf("failed to initialize biggest for table %s", t.Filename())
+	}
+	t.largest = iterator.Key()
 
-	return nil, nil
+	return nil
+}
+
+// initIndex reads the index from the footer of the table, verifying its checksum and decrypting it if the table is
+// encrypted. A table that is corrupted returns an error rather than crashing, the footer can point anywhere if the file
+// is damaged.
+func (t *Table) initIndex() error {
+	readPosition := t.tableSize
+
+	// Read the checksum length from the last 4 bytes.
+	readPosition -= 4
+	buf, err := t.read(readPosition, 4)
+	if err != nil {
+		return z.Wrapf(err, "failed to read checksum length for table: %s", t.Filename())
+	}
+	checksumLength := int(binary.BigEndian.Uint32(buf))
+	if checksumLength < 0 {
+		return errors.New("checksum length less than zero. Data corrupted")
+	}
+
+	// Read the checksum.
+	readPosition -= checksumLength
+	expectedChecksum, err := t.read(readPosition, checksumLength)
+	if err != nil {
+		return z.Wrapf(err, "failed to read checksum for table: %s", t.Filename())
+	}
+
+	// Read the index size.
+	readPosition -= 4
+	buf, err = t.read(readPosition, 4)
+	if err != nil {
+		return z.Wrapf(err, "failed to read index size for table: %s", t.Filename())
+	}
+	indexLength := int(binary.BigEndian.Uint32(buf))
+
+	// Read the index.
+	readPosition -= indexLength
+	indexStart := readPosition
+	data, err := t.read(readPosition, indexLength)
+	if err != nil {
+		return z.Wrapf(err, "failed to read index for table: %s", t.Filename())
+	}
+
+	if err := verifyChecksum(data, expectedChecksum); err != nil {
+		return z.Wrapf(err, "failed to verify checksum for table: %s", t.Filename())
+	}
+
+	if t.shouldDecrypt() {
+		if len(data) < aes.BlockSize {
+			return errors.Errorf("encrypted index is too small for table: %s", t.Filename())
+		}
+
+		// The base IV is stored in plaintext at the end of the encrypted index.
+		t.baseIV = z.Copy(data[len(data)-aes.BlockSize:])
+
+		if data, err = t.decrypt(data[:len(data)-aes.BlockSize], uint32(indexStart)); err != nil {
+			return z.Wrapf(err, "error while decrypting table index for table %s", t.Filename())
+		}
+	}
+
+	index := pb.TableIndex{}
+	if err := index.Unmarshal(data); err != nil {
+		return z.Wrapf(err, "failed to read table index for table %s", t.Filename())
+	}
+
+	// Tables written before bloom filters were added to the index or with the bloom filter disabled do not have one,
+	// DoesNotHave handles a nil filter. The filter is not loaded either if it is disabled when the table is opened.
+	if len(index.BloomFilter) > 0 && t.options.BloomFalsePositive > 0 {
+		t.bloomFilter = b.JSONUnmarshal(index.BloomFilter)
+	}
+	t.estimatedSize = index.EstimatedSize
+	t.keyCount = index.KeyCount
+	t.blockIndex = index.Offsets
+
+	return nil
+}
+
+// read returns size bytes from the table starting at the provided offset. When the table is loaded into memory the
+// returned bytes will reference the memory map directly. Reads outside of the table return an error.
+func (t *Table) read(offset, size int) ([]byte, error) {
+	if offset < 0 || size < 0 || offset+size > t.tableSize {
+		return nil, errors.Errorf("cannot read %d bytes at offset %d from table %s of size %d",
+			size, offset, t.Filename(), t.tableSize)
+	}
+
+	if len(t.memoryMap) > 0 {
+		if len(t.memoryMap[offset:]) < size {
+			return nil, io.EOF
+		}
+
+		return t.memoryMap[offset : offset+size], nil
+	}
+
+	result := make([]byte, size)
+	_, err := t.file.ReadAt(result, int64(offset))
+	return result, err
+}
+
+// block returns the block at the provided index in the table. If a cache is configured and useCache is true then the
+// block will be read from the cache when possible, and added to it otherwise.
+func (t *Table) block(idx int, useCache bool) (*block, error) {
+	z.AssertTruef(idx >= 0, "idx=%d", idx)
+	if idx >= len(t.blockIndex) {
+		return nil, errors.New("block out of index")
+	}
+
+	if t.options.Cache != nil && useCache {
+		key := t.blockCacheKey(idx)
+		if blk, ok := t.options.Cache.Get(key); ok && blk != nil {
+			return blk.(*block), nil
+		}
+	}
+
+	atomic.AddUint64(&t.blockReads, 1)
+	offset := t.blockIndex[idx]
+	blk := &block{
+		offset: int(offset.Offset),
+	}
+
+	var err error
+	if blk.data, err = t.read(blk.offset, int(offset.Length)); err != nil {
+		return nil, z.Wrapf(err,
+			"failed to read from file: %s at offset: %d, len: %d", t.file.Name(), blk.offset, offset.Length)
+	}
+
+	if t.shouldDecrypt() {
+		// Decrypt the block if it is encrypted.
+		if blk.data, err = t.decrypt(blk.data, offset.Offset); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every block ends with the entry count, the checksum and the checksum length.
+	if len(blk.data) < 8 {
+		return nil, errors.Errorf("block %d in table %s is too small: %d bytes", idx, t.Filename(), len(blk.data))
+	}
+
+	// Read the checksum and the checksum length from the end of the block.
+	readPosition := len(blk.data) - 4 // First read the checksum length.
+	blk.checksumLength = int(binary.BigEndian.Uint32(blk.data[readPosition : readPosition+4]))
+
+	// The checksum length cannot be negative and cannot be longer than the rest of the block, which still has to hold
+	// the entry count.
+	if blk.checksumLength < 0 || blk.checksumLength > readPosition-4 {
+		return nil, errors.New("invalid checksum length. Either the data is corrupted or the table options " +
+			"are incorrectly set")
+	}
+
+	// Read the checksum and then the number of entries in the block.
+	readPosition -= blk.checksumLength
+	blk.checksum = blk.data[readPosition : readPosition+blk.checksumLength]
+
+	readPosition -= 4
+	numberOfEntries := int(binary.BigEndian.Uint32(blk.data[readPosition : readPosition+4]))
+
+	entriesIndexStart := readPosition - (numberOfEntries * 4)
+	if entriesIndexStart < 0 {
+		return nil, errors.Errorf("invalid entry count %d for block %d in table %s",
+			numberOfEntries, idx, t.Filename())
+	}
+	blk.entryOffsets = z.BytesToU32Slice(blk.data[entriesIndexStart:readPosition])
+	blk.entriesIndexStart = entriesIndexStart
+
+	// Drop the checksum from the data since it is not needed for iterating.
+	blk.data = blk.data[:readPosition+4]
+
+	if t.options.ChkMode == options.OnBlockRead || t.options.ChkMode == options.OnTableAndBlockRead {
+		if err = blk.verifyChecksum(); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.options.Cache != nil && useCache {
+		key := t.blockCacheKey(idx)
+		t.options.Cache.Set(key, blk, blk.size())
+	}
+
+	return blk, nil
+}
+
+// blockCacheKey returns the key that the block at the provided index is stored under in the block cache. The
+// partition Id and the file Id are included since the cache is shared by every table.
+func (t *Table) blockCacheKey(idx int) []byte {
+	z.AssertTrue(idx >= 0)
+
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint32(buf[0:4], t.partitionId)
+	binary.BigEndian.PutUint64(buf[4:12], t.fileId)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(idx))
+	return buf
+}
+
+// VerifyChecksum reads every block in the table and verifies its checksum. An error is returned for the first block
+// that does not match.
+func (t *Table) VerifyChecksum() error {
+	for i := range t.blockIndex {
+		blk, err := t.block(i, true)
+		if err != nil {
+			return z.Wrapf(err, "checksum validation failed for table: %s, block: %d, offset: %d",
+				t.Filename(), i, t.blockIndex[i].Offset)
+		}
+
+		// If the checksum has already been verified when the block was read then there is no need to do it again.
+		if t.options.ChkMode == options.OnBlockRead || t.options.ChkMode == options.OnTableAndBlockRead {
+			continue
+		}
+
+		if err = blk.verifyChecksum(); err != nil {
+			return z.Wrapf(err, "checksum validation failed for table: %s, block: %d, offset: %d",
+				t.Filename(), i, blk.offset)
+		}
+	}
+
+	return nil
+}
+
+// VerifyBloom checks that the bloom filter of the table has every key in the table. A bloom filter can have false
+// positives but never false negatives, so a key that the filter does not have means the filter or the block is corrupt.
+// An error is returned for the first such key, along with the block it is in. A table without a bloom filter has
+// nothing to verify. The blocks are neither read from nor added to the block cache.
+func (t *Table) VerifyBloom() error {
+	if t.bloomFilter == nil {
+		return nil
+	}
+
+	var iterator blockIterator
+	for i := range t.blockIndex {
+		blk, err := t.block(i, false)
+		if err != nil {
+			return z.Wrapf(err, "bloom filter validation failed for table: %s, block: %d, offset: %d",
+				t.Filename(), i, t.blockIndex[i].Offset)
+		}
+
+		iterator.setBlock(blk)
+		for iterator.seekToFirst(); iterator.Valid(); iterator.next() {
+			if t.DoesNotHave(farm.Fingerprint64(z.ParseKey(iterator.key))) {
+				return errors.Errorf("bloom filter of table: %s does not have key: %q in block: %d, offset: %d",
+					t.Filename(), z.ParseKey(iterator.key), i, blk.offset)
+			}
+		}
+		if err := iterator.Error(); err != io.EOF {
+			return z.Wrapf(err, "bloom filter validation failed for table: %s, block: %d, offset: %d",
+				t.Filename(), i, blk.offset)
+		}
+	}
+
+	return nil
+}
+
+// DoesNotHave returns true if (but not "only if") the table does not have the key hash. It does a bloom filter lookup.
+// If the table does not have a bloom filter then this always returns false.
+func (t *Table) DoesNotHave(hash uint64) bool {
+	if t.bloomFilter == nil {
+		return false
+	}
+
+	return !t.bloomFilter.Has(hash)
+}
+
+// MayContain returns false if the table definitely does not have any version of the provided key. The key includes its
+// timestamp. This only checks the bloom filter, so no blocks are read.
+func (t *Table) MayContain(key []byte) bool {
+	return !t.DoesNotHave(farm.Fingerprint64(z.ParseKey(key)))
+}
+
+// Get returns the newest version of the provided key that is at or below the timestamp of the key, with the version
+// populated. An empty value is returned if the table does not have the key. The bloom filter is checked before any
+// blocks are read, so looking up a key that is not in the table is cheap.
+func (t *Table) Get(key []byte) (z.ValueStruct, error) {
+	return t.get(key, false)
+}
+
+// GetNoCache returns the newest version of the provided key like Get, but the blocks it reads are neither read from
+// nor added to the block cache.
+func (t *Table) GetNoCache(key []byte) (z.ValueStruct, error) {
+	return t.get(key, true)
+}
+
+func (t *Table) get(key []byte, noCache bool) (z.ValueStruct, error) {
+	if !t.MayContain(key) {
+		return z.ValueStruct{}, nil
+	}
+
+	iterator := t.newIterator(false, noCache)
+	iterator.Seek(key)
+	if !iterator.Valid() || !z.SameKey(key, iterator.Key()) {
+		if err := iterator.Err(); err != nil {
+			_ = iterator.Close()
+			return z.ValueStruct{}, err
+		}
+		return z.ValueStruct{}, iterator.Close()
+	}
+
+	value := iterator.ValueCopy()
+	value.Version = z.ParseTs(iterator.Key())
+	if err := iterator.Err(); err != nil {
+		_ = iterator.Close()
+		return z.ValueStruct{}, err
+	}
+
+	return value, iterator.Close()
+}
+
+// Filename is the name of the file backing the table, or an empty string if the table is only in memory.
+func (t *Table) Filename() string {
+	if t.file == nil {
+		return ""
+	}
+
+	return t.file.Name()
+}
+
+// KeyID returns the Id of the data key that was used to encrypt the table, or 0 if the table is not encrypted.
+func (t *Table) KeyID() uint64 {
+	if t.options.DataKey != nil {
+		return t.options.DataKey.KeyId
+	}
+
+	// By default 0 indicates that the table is stored in plaintext.
+	return 0
+}
+
+// shouldDecrypt returns true if the table has a data key and is therefore encrypted.
+func (t *Table) shouldDecrypt() bool {
+	return t.options.DataKey != nil
+}
+
+// decrypt decrypts the data that was read from the provided offset in the table.
+func (t *Table) decrypt(data []byte, offset uint32) ([]byte, error) {
+	return z.XORBlock(data, t.options.DataKey.Data, blockIV(t.baseIV, offset))
 }
 
 // CompressionType returns the compression algorithm used for block compression.
@@ -131,15 +597,26 @@ func (t *Table) CompressionType() options.CompressionType {
 	return t.options.Compression
 }
 
+// LoadingMode returns how the data of the table is read, either from memory or from the file.
+func (t *Table) LoadingMode() options.FileLoadingMode {
+	return t.options.LoadingMode
+}
+
 // IncrementReference bumps the reference count (having to do with whether the file should be deleted or not).
 func (t *Table) IncrementReference() {
-	atomic.AddInt32(&t.references, 1)
+	t.trackReference(1, atomic.AddInt32(&t.references, 1))
 }
 
 // DecrementReference subtracts from the reference count, and if the reference count results in 0 then that means there
 // is not a single reference left in the database for this table. The file will be deleted.
 func (t *Table) DecrementReference() error {
 	newReference := atomic.AddInt32(&t.references, -1)
+	t.trackReference(-1, newReference)
+	if newReference < 0 && t.options.ReferenceTracker != nil {
+		return errors.Errorf("table %d in partition %d was released more times than it was referenced: %s",
+			t.fileId, t.partitionId, t.ReferenceCallers())
+	}
+
 	if newReference == 0 {
 		// We can safely delete this file, because for all the current file we always have at least one reference
 		// pointing to them.
@@ -169,7 +646,7 @@ func (t *Table) DecrementReference() error {
 			return err
 		}
 
-		if err := os.Remove(fileName); err != nil {
+		if err := t.options.fileSystem().Remove(fileName); err != nil {
 			return err
 		}
 	}
@@ -177,8 +654,26 @@ func (t *Table) DecrementReference() error {
 	return nil
 }
 
+// References returns the number of references to the table that have not been released.
+func (t *Table) References() int32 {
+	return atomic.LoadInt32(&t.references)
+}
+
+// Advise changes how the kernel expects the memory map of the table to be read, overriding the ReadAhead option the
+// table was opened with. Tables that are not memory mapped are not affected.
+func (t *Table) Advise(readAhead bool) error {
+	if t.options.LoadingMode != options.MemoryMap || len(t.memoryMap) == 0 {
+		return nil
+	}
+
+	return z.Madvise(t.memoryMap, readAhead)
+}
+
 // Close closes the open table.  (Releases resources back to the OS.)
 func (t *Table) Close() error {
+	// A closed table can't be used anymore regardless of its references, so it should not be reported as leaked.
+	t.options.ReferenceTracker.remove(t)
+
 	if t.options.LoadingMode == options.MemoryMap {
 		if err := z.Munmap(t.memoryMap); err != nil {
 			return err
@@ -198,6 +693,21 @@ func (t *Table) Size() int64 {
 	return int64(t.tableSize)
 }
 
+// EstimatedSize returns the total size of the keys and values in the table, including the size of any values that are
+// stored in the value log. Tables that were written without an estimated size fall back to the size of the table.
+func (t *Table) EstimatedSize() int64 {
+	if t.estimatedSize == 0 {
+		return t.Size()
+	}
+
+	return int64(t.estimatedSize)
+}
+
+// KeyCount returns the number of entries in the table. Every version of a key is counted as its own entry.
+func (t *Table) KeyCount() uint32 {
+	return t.keyCount
+}
+
 // FileId is the table's ID number used to generate the file name.
 func (t *Table) FileId() uint64 {
 	return t.fileId
@@ -217,8 +727,78 @@ func (t *Table) Largest() []byte {
 	return t.largest
 }
 
+// verifyChecksum verifies that the checksum stored in the block matches the data in the block.
+func (b *block) verifyChecksum() error {
+	return verifyChecksum(b.data, b.checksum)
+}
+
 // size returns the total size in bytes of the block.
 func (b *block) size() int64 {
 	return int64(3*intSize /* Size of the offset, entriesIndexStart and checksumLength */ +
 		cap(b.data) + cap(b.checksum) + cap(b.entryOffsets)*4)
 }
+
+// calculateChecksum returns the checksum of the provided data prefixed with the checksum type, so the checksum can be
+// verified without knowing which checksum type the table was built with. XXHash checksums are 64 bits and all other
+// checksums are 32 bits.
+func calculateChecksum(data []byte, checksumType options.ChecksumType) ([]byte, error) {
+	if checksumType == options.XXHash {
+		checksum := make([]byte, 1+8)
+		checksum[0] = byte(checksumType)
+		binary.BigEndian.PutUint64(checksum[1:], xxhash.Checksum64(data))
+		return checksum, nil
+	}
+
+	sum, err := z.Checksum32(data, checksumType)
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := make([]byte, 1+4)
+	checksum[0] = byte(checksumType)
+	binary.BigEndian.PutUint32(checksum[1:], sum)
+	return checksum, nil
+}
+
+// newChecksumHash returns a hash that produces the same checksum as calculateChecksum, so the checksum of data that is
+// written in pieces can be calculated without reading all of the data again. The checksum is read with hashChecksum.
+func newChecksumHash(checksumType options.ChecksumType) (hash.Hash, error) {
+	switch checksumType {
+	case options.XXHash:
+		return xxhash.New64(), nil
+	case options.CRC32Castagnoli:
+		return crc32.New(z.CastagnoliCrcTable), nil
+	default:
+		return nil, errors.Wrapf(z.ErrUnknownChecksumType, "checksum type %d", checksumType)
+	}
+}
+
+// hashChecksum returns the checksum of the data that has been written to a hash from newChecksumHash, in the same
+// format as calculateChecksum.
+func hashChecksum(h hash.Hash, checksumType options.ChecksumType) []byte {
+	return h.Sum([]byte{byte(checksumType)})
+}
+
+// verifyChecksum returns an error if the checksum of the provided data does not match the expected checksum. Tables
+// that were built before the checksum type was stored have an 8 byte xxhash checksum with no checksum type.
+func verifyChecksum(data, expected []byte) error {
+	var actual []byte
+	switch len(expected) {
+	case 0:
+		return errors.New("checksum is missing")
+	case legacyChecksumSize:
+		actual = make([]byte, legacyChecksumSize)
+		binary.BigEndian.PutUint64(actual, xxhash.Checksum64(data))
+	default:
+		var err error
+		if actual, err = calculateChecksum(data, options.ChecksumType(expected[0])); err != nil {
+			return err
+		}
+	}
+
+	if !bytes.Equal(actual, expected) {
+		return errors.Errorf("checksum mismatch. actual: %x, expected: %x", actual, expected)
+	}
+
+	return nil
+}
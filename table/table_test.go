@@ -0,0 +1,548 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	b "github.com/dgraph-io/ristretto/z"
+	"github.com/dgryski/go-farm"
+	"github.com/elliotcourant/notbadger/options"
+	"github.com/elliotcourant/notbadger/pb"
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestTableOptions() Options {
+	return Options{
+		LoadingMode:        options.LoadToRAM,
+		ChkMode:            options.OnTableAndBlockRead,
+		BlockSize:          4 * 1024,
+		BloomFalsePositive: 0.01,
+	}
+}
+
+func buildTestTableData(count int, opts Options) []byte {
+	builder := NewBuilder(opts)
+	defer builder.Close()
+	for i := 0; i < count; i++ {
+		key := z.KeyWithTs([]byte(fmt.Sprintf("key%05d", i)), 0)
+		builder.Add(key, z.ValueStruct{Value: []byte(fmt.Sprintf("secret value %05d", i))}, 0)
+	}
+
+	return builder.Finish()
+}
+
+func openTestTable(t *testing.T, dir string, fileId uint64, data []byte, opts Options) (*Table, error) {
+	file, err := z.CreateSyncedFile(z.OSFileSystem, NewFilename(0, fileId, dir), true)
+	assert.NoError(t, err)
+
+	_, err = file.Write(data)
+	assert.NoError(t, err)
+
+	return OpenTable(file, opts)
+}
+
+func buildTestTable(t *testing.T, dir string, fileId uint64, count int, opts Options) *Table {
+	table, err := openTestTable(t, dir, fileId, buildTestTableData(count, opts), opts)
+	assert.NoError(t, err)
+	return table
+}
+
+func TestTable_Iterator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	count := 1000
+	table := buildTestTable(t, dir, 1, count, getTestTableOptions())
+	defer table.DecrementReference()
+
+	assert.Equal(t, z.KeyWithTs([]byte("key00000"), 0), table.Smallest())
+	assert.Equal(t, z.KeyWithTs([]byte(fmt.Sprintf("key%05d", count-1)), 0), table.Largest())
+
+	iterator := table.NewIterator(false)
+	defer iterator.Close()
+
+	i := 0
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		assert.Equal(t, z.KeyWithTs([]byte(fmt.Sprintf("key%05d", i)), 0), iterator.Key())
+		assert.Equal(t, []byte(fmt.Sprintf("secret value %05d", i)), iterator.Value().Value)
+		i++
+	}
+	assert.Equal(t, count, i)
+
+	iterator.Seek(z.KeyWithTs([]byte("key00500"), 0))
+	assert.True(t, iterator.Valid())
+	assert.Equal(t, []byte("secret value 00500"), iterator.Value().Value)
+}
+
+func TestOpenTable_Corrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	table := buildTestTable(t, dir, 1, 100, getTestTableOptions())
+	assert.NoError(t, table.Close())
+
+	// Point the checksum length past the start of the file, opening the table should fail rather than crash.
+	fileName := NewFilename(0, 1, dir)
+	data, err := ioutil.ReadFile(fileName)
+	assert.NoError(t, err)
+	for i := len(data) - 4; i < len(data); i++ {
+		data[i] = 0xff
+	}
+	assert.NoError(t, ioutil.WriteFile(fileName, data, 0600))
+
+	file, err := os.Open(fileName)
+	assert.NoError(t, err)
+
+	_, err = OpenTable(file, getTestTableOptions())
+	assert.Error(t, err)
+}
+
+func TestTable_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	iv, err := z.GenerateIV()
+	assert.NoError(t, err)
+
+	count := 1000
+	opts := getTestTableOptions()
+	opts.DataKey = &pb.DataKey{
+		KeyId:     1,
+		Data:      []byte("0123456789abcdef0123456789abcdef"),
+		Iv:        iv,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	tables := map[string]*Table{
+		"encrypted": buildTestTable(t, dir, 1, count, opts),
+		"plaintext": buildTestTable(t, dir, 2, count, getTestTableOptions()),
+	}
+
+	// The values written to the encrypted table should not be visible on disk.
+	encrypted, err := ioutil.ReadFile(NewFilename(0, 1, dir))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "secret value")
+
+	plaintext, err := ioutil.ReadFile(NewFilename(0, 2, dir))
+	assert.NoError(t, err)
+	assert.Contains(t, string(plaintext), "secret value")
+
+	for name, table := range tables {
+		t.Run(name, func(t *testing.T) {
+			defer table.DecrementReference()
+
+			assert.Equal(t, z.KeyWithTs([]byte("key00000"), 0), table.Smallest())
+			assert.Equal(t, z.KeyWithTs([]byte(fmt.Sprintf("key%05d", count-1)), 0), table.Largest())
+
+			iterator := table.NewIterator(false)
+			defer iterator.Close()
+
+			i := 0
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+				assert.Equal(t, z.KeyWithTs([]byte(fmt.Sprintf("key%05d", i)), 0), iterator.Key())
+				assert.Equal(t, []byte(fmt.Sprintf("secret value %05d", i)), iterator.Value().Value)
+				i++
+			}
+			assert.Equal(t, count, i)
+
+			iterator.Seek(z.KeyWithTs([]byte("key00500"), 0))
+			assert.True(t, iterator.Valid())
+			assert.Equal(t, []byte("secret value 00500"), iterator.Value().Value)
+		})
+	}
+}
+
+func TestTable_ChecksumType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	count := 1000
+	crcOptions := getTestTableOptions()
+	crcOptions.ChecksumType = options.CRC32Castagnoli
+
+	// The checksum type is stored with the checksums, so tables can be read with a different checksum type.
+	tables := map[string]*Table{
+		"xxhash": buildTestTable(t, dir, 1, count, getTestTableOptions()),
+		"crc32":  buildTestTable(t, dir, 2, count, crcOptions),
+	}
+	for name, table := range tables {
+		t.Run(name, func(t *testing.T) {
+			defer table.DecrementReference()
+			assert.NoError(t, table.VerifyChecksum())
+
+			iterator := table.NewIterator(false)
+			defer iterator.Close()
+
+			i := 0
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+				i++
+			}
+			assert.Equal(t, count, i)
+		})
+	}
+
+	// The index checksum is at the end of the table followed by its length, the checksum type is its first byte.
+	data := buildTestTableData(count, crcOptions)
+	checksumTypeOffset := len(data) - 4 - (1 + 4)
+	assert.Equal(t, byte(options.CRC32Castagnoli), data[checksumTypeOffset])
+
+	t.Run("unknown checksum type", func(t *testing.T) {
+		data := append([]byte{}, data...)
+		data[checksumTypeOffset] = 0xff
+
+		_, err := openTestTable(t, dir, 3, data, getTestTableOptions())
+		assert.Error(t, err)
+		assert.Equal(t, z.ErrUnknownChecksumType, errors.Cause(err))
+	})
+
+	t.Run("different checksum type", func(t *testing.T) {
+		data := append([]byte{}, data...)
+		data[checksumTypeOffset] = byte(options.XXHash)
+
+		_, err := openTestTable(t, dir, 4, data, getTestTableOptions())
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "checksum mismatch")
+	})
+}
+
+func TestBuilder_Checksum(t *testing.T) {
+	for _, checksumType := range []options.ChecksumType{options.XXHash, options.CRC32Castagnoli} {
+		opts := getTestTableOptions()
+		opts.ChecksumType = checksumType
+		builder := NewBuilder(opts)
+		for i := 0; i < 1000; i++ {
+			key := z.KeyWithTs([]byte(fmt.Sprintf("key%05d", i)), 0)
+			builder.Add(key, z.ValueStruct{Value: []byte(fmt.Sprintf("value %05d", i))}, 0)
+		}
+		data := builder.Finish()
+
+		// The checksum covers everything before the size of the index, which is the blocks followed by the index.
+		checksumLength := int(binary.BigEndian.Uint32(data[len(data)-4:]))
+		expected, err := calculateChecksum(data[:len(data)-4-checksumLength-4], checksumType)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, builder.Checksum(), checksumType)
+
+		// The checksums of the blocks were calculated as the entries were added, they must still match the blocks.
+		table, err := OpenInMemoryTable(data, 0, 1, &opts)
+		assert.NoError(t, err)
+		assert.Greater(t, len(table.blockIndex), 1)
+		assert.NoError(t, table.VerifyChecksum())
+		assert.NoError(t, table.DecrementReference())
+	}
+}
+
+func TestVerifyChecksum_Legacy(t *testing.T) {
+	data := []byte("block data")
+
+	// Tables built before the checksum type was stored only have an 8 byte xxhash checksum.
+	checksum, err := calculateChecksum(data, options.XXHash)
+	assert.NoError(t, err)
+	legacy := checksum[1:]
+	assert.Len(t, legacy, legacyChecksumSize)
+	assert.NoError(t, verifyChecksum(data, legacy))
+	assert.Error(t, verifyChecksum([]byte("other data"), legacy))
+	assert.Error(t, verifyChecksum(data, nil))
+}
+
+func TestTable_Get(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestTableOptions()
+	table := buildTestTable(t, dir, 1, 1000, opts)
+	defer table.DecrementReference()
+
+	value, err := table.Get(z.KeyWithTs([]byte("key00500"), 0))
+	assert.NoError(t, err)
+	assert.Equal(t, "secret value 00500", string(value.Value))
+
+	// A key that is not in the table is rejected by the bloom filter before any blocks are read.
+	for i := 0; i < 100; i++ {
+		missing := z.KeyWithTs([]byte(fmt.Sprintf("missing%05d", i)), 0)
+		if !table.MayContain(missing) {
+			reads := atomic.LoadUint64(&table.blockReads)
+			value, err := table.Get(missing)
+			assert.NoError(t, err)
+			assert.Nil(t, value.Value)
+			assert.Equal(t, reads, atomic.LoadUint64(&table.blockReads))
+		}
+	}
+
+	// Without a bloom filter every key has to be looked up.
+	table.bloomFilter = nil
+	assert.True(t, table.MayContain(z.KeyWithTs([]byte("missing"), 0)))
+	value, err = table.Get(z.KeyWithTs([]byte("missing"), 0))
+	assert.NoError(t, err)
+	assert.Nil(t, value.Value)
+}
+
+func TestTable_DisabledBloomFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestTableOptions()
+	opts.BloomFalsePositive = 0
+	table := buildTestTable(t, dir, 1, 1000, opts)
+	defer table.DecrementReference()
+	assert.Nil(t, table.bloomFilter)
+	assert.Equal(t, uint32(1000), table.KeyCount())
+
+	// Every key has to be looked up, but reads should still work.
+	value, err := table.Get(z.KeyWithTs([]byte("key00500"), 0))
+	assert.NoError(t, err)
+	assert.Equal(t, "secret value 00500", string(value.Value))
+	assert.True(t, table.MayContain(z.KeyWithTs([]byte("missing"), 0)))
+	value, err = table.Get(z.KeyWithTs([]byte("missing"), 0))
+	assert.NoError(t, err)
+	assert.Nil(t, value.Value)
+
+	// A table that was built with a bloom filter does not load it while the filter is disabled.
+	withFilter, err := openTestTable(t, dir, 2, buildTestTableData(10, getTestTableOptions()), opts)
+	assert.NoError(t, err)
+	defer withFilter.DecrementReference()
+	assert.Nil(t, withFilter.bloomFilter)
+}
+
+func TestTable_VerifyBloom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestTableOptions()
+	opts.BlockSize = 1024
+	table := buildTestTable(t, dir, 1, 1000, opts)
+	defer table.DecrementReference()
+	assert.Greater(t, len(table.blockIndex), 1)
+	assert.NoError(t, table.VerifyBloom())
+
+	// A filter that is missing the keys in the second half of the table has false negatives.
+	bloom := b.NewBloomFilter(1000, 0.0001)
+	for i := 0; i < 500; i++ {
+		bloom.Add(farm.Fingerprint64([]byte(fmt.Sprintf("key%05d", i))))
+	}
+	table.bloomFilter = bloom
+	err = table.VerifyBloom()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `does not have key: "key00`)
+	assert.NotContains(t, err.Error(), "in block: 0,")
+
+	// Without a bloom filter there is nothing to verify.
+	table.bloomFilter = nil
+	assert.NoError(t, table.VerifyBloom())
+}
+
+func TestTable_Advise(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for i, readAhead := range []bool{false, true} {
+		opts := getTestTableOptions()
+		opts.LoadingMode = options.MemoryMap
+		opts.ReadAhead = readAhead
+		table := buildTestTable(t, dir, uint64(i+1), 1000, opts)
+
+		// Changing the hint in either direction should not affect what is read from the table.
+		for _, hint := range []bool{!readAhead, readAhead} {
+			assert.NoError(t, table.Advise(hint))
+			value, err := table.Get(z.KeyWithTs([]byte("key00500"), 0))
+			assert.NoError(t, err)
+			assert.Equal(t, "secret value 00500", string(value.Value))
+		}
+		assert.NoError(t, table.DecrementReference())
+	}
+
+	// Tables that are not memory mapped ignore the hint.
+	table := buildTestTable(t, dir, 3, 10, getTestTableOptions())
+	defer table.DecrementReference()
+	assert.NoError(t, table.Advise(true))
+}
+
+func TestTable_TrackReferences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestTableOptions()
+	opts.ReferenceTracker = NewReferenceTracker()
+	table := buildTestTable(t, dir, 1, 10, opts)
+
+	table.IncrementReference()
+	assert.Equal(t, int32(2), table.References())
+	assert.Contains(t, table.ReferenceCallers(), "table_test.go")
+	assert.Equal(t, []*Table{table}, opts.ReferenceTracker.Tables())
+
+	// Releasing the table more times than it was referenced should fail rather than go unnoticed.
+	assert.NoError(t, table.DecrementReference())
+	assert.NoError(t, table.DecrementReference())
+	assert.Empty(t, opts.ReferenceTracker.Tables())
+	assert.Error(t, table.DecrementReference())
+}
+
+func TestEntriesIterator(t *testing.T) {
+	opts := getTestTableOptions()
+	data := buildTestTableData(1000, opts)
+
+	// Zero the end of the index and its footer, the table can no longer be opened.
+	for i := len(data) - 64; i < len(data); i++ {
+		data[i] = 0
+	}
+	_, err := OpenInMemoryTable(data, 0, 1, &opts)
+	assert.Error(t, err)
+
+	scan := func(data []byte) int {
+		iterator := NewEntriesIterator(data)
+		count := 0
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			assert.Equal(t, z.KeyWithTs([]byte(fmt.Sprintf("key%05d", count)), 0), iterator.Key())
+			assert.Equal(t, fmt.Sprintf("secret value %05d", count), string(iterator.Value().Value))
+			count++
+		}
+
+		// The scan always stops at the index, or at the first block that is damaged.
+		assert.Error(t, iterator.Error())
+		return count
+	}
+
+	// Every entry is in a block that is still intact.
+	assert.Equal(t, 1000, scan(data))
+
+	// Damaging a block in the middle of the table should still recover the entries in the blocks before it.
+	data[len(data)/2] ^= 0xff
+	recovered := scan(data)
+	assert.True(t, recovered > 0 && recovered < 1000, "recovered %d entries", recovered)
+}
+
+func TestIterator_Err(t *testing.T) {
+	// Blocks are only verified when they are read, so the damaged table can still be opened.
+	opts := getTestTableOptions()
+	opts.ChkMode = options.OnBlockRead
+	data := buildTestTableData(1000, opts)
+
+	scan := func(iterator z.Iterator) (int, error) {
+		defer iterator.Close()
+		count := 0
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			count++
+		}
+		return count, iterator.Err()
+	}
+
+	table, err := OpenInMemoryTable(data, 0, 1, &opts)
+	assert.NoError(t, err)
+	count, err := scan(table.NewIterator(false))
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, count)
+	assert.NoError(t, table.DecrementReference())
+
+	// The scan stops at the damaged block rather than skipping it, and the error tells it apart from the end of the
+	// table, through a merge iterator as well.
+	data[len(data)/2] ^= 0xff
+	for _, reversed := range []bool{false, true} {
+		table, err := OpenInMemoryTable(data, 0, 1, &opts)
+		assert.NoError(t, err)
+
+		count, err := scan(table.NewIterator(reversed))
+		assert.Error(t, err)
+		assert.True(t, count > 0 && count < 1000, "read %d entries", count)
+
+		count, err = scan(z.NewMergeIterator([]z.Iterator{table.NewIterator(reversed)}, reversed))
+		assert.Error(t, err)
+		assert.True(t, count > 0 && count < 1000, "read %d entries", count)
+
+		assert.NoError(t, table.DecrementReference())
+	}
+}
+
+func TestTable_EstimatedSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestTableOptions()
+	build := func(fileId uint64, valuePointerLength uint32) *Table {
+		builder := NewBuilder(opts)
+		defer builder.Close()
+		for i := 0; i < 100; i++ {
+			key := z.KeyWithTs([]byte(fmt.Sprintf("key%05d", i)), 0)
+			builder.Add(key, z.ValueStruct{Value: make([]byte, 12)}, valuePointerLength)
+		}
+
+		table, err := openTestTable(t, dir, fileId, builder.Finish(), opts)
+		assert.NoError(t, err)
+		return table
+	}
+
+	inline := build(1, 0)
+	defer inline.DecrementReference()
+	external := build(2, 1<<10)
+	defer external.DecrementReference()
+
+	// Both tables take the same space on disk, but the values of the second table are in the value log.
+	assert.Equal(t, inline.Size(), external.Size())
+	assert.Equal(t, int64(100*(16+z.ValueStructHeaderSize+12)), inline.EstimatedSize())
+	assert.Equal(t, int64(100*(16+1<<10)), external.EstimatedSize())
+	assert.True(t, external.EstimatedSize() > external.Size())
+}
+
+func TestBuilder_Stream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	iv, err := z.GenerateIV()
+	assert.NoError(t, err)
+
+	encrypted := getTestTableOptions()
+	encrypted.DataKey = &pb.DataKey{
+		KeyId:     1,
+		Data:      []byte("0123456789abcdef0123456789abcdef"),
+		Iv:        iv,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	for fileId, opts := range []Options{getTestTableOptions(), encrypted} {
+		file, err := z.CreateSyncedFile(z.OSFileSystem, NewFilename(0, uint64(fileId), dir), true)
+		assert.NoError(t, err)
+
+		// The table is several times larger than the buffer of a builder, so it can only be built with bounded memory
+		// if blocks are written out as they are finished.
+		const count = 200000
+		builder := NewStreamBuilder(file, opts)
+		for i := 0; i < count; i++ {
+			key := z.KeyWithTs([]byte(fmt.Sprintf("key%08d", i)), 0)
+			builder.Add(key, z.ValueStruct{Value: []byte(fmt.Sprintf("value %08d", i))}, 0)
+			assert.True(t, builder.buffer.Cap() <= 1<<20)
+		}
+		assert.NoError(t, builder.FinishTo(file))
+		assert.True(t, builder.flushed > 4<<20)
+
+		table, err := OpenTable(file, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(count), table.KeyCount())
+
+		iterator := table.NewIterator(false)
+		var i int
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			assert.Equal(t, fmt.Sprintf("key%08d", i), string(z.ParseKey(iterator.Key())))
+			assert.Equal(t, fmt.Sprintf("value %08d", i), string(iterator.Value().Value))
+			i++
+		}
+		assert.Equal(t, count, i)
+		assert.NoError(t, iterator.Close())
+		assert.NoError(t, table.DecrementReference())
+	}
+}
@@ -1,10 +1,30 @@
 package notbadger
 
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/dgryski/go-farm"
+	"github.com/elliotcourant/notbadger/z"
+)
+
+const (
+	// maxKeySize is the maximum size of a key that can be written. Keys are stored in the memory tables with a uint16
+	// length and an 8 byte timestamp is appended to every key, so this leaves exactly enough room for the timestamp.
+	maxKeySize = math.MaxUint16 - 8
+)
+
 type (
 	Transaction struct {
 		readTimestamp   uint64
 		commitTimestamp uint64
 
+		// readMarkTimestamp is the timestamp the read was registered with in the oracle's read mark. This is newer
+		// than the read timestamp for transactions that read at a historical timestamp.
+		readMarkTimestamp uint64
+
 		update bool                     // update is used to conditionally keep track of reads.
 		reads  map[PartitionId][]uint64 // contains fingerprints of keys read.
 		writes map[PartitionId][]uint64 // contains fingerprints of keys written.
@@ -13,9 +33,626 @@ type (
 
 		db        *DB
 		discarded bool
+		doneRead  bool
+
+		// err is returned by every operation on a transaction that can't be used, instead of running the operation.
+		err error
 
 		size              int64
 		count             int64
 		numberOfIterators int32
 	}
+
+	// WriteOptions changes how a single write is committed, overriding the options the database was opened with.
+	WriteOptions struct {
+		// Sync waits for the write to be synced to disk before the commit returns, regardless of SyncWrites. Writes
+		// that do not sync are still batched with the writes that do, so they may be synced along with them.
+		Sync bool
+	}
+
+	// ReadOptions changes how a single read is done.
+	ReadOptions struct {
+		// NoCache skips the block cache, the blocks of the tables that are read are neither looked up in the cache nor
+		// added to it. This keeps reads of batch jobs and large scans from evicting the blocks that other reads need.
+		NoCache bool
+	}
+
+	// MultiGetValue is the newest version of a single key read by MultiGet.
+	MultiGetValue struct {
+		// Found is false if the key was never written or if its newest version was deleted or has expired, the rest of
+		// the fields are only set when it is true.
+		Found     bool
+		Value     []byte
+		UserMeta  byte
+		ExpiresAt uint64
+		Version   uint64
+	}
 )
+
+// NewTransaction creates a new transaction. NotBadger supports concurrent execution of transactions, providing
+// serializable snapshot isolation, avoiding write skews. NotBadger achieves this by tracking the keys read and at
+// Commit time, ensuring that these read keys weren't concurrently modified by another transaction.
+//
+// For read-only transactions, set update to false. In this mode, we don't track the rows read for any changes. Thus,
+// any long running iterations done in this mode wouldn't pay this overhead.
+//
+// Running transactions concurrently is OK. However, a transaction itself isn't thread safe, and should only be run
+// serially. It doesn't matter if a transaction is created by one goroutine and passed down to another, as long as the
+// Transaction APIs are called serially.
+//
+// When you create a new transaction, it is absolutely essential to call Discard(). This should be done irrespective of
+// what the update param is set to. Commit API internally runs Discard, but running it twice wouldn't cause any issues.
+//
+// If the database was opened with OpenManaged then every operation on the returned transaction returns
+// ErrManagedTransaction, NewTransactionAt must be used instead.
+func (db *DB) NewTransaction(update bool) *Transaction {
+	if db.oracle.isManaged {
+		return &Transaction{
+			update:    update,
+			db:        db,
+			discarded: true,
+			err:       ErrManagedTransaction,
+		}
+	}
+
+	return db.newTransaction(update, false)
+}
+
+func (db *DB) newTransaction(update, isManaged bool) *Transaction {
+	if db.options.ReadOnly && update {
+		// DB is read-only, force read-only transaction.
+		update = false
+	}
+
+	txn := &Transaction{
+		update: update,
+		db:     db,
+		count:  1,                               // One extra entry for the transaction key.
+		size:   int64(len(transactionKey) + 10), // Some buffer for the extra entry.
+	}
+
+	if update {
+		txn.reads = map[PartitionId][]uint64{}
+		txn.writes = map[PartitionId][]uint64{}
+		txn.pendingWrites = map[PartitionId]map[string]*Entry{}
+		txn.db.oracle.addReference()
+	}
+
+	// It is important that the oracle addReference happens BEFORE we retrieve a read timestamp. Otherwise, it is
+	// possible that the oracle commit map would get deleted without us knowing about it.
+	if !isManaged {
+		txn.readTimestamp = db.oracle.newReadTs()
+		txn.readMarkTimestamp = txn.readTimestamp
+	}
+
+	return txn
+}
+
+// NewTransactionAt creates a new transaction that reads the snapshot of the database as of the provided timestamp. It
+// works like NewTransaction, but the newest version of a key at or below the read timestamp is read instead of the
+// latest one. A read timestamp after the latest commit reads at the latest commit. Update transactions conflict with
+// any commit after the read timestamp to the keys they read.
+//
+// Compactions discard versions that are no longer visible to any transaction that is still open, a read in this
+// transaction returns ErrVersionDiscarded when the versions at the read timestamp may have been discarded. Iterators
+// do not check this, they skip the discarded versions.
+//
+// If the database was opened with OpenManaged then the transaction reads at exactly the provided timestamp, once the
+// commits at or below it have been written. Updates must be committed with CommitAt. Versions are only discarded at
+// or below the timestamp provided to SetDiscardTimestamp.
+func (db *DB) NewTransactionAt(readTs uint64, update bool) *Transaction {
+	if db.oracle.isManaged {
+		txn := db.newTransaction(update, true)
+		txn.readTimestamp = readTs
+		db.oracle.waitForCommits(readTs)
+		return txn
+	}
+
+	txn := db.newTransaction(update, false)
+	if readTs < txn.readTimestamp {
+		txn.readTimestamp = readTs
+	}
+
+	return txn
+}
+
+// GetAt returns a copy of the value of the newest version of the key in the provided partition at or below the provided
+// timestamp. If the key is not found, ErrKeyNotFound is returned. If the version may have been discarded by compaction
+// then ErrVersionDiscarded is returned.
+func (db *DB) GetAt(partitionId PartitionId, key []byte, ts uint64) ([]byte, error) {
+	txn := db.NewTransactionAt(ts, false)
+	defer txn.Discard()
+
+	item, err := txn.Get(partitionId, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+// Get returns a copy of the value of the newest version of the key in the provided partition, read with the provided
+// read options. If the key is not found, ErrKeyNotFound is returned.
+func (db *DB) Get(partitionId PartitionId, key []byte, opts ReadOptions) ([]byte, error) {
+	txn := db.newLatestTransaction()
+	defer txn.Discard()
+
+	item, err := txn.GetWithOptions(partitionId, key, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+// MultiGet returns copies of the newest versions of the provided keys in the partition, in the same order as the keys.
+// Keys that are not found have Found set to false. Every key is read at the same read timestamp and the memory
+// tables of the partition are only looked up once. The keys are read in sorted order, so keys that are close together
+// are found in the same tables and blocks, and tables that don't have a key are skipped with their bloom filters.
+func (db *DB) MultiGet(partitionId PartitionId, keys [][]byte) ([]MultiGetValue, error) {
+	for _, key := range keys {
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.validatePartitionId(partitionId); err != nil {
+		return nil, err
+	}
+
+	txn := db.newLatestTransaction()
+	defer txn.Discard()
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	// The range deletes are read before the tables, like GetWithOptions.
+	rangeDeletes := db.rangeDeletes.get(partitionId, txn.readTimestamp)
+	tables, decrement := db.getMemoryTables(partitionId)
+	defer decrement()
+
+	values := make([]MultiGetValue, len(keys))
+	for _, i := range order {
+		value, err := db.getFromTables(tables, partitionId, z.KeyWithTs(keys[i], txn.readTimestamp), ReadOptions{})
+		if err != nil {
+			return nil, z.Wrapf(err, "DB::MultiGet key: %q", keys[i])
+		}
+
+		if (value.Value == nil && value.Meta == 0) ||
+			isDeletedOrExpired(value.Meta, value.ExpiresAt, db.options.clock) ||
+			isRangeDeleted(rangeDeletes, keys[i], value.Version) {
+			continue
+		}
+
+		values[i] = MultiGetValue{
+			Found:     true,
+			Value:     z.SafeCopy(nil, value.Value),
+			UserMeta:  value.UserMeta,
+			ExpiresAt: value.ExpiresAt,
+			Version:   value.Version,
+		}
+	}
+
+	if (db.oracle.isManaged || txn.readTimestamp < txn.readMarkTimestamp) &&
+		txn.readTimestamp < db.levelsController.discardTimestamp(partitionId) {
+		return nil, ErrVersionDiscarded
+	}
+
+	return values, nil
+}
+
+// newLatestTransaction returns a read-only transaction that reads the latest version of every key, whether or not the
+// timestamps are managed by the user.
+func (db *DB) newLatestTransaction() *Transaction {
+	if db.oracle.isManaged {
+		return db.NewTransactionAt(math.MaxUint64, false)
+	}
+
+	return db.NewTransaction(false)
+}
+
+// View executes a function creating and managing a read-only transaction for the user. Error returned by the function
+// is relayed by the View method.
+func (db *DB) View(fn func(txn *Transaction) error) error {
+	txn := db.NewTransaction(false)
+	if txn.err != nil {
+		return txn.err
+	}
+	defer txn.Discard()
+
+	return fn(txn)
+}
+
+// Update executes a function, creating and managing a read-write transaction for the user. Error returned by the
+// function is relayed by the Update method.
+func (db *DB) Update(fn func(txn *Transaction) error) error {
+	txn := db.NewTransaction(true)
+	if txn.err != nil {
+		return txn.err
+	}
+	defer txn.Discard()
+
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// UpdateWithOptions is like Update, but the transaction is committed with the provided write options.
+func (db *DB) UpdateWithOptions(opts WriteOptions, fn func(txn *Transaction) error) error {
+	txn := db.NewTransaction(true)
+	if txn.err != nil {
+		return txn.err
+	}
+	defer txn.Discard()
+
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	return txn.CommitWithOptions(opts)
+}
+
+// Set writes a single key-value pair to the provided partition in its own transaction, committed with the provided
+// write options.
+func (db *DB) Set(partitionId PartitionId, key, value []byte, opts WriteOptions) error {
+	return db.UpdateWithOptions(opts, func(txn *Transaction) error {
+		return txn.Set(partitionId, key, value)
+	})
+}
+
+// Set adds a key-value pair to the provided partition in the database.
+//
+// The current transaction keeps a reference to the key and value byte slice arguments. Users must not modify key and
+// value until the end of the transaction.
+func (txn *Transaction) Set(partitionId PartitionId, key, value []byte) error {
+	return txn.SetEntry(partitionId, &Entry{
+		Key:   key,
+		Value: value,
+	})
+}
+
+// SetEntry takes an Entry struct and adds the key-value pair in the struct, along with other metadata to the provided
+// partition in the database.
+//
+// The current transaction keeps a reference to the entry passed in argument. Users must not modify the entry until the
+// end of the transaction.
+func (txn *Transaction) SetEntry(partitionId PartitionId, e *Entry) error {
+	return txn.modify(partitionId, e)
+}
+
+// Delete deletes a key from the provided partition.
+//
+// This is done by adding a delete marker for the key at commit timestamp. Any reads happening before this timestamp
+// would be unaffected. Any reads after this commit would see the deletion.
+//
+// The current transaction keeps a reference to the key byte slice argument. Users must not modify the key until the
+// end of the transaction.
+func (txn *Transaction) Delete(partitionId PartitionId, key []byte) error {
+	return txn.modify(partitionId, &Entry{
+		Key:  key,
+		meta: bitDelete,
+	})
+}
+
+// Get looks for key in the provided partition and returns the corresponding Item. If key is not found,
+// ErrKeyNotFound is returned.
+func (txn *Transaction) Get(partitionId PartitionId, key []byte) (item *Item, err error) {
+	return txn.GetWithOptions(partitionId, key, ReadOptions{})
+}
+
+// GetWithOptions is like Get, but the key is read with the provided read options.
+func (txn *Transaction) GetWithOptions(partitionId PartitionId, key []byte, opts ReadOptions) (item *Item, err error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	} else if txn.err != nil {
+		return nil, txn.err
+	} else if txn.discarded {
+		return nil, ErrDiscardedTxn
+	} else if err := txn.db.validatePartitionId(partitionId); err != nil {
+		return nil, err
+	}
+
+	item = &Item{
+		partitionId: partitionId,
+		clock:       txn.db.options.clock,
+	}
+
+	if txn.update {
+		if e, has := txn.pendingWrites[partitionId][string(key)]; has && bytes.Equal(key, e.Key) {
+			if isDeletedOrExpired(e.meta, e.ExpiresAt, txn.db.options.clock) {
+				return nil, ErrKeyNotFound
+			}
+
+			// Fulfill from the pending writes.
+			item.meta = e.meta
+			item.value = e.Value
+			item.userMeta = e.UserMeta
+			item.key = key
+			item.version = txn.readTimestamp
+			item.expiresAt = e.ExpiresAt
+
+			return item, nil
+		}
+
+		// Only track reads if this is update transaction. No need to track the read if the transaction serviced it
+		// internally.
+		txn.addReadKey(partitionId, key)
+	}
+
+	// The range deletes are read before the tables, a compaction only discards a range delete once the versions it
+	// deletes have been discarded as well.
+	rangeDeletes := txn.db.rangeDeletes.get(partitionId, txn.readTimestamp)
+
+	seek := z.KeyWithTs(key, txn.readTimestamp)
+	value, err := txn.db.getWithOptions(partitionId, seek, opts)
+	if err != nil {
+		return nil, z.Wrapf(err, "DB::Get key: %q", key)
+	}
+
+	// The discard timestamp is raised before a compaction's tables can be read, so checking it after the read catches
+	// any compaction that could have discarded the version that should have been found.
+	if (txn.db.oracle.isManaged || txn.readTimestamp < txn.readMarkTimestamp) &&
+		txn.readTimestamp < txn.db.levelsController.discardTimestamp(partitionId) {
+		return nil, ErrVersionDiscarded
+	}
+
+	if value.Value == nil && value.Meta == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	if isDeletedOrExpired(value.Meta, value.ExpiresAt, txn.db.options.clock) ||
+		isRangeDeleted(rangeDeletes, key, value.Version) {
+		return nil, ErrKeyNotFound
+	}
+
+	item.key = key
+	item.version = value.Version
+	item.meta = value.Meta
+	item.userMeta = value.UserMeta
+	item.value = z.Copy(value.Value)
+	item.expiresAt = value.ExpiresAt
+
+	return item, nil
+}
+
+// Commit commits the transaction, following these steps:
+//
+// 1. If there are no writes, return immediately.
+//
+// 2. Check if read rows were updated since the transaction started. If so, return ErrConflict.
+//
+// 3. If no conflict, generate a commit timestamp and update written rows' commit timestamp.
+//
+// 4. Batch up all writes, write them to the LSM tree and wait for them to be applied.
+//
+// If error is nil, the transaction is successfully committed. In case of a non-nil error, the LSM tree won't be
+// updated, so there's no need for any rollback.
+//
+// The write is synced to disk if the database was opened with SyncWrites.
+func (txn *Transaction) Commit() error {
+	return txn.CommitWithOptions(WriteOptions{
+		Sync: txn.db.options.SyncWrites,
+	})
+}
+
+// CommitWithOptions is like Commit, but the write is synced to disk based on the provided write options instead of
+// the SyncWrites option.
+func (txn *Transaction) CommitWithOptions(opts WriteOptions) error {
+	if txn.err != nil {
+		return txn.err
+	} else if txn.discarded {
+		return ErrDiscardedTxn
+	}
+	defer txn.Discard()
+
+	if len(txn.writes) == 0 {
+		return nil // Nothing to do.
+	}
+
+	if txn.db.oracle.isManaged && txn.commitTimestamp == 0 {
+		return ErrManagedTransaction
+	}
+
+	callback, err := txn.commitAndSend(opts.Sync)
+	if err != nil {
+		return err
+	}
+
+	return callback()
+}
+
+// CommitAt commits the transaction at the provided commit timestamp, this can only be used when the database was opened
+// with OpenManaged. The commit timestamp must be greater than the read timestamp of the transaction and greater than
+// the timestamp of every commit before it, otherwise ErrCommitTimestamp is returned.
+func (txn *Transaction) CommitAt(commitTs uint64) error {
+	if !txn.db.oracle.isManaged {
+		return ErrNotManaged
+	}
+
+	txn.commitTimestamp = commitTs
+	return txn.Commit()
+}
+
+// Discard discards a created transaction. This method is very important and must be called. Commit method calls this
+// internally, however, calling this multiple times doesn't cause any issues. So, this can safely be called via a defer
+// right when transaction is created.
+//
+// NOTE: If any operations are run on a discarded transaction, ErrDiscardedTxn is returned.
+func (txn *Transaction) Discard() {
+	if txn.discarded { // Avoid a re-run.
+		return
+	}
+
+	if txn.numberOfIterators > 0 {
+		panic("Unclosed iterator at time of Transaction.Discard.")
+	}
+
+	txn.discarded = true
+	if !txn.db.oracle.isManaged {
+		txn.db.oracle.doneRead(txn)
+	}
+
+	if txn.update {
+		txn.db.oracle.decrementReference()
+	}
+}
+
+func (txn *Transaction) commitAndSend(sync bool) (func() error, error) {
+	orc := txn.db.oracle
+
+	// Ensure that the order in which we get the commit timestamp is the same as the order in which we push these
+	// updates to the write channel. So, we acquire a writeChannelLock before getting a commit timestamp, and only
+	// release it after pushing the entries to it.
+	orc.writeChannelLock.Lock()
+	defer orc.writeChannelLock.Unlock()
+
+	if orc.isManaged {
+		if err := orc.checkCommitTs(txn); err != nil {
+			return nil, err
+		}
+	}
+
+	commitTimestamp, conflict := orc.newCommitTs(txn)
+	if conflict {
+		return nil, ErrConflict
+	}
+
+	entries := make([]*Entry, 0, txn.count)
+	for partitionId, pendingWrites := range txn.pendingWrites {
+		for _, e := range pendingWrites {
+			// Suffix the keys with the commit timestamp so the key versions are sorted between partitions.
+			e.Key = z.KeyWithTs(e.Key, commitTimestamp)
+			e.partitionId = partitionId
+			e.version = commitTimestamp
+			e.meta |= bitTxn
+			entries = append(entries, e)
+		}
+	}
+
+	// The transaction key is used to mark the end of the transaction, it is always written to the default partition.
+	entries = append(entries, &Entry{
+		Key:   z.KeyWithTs(transactionKey, commitTimestamp),
+		Value: []byte(strconv.FormatUint(commitTimestamp, 10)),
+		meta:  bitFinTxn,
+	})
+
+	req, err := txn.db.sendToWriteChannel(entries, sync)
+	if err != nil {
+		orc.doneCommit(commitTimestamp)
+		return nil, err
+	}
+
+	return func() error {
+		err := req.Wait()
+
+		// Wait before marking commitTimestamp as done. We can't defer doneCommit above, because it is being called
+		// from a callback here.
+		orc.doneCommit(commitTimestamp)
+		return err
+	}, nil
+}
+
+func (txn *Transaction) modify(partitionId PartitionId, e *Entry) error {
+	switch {
+	case txn.err != nil:
+		return txn.err
+	case txn.db.options.ReadOnly:
+		return ErrReadOnly
+	case !txn.update:
+		return ErrReadOnlyTxn
+	case txn.discarded:
+		return ErrDiscardedTxn
+	case validateKey(e.Key) != nil:
+		return validateKey(e.Key)
+	case isInternalKey(e.Key):
+		return ErrInvalidKey
+	}
+
+	return txn.modifyInternal(partitionId, e)
+}
+
+// modifyInternal adds the entry to the pending writes of the transaction like modify, but the entry can have an
+// internal key.
+func (txn *Transaction) modifyInternal(partitionId PartitionId, e *Entry) error {
+	switch {
+	case txn.err != nil:
+		return txn.err
+	case txn.db.options.ReadOnly:
+		return ErrReadOnly
+	case !txn.update:
+		return ErrReadOnlyTxn
+	case txn.discarded:
+		return ErrDiscardedTxn
+	case validateKey(e.Key) != nil:
+		return validateKey(e.Key)
+	case txn.db.validatePartitionId(partitionId) != nil:
+		return ErrInvalidPartitionId
+	case int64(len(e.Value)) > txn.db.options.maxValueSize(len(e.Key)):
+		return ErrValueTooLarge
+	}
+
+	if err := txn.checkSize(e); err != nil {
+		return err
+	}
+
+	fingerprint := farm.Fingerprint64(e.Key) // Avoid dealing with byte arrays.
+	txn.writes[partitionId] = append(txn.writes[partitionId], fingerprint)
+
+	pendingWrites, ok := txn.pendingWrites[partitionId]
+	if !ok {
+		pendingWrites = map[string]*Entry{}
+		txn.pendingWrites[partitionId] = pendingWrites
+	}
+
+	// If a duplicate entry was inserted then the newer entry replaces the older one, the older entry is no longer
+	// counted towards the size of the transaction.
+	if old, ok := pendingWrites[string(e.Key)]; ok {
+		txn.count--
+		txn.size -= int64(old.estimateSize(txn.db.options.ValueThreshold))
+	}
+	pendingWrites[string(e.Key)] = e
+
+	return nil
+}
+
+func (txn *Transaction) checkSize(e *Entry) error {
+	count := txn.count + 1
+	// Extra bytes for version in key.
+	size := txn.size + int64(e.estimateSize(txn.db.options.ValueThreshold)) + 10
+	if count >= txn.db.options.maxBatchCount || size >= txn.db.options.maxBatchSize {
+		return ErrTxnTooBig
+	}
+
+	txn.count, txn.size = count, size
+	return nil
+}
+
+// addReadKey tracks the fingerprint of a key that was read in the partition, so the transaction conflicts with any
+// commit to the key after its read timestamp. Only update transactions can conflict, so read-only transactions don't
+// track their reads, which keeps long scans from building up a fingerprint for every key they read.
+func (txn *Transaction) addReadKey(partitionId PartitionId, key []byte) {
+	if txn.update {
+		fingerprint := farm.Fingerprint64(key)
+		txn.reads[partitionId] = append(txn.reads[partitionId], fingerprint)
+	}
+}
+
+// validateKey returns an error if the key is empty or too large to be stored with a timestamp appended to it. An empty
+// key would only be a timestamp once the timestamp is appended.
+func validateKey(key []byte) error {
+	switch {
+	case len(key) == 0:
+		return ErrEmptyKey
+	case len(key) > maxKeySize:
+		return ErrKeyTooLarge
+	}
+
+	return nil
+}
@@ -0,0 +1,766 @@
+package notbadger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getTestOptions(dir string) Options {
+	return DefaultOptions(dir).
+		WithMaxTableSize(1 << 15). // Force more compaction.
+		WithLevelOneSize(4 << 15). // Force more compaction.
+		WithSyncWrites(false)
+}
+
+// withoutCompactors returns options that open the database without any compactors, for tests that run the compactions
+// themselves. Nothing else would make room in level 0, so the level 0 stall is disabled as well.
+func (opt Options) withoutCompactors() Options {
+	opt.noCompactors = true
+	opt.NumLevelZeroTablesStall = 0
+	return opt
+}
+
+func runNotBadgerTest(t *testing.T, opts *Options, test func(t *testing.T, db *DB)) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	if opts == nil {
+		opts = new(Options)
+		*opts = getTestOptions(dir)
+	} else {
+		opts.Directory = dir
+		opts.ValueDirectory = dir
+	}
+
+	db, err := Open(*opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	test(t, db)
+}
+
+func TestTransaction_ReadYourWrites(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key, value := []byte("key"), []byte("value")
+
+		txn := db.NewTransaction(true)
+		require.NoError(t, txn.Set(0, key, value))
+
+		// The pending write should be visible within the transaction, but only within the partition it was written to.
+		item, err := txn.Get(0, key)
+		require.NoError(t, err)
+		require.Equal(t, value, item.value)
+
+		_, err = txn.Get(1, key)
+		require.Equal(t, ErrKeyNotFound, err)
+
+		// But other transactions should not be able to see the write until it has been committed.
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			_, err := txn.Get(0, key)
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		}))
+
+		require.NoError(t, txn.Commit())
+
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			item, err := txn.Get(0, key)
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), item.Version())
+
+			result, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, value, result)
+			return nil
+		}))
+
+		// Deleting the key should hide it from later reads.
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Delete(0, key)
+		}))
+
+		require.Equal(t, ErrReadOnlyTxn, db.View(func(txn *Transaction) error {
+			_, err := txn.Get(0, key)
+			require.Equal(t, ErrKeyNotFound, err)
+			return txn.Set(0, key, value)
+		}))
+	})
+}
+
+func TestTransaction_CommitConflict(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+
+		first := db.NewTransaction(true)
+		defer first.Discard()
+		second := db.NewTransaction(true)
+		defer second.Discard()
+
+		// Both transactions read the key before writing it.
+		_, err := first.Get(0, key)
+		require.Equal(t, ErrKeyNotFound, err)
+		_, err = second.Get(0, key)
+		require.Equal(t, ErrKeyNotFound, err)
+
+		require.NoError(t, first.Set(0, key, []byte("first")))
+		require.NoError(t, second.Set(0, key, []byte("second")))
+
+		require.NoError(t, first.Commit())
+		require.Equal(t, ErrConflict, second.Commit())
+
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			item, err := txn.Get(0, key)
+			require.NoError(t, err)
+			return item.Value(func(value []byte) error {
+				require.Equal(t, []byte("first"), value)
+				return nil
+			})
+		}))
+	})
+}
+
+func TestTransaction_CommitConflict_Partitions(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+
+		// Both transactions read and write the same key, but each in its own partition.
+		first := db.NewTransaction(true)
+		defer first.Discard()
+		second := db.NewTransaction(true)
+		defer second.Discard()
+
+		for partitionId, txn := range map[PartitionId]*Transaction{1: first, 2: second} {
+			_, err := txn.Get(partitionId, key)
+			require.Equal(t, ErrKeyNotFound, err)
+			require.NoError(t, txn.Set(partitionId, key, []byte(fmt.Sprintf("value-%d", partitionId))))
+		}
+
+		require.NoError(t, first.Commit())
+		require.NoError(t, second.Commit())
+
+		metrics := db.Metrics()
+		require.Equal(t, 2, metrics.TrackedCommits)
+		require.Zero(t, metrics.Conflicts)
+
+		// The same key in the same partition still conflicts.
+		third := db.NewTransaction(true)
+		defer third.Discard()
+		_, err := third.Get(1, key)
+		require.NoError(t, err)
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(1, key, []byte("updated"))
+		}))
+		require.NoError(t, third.Set(1, key, []byte("conflict")))
+		require.Equal(t, ErrConflict, third.Commit())
+		require.Equal(t, uint64(1), db.Metrics().Conflicts)
+	})
+}
+
+func TestTransaction_ReadTracking(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			for _, key := range []string{"a", "b", "c"} {
+				if err := txn.Set(1, []byte(key), []byte(key)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+
+		read := func(txn *Transaction) {
+			_, err := txn.Get(1, []byte("a"))
+			require.NoError(t, err)
+			_, err = txn.Get(1, []byte("missing"))
+			require.Equal(t, ErrKeyNotFound, err)
+
+			iterator := txn.NewIterator(1, DefaultIteratorOptions)
+			defer iterator.Close()
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+				require.NotNil(t, iterator.Item())
+			}
+		}
+
+		// Read-only transactions never conflict, so they don't track anything they read.
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			read(txn)
+			require.Empty(t, txn.reads)
+			return nil
+		}))
+
+		// Update transactions track every key they read, including the keys that were not found and the keys that were
+		// iterated over.
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		read(txn)
+		require.Len(t, txn.reads, 1)
+		require.Len(t, txn.reads[1], 5)
+
+		// A key that was only iterated over conflicts once it has been committed by another transaction.
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(1, []byte("c"), []byte("updated"))
+		}))
+		require.NoError(t, txn.Set(1, []byte("d"), []byte("d")))
+		require.Equal(t, ErrConflict, txn.Commit())
+	})
+}
+
+func TestDB_GetAt(t *testing.T) {
+	opts := getTestOptions("").withoutCompactors() // Compactions are run manually.
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		key := []byte("key")
+
+		var versions []uint64
+		for _, value := range []string{"one", "two", "three"} {
+			require.NoError(t, db.Update(func(txn *Transaction) error {
+				return txn.Set(0, key, []byte(value))
+			}))
+			require.NoError(t, db.View(func(txn *Transaction) error {
+				item, err := txn.Get(0, key)
+				require.NoError(t, err)
+				versions = append(versions, item.Version())
+				return nil
+			}))
+		}
+
+		value, err := db.GetAt(0, key, versions[1])
+		require.NoError(t, err)
+		require.Equal(t, "two", string(value))
+
+		// The newest version at or below the timestamp is read.
+		value, err = db.GetAt(0, key, versions[2]-1)
+		require.NoError(t, err)
+		require.Equal(t, "two", string(value))
+
+		_, err = db.GetAt(0, key, versions[0]-1)
+		require.Equal(t, ErrKeyNotFound, err)
+
+		// An update transaction at an older timestamp conflicts with the newer versions of the keys it read.
+		txn := db.NewTransactionAt(versions[0], true)
+		item, err := txn.Get(0, key)
+		require.NoError(t, err)
+		require.Equal(t, versions[0], item.Version())
+		require.NoError(t, txn.Set(0, key, []byte("four")))
+		require.Equal(t, ErrConflict, txn.Commit())
+
+		// Once the older versions have been compacted they can't be read anymore. The reads are marked as done in the
+		// background, so wait for them before compacting.
+		require.NoError(t, db.oracle.readMark.WaitForMark(context.Background(), versions[2]))
+		require.NoError(t, db.Flush(0))
+		require.NoError(t, db.levelsController.compactLevel0())
+
+		_, err = db.GetAt(0, key, versions[1])
+		require.Equal(t, ErrVersionDiscarded, err)
+
+		value, err = db.GetAt(0, key, versions[2])
+		require.NoError(t, err)
+		require.Equal(t, "three", string(value))
+	})
+}
+
+func TestDB_OpenManaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := OpenManaged(getTestOptions(dir))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	key := []byte("key")
+
+	// Transactions that don't provide their own timestamps can't be used.
+	_, err = db.NewTransaction(false).Get(0, key)
+	require.Equal(t, ErrManagedTransaction, err)
+	require.Equal(t, ErrManagedTransaction, db.View(func(txn *Transaction) error {
+		return nil
+	}))
+	require.Equal(t, ErrManagedTransaction, db.Update(func(txn *Transaction) error {
+		return nil
+	}))
+
+	set := func(readTs, commitTs uint64, value string) error {
+		txn := db.NewTransactionAt(readTs, true)
+		defer txn.Discard()
+		require.NoError(t, txn.Set(0, key, []byte(value)))
+		return txn.CommitAt(commitTs)
+	}
+
+	require.NoError(t, set(0, 10, "one"))
+	require.NoError(t, set(10, 20, "two"))
+
+	for readTs, expected := range map[uint64]string{10: "one", 15: "one", 20: "two", 25: "two"} {
+		value, err := db.GetAt(0, key, readTs)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(value), readTs)
+	}
+
+	_, err = db.GetAt(0, key, 5)
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// Commit timestamps must be greater than the read timestamp and every commit before them.
+	require.Equal(t, ErrCommitTimestamp, set(20, 15, "three"))
+	require.Equal(t, ErrCommitTimestamp, set(25, 25, "three"))
+	require.Equal(t, ErrCommitTimestamp, set(5, 20, "three"))
+
+	txn := db.NewTransactionAt(25, true)
+	require.NoError(t, txn.Set(0, key, []byte("three")))
+	require.Equal(t, ErrManagedTransaction, txn.Commit())
+
+	require.NoError(t, set(25, 30, "three"))
+	value, err := db.GetAt(0, key, 30)
+	require.NoError(t, err)
+	require.Equal(t, "three", string(value))
+}
+
+func TestTransaction_CommitAt_NotManaged(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.Set(0, []byte("key"), []byte("value")))
+		require.Equal(t, ErrNotManaged, txn.CommitAt(10))
+		require.Equal(t, ErrNotManaged, db.SetDiscardTimestamp(10))
+	})
+}
+
+func TestTransaction_Commit_CrashBeforeMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+
+	commit := func(first, second string) {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			require.NoError(t, txn.Set(1, []byte(first), []byte(first)))
+			return txn.Set(2, []byte(second), []byte(second))
+		}))
+	}
+	commit("a", "b")
+	commit("c", "d")
+	require.NoError(t, db.Sync())
+
+	// The second transaction is the last thing in the value log and ends with its marker.
+	data, err := ioutil.ReadFile(db.valueLog.filePath(0))
+	require.NoError(t, err)
+	var markerOffset uint32
+	var markerVersion uint64
+	file, err := os.Open(db.valueLog.filePath(0))
+	require.NoError(t, err)
+	_, err = iterateEntries(file, 0, 0, func(e *Entry, pointer valuePointer) error {
+		if e.meta&bitFinTxn > 0 {
+			markerOffset, markerVersion = pointer.Offset, z.ParseTs(e.Key)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.NoError(t, db.Close())
+
+	// Nothing was flushed to a table in the copy, so everything has to be recovered from the value log. The copy ends
+	// right before the marker of the second transaction, as if the database crashed while writing it.
+	crashDir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(crashDir)
+	require.NoError(t, ioutil.WriteFile(valueLogFilePath(crashDir, 0), data[:markerOffset], 0600))
+
+	db, err = Open(getTestOptions(crashDir))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		for _, key := range []struct {
+			partitionId PartitionId
+			key         string
+			exists      bool
+		}{
+			{1, "a", true},
+			{2, "b", true},
+			{1, "c", false},
+			{2, "d", false},
+		} {
+			item, err := txn.Get(key.partitionId, []byte(key.key))
+			if !key.exists {
+				require.Equal(t, ErrKeyNotFound, err, key.key)
+				continue
+			}
+			require.NoError(t, err, key.key)
+			value, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, key.key, string(value))
+		}
+		return nil
+	}))
+
+	// The timestamp of the incomplete transaction is not reused.
+	commit("e", "f")
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		item, err := txn.Get(1, []byte("e"))
+		require.NoError(t, err)
+		require.Greater(t, item.Version(), markerVersion)
+		return nil
+	}))
+}
+
+func TestTransaction_Set_KeySize(t *testing.T) {
+	// The default table size leaves room for a transaction with a key at the limit.
+	opts := DefaultOptions("").WithSyncWrites(false)
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		largest := bytes.Repeat([]byte("k"), maxKeySize)
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			require.Equal(t, ErrEmptyKey, txn.Set(1, nil, []byte("value")))
+			require.Equal(t, ErrEmptyKey, txn.Delete(1, []byte{}))
+			require.Equal(t, ErrKeyTooLarge, txn.Set(1, append(largest, 'k'), []byte("value")))
+			return txn.Set(1, largest, []byte("value"))
+		}))
+
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			_, err := txn.Get(1, nil)
+			require.Equal(t, ErrEmptyKey, err)
+			_, err = txn.Get(1, append(largest, 'k'))
+			require.Equal(t, ErrKeyTooLarge, err)
+
+			item, err := txn.Get(1, largest)
+			require.NoError(t, err)
+			require.Equal(t, largest, item.Key())
+			return nil
+		}))
+
+		// The key is still intact once it has been written to a table.
+		require.NoError(t, db.Flush(1))
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			item, err := txn.Get(1, largest)
+			require.NoError(t, err)
+			require.Equal(t, largest, item.Key())
+			return nil
+		}))
+	})
+}
+
+func TestTransaction_Set_ValueSize(t *testing.T) {
+	opts := DefaultOptions("").WithValueLogFileSize(1 << 20).WithSyncWrites(false)
+	runNotBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		largest := bytes.Repeat([]byte("v"), int(db.options.maxValueSize(len(key))))
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			require.Equal(t, ErrValueTooLarge, txn.Set(1, key, append(largest, 'v')))
+			return txn.Set(1, key, largest)
+		}))
+
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			item, err := txn.Get(1, key)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(largest)), item.ValueSize())
+			return nil
+		}))
+	})
+}
+
+func TestTransaction_SetEntry_UserMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+
+	entry := NewEntry([]byte("key"), []byte("value")).WithMeta(7).WithTTL(time.Hour)
+	require.NotZero(t, entry.ExpiresAt)
+
+	verify := func(item *Item) {
+		require.Equal(t, byte(7), item.UserMeta())
+		require.Equal(t, entry.ExpiresAt, item.ExpiresAt())
+		value, err := item.ValueCopy(nil)
+		require.NoError(t, err)
+		require.Equal(t, "value", string(value))
+	}
+
+	verifyDB := func() {
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			item, err := txn.Get(1, []byte("key"))
+			require.NoError(t, err)
+			verify(item)
+
+			iterator := txn.NewIterator(1, DefaultIteratorOptions)
+			defer iterator.Close()
+			iterator.Rewind()
+			require.True(t, iterator.Valid())
+			verify(iterator.Item())
+			return nil
+		}))
+	}
+
+	require.NoError(t, db.Update(func(txn *Transaction) error {
+		require.NoError(t, txn.SetEntry(1, entry))
+		item, err := txn.Get(1, []byte("key"))
+		require.NoError(t, err)
+		verify(item)
+		return nil
+	}))
+	verifyDB()
+
+	// The user metadata and expiration are written to the level 0 table.
+	require.NoError(t, db.Flush(1))
+	verifyDB()
+
+	require.NoError(t, db.Close())
+	db, err = Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	verifyDB()
+}
+
+func TestDB_Set_WriteOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// Writes are not synced by default, so only the writes that ask for it are synced.
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	// Interleave synced and unsynced writes so they end up batched together.
+	const writers, writes = 4, 25
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				key := []byte(fmt.Sprintf("key-%d-%02d", i, j))
+				require.NoError(t, db.Set(PartitionId(i), key, key, WriteOptions{Sync: j%2 == 0}))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.NoError(t, db.UpdateWithOptions(WriteOptions{Sync: true}, func(txn *Transaction) error {
+		return txn.Set(0, []byte("batch"), []byte("synced"))
+	}))
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		for i := 0; i < writers; i++ {
+			for j := 0; j < writes; j++ {
+				key := []byte(fmt.Sprintf("key-%d-%02d", i, j))
+				item, err := txn.Get(PartitionId(i), key)
+				require.NoError(t, err)
+				require.Equal(t, key, item.value)
+			}
+		}
+
+		item, err := txn.Get(0, []byte("batch"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("synced"), item.value)
+		return nil
+	}))
+}
+
+func BenchmarkDB_Set_SyncInterval(b *testing.B) {
+	for _, interval := range []time.Duration{0, 20 * time.Microsecond} {
+		b.Run(fmt.Sprintf("interval=%s", interval), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "badger-test")
+			require.NoError(b, err)
+			defer removeDir(dir)
+
+			db, err := Open(DefaultOptions(dir).WithSyncInterval(interval))
+			require.NoError(b, err)
+			defer func() {
+				require.NoError(b, db.Close())
+			}()
+
+			// Many writers that each wait for their own write to be synced.
+			var counter int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := []byte(fmt.Sprintf("key%09d", atomic.AddInt64(&counter, 1)))
+					if err := db.Set(0, key, key, WriteOptions{Sync: true}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestDB_Get_NoCache(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for i := 0; i < 100; i += 20 {
+			require.NoError(t, db.Update(func(txn *Transaction) error {
+				for j := i; j < i+20; j++ {
+					key := []byte(fmt.Sprintf("key%03d", j))
+					if err := txn.Set(1, key, key); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+		require.NoError(t, db.Flush(1))
+
+		// Neither reads nor iterators with NoCache look up or add blocks to the cache.
+		before := db.Metrics()
+		value, err := db.Get(1, []byte("key042"), ReadOptions{NoCache: true})
+		require.NoError(t, err)
+		require.Equal(t, "key042", string(value))
+
+		_, err = db.Get(1, []byte("missing"), ReadOptions{NoCache: true})
+		require.Equal(t, ErrKeyNotFound, err)
+
+		require.NoError(t, db.View(func(txn *Transaction) error {
+			iterator := txn.NewIterator(1, IteratorOptions{ReadOptions: ReadOptions{NoCache: true}})
+			defer iterator.Close()
+			var count int
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+				count++
+			}
+			require.Equal(t, 100, count)
+			return nil
+		}))
+
+		after := db.Metrics()
+		require.Equal(t, before.CacheHits, after.CacheHits)
+		require.Equal(t, before.CacheMisses, after.CacheMisses)
+
+		// A read that uses the cache looks the block up.
+		value, err = db.Get(1, []byte("key042"), ReadOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "key042", string(value))
+		metrics := db.Metrics()
+		require.Greater(t, metrics.CacheHits+metrics.CacheMisses, after.CacheHits+after.CacheMisses)
+	})
+}
+
+func TestDB_MultiGet(t *testing.T) {
+	runNotBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		// Some of the keys are in level 0 and the rest are in the memory tables.
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			for _, key := range []string{"a", "b", "c", "d"} {
+				if err := txn.Set(1, []byte(key), []byte("old-"+key)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		require.NoError(t, db.Flush(1))
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			if err := txn.Set(1, []byte("b"), []byte("new-b")); err != nil {
+				return err
+			}
+			if err := txn.Set(1, []byte("e"), []byte{}); err != nil {
+				return err
+			}
+			return txn.Delete(1, []byte("c"))
+		}))
+
+		values, err := db.MultiGet(1, [][]byte{[]byte("e"), []byte("d"), []byte("missing"), []byte("c"), []byte("b"),
+			[]byte("a"), []byte("d")})
+		require.NoError(t, err)
+		require.Len(t, values, 7)
+
+		// A key with an empty value is found, while a key that was never written and a deleted key are not.
+		require.True(t, values[0].Found)
+		require.Empty(t, values[0].Value)
+		require.Equal(t, uint64(2), values[0].Version)
+		require.Equal(t, MultiGetValue{}, values[2])
+		require.Equal(t, MultiGetValue{}, values[3])
+
+		for i, expected := range map[int]string{1: "old-d", 4: "new-b", 5: "old-a", 6: "old-d"} {
+			require.True(t, values[i].Found)
+			require.Equal(t, expected, string(values[i].Value))
+		}
+		require.Equal(t, uint64(1), values[1].Version)
+		require.Equal(t, uint64(2), values[4].Version)
+
+		values, err = db.MultiGet(2, [][]byte{[]byte("a")})
+		require.NoError(t, err)
+		require.Equal(t, []MultiGetValue{{}}, values)
+
+		_, err = db.MultiGet(1, [][]byte{[]byte("a"), nil})
+		require.Equal(t, ErrEmptyKey, err)
+	})
+}
+
+func BenchmarkDB_MultiGet(b *testing.B) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(b, err)
+	defer removeDir(dir)
+
+	db, err := Open(DefaultOptions(dir))
+	require.NoError(b, err)
+	defer func() {
+		require.NoError(b, db.Close())
+	}()
+
+	const numberOfKeys = 10000
+	for i := 0; i < numberOfKeys; i += 1000 {
+		require.NoError(b, db.Update(func(txn *Transaction) error {
+			for j := i; j < i+1000; j++ {
+				key := []byte(fmt.Sprintf("key%06d", j))
+				if err := txn.Set(1, key, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	require.NoError(b, db.Flush(1))
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%06d", rand.Intn(numberOfKeys)))
+	}
+
+	b.Run("Get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				if _, err := db.Get(1, key, ReadOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("MultiGet", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.MultiGet(1, keys); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRequestsNeedSync(t *testing.T) {
+	require.False(t, requestsNeedSync(nil))
+	require.False(t, requestsNeedSync([]*request{{}, {}}))
+	require.True(t, requestsNeedSync([]*request{{}, {sync: true}, {}}))
+}
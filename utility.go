@@ -3,11 +3,10 @@ package notbadger
 import (
 	"github.com/elliotcourant/notbadger/table"
 	"github.com/elliotcourant/notbadger/z"
-	"io/ioutil"
 )
 
-func getFileIdMap(directory string) (idMap map[PartitionId]map[uint64]struct{}) {
-	fileInfoList, err := ioutil.ReadDir(directory)
+func getFileIdMap(fs z.FileSystem, directory string) (idMap map[PartitionId]map[uint64]struct{}) {
+	fileInfoList, err := z.ReadDir(fs, directory)
 	z.Check(err)
 
 	idMap = map[PartitionId]map[uint64]struct{}{}
@@ -1,13 +1,40 @@
 package notbadger
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
 	"github.com/elliotcourant/notbadger/options"
 	"github.com/elliotcourant/notbadger/pb"
 	"github.com/elliotcourant/notbadger/z"
+	"github.com/elliotcourant/timber"
+	"github.com/pkg/errors"
 	"golang.org/x/net/trace"
-	"os"
-	"sync"
+)
+
+var (
+	// errTruncate is returned when an entry in the value log is incomplete, the value log needs to be truncated at the
+	// start of the entry.
+	errTruncate = errors.New("Do truncate")
+
+	// errChecksumMismatch is returned when the checksum of an entry in the value log does not match its contents.
+	errChecksumMismatch = errors.New("Value log entry checksum mismatch")
+
+	// errStop is returned by a callback to stop iterating the entries of the value log early.
+	errStop = errors.New("Stop iteration")
 )
 
 type (
@@ -16,6 +43,16 @@ type (
 		Entries []*Entry
 
 		Pointers []valuePointer
+
+		Wg  sync.WaitGroup
+		Err error
+
+		// sync is set when the value log and the manifest must be synced before the request is done.
+		sync bool
+
+		// logFileId is the write-ahead log file that the request was written to, or zero if it was not written to the
+		// write-ahead log.
+		logFileId uint32
 	}
 
 	logFile struct {
@@ -48,8 +85,15 @@ type (
 	}
 
 	valueLog struct {
-		directoryPath string
-		elog          trace.EventLog
+		// directoryPaths are the directories that the value log files are spread across, see filePath.
+		directoryPaths []string
+		elog           trace.EventLog
+
+		// fileDirectories is the directory that each value log file was found in the last time the value directories
+		// were read. The value directories can change between opens, so existing files are not always in the directory
+		// that filePath would assign them to.
+		directoriesLock sync.RWMutex
+		fileDirectories map[uint32]string
 
 		// filesLock guards our view of which files exist, which to be deleted and how many active iterators.
 		filesLock        sync.RWMutex
@@ -69,8 +113,643 @@ type (
 		garbageChannel      chan struct{}
 		logFileDiscardStats *logFileDiscardStats
 	}
+
+	// hashReader wraps a reader and computes the CRC32 checksum of everything that is read from it.
+	hashReader struct {
+		reader    io.Reader
+		hash      hash.Hash32
+		bytesRead int
+	}
+
+	// safeRead reads entries from a value log file one at a time. The key and value buffers are reused between
+	// entries, so an entry is only valid until the next entry is read.
+	safeRead struct {
+		key   []byte
+		value []byte
+
+		recordOffset uint32
+	}
 )
 
+// Wait blocks until the request has been written and returns the error from the write if there was one.
+func (req *request) Wait() error {
+	req.Wg.Wait()
+	return req.Err
+}
+
+// sync fsyncs the value log file that is currently being written to. If nothing has been written to the value log yet
+// then there is nothing to sync.
+func (vlog *valueLog) sync() error {
+	vlog.filesLock.RLock()
+	current, ok := vlog.filesMap[atomic.LoadUint32(&vlog.maxFileId)]
+	vlog.filesLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	current.lock.RLock()
+	defer current.lock.RUnlock()
+
+	// The file is closed once the value log moves on to the next file, it was synced before it was closed.
+	if current.file == nil {
+		return nil
+	}
+
+	return z.FileSync(current.file)
+}
+
+// write appends the entries of the requests to the value log in the order of the requests, and records where each
+// entry was written in the pointers of its request. The entries of a single request are always written to the same
+// file, so a transaction is never split from the marker at the end of it. The value log moves on to a new file once the
+// current file would grow past ValueLogFileSize or ValueLogMaxEntries. write is only called by the goroutine that
+// writes requests.
+func (vlog *valueLog) write(requests []*request) error {
+	var buf bytes.Buffer
+	for _, req := range requests {
+		if len(req.Entries) == 0 {
+			continue
+		}
+
+		buf.Reset()
+		lengths := make([]uint32, len(req.Entries))
+		for i, e := range req.Entries {
+			n, err := e.Encode(&buf)
+			if err != nil {
+				return z.Wrapf(err, "failed to encode entry for value log")
+			}
+			lengths[i] = uint32(n)
+		}
+
+		current, offset, err := vlog.fileForWrite(buf.Len(), len(req.Entries))
+		if err != nil {
+			return err
+		}
+
+		current.lock.RLock()
+		_, err = current.file.WriteAt(buf.Bytes(), int64(offset))
+		current.lock.RUnlock()
+		if err != nil {
+			return z.Wrapf(err, "failed to write to value log file: %q", current.path)
+		}
+
+		req.Pointers = req.Pointers[:0]
+		for _, length := range lengths {
+			req.Pointers = append(req.Pointers, valuePointer{
+				Fid:    current.fileId,
+				Len:    length,
+				Offset: offset,
+			})
+			offset += length
+		}
+
+		atomic.StoreUint32(&vlog.writableLogOffset, offset)
+		atomic.AddUint32(&vlog.numEntriesWritten, uint32(len(req.Entries)))
+	}
+
+	return nil
+}
+
+// fileForWrite returns the value log file that the next write of the provided size should be written to along with the
+// offset to write it at. If the write would not fit in the current file then the current file is synced and closed and
+// a new file is created. A write that is larger than ValueLogFileSize on its own is written to an empty file.
+func (vlog *valueLog) fileForWrite(size, numberOfEntries int) (*logFile, uint32, error) {
+	vlog.filesLock.Lock()
+	defer vlog.filesLock.Unlock()
+
+	fileId := atomic.LoadUint32(&vlog.maxFileId)
+	offset := atomic.LoadUint32(&vlog.writableLogOffset)
+	current, ok := vlog.filesMap[fileId]
+
+	isFull := int64(offset)+int64(size) > vlog.options.ValueLogFileSize ||
+		atomic.LoadUint32(&vlog.numEntriesWritten)+uint32(numberOfEntries) > vlog.options.ValueLogMaxEntries
+	if offset > 0 && isFull {
+		if ok {
+			if err := current.close(); err != nil {
+				return nil, 0, err
+			}
+			delete(vlog.filesMap, fileId)
+		}
+
+		fileId, offset, ok = fileId+1, 0, false
+		atomic.StoreUint32(&vlog.maxFileId, fileId)
+		atomic.StoreUint32(&vlog.writableLogOffset, 0)
+		atomic.StoreUint32(&vlog.numEntriesWritten, 0)
+	}
+
+	if ok {
+		return current, offset, nil
+	}
+
+	path := vlog.filePath(fileId)
+	file, err := vlog.options.FileSystem.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, z.Wrapf(err, "failed to open value log file: %q", path)
+	}
+
+	if offset == 0 {
+		// Do dir sync as best effort. The file is synced before a write to it is acknowledged.
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			vlog.db.eventLog.Errorf("failed to sync value directory for %q: %v", path, err)
+		}
+	}
+
+	current = &logFile{
+		path:   path,
+		file:   file,
+		fileId: fileId,
+	}
+	vlog.filesMap[fileId] = current
+
+	return current, offset, nil
+}
+
+// removeBefore removes the value log files with an Id below the provided Id. The file that is being written to is never
+// removed.
+func (vlog *valueLog) removeBefore(fileId uint32) error {
+	vlog.filesLock.Lock()
+	defer vlog.filesLock.Unlock()
+
+	if maxFileId := atomic.LoadUint32(&vlog.maxFileId); maxFileId < fileId {
+		fileId = maxFileId
+	}
+
+	fileIds, err := vlog.fileIds()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range fileIds {
+		if id >= fileId {
+			break
+		}
+
+		path := vlog.filePath(id)
+		if err := vlog.options.FileSystem.Remove(path); err != nil && !os.IsNotExist(err) {
+			return z.Wrapf(err, "failed to remove value log file: %q", path)
+		}
+	}
+
+	return nil
+}
+
+// close syncs and closes the value log file that is currently being written to.
+func (vlog *valueLog) close() error {
+	vlog.filesLock.Lock()
+	defer vlog.filesLock.Unlock()
+
+	for fileId, lf := range vlog.filesMap {
+		if err := lf.close(); err != nil {
+			return err
+		}
+		delete(vlog.filesMap, fileId)
+	}
+
+	return nil
+}
+
+// close syncs and closes the file descriptor of the log file. Anything still holding the log file sees a nil file.
+func (lf *logFile) close() error {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+
+	if err := z.FileSync(lf.file); err != nil {
+		return z.Wrapf(err, "failed to sync value log file: %q", lf.path)
+	}
+
+	if err := lf.file.Close(); err != nil {
+		return z.Wrapf(err, "failed to close value log file: %q", lf.path)
+	}
+	lf.file = nil
+
+	return nil
+}
+
+func newHashReader(reader io.Reader) *hashReader {
+	return &hashReader{
+		reader: reader,
+		hash:   crc32.New(z.CastagnoliCrcTable),
+	}
+}
+
+// Read reads len(p) bytes from the reader. Returns the number of bytes read and any error encountered.
+func (t *hashReader) Read(p []byte) (int, error) {
+	n, err := t.reader.Read(p)
+	if err != nil {
+		return n, err
+	}
+	t.bytesRead += n
+	return t.hash.Write(p[:n])
+}
+
+// ReadByte reads exactly one byte from the reader. Returns an error if it fails.
+func (t *hashReader) ReadByte() (byte, error) {
+	b := make([]byte, 1)
+	_, err := t.Read(b)
+	return b[0], err
+}
+
+// Sum32 returns the CRC32 checksum of everything that has been read so far.
+func (t *hashReader) Sum32() uint32 {
+	return t.hash.Sum32()
+}
+
+// Entry reads the next entry from the reader. io.EOF is returned if there are no more entries. errTruncate is returned
+// if the entry is incomplete and errChecksumMismatch is returned if the entry is corrupt.
+func (r *safeRead) Entry(reader io.Reader) (*Entry, error) {
+	hashReader := newHashReader(reader)
+	var h header
+	headerLength, err := h.DecodeFrom(hashReader)
+	if err == io.EOF && hashReader.bytesRead == 0 {
+		return nil, io.EOF
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errTruncate
+	} else if err != nil {
+		return nil, err
+	}
+
+	keyLength, valueLength := int(h.keyLength), int(h.valueLength)
+	if cap(r.key) < keyLength {
+		r.key = make([]byte, 2*keyLength)
+	}
+	if cap(r.value) < valueLength {
+		r.value = make([]byte, 2*valueLength)
+	}
+
+	e := &Entry{
+		Key:          r.key[:keyLength],
+		Value:        r.value[:valueLength],
+		UserMeta:     h.userMeta,
+		ExpiresAt:    h.expiresAt,
+		meta:         h.meta,
+		partitionId:  h.partitionId,
+		offset:       r.recordOffset,
+		headerLength: headerLength,
+	}
+
+	if _, err = io.ReadFull(hashReader, e.Key); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errTruncate
+		}
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(hashReader, e.Value); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errTruncate
+		}
+		return nil, err
+	}
+
+	var crcBuf [crc32Size]byte
+	if _, err = io.ReadFull(reader, crcBuf[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errTruncate
+		}
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(crcBuf[:]) != hashReader.Sum32() {
+		return nil, errChecksumMismatch
+	}
+
+	r.recordOffset += uint32(headerLength + keyLength + valueLength + crc32Size)
+
+	return e, nil
+}
+
+// iterateEntries reads every entry from the reader starting at the provided offset, calling fn with the entry and a
+// pointer to where the entry is in the value log file. Iteration stops at the end of the reader, when fn returns an
+// error, or when an incomplete or corrupt entry is found. The offset after the last valid entry is returned.
+func iterateEntries(reader io.Reader, fileId, offset uint32, fn func(e *Entry, pointer valuePointer) error) (
+	uint32, error,
+) {
+	read := &safeRead{
+		key:          make([]byte, 10),
+		value:        make([]byte, 10),
+		recordOffset: offset,
+	}
+
+	bufferedReader := bufio.NewReader(reader)
+	validEndOffset := offset
+	for {
+		e, err := read.Entry(bufferedReader)
+		switch {
+		case err == io.EOF:
+			return validEndOffset, nil
+		case err == errTruncate || err == errChecksumMismatch:
+			return validEndOffset, err
+		case err != nil:
+			return validEndOffset, z.Wrapf(err, "failed to read entry at offset %d", validEndOffset)
+		}
+
+		pointer := valuePointer{
+			Fid:    fileId,
+			Len:    read.recordOffset - e.offset,
+			Offset: e.offset,
+		}
+		validEndOffset = read.recordOffset
+
+		if err := fn(e, pointer); err != nil {
+			return validEndOffset, err
+		}
+	}
+}
+
+// iterate reads the entries of the log file starting at the provided offset, calling fn with every entry and a pointer
+// to where the entry is in the file. Iteration stops cleanly at the first incomplete or corrupt entry, which is what a
+// crash in the middle of a write leaves behind, so the returned offset is the end of the last valid entry.
+func (vlog *valueLog) iterate(lf *logFile, offset uint32, fn func(e *Entry, pointer valuePointer) error) (
+	uint32, error,
+) {
+	lf.lock.RLock()
+	defer lf.lock.RUnlock()
+
+	reader := io.NewSectionReader(lf.file, int64(offset), math.MaxInt64-int64(offset))
+	endOffset, err := iterateEntries(reader, lf.fileId, offset, fn)
+	if err == errTruncate || err == errChecksumMismatch {
+		return endOffset, nil
+	}
+
+	return endOffset, err
+}
+
+// IterateValueLogFile reads every entry in the value log file at the provided path without opening a database, which
+// is useful for inspecting a corrupt value log. The callback receives each entry with the timestamp removed from its
+// key and its version set, along with the offset of the entry in the file. The entry is only valid until the callback
+// returns. Iteration stops at the first incomplete or corrupt entry, and the offset after the last valid entry is
+// returned.
+func IterateValueLogFile(path string, fn func(e *Entry, offset uint32) error) (uint32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, z.Wrapf(err, "failed to open value log file: %q", path)
+	}
+	defer file.Close()
+
+	lf := &logFile{
+		path: path,
+		file: file,
+	}
+
+	var vlog valueLog
+	return vlog.iterate(lf, 0, func(e *Entry, pointer valuePointer) error {
+		e.version = z.ParseTs(e.Key)
+		e.Key = z.ParseKey(e.Key)
+		return fn(e, pointer.Offset)
+	})
+}
+
+// open finds the value log files in the value directories and replays the latest one to find where the next entry
+// should be written. If a crash left a partially written or corrupt entry at the end of the file then the file is
+// truncated to the end of the last valid entry when the Truncate option is set, otherwise ErrTruncateNeeded is
+// returned.
+func (vlog *valueLog) open(db *DB) error {
+	vlog.db = db
+	vlog.options = db.options
+	vlog.filesMap = make(map[uint32]*logFile)
+
+	fileIds, err := vlog.fileIds()
+	if err != nil {
+		return err
+	}
+
+	if len(fileIds) == 0 {
+		return nil
+	}
+
+	// Only the latest file can have been in the middle of a write when the database stopped.
+	fileId := fileIds[len(fileIds)-1]
+	atomic.StoreUint32(&vlog.maxFileId, fileId)
+
+	endOffset, err := vlog.replayFile(fileId)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&vlog.writableLogOffset, endOffset)
+
+	return nil
+}
+
+// replay reads every entry in the value log in the order it was written and calls fn with the entries of every
+// transaction that was completely written, along with the pointers to where the entries were written. A transaction is
+// only complete once the marker at the end of it has been read, so the entries of a transaction that was cut short by a
+// crash are skipped and none of its writes are applied. Entries that were not written by a transaction are passed to fn
+// on their own. The largest version that was read is returned, including the versions of transactions that were
+// skipped, so that their timestamps are never reused.
+//
+// Replay begins at the provided start, the entries before it have already been flushed to tables. The start is checked
+// against the value log first, the whole value log is replayed if no entry can be found where it points.
+func (vlog *valueLog) replay(start valuePointer, fn func(entries []*Entry, pointers []valuePointer) error) (
+	uint64, error,
+) {
+	fileIds, err := vlog.fileIds()
+	if err != nil {
+		return 0, err
+	}
+
+	if !start.IsZero() && !vlog.isValidReplayStart(start, fileIds) {
+		timber.Warningf("no entry found in the value log at the replay start %+v, replaying the whole value log", start)
+		start = valuePointer{}
+	}
+
+	var maxVersion uint64
+	for _, fileId := range fileIds {
+		if fileId < start.Fid {
+			continue
+		}
+
+		var offset uint32
+		if fileId == start.Fid {
+			offset = start.Offset
+		}
+
+		path := vlog.filePath(fileId)
+		file, err := vlog.options.FileSystem.Open(path)
+		if err != nil {
+			return 0, z.Wrapf(err, "failed to open value log file: %q", path)
+		}
+
+		lf := &logFile{
+			path:   path,
+			file:   file,
+			fileId: fileId,
+		}
+
+		// A transaction is always written to a single file, so anything pending at the end of a file is incomplete.
+		var pending []*Entry
+		var pointers []valuePointer
+		_, err = vlog.iterate(lf, offset, func(e *Entry, pointer valuePointer) error {
+			version := z.ParseTs(e.Key)
+			if version > maxVersion {
+				maxVersion = version
+			}
+
+			switch {
+			case e.meta&bitFinTxn > 0:
+				// Every entry of a transaction has the same version as its marker.
+				complete := len(pending) > 0 && z.ParseTs(pending[0].Key) == version
+				entries, entryPointers := pending, pointers
+				pending, pointers = nil, nil
+				if !complete {
+					return nil
+				}
+
+				return fn(entries, entryPointers)
+			case e.meta&bitTxn > 0:
+				// A new transaction started before the marker of the previous one was written.
+				if len(pending) > 0 && z.ParseTs(pending[0].Key) != version {
+					pending, pointers = nil, nil
+				}
+
+				pending = append(pending, copyEntry(e))
+				pointers = append(pointers, pointer)
+				return nil
+			default:
+				return fn([]*Entry{copyEntry(e)}, []valuePointer{pointer})
+			}
+		})
+		_ = file.Close()
+		if err != nil {
+			return 0, z.Wrapf(err, "failed to replay value log file: %q", path)
+		}
+	}
+
+	return maxVersion, nil
+}
+
+// isValidReplayStart returns true if the value log has an entry that starts at the replay start and has the same length.
+// The start is read from the tables, so it could point past the end of a value log that was truncated or lost.
+func (vlog *valueLog) isValidReplayStart(start valuePointer, fileIds []uint32) bool {
+	i := sort.Search(len(fileIds), func(i int) bool {
+		return fileIds[i] >= start.Fid
+	})
+	if i == len(fileIds) || fileIds[i] != start.Fid {
+		return false
+	}
+
+	file, err := vlog.options.FileSystem.Open(vlog.filePath(start.Fid))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	var found valuePointer
+	reader := io.NewSectionReader(file, int64(start.Offset), math.MaxInt64-int64(start.Offset))
+	_, err = iterateEntries(reader, start.Fid, start.Offset, func(_ *Entry, pointer valuePointer) error {
+		found = pointer
+		return errStop
+	})
+
+	return err == errStop && found == start
+}
+
+// copyEntry returns a copy of an entry that was read from the value log, which is only valid until the next entry is
+// read.
+func copyEntry(e *Entry) *Entry {
+	copied := *e
+	copied.Key = z.Copy(e.Key)
+	copied.Value = z.Copy(e.Value)
+	return &copied
+}
+
+// fileIds returns the Ids of the value log files in every value directory in ascending order.
+func (vlog *valueLog) fileIds() ([]uint32, error) {
+	var fileIds []uint32
+	directories := make(map[uint32]string)
+	for _, directory := range vlog.directoryPaths {
+		files, err := z.ReadDir(vlog.options.FileSystem, directory)
+		if err != nil {
+			return nil, z.Wrapf(err, "failed to read value directory: %q", directory)
+		}
+
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), ".vlog") {
+				continue
+			}
+
+			fileId, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".vlog"), 10, 32)
+			if err != nil {
+				return nil, z.Wrapf(err, "failed to parse value log file Id: %q", file.Name())
+			}
+			fileIds = append(fileIds, uint32(fileId))
+			directories[uint32(fileId)] = directory
+		}
+	}
+
+	vlog.directoriesLock.Lock()
+	vlog.fileDirectories = directories
+	vlog.directoriesLock.Unlock()
+
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+
+	return fileIds, nil
+}
+
+// replayFile reads every entry in the value log file and returns the offset after the last valid entry. If the file
+// ends with an incomplete or corrupt entry then it is truncated to that offset, or ErrTruncateNeeded is returned if the
+// Truncate option is not set.
+func (vlog *valueLog) replayFile(fileId uint32) (uint32, error) {
+	path := vlog.filePath(fileId)
+	flags := os.O_RDWR
+	if vlog.options.ReadOnly {
+		flags = os.O_RDONLY
+	}
+
+	file, err := vlog.options.FileSystem.OpenFile(path, flags, 0)
+	if err != nil {
+		return 0, z.Wrapf(err, "failed to open value log file: %q", path)
+	}
+	defer file.Close()
+
+	lf := &logFile{
+		path:   path,
+		file:   file,
+		fileId: fileId,
+	}
+	endOffset, err := vlog.iterate(lf, 0, func(*Entry, valuePointer) error {
+		return nil
+	})
+	if err != nil {
+		return 0, z.Wrapf(err, "failed to replay value log file: %q", path)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, z.Wrapf(err, "failed to stat value log file: %q", path)
+	}
+
+	// Iteration stops at the first incomplete or corrupt entry, so anything after the end offset is not valid.
+	if int64(endOffset) == info.Size() {
+		return endOffset, nil
+	}
+
+	if !vlog.options.Truncate {
+		return 0, ErrTruncateNeeded
+	}
+
+	vlog.db.eventLog.Printf("Truncating value log file %q from %d bytes to offset %d", path, info.Size(), endOffset)
+	if err := file.Truncate(int64(endOffset)); err != nil {
+		return 0, z.Wrapf(err, "failed to truncate value log file: %q", path)
+	}
+
+	return endOffset, z.Wrapf(z.FileSync(file), "failed to sync value log file: %q", path)
+}
+
+// filePath returns the path of the value log file with the provided file Id. Files that already exist are found in the
+// directory they were read from, new files are assigned to the value directories round-robin by their file Id so
+// consecutive files are written to different directories.
+func (vlog *valueLog) filePath(fid uint32) string {
+	vlog.directoriesLock.RLock()
+	directory, ok := vlog.fileDirectories[fid]
+	vlog.directoriesLock.RUnlock()
+	if ok {
+		return valueLogFilePath(directory, fid)
+	}
+
+	return valueLogFilePath(vlog.directoryPaths[int(fid)%len(vlog.directoryPaths)], fid)
+}
+
 func valueLogFilePath(dirPath string, fid uint32) string {
 	return fmt.Sprintf("%s%s%06d.vlog", dirPath, string(os.PathSeparator), fid)
 }
@@ -0,0 +1,428 @@
+package notbadger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeTestEntries encodes the entries one after another in the value log format.
+func encodeTestEntries(t *testing.T, entries ...*Entry) []byte {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		size := buf.Len()
+		n, err := e.Encode(&buf)
+		require.NoError(t, err)
+		require.Equal(t, buf.Len()-size, n)
+	}
+	return buf.Bytes()
+}
+
+func newTestEntry(partitionId PartitionId, key string, version uint64, value string) *Entry {
+	return &Entry{
+		Key:         z.KeyWithTs([]byte(key), version),
+		Value:       []byte(value),
+		UserMeta:    byte(version),
+		ExpiresAt:   version * 1000,
+		meta:        bitTxn,
+		partitionId: partitionId,
+		version:     version,
+	}
+}
+
+func TestHeader_Encode(t *testing.T) {
+	headers := []header{
+		{},
+		{meta: bitDelete, userMeta: 7, partitionId: 3, keyLength: 10, valueLength: 100, expiresAt: 12345},
+		{
+			meta:        math.MaxUint8,
+			userMeta:    math.MaxUint8,
+			partitionId: math.MaxUint32,
+			keyLength:   math.MaxUint32,
+			valueLength: math.MaxUint32,
+			expiresAt:   math.MaxUint64,
+		},
+	}
+
+	for _, h := range headers {
+		buf := make([]byte, maxHeaderSize)
+		n := h.Encode(buf)
+
+		var decoded header
+		read, err := decoded.Decode(buf[:n])
+		require.NoError(t, err)
+		require.Equal(t, n, read)
+		require.Equal(t, h, decoded)
+
+		decoded = header{}
+		read, err = decoded.DecodeFrom(newHashReader(bytes.NewReader(buf[:n])))
+		require.NoError(t, err)
+		require.Equal(t, n, read)
+		require.Equal(t, h, decoded)
+
+		// A header that is missing its last byte cannot be decoded.
+		_, err = decoded.Decode(buf[:n-1])
+		require.Error(t, err)
+	}
+}
+
+func TestIterateEntries(t *testing.T) {
+	entries := []*Entry{
+		newTestEntry(0, "a", 1, "a1"),
+		newTestEntry(1, "b", 2, ""),
+		newTestEntry(2, "c", 3, "c3"),
+	}
+	data := encodeTestEntries(t, entries...)
+
+	t.Run("valid", func(t *testing.T) {
+		var read []string
+		var offset uint32
+		end, err := iterateEntries(bytes.NewReader(data), 5, 0, func(e *Entry, pointer valuePointer) error {
+			require.Equal(t, uint32(5), pointer.Fid)
+			require.Equal(t, offset, pointer.Offset)
+			offset += pointer.Len
+
+			read = append(read, fmt.Sprintf("%d/%s@%d=%s meta:%d user:%d expires:%d",
+				e.partitionId, z.ParseKey(e.Key), z.ParseTs(e.Key), e.Value, e.meta, e.UserMeta, e.ExpiresAt))
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint32(len(data)), end)
+		require.Equal(t, []string{
+			fmt.Sprintf("0/a@1=a1 meta:%d user:1 expires:1000", bitTxn),
+			fmt.Sprintf("1/b@2= meta:%d user:2 expires:2000", bitTxn),
+			fmt.Sprintf("2/c@3=c3 meta:%d user:3 expires:3000", bitTxn),
+		}, read)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		first := len(encodeTestEntries(t, entries[0]))
+		last := len(data) - len(encodeTestEntries(t, entries[2]))
+
+		// Cutting the last entry short at any point should stop at the end of the entry before it.
+		for size := last + 1; size < len(data); size++ {
+			var count int
+			end, err := iterateEntries(bytes.NewReader(data[:size]), 0, 0, func(*Entry, valuePointer) error {
+				count++
+				return nil
+			})
+			require.Equal(t, errTruncate, err, "size %d", size)
+			require.Equal(t, uint32(last), end)
+			require.Equal(t, 2, count)
+		}
+
+		// Reading can also start in the middle of a file.
+		end, err := iterateEntries(bytes.NewReader(data[first:last]), 0, uint32(first), func(
+			e *Entry, pointer valuePointer,
+		) error {
+			require.Equal(t, uint32(first), pointer.Offset)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint32(last), end)
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		first := len(encodeTestEntries(t, entries[0]))
+
+		// Flip the last byte of the second entry before its checksum.
+		corrupt := append([]byte{}, data...)
+		corrupt[first+len(encodeTestEntries(t, entries[1]))-crc32Size-1] ^= 0xff
+
+		var count int
+		end, err := iterateEntries(bytes.NewReader(corrupt), 0, 0, func(*Entry, valuePointer) error {
+			count++
+			return nil
+		})
+		require.Equal(t, errChecksumMismatch, err)
+		require.Equal(t, uint32(first), end)
+		require.Equal(t, 1, count)
+	})
+}
+
+func TestValueLog_Directories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// The value directories are not inside of the primary directory, like they would be if they were on other disks.
+	valueDirectory, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(valueDirectory)
+
+	valueDirectories := []string{filepath.Join(valueDirectory, "disk0"), filepath.Join(valueDirectory, "disk1")}
+	db, err := Open(getTestOptions(dir).WithValueDirectories(valueDirectories...))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// Every value directory is created and locked.
+	require.Len(t, db.valueDirectoryLockGuards, 2)
+	for _, directory := range valueDirectories {
+		_, err := acquireDirectoryLock(directory, lockFileName, false)
+		require.Error(t, err)
+	}
+
+	// Consecutive files alternate between the directories and can be read back from where they were written.
+	var expectedSize int64
+	for fid := uint32(0); fid < 4; fid++ {
+		path := db.valueLog.filePath(fid)
+		require.Equal(t, valueDirectories[fid%2], filepath.Dir(path))
+
+		data := encodeTestEntries(t, newTestEntry(1, fmt.Sprintf("key%d", fid), 1, fmt.Sprintf("value%d", fid)))
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+		expectedSize += int64(len(data))
+	}
+
+	for fid := uint32(0); fid < 4; fid++ {
+		file, err := os.Open(db.valueLog.filePath(fid))
+		require.NoError(t, err)
+
+		var values []string
+		_, err = iterateEntries(file, fid, 0, func(e *Entry, pointer valuePointer) error {
+			values = append(values, string(e.Value))
+			return nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		require.Equal(t, []string{fmt.Sprintf("value%d", fid)}, values)
+	}
+
+	// The size of the value log includes the files in every directory.
+	db.calculateSize()
+	require.Equal(t, expectedSize, db.Metrics().ValueLogSize)
+}
+
+func TestValueLog_DirectoriesChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	valueDirectories := []string{filepath.Join(dir, "disk0"), filepath.Join(dir, "disk1")}
+	db, err := Open(getTestOptions(dir).WithValueDirectories(valueDirectories...).WithValueLogMaxEntries(10))
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(0, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		}))
+	}
+	require.NoError(t, db.Close())
+
+	// The order of the value directories changed, so the existing files are no longer where a new file with the same Id
+	// would be written.
+	swapped := []string{valueDirectories[1], valueDirectories[0]}
+	db, err = Open(getTestOptions(dir).WithValueDirectories(swapped...).WithValueLogMaxEntries(10))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	fileIds, err := db.valueLog.fileIds()
+	require.NoError(t, err)
+	require.NotEmpty(t, fileIds)
+	for _, fid := range fileIds {
+		path := db.valueLog.filePath(fid)
+		require.Equal(t, valueDirectories[fid%2], filepath.Dir(path))
+		_, err := os.Stat(path)
+		require.NoError(t, err)
+	}
+
+	// New files are still assigned to the directories round-robin.
+	fid := fileIds[len(fileIds)-1] + 1
+	require.Equal(t, swapped[fid%2], filepath.Dir(db.valueLog.filePath(fid)))
+
+	for i := 50; i < 100; i++ {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(0, []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		}))
+	}
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		for i := 0; i < 100; i++ {
+			item, err := txn.Get(0, []byte(fmt.Sprintf("key%d", i)))
+			if err != nil {
+				return err
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			require.Equal(t, fmt.Sprintf("value%d", i), string(value))
+		}
+		return nil
+	}))
+}
+
+func TestValueLog_Truncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// The latest file ends with an entry that was only partially written.
+	valid := encodeTestEntries(t, newTestEntry(1, "a", 1, "a1"), newTestEntry(1, "b", 2, "b2"))
+	partial := encodeTestEntries(t, newTestEntry(1, "c", 3, "c3"))
+	require.NoError(t, ioutil.WriteFile(valueLogFilePath(dir, 0), valid, 0600))
+	require.NoError(t, ioutil.WriteFile(valueLogFilePath(dir, 1), append(valid, partial[:len(partial)-2]...), 0600))
+
+	opts := getTestOptions(dir)
+	_, err = Open(opts)
+	require.Equal(t, ErrTruncateNeeded, err)
+
+	db, err := Open(opts.WithTruncate(true))
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), db.valueLog.maxFileId)
+	require.Equal(t, uint32(len(valid)), db.valueLog.writableLogOffset)
+	require.NoError(t, db.Close())
+
+	// Only the partial entry should have been removed.
+	info, err := os.Stat(valueLogFilePath(dir, 1))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(valid)), info.Size())
+
+	// Now that the tail is gone the database can be opened without truncating.
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestIterateValueLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	entries := []*Entry{
+		newTestEntry(0, "a", 1, "a1"),
+		newTestEntry(1, "b", 2, "b2"),
+		newTestEntry(2, "c", 3, "c3"),
+	}
+	data := encodeTestEntries(t, entries...)
+	first := len(encodeTestEntries(t, entries[0]))
+	last := len(data) - len(encodeTestEntries(t, entries[2]))
+
+	// The last entry was only partially written.
+	path := valueLogFilePath(dir, 1)
+	require.NoError(t, ioutil.WriteFile(path, data[:len(data)-3], 0600))
+
+	var read []string
+	end, err := IterateValueLogFile(path, func(e *Entry, offset uint32) error {
+		read = append(read, fmt.Sprintf("%d/%s@%d=%s offset:%d", e.PartitionId(), e.Key, e.Version(), e.Value, offset))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(last), end)
+	require.Equal(t, []string{"0/a@1=a1 offset:0", fmt.Sprintf("1/b@2=b2 offset:%d", first)}, read)
+
+	// Iteration can also start at the offset of any entry in the file.
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var vlog valueLog
+	var pointers []valuePointer
+	end, err = vlog.iterate(&logFile{file: file, fileId: 1}, uint32(first), func(e *Entry, pointer valuePointer) error {
+		pointers = append(pointers, pointer)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(last), end)
+	require.Equal(t, []valuePointer{{Fid: 1, Len: uint32(last - first), Offset: uint32(first)}}, pointers)
+
+	_, err = IterateValueLogFile(valueLogFilePath(dir, 2), func(*Entry, uint32) error {
+		return nil
+	})
+	require.True(t, os.IsNotExist(errors.Cause(err)))
+}
+
+func TestValueLog_RemoveObsoleteFiles(t *testing.T) {
+	// write commits each key in its own transaction, every transaction is two entries with its marker, so the value
+	// log moves on to a new file every few transactions.
+	write := func(t *testing.T, db *DB, from, to int) {
+		for i := from; i < to; i++ {
+			require.NoError(t, db.Update(func(txn *Transaction) error {
+				return txn.Set(1, []byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%04d", i)))
+			}))
+		}
+	}
+
+	check := func(t *testing.T, db *DB, n int) {
+		for i := 0; i < n; i++ {
+			value, err := db.Get(1, []byte(fmt.Sprintf("key%04d", i)), ReadOptions{})
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("value%04d", i), string(value))
+		}
+	}
+
+	fileIds := func(t *testing.T, db *DB) []uint32 {
+		fileIds, err := db.valueLog.fileIds()
+		require.NoError(t, err)
+		return fileIds
+	}
+
+	t.Run("flush", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+
+		opts := getTestOptions(dir).
+			WithKeepL0InMemory(false).
+			WithValueLogMaxEntries(10)
+		db, err := Open(opts)
+		require.NoError(t, err)
+
+		write(t, db, 0, 100)
+		require.NoError(t, db.Flush(1))
+		require.Len(t, fileIds(t, db), 20)
+
+		// The files with the entries that were flushed first are only removed once the replay start stored by a later
+		// flush is past them.
+		write(t, db, 100, 110)
+		require.NoError(t, db.Flush(1))
+		require.Equal(t, []uint32{20, 21}, fileIds(t, db))
+		require.NoError(t, db.Close())
+
+		db, err = Open(opts)
+		require.NoError(t, err)
+		check(t, db, 110)
+		require.NoError(t, db.Close())
+	})
+
+	t.Run("close", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+
+		// Level 0 tables are kept in memory, so nothing is removed until they are written to disk when the database
+		// is closed.
+		opts := getTestOptions(dir).WithValueLogMaxEntries(10)
+		db, err := Open(opts)
+		require.NoError(t, err)
+
+		write(t, db, 0, 100)
+		require.NoError(t, db.Flush(1))
+		require.Len(t, fileIds(t, db), 20)
+		require.NoError(t, db.Close())
+
+		db, err = Open(opts)
+		require.NoError(t, err)
+		require.Equal(t, []uint32{19}, fileIds(t, db))
+		check(t, db, 100)
+
+		// New files continue after the file that was kept.
+		write(t, db, 100, 110)
+		require.Equal(t, []uint32{19, 20}, fileIds(t, db))
+		require.NoError(t, db.Close())
+
+		db, err = Open(opts)
+		require.NoError(t, err)
+		check(t, db, 110)
+		require.NoError(t, db.Close())
+	})
+}
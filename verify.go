@@ -0,0 +1,180 @@
+package notbadger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/elliotcourant/notbadger/options"
+	"github.com/elliotcourant/notbadger/table"
+	"github.com/elliotcourant/notbadger/z"
+)
+
+type (
+	// VerifyError is returned by DB.VerifyChecksum when the database has any problems. Every problem that was found is
+	// included, not just the first one.
+	VerifyError struct {
+		Problems []error
+	}
+
+	// TableRef identifies a single table file of a partition.
+	TableRef struct {
+		PartitionId PartitionId
+		FileId      uint64
+	}
+)
+
+// Error lists every problem that was found, one per line.
+func (e *VerifyError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		messages[i] = problem.Error()
+	}
+
+	return fmt.Sprintf("found %d problems:\n%s", len(e.Problems), strings.Join(messages, "\n"))
+}
+
+// VerifyChecksum checks the integrity of the tables of every partition without changing anything. Every table in the
+// manifest must have a file, every block of those files must match its checksum, the bloom filter of every table must
+// have all of its keys, and the tables in each level above level 0 must not overlap. If any problems are found then a *VerifyError is returned.
+func (db *DB) VerifyChecksum() error {
+	var problems []error
+	if !db.options.InMemory {
+		db.manifest.appendLock.Lock()
+		manifest := db.manifest.manifest.clone()
+		db.manifest.appendLock.Unlock()
+
+		idMap := getFileIdMap(db.options.FileSystem, db.options.Directory)
+		problems = append(problems, checkManifestFiles(&manifest, idMap)...)
+
+		for partitionId, partition := range manifest.Partitions {
+			for fileId, tableManifest := range partition.Tables {
+				// Missing files have already been reported.
+				if _, ok := idMap[partitionId][fileId]; !ok {
+					continue
+				}
+
+				if err := db.verifyTableFile(partitionId, fileId, tableManifest); err != nil {
+					problems = append(problems, err)
+				}
+			}
+		}
+	}
+
+	db.levelsController.partitionsLock.RLock()
+	for partitionId, partition := range db.levelsController.partitions {
+		for _, handler := range partition.levels {
+			if err := handler.validate(); err != nil {
+				problems = append(problems, z.Wrapf(err, "partition %d level %d is invalid", partitionId, handler.level))
+			}
+		}
+	}
+	db.levelsController.partitionsLock.RUnlock()
+
+	if len(problems) > 0 {
+		return &VerifyError{Problems: problems}
+	}
+
+	return nil
+}
+
+// verifyTableFile opens a separate copy of the table file and verifies the checksum of the table and of every block,
+// and the bloom filter of the table.
+// The table that is in use by the database is not touched, and the blocks are read from disk rather than the cache.
+func (db *DB) verifyTableFile(partitionId PartitionId, fileId uint64, tableManifest TableManifest) error {
+	fileName := table.NewFilename(uint32(partitionId), fileId, db.options.Directory)
+	file, err := z.OpenExistingFile(db.options.FileSystem, fileName, z.ReadOnly)
+	if err != nil {
+		return z.Wrapf(err, "failed to open table file: %q", fileName)
+	}
+
+	dataKey, err := db.registry.dataKey(partitionId, tableManifest.KeyID)
+	if err != nil {
+		_ = file.Close()
+		return z.Wrapf(err, "failed to read data key for table file: %q", fileName)
+	}
+
+	tableOptions := buildTableOptions(db.options)
+	tableOptions.LoadingMode = options.FileIO
+	tableOptions.ChkMode = options.OnTableAndBlockRead
+	tableOptions.Compression = tableManifest.Compression
+	tableOptions.DataKey = dataKey
+	t, err := table.OpenTable(file, tableOptions)
+	if err != nil {
+		return z.Wrapf(err, "table file %q is corrupt", fileName)
+	}
+
+	// A key that the bloom filter does not have would never be found by a read.
+	err = t.VerifyBloom()
+
+	// Close rather than release the table, releasing the last reference would delete the file.
+	if closeErr := t.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// VerifyManifest compares the manifest in the directory with the table files in the directory without changing or
+// opening any of them, so it can be used to check a directory before the database is opened. Missing are the tables in
+// the manifest that do not have a file, and orphans are the table files that are not in the manifest. Opening the
+// database fails if any tables are missing, and removes the orphans of partitions that are not in the manifest. A
+// directory without a manifest is treated as an empty manifest. Both lists are sorted by partition and then file Id.
+func VerifyManifest(dir string) (missing []TableRef, orphans []TableRef, err error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, nil, z.Wrapf(err, "failed to read directory %q", dir)
+	}
+
+	manifest := createManifest()
+	file, err := os.Open(filepath.Join(dir, ManifestFilename))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, nil, z.Wrapf(err, "failed to open manifest")
+	default:
+		manifest, _, err = ReplayManifestFile(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, nil, z.Wrapf(err, "failed to replay manifest")
+		}
+	}
+
+	idMap := getFileIdMap(z.OSFileSystem, dir)
+	for partitionId, partition := range manifest.Partitions {
+		for fileId := range partition.Tables {
+			if _, ok := idMap[partitionId][fileId]; !ok {
+				missing = append(missing, TableRef{PartitionId: partitionId, FileId: fileId})
+			}
+		}
+	}
+
+	for partitionId, files := range idMap {
+		for fileId := range files {
+			if partition, ok := manifest.Partitions[partitionId]; ok {
+				if _, ok := partition.Tables[fileId]; ok {
+					continue
+				}
+			}
+			orphans = append(orphans, TableRef{PartitionId: partitionId, FileId: fileId})
+		}
+	}
+
+	sortTableRefs(missing)
+	sortTableRefs(orphans)
+
+	return missing, orphans, nil
+}
+
+// sortTableRefs sorts the table references by partition and then by file Id.
+func sortTableRefs(refs []TableRef) {
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].PartitionId != refs[j].PartitionId {
+			return refs[i].PartitionId < refs[j].PartitionId
+		}
+		return refs[i].FileId < refs[j].FileId
+	})
+}
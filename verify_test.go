@@ -0,0 +1,114 @@
+package notbadger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/elliotcourant/notbadger/table"
+	"github.com/elliotcourant/notbadger/z"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_VerifyChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir).WithKeepL0InMemory(false).WithCompactL0OnClose(false)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	for _, partitionId := range []PartitionId{1, 2} {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			for i := 0; i < 40; i++ {
+				if err := txn.Set(partitionId, []byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		require.NoError(t, db.Flush(partitionId))
+	}
+	require.NoError(t, db.VerifyChecksum())
+
+	fileName := func(partitionId PartitionId) string {
+		for _, level := range db.Tables() {
+			if level.PartitionId == partitionId && len(level.Tables) > 0 {
+				return table.NewFilename(uint32(partitionId), level.Tables[0].FileId, dir)
+			}
+		}
+		require.FailNow(t, "partition does not have a table", "partition %d", partitionId)
+		return ""
+	}
+
+	// Corrupt the first block of the table in partition 1 and remove the table in partition 2.
+	corrupted, removed := fileName(1), fileName(2)
+	file, err := os.OpenFile(corrupted, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte("corrupt"), 10)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.NoError(t, os.Remove(removed))
+
+	err = db.VerifyChecksum()
+	require.IsType(t, &VerifyError{}, err)
+	problems := err.(*VerifyError).Problems
+	require.Len(t, problems, 2)
+	require.Contains(t, err.Error(), "found 2 problems")
+	require.Contains(t, err.Error(), fmt.Sprintf("table file %q is corrupt", corrupted))
+	require.Contains(t, err.Error(), "checksum")
+	require.Contains(t, err.Error(), "in partition 2")
+}
+
+func TestVerifyManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// A directory without a manifest has nothing to report.
+	missing, orphans, err := VerifyManifest(dir)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+	require.Empty(t, orphans)
+
+	opts := getTestOptions(dir).WithKeepL0InMemory(false).WithCompactL0OnClose(false)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for partitionId := PartitionId(0); partitionId < 2; partitionId++ {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(partitionId, []byte("key"), []byte("value"))
+		}))
+		require.NoError(t, db.Flush(partitionId))
+	}
+	require.NoError(t, db.Close())
+
+	missing, orphans, err = VerifyManifest(dir)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+	require.Empty(t, orphans)
+
+	var fileId uint64
+	for fileId = range getFileIdMap(z.OSFileSystem, dir)[1] {
+		break
+	}
+	require.NoError(t, os.Remove(table.NewFilename(1, fileId, dir)))
+	orphan := table.NewFilename(2, 5, dir)
+	require.NoError(t, ioutil.WriteFile(orphan, []byte("orphan"), 0600))
+
+	missing, orphans, err = VerifyManifest(dir)
+	require.NoError(t, err)
+	require.Equal(t, []TableRef{{PartitionId: 1, FileId: fileId}}, missing)
+	require.Equal(t, []TableRef{{PartitionId: 2, FileId: 5}}, orphans)
+
+	// Nothing is removed.
+	_, err = os.Stat(orphan)
+	require.NoError(t, err)
+
+	_, _, err = VerifyManifest(table.NewFilename(3, 1, dir))
+	require.Error(t, err)
+}
@@ -0,0 +1,324 @@
+package notbadger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elliotcourant/notbadger/z"
+)
+
+const (
+	// walFileExtension is the extension of the files of the write-ahead log.
+	walFileExtension = ".wal"
+
+	// walRecordHeaderSize is the size of the header of every record in the write-ahead log, the length of the record
+	// followed by a CRC32 checksum of it.
+	walRecordHeaderSize = 8
+)
+
+type (
+	// writeAheadLog is the log that the writes to the memory tables are appended to when Options.UseWAL is set, instead
+	// of the value log. Every request is appended as a single record with a checksum, so a request that was cut short
+	// by a crash is never replayed in part. The log is split into files, and a file is removed once every memory table
+	// that has entries from it has been flushed to a level 0 table on disk. The files that are left when the database
+	// is opened are replayed into fresh memory tables.
+	writeAheadLog struct {
+		db *DB
+
+		// lock guards the fields below. Only the goroutine that writes requests writes to the log, but files are
+		// removed after flushes.
+		lock sync.Mutex
+
+		// fileIds has the Ids of the files of the log that have not been removed, in ascending order. The file with the
+		// largest Id is the one being written to, if file is not nil.
+		fileIds []uint32
+		file    *os.File
+		size    int64
+
+		// pendingFileId is the file of the first request of the batch that is being written to the memory tables, or
+		// zero. The memory tables don't know about that file yet, so it must not be removed.
+		pendingFileId uint32
+	}
+)
+
+// open finds the files of the write-ahead log in the directory. Nothing is written to the files that are found, the
+// next write starts a new file.
+func (wal *writeAheadLog) open(db *DB) error {
+	wal.db = db
+
+	files, err := z.ReadDir(db.options.FileSystem, db.options.Directory)
+	if err != nil {
+		return z.Wrapf(err, "failed to read directory: %q", db.options.Directory)
+	}
+
+	wal.fileIds = wal.fileIds[:0]
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), walFileExtension) {
+			continue
+		}
+
+		fileId, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), walFileExtension), 10, 32)
+		if err != nil {
+			return z.Wrapf(err, "failed to parse write-ahead log file Id: %q", file.Name())
+		}
+		wal.fileIds = append(wal.fileIds, uint32(fileId))
+	}
+
+	sort.Slice(wal.fileIds, func(i, j int) bool {
+		return wal.fileIds[i] < wal.fileIds[j]
+	})
+
+	return nil
+}
+
+// filePath returns the path of the write-ahead log file with the provided Id.
+func (wal *writeAheadLog) filePath(fileId uint32) string {
+	return filepath.Join(wal.db.options.Directory, fmt.Sprintf("%06d%s", fileId, walFileExtension))
+}
+
+// replay reads every complete record of every file of the log in the order they were written, and calls fn with the
+// request that was written and the Id of the file it was read from. Reading a file stops at the first incomplete or
+// corrupt record, which is what a crash in the middle of a write leaves behind.
+func (wal *writeAheadLog) replay(fn func(req *request, fileId uint32) error) error {
+	for _, fileId := range wal.fileIds {
+		path := wal.filePath(fileId)
+		file, err := wal.db.options.FileSystem.Open(path)
+		if err != nil {
+			return z.Wrapf(err, "failed to open write-ahead log file: %q", path)
+		}
+
+		err = replayWriteAheadLogFile(file, func(req *request) error {
+			return fn(req, fileId)
+		})
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return z.Wrapf(err, "failed to replay write-ahead log file: %q", path)
+		}
+	}
+
+	return nil
+}
+
+// replayWriteAheadLogFile reads every complete record from the reader and calls fn with the request in it.
+func replayWriteAheadLogFile(reader io.Reader, fn func(req *request) error) error {
+	bufferedReader := bufio.NewReader(reader)
+	var recordHeader [walRecordHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(bufferedReader, recordHeader[:]); err != nil {
+			// Nothing, or only part of a header, is left at the end of the file.
+			return nil
+		}
+
+		record := make([]byte, binary.BigEndian.Uint32(recordHeader[:4]))
+		if _, err := io.ReadFull(bufferedReader, record); err != nil {
+			return nil
+		}
+
+		if crc32.Checksum(record, z.CastagnoliCrcTable) != binary.BigEndian.Uint32(recordHeader[4:]) {
+			return nil
+		}
+
+		req := &request{}
+		_, err := iterateEntries(bytes.NewReader(record), 0, 0, func(e *Entry, _ valuePointer) error {
+			req.Entries = append(req.Entries, copyEntry(e))
+			return nil
+		})
+		if err != nil {
+			// The checksum of the record matched, so the entries in it can only be invalid if they were written that
+			// way.
+			return z.Wrapf(err, "invalid entries in write-ahead log record")
+		}
+
+		if err := fn(req); err != nil {
+			return err
+		}
+	}
+}
+
+// write appends every request to the log as a single record, and records the file that each request was written to.
+// The log moves on to a new file once the current file has grown past MaxTableSize, the records are never split
+// between files. write is only called by the goroutine that writes requests, and the requests must be added to the
+// memory tables before written is called.
+func (wal *writeAheadLog) write(requests []*request) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	var buf bytes.Buffer
+	for _, req := range requests {
+		if len(req.Entries) == 0 {
+			continue
+		}
+
+		buf.Reset()
+		buf.Write(make([]byte, walRecordHeaderSize))
+		for _, e := range req.Entries {
+			if _, err := e.Encode(&buf); err != nil {
+				return z.Wrapf(err, "failed to encode entry for write-ahead log")
+			}
+		}
+
+		record := buf.Bytes()
+		binary.BigEndian.PutUint32(record[:4], uint32(len(record)-walRecordHeaderSize))
+		binary.BigEndian.PutUint32(record[4:walRecordHeaderSize],
+			crc32.Checksum(record[walRecordHeaderSize:], z.CastagnoliCrcTable))
+
+		if wal.file == nil || (wal.size > 0 && wal.size+int64(len(record)) > wal.db.options.MaxTableSize) {
+			if err := wal.rotate(); err != nil {
+				return err
+			}
+		}
+
+		if _, err := wal.file.Write(record); err != nil {
+			return z.Wrapf(err, "failed to write to write-ahead log file: %q", wal.file.Name())
+		}
+		wal.size += int64(len(record))
+
+		req.logFileId = wal.fileIds[len(wal.fileIds)-1]
+		if wal.pendingFileId == 0 {
+			wal.pendingFileId = req.logFileId
+		}
+	}
+
+	return nil
+}
+
+// written is called once the requests that were last passed to write have been added to the memory tables.
+func (wal *writeAheadLog) written() {
+	wal.lock.Lock()
+	wal.pendingFileId = 0
+	wal.lock.Unlock()
+}
+
+// rotate syncs and closes the file that is being written to and creates the next file. The lock must be held.
+func (wal *writeAheadLog) rotate() error {
+	if wal.file != nil {
+		if err := wal.closeFile(); err != nil {
+			return err
+		}
+	}
+
+	var fileId uint32 = 1
+	if len(wal.fileIds) > 0 {
+		fileId = wal.fileIds[len(wal.fileIds)-1] + 1
+	}
+
+	path := wal.filePath(fileId)
+	file, err := z.CreateSyncedFile(wal.db.options.FileSystem, path, false)
+	if err != nil {
+		return z.Wrapf(err, "failed to create write-ahead log file: %q", path)
+	}
+
+	// Do dir sync as best effort. The file is synced before a write to it is acknowledged.
+	if err := syncDir(wal.db.options.Directory); err != nil {
+		wal.db.eventLog.Errorf("failed to sync directory for %q: %v", path, err)
+	}
+
+	wal.fileIds = append(wal.fileIds, fileId)
+	wal.file, wal.size = file, 0
+
+	return nil
+}
+
+// sync fsyncs the file that is being written to. The files before it were synced when the log moved on from them.
+func (wal *writeAheadLog) sync() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.file == nil {
+		return nil
+	}
+
+	return z.FileSync(wal.file)
+}
+
+// removeBefore removes the files of the log with an Id below the provided Id. The file that is being written to, and
+// the files of requests that are still being added to the memory tables, are never removed.
+func (wal *writeAheadLog) removeBefore(fileId uint32) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.pendingFileId != 0 && wal.pendingFileId < fileId {
+		fileId = wal.pendingFileId
+	}
+
+	if wal.file != nil && wal.fileIds[len(wal.fileIds)-1] < fileId {
+		fileId = wal.fileIds[len(wal.fileIds)-1]
+	}
+
+	for len(wal.fileIds) > 0 && wal.fileIds[0] < fileId {
+		path := wal.filePath(wal.fileIds[0])
+		if err := wal.db.options.FileSystem.Remove(path); err != nil && !os.IsNotExist(err) {
+			return z.Wrapf(err, "failed to remove write-ahead log file: %q", path)
+		}
+		wal.fileIds = wal.fileIds[1:]
+	}
+
+	return nil
+}
+
+// nextFileId returns the Id of the file that is being written to, or of the file that will be written to next if
+// there isn't one. Every entry in the memory tables from an older file has been read from that file.
+func (wal *writeAheadLog) nextFileId() uint32 {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	switch {
+	case wal.file != nil:
+		return wal.fileIds[len(wal.fileIds)-1]
+	case len(wal.fileIds) > 0:
+		return wal.fileIds[len(wal.fileIds)-1] + 1
+	default:
+		return 1
+	}
+}
+
+// closeFile syncs and closes the file that is being written to. The lock must be held.
+func (wal *writeAheadLog) closeFile() error {
+	file := wal.file
+	wal.file = nil
+	if err := z.FileSync(file); err != nil {
+		_ = file.Close()
+		return z.Wrapf(err, "failed to sync write-ahead log file: %q", file.Name())
+	}
+
+	return file.Close()
+}
+
+// close syncs and closes the file that is being written to. If remove is true then every file of the log is removed,
+// which is only safe once everything in the memory tables has been written to tables on disk.
+func (wal *writeAheadLog) close(remove bool) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.file != nil {
+		if err := wal.closeFile(); err != nil {
+			return err
+		}
+	}
+
+	if !remove {
+		return nil
+	}
+
+	for len(wal.fileIds) > 0 {
+		path := wal.filePath(wal.fileIds[0])
+		if err := wal.db.options.FileSystem.Remove(path); err != nil && !os.IsNotExist(err) {
+			return z.Wrapf(err, "failed to remove write-ahead log file: %q", path)
+		}
+		wal.fileIds = wal.fileIds[1:]
+	}
+
+	return nil
+}
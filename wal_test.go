@@ -0,0 +1,116 @@
+package notbadger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAheadLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	crashDir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(crashDir)
+
+	walFiles := func(dir string) []string {
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), walFileExtension) {
+				names = append(names, file.Name())
+			}
+		}
+		return names
+	}
+
+	// Flushed level 0 tables are only durable when they are not kept in memory.
+	opts := getTestOptions(dir).WithUseWAL(true).WithKeepL0InMemory(false).WithCompactL0OnClose(false)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	set := func(partitionId PartitionId, key string) {
+		require.NoError(t, db.Update(func(txn *Transaction) error {
+			return txn.Set(partitionId, []byte(key), []byte("value-"+key))
+		}))
+	}
+
+	// Partition 3 is never flushed so the log file is kept. Partition 2 is flushed after it is dropped, so the drop and
+	// the key before it must not be replayed.
+	set(3, "x")
+	set(2, "old")
+	require.NoError(t, db.DropPartitions(2))
+	set(2, "new")
+	require.NoError(t, db.Flush(2))
+	set(1, "a")
+	require.NoError(t, db.Flush(1))
+	set(1, "b")
+	require.NoError(t, db.Sync())
+
+	// Nothing is written to the value log.
+	for _, partitionId := range db.Partitions() {
+		partition := db.getPartition(partitionId)
+		partition.Lock()
+		require.True(t, partition.activeHead.IsZero())
+		partition.Unlock()
+	}
+
+	logFiles := walFiles(dir)
+	require.NotEmpty(t, logFiles)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(crashDir, file.Name()), data, file.Mode()))
+	}
+	require.NoError(t, db.Close())
+	require.Empty(t, walFiles(dir))
+
+	// A record that was cut short by the crash is ignored.
+	file, err := os.OpenFile(filepath.Join(crashDir, logFiles[len(logFiles)-1]), os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	db, err = Open(getTestOptions(crashDir).WithUseWAL(true).WithKeepL0InMemory(false).WithCompactL0OnClose(false))
+	require.NoError(t, err)
+
+	require.NoError(t, db.View(func(txn *Transaction) error {
+		for _, write := range []struct {
+			partitionId PartitionId
+			key         string
+			found       bool
+		}{
+			{3, "x", true},
+			{2, "old", false},
+			{2, "new", true},
+			{1, "a", true},
+			{1, "b", true},
+		} {
+			item, err := txn.Get(write.partitionId, []byte(write.key))
+			if !write.found {
+				require.Equal(t, ErrKeyNotFound, err, "key %s in partition %d", write.key, write.partitionId)
+				continue
+			}
+			require.NoError(t, err, "key %s in partition %d", write.key, write.partitionId)
+			value, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, "value-"+write.key, string(value))
+		}
+		return nil
+	}))
+
+	// The log is removed once everything in it has been written to tables.
+	require.NoError(t, db.Close())
+	require.Empty(t, walFiles(crashDir))
+}
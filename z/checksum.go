@@ -0,0 +1,26 @@
+package z
+
+import (
+	"hash/crc32"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/elliotcourant/notbadger/options"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrUnknownChecksumType is returned when data was checksummed with an algorithm that is not known.
+	ErrUnknownChecksumType = errors.New("unknown checksum type")
+)
+
+// Checksum32 returns the 32 bit checksum of the data using the provided checksum algorithm.
+func Checksum32(data []byte, checksumType options.ChecksumType) (uint32, error) {
+	switch checksumType {
+	case options.XXHash:
+		return xxhash.Checksum32(data), nil
+	case options.CRC32Castagnoli:
+		return crc32.Checksum(data, CastagnoliCrcTable), nil
+	default:
+		return 0, errors.Wrapf(ErrUnknownChecksumType, "checksum type %d", checksumType)
+	}
+}
@@ -0,0 +1,31 @@
+package z
+
+import (
+	"time"
+)
+
+type (
+	// Clock is a source of the current time. It can be replaced in tests to control when entries expire.
+	Clock interface {
+		// Now returns the current time.
+		Now() time.Time
+	}
+
+	// monotonicClock starts at the wall clock time when it was created and advances with the monotonic clock from
+	// then on, so the time it returns never moves backwards when the wall clock is changed.
+	monotonicClock struct {
+		start time.Time
+	}
+)
+
+// NewMonotonicClock returns a clock that starts at the current wall clock time and advances with the monotonic clock.
+func NewMonotonicClock() Clock {
+	return &monotonicClock{
+		start: time.Now(),
+	}
+}
+
+// Now returns the time the clock was created at plus the monotonic time that has passed since then.
+func (c *monotonicClock) Now() time.Time {
+	return c.start.Add(time.Since(c.start))
+}
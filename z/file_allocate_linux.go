@@ -0,0 +1,21 @@
+// +build linux
+
+package z
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Preallocate reserves size bytes of disk space for the file before it is written, so the filesystem can place the
+// file in as few extents as possible. The file will be at least size bytes long afterwards. Filesystems that do not
+// support fallocate fall back to extending the file with Truncate.
+func Preallocate(file *os.File, size int64) error {
+	err := unix.Fallocate(int(file.Fd()), 0, 0, size)
+	if err == unix.EOPNOTSUPP {
+		return file.Truncate(size)
+	}
+
+	return err
+}
@@ -0,0 +1,22 @@
+// +build !linux
+
+package z
+
+import (
+	"os"
+)
+
+// Preallocate extends the file to size bytes before it is written. Unlike Linux there is no portable way to reserve
+// the disk space, so this only helps on filesystems that allocate space when the file is extended.
+func Preallocate(file *os.File, size int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() >= size {
+		return nil
+	}
+
+	return file.Truncate(size)
+}
@@ -0,0 +1,84 @@
+package z
+
+import (
+	"os"
+)
+
+var (
+	// OSFileSystem is the FileSystem that calls the os package directly, it is used by default.
+	OSFileSystem FileSystem = osFileSystem{}
+)
+
+type (
+	// FileSystem is the set of file operations that the database uses to create, open, rename and remove its files.
+	// It can be replaced to inject faults in tests or to change where the files are stored. The files are returned as
+	// real files because tables and value log files are memory mapped, an implementation is expected to wrap the os
+	// package rather than replace it entirely. Locking the directory and syncing it are always done through the os
+	// package.
+	FileSystem interface {
+		// Open opens the named file or directory for reading.
+		Open(name string) (*os.File, error)
+
+		// OpenFile opens the named file with the provided flags and permissions, like os.OpenFile.
+		OpenFile(name string, flag int, perm os.FileMode) (*os.File, error)
+
+		// Rename moves the old path to the new path, replacing the new path if it already exists.
+		Rename(oldPath, newPath string) error
+
+		// Remove removes the named file or empty directory.
+		Remove(name string) error
+
+		// Mkdir creates the named directory with the provided permissions.
+		Mkdir(name string, perm os.FileMode) error
+
+		// Stat returns the file info of the named file.
+		Stat(name string) (os.FileInfo, error)
+	}
+
+	osFileSystem struct{}
+)
+
+// Open opens the named file or directory for reading with os.Open.
+func (osFileSystem) Open(name string) (*os.File, error) {
+	return os.Open(name)
+}
+
+// OpenFile opens the named file with os.OpenFile.
+func (osFileSystem) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+// Rename moves the old path to the new path with os.Rename.
+func (osFileSystem) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+// Remove removes the named file or empty directory with os.Remove.
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Mkdir creates the named directory with os.Mkdir.
+func (osFileSystem) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+// Stat returns the file info of the named file with os.Stat.
+func (osFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// ReadDir returns the file info of every entry in the named directory, read through the file system.
+func ReadDir(fs FileSystem, name string) ([]os.FileInfo, error) {
+	dir, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := dir.Readdir(-1)
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+
+	return list, err
+}
@@ -1,6 +1,17 @@
 package z
 
-import "encoding/binary"
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ValueStructHeaderSize is the size of the meta, user meta and expires at fields that are encoded before the value
+	// of a ValueStruct.
+	ValueStructHeaderSize = 1 + 1 + 8
+)
 
 type (
 	// ValueStruct represents the value info that can be associated with a key, but also the internal
@@ -13,11 +24,29 @@ type (
 
 		Version uint64 // This field is not serialized. Only for internal usage.
 	}
+
+	// Iterator is an interface for a basic iterator.
+	Iterator interface {
+		Next()
+		Rewind()
+		Seek(key []byte)
+		Key() []byte
+		Value() ValueStruct
+		Valid() bool
+
+		// Err returns the error that made the iterator invalid, or nil if the iterator is valid or has moved past the
+		// last element. Iterators stop at the first error, so it must be checked once Valid returns false to tell a
+		// failed read apart from the end of the data.
+		Err() error
+
+		// All iterators should be closed so that file garbage collection works.
+		Close() error
+	}
 )
 
 // EncodedSize is the size (in bytes) of the ValueStruct once it has been marshalled.
 func (v *ValueStruct) EncodedSize() uint32 {
-	return 1 + 1 + 8 + uint32(len(v.Value))
+	return ValueStructHeaderSize + uint32(len(v.Value))
 }
 
 // Marshal encodes the ValueStruct into the destination byte array provided. The destination byte array must be at least
@@ -29,11 +58,29 @@ func (v *ValueStruct) Marshal(dst []byte) {
 	copy(dst[10:], v.Value)
 }
 
-// Unmarshal decodes the ValueStruct from the source bytes. The source bytes must be at least 10 bytes to not cause an
-// invalid index panic.
-func (v *ValueStruct) Unmarshal(src []byte) {
+// EncodeTo writes the encoded ValueStruct to the end of the provided buffer. This produces the same bytes as Marshal but
+// avoids needing to allocate a destination array first.
+func (v *ValueStruct) EncodeTo(buf *bytes.Buffer) {
+	var expiresAt [8]byte
+	binary.BigEndian.PutUint64(expiresAt[:], v.ExpiresAt)
+	buf.WriteByte(v.Meta)
+	buf.WriteByte(v.UserMeta)
+	buf.Write(expiresAt[:])
+	buf.Write(v.Value)
+}
+
+// Unmarshal decodes the ValueStruct from the source bytes. The value references the source bytes rather than being
+// copied. An error is returned if the source bytes are shorter than ValueStructHeaderSize.
+func (v *ValueStruct) Unmarshal(src []byte) error {
+	if len(src) < ValueStructHeaderSize {
+		return errors.Errorf("encoded value requires at least %d bytes, but only %d bytes were provided",
+			ValueStructHeaderSize, len(src))
+	}
+
 	v.Meta = src[0]
 	v.UserMeta = src[1]
-	v.ExpiresAt = binary.BigEndian.Uint64(src[2 : 2+8])
-	v.Value = src[10:]
+	v.ExpiresAt = binary.BigEndian.Uint64(src[2:ValueStructHeaderSize])
+	v.Value = src[ValueStructHeaderSize:]
+
+	return nil
 }
@@ -0,0 +1,49 @@
+package z
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueStruct_Unmarshal(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		value := ValueStruct{
+			Meta:      1,
+			UserMeta:  2,
+			ExpiresAt: 12345,
+			Value:     []byte("value"),
+		}
+
+		var buf bytes.Buffer
+		value.EncodeTo(&buf)
+		require.Equal(t, int(value.EncodedSize()), buf.Len())
+
+		var decoded ValueStruct
+		require.NoError(t, decoded.Unmarshal(buf.Bytes()))
+		require.Equal(t, value, decoded)
+
+		// The value should reference the source bytes rather than a copy.
+		buf.Bytes()[ValueStructHeaderSize] = 'V'
+		require.Equal(t, []byte("Value"), decoded.Value)
+	})
+
+	t.Run("empty value", func(t *testing.T) {
+		value := ValueStruct{Meta: 1}
+		dst := make([]byte, value.EncodedSize())
+		value.Marshal(dst)
+
+		var decoded ValueStruct
+		require.NoError(t, decoded.Unmarshal(dst))
+		require.Equal(t, uint8(1), decoded.Meta)
+		require.Empty(t, decoded.Value)
+	})
+
+	t.Run("short buffer", func(t *testing.T) {
+		var decoded ValueStruct
+		require.Error(t, decoded.Unmarshal([]byte{1, 2, 3}))
+		require.Error(t, decoded.Unmarshal(nil))
+		require.Equal(t, ValueStruct{}, decoded)
+	})
+}
@@ -0,0 +1,196 @@
+package z
+
+import (
+	"bytes"
+	"container/heap"
+)
+
+type (
+	// mergeElement is a single iterator within the heap of a MergeIterator.
+	mergeElement struct {
+		iterator Iterator
+
+		// nice is the position of the iterator in the slice provided to the MergeIterator. When two iterators are on
+		// the exact same key the iterator with the lower nice takes precedence.
+		nice     int
+		reversed bool
+	}
+
+	mergeHeap []*mergeElement
+
+	// MergeIterator merges multiple iterators into a single sorted stream. Keys are compared using CompareKeys so the
+	// newest version of a key is always surfaced first. When more than one iterator has the exact same key (including
+	// the timestamp) only the value from the iterator that was provided first is surfaced.
+	// NOTE: MergeIterator owns the array of iterators and is responsible for closing them.
+	MergeIterator struct {
+		heap       mergeHeap
+		currentKey []byte
+		reversed   bool
+		all        []Iterator
+
+		// err is the first error of any of the iterators since the merge iterator was last positioned. The merge
+		// iterator is invalid once there is an error, rather than going on without the iterator that failed.
+		err error
+	}
+)
+
+func (h mergeHeap) Len() int {
+	return len(h)
+}
+
+func (h mergeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h mergeHeap) Less(i, j int) bool {
+	cmp := CompareKeys(h[i].iterator.Key(), h[j].iterator.Key())
+	if cmp < 0 {
+		return !h[i].reversed
+	}
+
+	if cmp > 0 {
+		return h[i].reversed
+	}
+
+	// The keys are equal. In this case the lower nice takes precedence. This is important.
+	return h[i].nice < h[j].nice
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	*h = append(*h, x.(*mergeElement))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	// Remove the last element, because the heap has already swapped the 0th element with the last.
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// NewMergeIterator creates a new iterator that merges the provided iterators. The iterators should be ordered from
+// newest to oldest so that the newest value wins when the same key exists in more than one iterator.
+func NewMergeIterator(iterators []Iterator, reversed bool) *MergeIterator {
+	m := &MergeIterator{
+		heap:     make(mergeHeap, 0, len(iterators)),
+		reversed: reversed,
+		all:      iterators,
+	}
+	m.initHeap()
+
+	return m
+}
+
+// initHeap checks all of the iterators and initializes the heap. This needs to be run whenever the iterators are
+// repositioned.
+func (m *MergeIterator) initHeap() {
+	m.heap, m.err = m.heap[:0], nil
+	for i, iterator := range m.all {
+		if !iterator.Valid() {
+			if err := iterator.Err(); err != nil && m.err == nil {
+				m.err = err
+			}
+			continue
+		}
+
+		m.heap = append(m.heap, &mergeElement{
+			iterator: iterator,
+			nice:     i,
+			reversed: m.reversed,
+		})
+	}
+
+	heap.Init(&m.heap)
+	if len(m.heap) > 0 {
+		m.currentKey = SafeCopy(m.currentKey, m.heap[0].iterator.Key())
+	}
+}
+
+// Valid returns whether the MergeIterator is at a valid element.
+func (m *MergeIterator) Valid() bool {
+	return m != nil && m.err == nil && len(m.heap) > 0 && m.heap[0].iterator.Valid()
+}
+
+// Err returns the first error of any of the iterators that are being merged.
+func (m *MergeIterator) Err() error {
+	return m.err
+}
+
+// Key returns the key of the current element.
+func (m *MergeIterator) Key() []byte {
+	if len(m.heap) == 0 {
+		return nil
+	}
+
+	return m.heap[0].iterator.Key()
+}
+
+// Value returns the value of the current element.
+func (m *MergeIterator) Value() ValueStruct {
+	if len(m.heap) == 0 {
+		return ValueStruct{}
+	}
+
+	return m.heap[0].iterator.Value()
+}
+
+// Next moves to the next element. Any iterators that are positioned on the same key as the current element are moved
+// past it, so duplicate keys are only surfaced once.
+func (m *MergeIterator) Next() {
+	if len(m.heap) == 0 {
+		return
+	}
+
+	m.heap[0].iterator.Next()
+	for len(m.heap) > 0 {
+		top := m.heap[0].iterator
+		if !top.Valid() {
+			if err := top.Err(); err != nil {
+				m.err = err
+				return
+			}
+			heap.Pop(&m.heap)
+			continue
+		}
+
+		heap.Fix(&m.heap, 0)
+		top = m.heap[0].iterator
+		if !bytes.Equal(m.currentKey, top.Key()) {
+			m.currentKey = SafeCopy(m.currentKey, top.Key())
+			return
+		}
+
+		top.Next()
+	}
+}
+
+// Rewind seeks to the first element, or the last element for a reversed iterator.
+func (m *MergeIterator) Rewind() {
+	for _, iterator := range m.all {
+		iterator.Rewind()
+	}
+
+	m.initHeap()
+}
+
+// Seek moves to the first element with a key >= the provided key, or <= the provided key for a reversed iterator.
+func (m *MergeIterator) Seek(key []byte) {
+	for _, iterator := range m.all {
+		iterator.Seek(key)
+	}
+
+	m.initHeap()
+}
+
+// Close closes all of the iterators that are being merged.
+func (m *MergeIterator) Close() error {
+	var err error
+	for _, iterator := range m.all {
+		if closeErr := iterator.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return Wrapf(err, "failed to close merge iterator")
+}
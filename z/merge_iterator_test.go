@@ -0,0 +1,164 @@
+package z
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sliceIterator iterates over a sorted slice of keys, the value of each key is the name of the iterator.
+type sliceIterator struct {
+	name     string
+	keys     [][]byte
+	index    int
+	reversed bool
+	closed   bool
+}
+
+func newSliceIterator(name string, reversed bool, keys ...[]byte) *sliceIterator {
+	sort.Slice(keys, func(i, j int) bool {
+		return CompareKeys(keys[i], keys[j]) < 0
+	})
+
+	return &sliceIterator{name: name, keys: keys, reversed: reversed}
+}
+
+func (s *sliceIterator) Next() {
+	if s.reversed {
+		s.index--
+	} else {
+		s.index++
+	}
+}
+
+func (s *sliceIterator) Rewind() {
+	if s.reversed {
+		s.index = len(s.keys) - 1
+	} else {
+		s.index = 0
+	}
+}
+
+func (s *sliceIterator) Seek(key []byte) {
+	s.index = sort.Search(len(s.keys), func(i int) bool {
+		return CompareKeys(s.keys[i], key) >= 0
+	})
+	if s.reversed && (s.index == len(s.keys) || CompareKeys(s.keys[s.index], key) > 0) {
+		s.index--
+	}
+}
+
+func (s *sliceIterator) Key() []byte {
+	return s.keys[s.index]
+}
+
+func (s *sliceIterator) Value() ValueStruct {
+	return ValueStruct{Value: []byte(s.name)}
+}
+
+func (s *sliceIterator) Valid() bool {
+	return s.index >= 0 && s.index < len(s.keys)
+}
+
+func (s *sliceIterator) Err() error {
+	return nil
+}
+
+func (s *sliceIterator) Close() error {
+	s.closed = true
+	return nil
+}
+
+func collectMergeIterator(m *MergeIterator) (result []string) {
+	for ; m.Valid(); m.Next() {
+		result = append(result, fmt.Sprintf("%s@%d=%s", ParseKey(m.Key()), ParseTs(m.Key()), m.Value().Value))
+	}
+
+	return result
+}
+
+func newTestMergeIterators(reversed bool) []*sliceIterator {
+	return []*sliceIterator{
+		// The first iterator is the newest source, like the active memory table.
+		newSliceIterator("active", reversed, KeyWithTs([]byte("b"), 3), KeyWithTs([]byte("d"), 3)),
+		newSliceIterator("flushed", reversed, KeyWithTs([]byte("a"), 2), KeyWithTs([]byte("b"), 2),
+			KeyWithTs([]byte("d"), 3)),
+		newSliceIterator("table", reversed, KeyWithTs([]byte("a"), 1), KeyWithTs([]byte("c"), 1),
+			KeyWithTs([]byte("d"), 1)),
+	}
+}
+
+func TestMergeIterator(t *testing.T) {
+	t.Run("forward", func(t *testing.T) {
+		sources := newTestMergeIterators(false)
+		iterators := make([]Iterator, len(sources))
+		for i, source := range sources {
+			iterators[i] = source
+		}
+
+		m := NewMergeIterator(iterators, false)
+		m.Rewind()
+		// The newest version of each key comes first, and the duplicate d@3 is only surfaced from the newest source.
+		require.Equal(t, []string{
+			"a@2=flushed",
+			"a@1=table",
+			"b@3=active",
+			"b@2=flushed",
+			"c@1=table",
+			"d@3=active",
+			"d@1=table",
+		}, collectMergeIterator(m))
+
+		m.Seek(KeyWithTs([]byte("b"), 2))
+		require.Equal(t, []string{
+			"b@2=flushed",
+			"c@1=table",
+			"d@3=active",
+			"d@1=table",
+		}, collectMergeIterator(m))
+
+		require.NoError(t, m.Close())
+		for _, source := range sources {
+			require.True(t, source.closed)
+		}
+	})
+
+	t.Run("reverse", func(t *testing.T) {
+		sources := newTestMergeIterators(true)
+		iterators := make([]Iterator, len(sources))
+		for i, source := range sources {
+			iterators[i] = source
+		}
+
+		m := NewMergeIterator(iterators, true)
+		m.Rewind()
+		require.Equal(t, []string{
+			"d@1=table",
+			"d@3=active",
+			"c@1=table",
+			"b@2=flushed",
+			"b@3=active",
+			"a@1=table",
+			"a@2=flushed",
+		}, collectMergeIterator(m))
+
+		m.Seek(KeyWithTs([]byte("b"), 3))
+		require.Equal(t, []string{
+			"b@3=active",
+			"a@1=table",
+			"a@2=flushed",
+		}, collectMergeIterator(m))
+
+		require.NoError(t, m.Close())
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		m := NewMergeIterator(nil, false)
+		m.Rewind()
+		require.False(t, m.Valid())
+		require.Nil(t, m.Key())
+		require.NoError(t, m.Close())
+	})
+}
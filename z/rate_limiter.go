@@ -0,0 +1,69 @@
+package z
+
+import (
+	"sync"
+	"time"
+)
+
+// minimumRateLimiterDelay is the shortest delay that a caller of RateLimiter.Wait is put to sleep for. Shorter delays
+// are carried over to the next call, so callers that take a few bytes at a time are not put to sleep for every call.
+const minimumRateLimiterDelay = 10 * time.Millisecond
+
+type (
+	// RateLimiter is a token bucket that limits the number of bytes that are processed per second. The bucket holds up
+	// to one second of bytes, so a caller that has been idle can take that many right away before it is slowed down.
+	// It is safe to use from multiple goroutines, which then share the rate. A nil RateLimiter does not limit anything.
+	RateLimiter struct {
+		lock           sync.Mutex
+		bytesPerSecond float64
+		available      float64
+		last           time.Time
+	}
+)
+
+// NewRateLimiter creates a rate limiter that allows the provided number of bytes per second. A nil rate limiter is
+// returned if the number of bytes per second is not greater than zero, which does not limit anything.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &RateLimiter{
+		bytesPerSecond: float64(bytesPerSecond),
+		available:      float64(bytesPerSecond),
+		last:           time.Now(),
+	}
+}
+
+// Wait takes the provided number of bytes from the bucket, and waits until the bucket has been refilled enough to cover
+// them. The bytes are taken right away, so callers that wait at the same time are spaced out rather than woken all at
+// once. If done is closed then Wait stops waiting and returns false.
+func (r *RateLimiter) Wait(bytes int, done <-chan struct{}) bool {
+	if r == nil {
+		return true
+	}
+
+	r.lock.Lock()
+	now := time.Now()
+	r.available += now.Sub(r.last).Seconds() * r.bytesPerSecond
+	if r.available > r.bytesPerSecond {
+		r.available = r.bytesPerSecond
+	}
+	r.last = now
+	r.available -= float64(bytes)
+	delay := time.Duration(-r.available / r.bytesPerSecond * float64(time.Second))
+	r.lock.Unlock()
+
+	if delay < minimumRateLimiterDelay {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
@@ -0,0 +1,36 @@
+package z
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter_Wait(t *testing.T) {
+	// A nil rate limiter does not limit anything.
+	require.Nil(t, NewRateLimiter(0))
+	require.True(t, (*RateLimiter)(nil).Wait(1<<30, nil))
+
+	const bytesPerSecond = 1 << 20
+	limiter := NewRateLimiter(bytesPerSecond)
+
+	// The bucket starts full, so the first second of bytes is taken without waiting.
+	start := time.Now()
+	require.True(t, limiter.Wait(bytesPerSecond, nil))
+	require.True(t, time.Since(start) < 100*time.Millisecond, "waited %s", time.Since(start))
+
+	// A quarter of the rate has to wait for a quarter of a second.
+	start = time.Now()
+	for i := 0; i < 64; i++ {
+		require.True(t, limiter.Wait(bytesPerSecond/256, nil))
+	}
+	require.True(t, time.Since(start) >= 200*time.Millisecond, "waited %s", time.Since(start))
+
+	// Closing done stops the wait.
+	done := make(chan struct{})
+	close(done)
+	start = time.Now()
+	require.False(t, limiter.Wait(10*bytesPerSecond, done))
+	require.True(t, time.Since(start) < time.Second, "waited %s", time.Since(start))
+}
@@ -0,0 +1,39 @@
+package z
+
+import (
+	"time"
+)
+
+const (
+	// renameAttempts is the number of times a rename that failed with a transient error is tried before giving up.
+	renameAttempts = 10
+
+	// renameRetryDelay is how long to wait after the first failed rename, the delay doubles after every attempt.
+	renameRetryDelay = 5 * time.Millisecond
+)
+
+// RenameWithRetry renames the old path to the new path. On Windows a rename fails while another handle to either file
+// is open, even if it is only held by a reader or a virus scanner for a moment, so those renames are retried a bounded
+// number of times with a backoff. On every other platform the rename is only tried once.
+func RenameWithRetry(fs FileSystem, oldPath, newPath string) error {
+	return renameWithRetry(fs, oldPath, newPath, isTransientRenameError, renameAttempts, renameRetryDelay)
+}
+
+// renameWithRetry renames the old path to the new path, trying again after each failure that is transient until the
+// rename has been tried the provided number of times.
+func renameWithRetry(
+	fs FileSystem,
+	oldPath, newPath string,
+	isTransient func(err error) bool,
+	attempts int,
+	delay time.Duration,
+) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = fs.Rename(oldPath, newPath); err == nil || attempt >= attempts || !isTransient(err) {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
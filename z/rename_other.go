@@ -0,0 +1,8 @@
+// +build !windows
+
+package z
+
+// isTransientRenameError returns false, renames only fail because of another open handle on Windows.
+func isTransientRenameError(err error) bool {
+	return false
+}
@@ -0,0 +1,24 @@
+// +build windows
+
+package z
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	// errorSharingViolation is ERROR_SHARING_VIOLATION, returned when another process has the file open without
+	// sharing it.
+	errorSharingViolation syscall.Errno = 32
+)
+
+// isTransientRenameError returns true if the rename failed because another handle to one of the files is still open,
+// which goes away once that handle is closed.
+func isTransientRenameError(err error) bool {
+	if linkErr, ok := err.(*os.LinkError); ok {
+		err = linkErr.Err
+	}
+
+	return err == syscall.ERROR_ACCESS_DENIED || err == errorSharingViolation
+}
@@ -0,0 +1,51 @@
+package z
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// SyncGroup coalesces concurrent syncs of a file into a single sync. The first caller leads a group, it waits for
+	// the interval so that other callers can join and then syncs once for all of them. The zero value is ready to use.
+	SyncGroup struct {
+		lock    sync.Mutex
+		pending *syncCall
+	}
+
+	// syncCall is a single sync that is shared by every caller in a group.
+	syncCall struct {
+		done chan struct{}
+		err  error
+	}
+)
+
+// Do calls sync once for the group that the caller joins, and returns the error of that call. Everything that was
+// written before Do was called is covered by the sync. If there is no group to join then the caller leads a new group,
+// waiting for the provided interval before calling sync. A caller that arrives after the sync of a group has started
+// leads the next group, since the sync might not cover its writes.
+func (g *SyncGroup) Do(interval time.Duration, sync func() error) error {
+	g.lock.Lock()
+	if call := g.pending; call != nil {
+		g.lock.Unlock()
+		<-call.done
+		return call.err
+	}
+
+	call := &syncCall{done: make(chan struct{})}
+	g.pending = call
+	g.lock.Unlock()
+
+	if interval > 0 {
+		time.Sleep(interval)
+	}
+
+	g.lock.Lock()
+	g.pending = nil
+	g.lock.Unlock()
+
+	call.err = sync()
+	close(call.done)
+
+	return call.err
+}
@@ -0,0 +1,58 @@
+package z
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncGroup_Do(t *testing.T) {
+	var group SyncGroup
+	var syncs int32
+	syncErr := errors.New("sync failed")
+
+	// Every caller that arrives within the interval shares the sync of the first caller, along with its error.
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = group.Do(100*time.Millisecond, func() error {
+				atomic.AddInt32(&syncs, 1)
+				return syncErr
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&syncs))
+	for _, err := range errs {
+		require.Equal(t, syncErr, err)
+	}
+
+	// A caller that arrives once the sync has started leads the next group.
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = group.Do(0, func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	result := make(chan error, 1)
+	go func() {
+		result <- group.Do(0, func() error {
+			return nil
+		})
+	}()
+	require.NoError(t, <-result)
+	close(release)
+}
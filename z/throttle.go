@@ -1,6 +1,7 @@
 package z
 
 import (
+	"context"
 	"sync"
 )
 
@@ -27,6 +28,18 @@ func NewThrottle(max int) *Throttle {
 // Do should be called by workers before they start working. It blocks if there are already maximum number of workers
 // working. If it detects an error from previously Done workers, it would return it.
 func (t *Throttle) Do() error {
+	return t.DoContext(context.Background())
+}
+
+// DoContext is the same as Do, but it stops waiting for a worker to finish and returns the context's error if the
+// context is cancelled first. A context that is already cancelled always returns its error, even if a slot is free.
+// The worker must not call Done if an error is returned.
+func (t *Throttle) DoContext(ctx context.Context) error {
+	// Select picks randomly between the cases that are ready, so without this a free slot could still be taken.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	for {
 		select {
 		case t.channel <- struct{}{}:
@@ -36,6 +49,8 @@ func (t *Throttle) Do() error {
 			if err != nil {
 				return err
 			}
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
@@ -0,0 +1,66 @@
+package z
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottle_DoContext(t *testing.T) {
+	throttle := NewThrottle(2)
+	require.NoError(t, throttle.Do())
+	require.NoError(t, throttle.DoContext(context.Background()))
+
+	// Every slot is taken, so the next worker has to wait until the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- throttle.DoContext(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		t.Fatalf("DoContext returned while every slot was taken: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	require.Equal(t, context.Canceled, <-result)
+
+	// The cancelled worker did not take a slot, so finishing the two running workers should not block.
+	throttle.Done(nil)
+	throttle.Done(nil)
+	require.NoError(t, throttle.Finish())
+}
+
+func TestThrottle_DoContext_Deadline(t *testing.T) {
+	throttle := NewThrottle(1)
+	require.NoError(t, throttle.Do())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, throttle.DoContext(ctx))
+
+	// Once the running worker finishes another worker can start.
+	throttle.Done(nil)
+	require.NoError(t, throttle.DoContext(context.Background()))
+	throttle.Done(nil)
+	require.NoError(t, throttle.Finish())
+}
+
+func TestThrottle_DoContext_Cancelled(t *testing.T) {
+	throttle := NewThrottle(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Every slot is free, but a context that is already cancelled never takes one.
+	for i := 0; i < 100; i++ {
+		require.Equal(t, context.Canceled, throttle.DoContext(ctx))
+	}
+
+	require.NoError(t, throttle.Do())
+	throttle.Done(nil)
+	require.NoError(t, throttle.Finish())
+}
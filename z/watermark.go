@@ -1,6 +1,12 @@
 package z
 
-import "golang.org/x/net/trace"
+import (
+	"container/heap"
+	"context"
+	"sync/atomic"
+
+	"golang.org/x/net/trace"
+)
 
 type (
 	WaterMark struct {
@@ -23,8 +29,23 @@ type (
 		// Done will be true once the last index is finished.
 		done bool
 	}
+
+	// uint64Heap is a min-heap of uint64s, it is used by the watermark to keep track of the pending indices.
+	uint64Heap []uint64
 )
 
+func (u uint64Heap) Len() int            { return len(u) }
+func (u uint64Heap) Less(i, j int) bool  { return u[i] < u[j] }
+func (u uint64Heap) Swap(i, j int)       { u[i], u[j] = u[j], u[i] }
+func (u *uint64Heap) Push(x interface{}) { *u = append(*u, x.(uint64)) }
+func (u *uint64Heap) Pop() interface{} {
+	old := *u
+	n := len(old)
+	x := old[n-1]
+	*u = old[0 : n-1]
+	return x
+}
+
 func (w *WaterMark) Init(closer *Closer, eventLogging bool) {
 	w.markChannel = make(chan mark, 100)
 	if eventLogging {
@@ -32,6 +53,176 @@ func (w *WaterMark) Init(closer *Closer, eventLogging bool) {
 	} else {
 		w.eventLog = NoEventLog
 	}
-	// TODO (elliotcourant) Need to add watermark process.
-	return
+	go w.process(closer)
+}
+
+// Begin sets the last index to the given value.
+func (w *WaterMark) Begin(index uint64) {
+	atomic.StoreUint64(&w.lastIndex, index)
+	w.markChannel <- mark{index: index, done: false}
+}
+
+// Done sets a single index as done.
+func (w *WaterMark) Done(index uint64) {
+	w.markChannel <- mark{index: index, done: true}
+}
+
+// BeginMany works like Begin but accepts multiple indices.
+func (w *WaterMark) BeginMany(indices []uint64) {
+	atomic.StoreUint64(&w.lastIndex, indices[len(indices)-1])
+	w.markChannel <- mark{index: 0, indicies: indices, done: false}
+}
+
+// DoneMany works like Done but accepts multiple indices.
+func (w *WaterMark) DoneMany(indices []uint64) {
+	w.markChannel <- mark{index: 0, indicies: indices, done: true}
+}
+
+// DoneUntil returns the maximum index that has the property that all indices less than or equal to it are done.
+func (w *WaterMark) DoneUntil() uint64 {
+	return atomic.LoadUint64(&w.doneUntil)
+}
+
+// SetDoneUntil sets the maximum index that has the property that all indices less than or equal to it are done.
+func (w *WaterMark) SetDoneUntil(val uint64) {
+	atomic.StoreUint64(&w.doneUntil, val)
+}
+
+// LastIndex returns the last index for which Begin has been called.
+func (w *WaterMark) LastIndex() uint64 {
+	return atomic.LoadUint64(&w.lastIndex)
+}
+
+// WaitForMark waits until the given index is marked as done.
+func (w *WaterMark) WaitForMark(ctx context.Context, index uint64) error {
+	if w.DoneUntil() >= index {
+		return nil
+	}
+
+	waitCh := make(chan struct{})
+	w.markChannel <- mark{index: index, waiter: waitCh}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-waitCh:
+		return nil
+	}
+}
+
+// process is used to process the marks channel. This is not thread-safe, so only run one goroutine for process. One is
+// sufficient, because all goroutine ops use purely memory and cpu. Each index has to emit at least one begin watermark
+// in serial order otherwise waiters can get blocked indefinitely. Example: We had an watermark at 100 and a waiter at
+// 101, if no watermark is emitted at index 101 then waiter would get stuck indefinitely as it can't decide whether the
+// task at 101 has decided not to emit watermark or it didn't get scheduled yet.
+func (w *WaterMark) process(closer *Closer) {
+	defer closer.Done()
+
+	var indices uint64Heap
+	// pending maps raft proposal index to the number of pending mutations for this proposal.
+	pending := make(map[uint64]int)
+	waiters := make(map[uint64][]chan struct{})
+
+	heap.Init(&indices)
+	var loop uint64
+
+	processOne := func(index uint64, done bool) {
+		// If not already done, then set. Otherwise, don't undo a done entry.
+		prev, present := pending[index]
+		if !present {
+			heap.Push(&indices, index)
+		}
+
+		delta := 1
+		if done {
+			delta = -1
+		}
+		pending[index] = prev + delta
+
+		loop++
+		if len(indices) > 0 && loop%10000 == 0 {
+			min := indices[0]
+			w.eventLog.Printf("WaterMark %s: Done entry %4d. Size: %4d Watermark: %-4d Looking for: %-4d. Value: %d\n",
+				w.Name, index, len(indices), w.DoneUntil(), min, pending[min])
+		}
+
+		// Update mark by going through all indices in order; and checking if they have been done. Stop at the first
+		// index, which isn't done.
+		doneUntil := w.DoneUntil()
+		if doneUntil > index {
+			AssertTruef(false, "Name: %s doneUntil: %d. Index: %d", w.Name, doneUntil, index)
+		}
+
+		until := doneUntil
+		loops := 0
+
+		for len(indices) > 0 {
+			min := indices[0]
+			if done := pending[min]; done > 0 {
+				break // len(indices) will be > 0.
+			}
+			// Even if done is called multiple times causing it to become negative, we should still pop the index.
+			heap.Pop(&indices)
+			delete(pending, min)
+			until = min
+			loops++
+		}
+
+		if until != doneUntil {
+			AssertTrue(atomic.CompareAndSwapUint64(&w.doneUntil, doneUntil, until))
+			w.eventLog.Printf("%s: Done until %d. Loops: %d\n", w.Name, until, loops)
+		}
+
+		notifyAndRemove := func(idx uint64, toNotify []chan struct{}) {
+			for _, ch := range toNotify {
+				close(ch)
+			}
+			delete(waiters, idx) // Release the memory back.
+		}
+
+		if until-doneUntil <= uint64(len(waiters)) {
+			// Issue #908 showed that if doneUntil is close to 2^60, while until = 0, this loop can hog up CPU just
+			// iterating over integers creating a busy-wait loop. So, only run this loop if until - doneUntil is less
+			// than number of waiters.
+			for idx := doneUntil + 1; idx <= until; idx++ {
+				if toNotify, ok := waiters[idx]; ok {
+					notifyAndRemove(idx, toNotify)
+				}
+			}
+		} else {
+			for idx, toNotify := range waiters {
+				if idx <= until {
+					notifyAndRemove(idx, toNotify)
+				}
+			}
+		} // end of notifying waiters.
+	}
+
+	for {
+		select {
+		case <-closer.HasBeenClosed():
+			return
+		case mark := <-w.markChannel:
+			if mark.waiter != nil {
+				doneUntil := atomic.LoadUint64(&w.doneUntil)
+				if doneUntil >= mark.index {
+					close(mark.waiter)
+				} else {
+					ws, ok := waiters[mark.index]
+					if !ok {
+						waiters[mark.index] = []chan struct{}{mark.waiter}
+					} else {
+						waiters[mark.index] = append(ws, mark.waiter)
+					}
+				}
+			} else {
+				if mark.index > 0 {
+					processOne(mark.index, mark.done)
+				}
+				for _, index := range mark.indicies {
+					processOne(index, mark.done)
+				}
+			}
+		}
+	}
 }
@@ -0,0 +1,53 @@
+package z
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaterMark_OutOfOrder(t *testing.T) {
+	closer := NewCloser(1)
+	defer closer.SignalAndWait()
+
+	w := &WaterMark{Name: "test"}
+	w.Init(closer, false)
+
+	for i := uint64(1); i <= 5; i++ {
+		w.Begin(i)
+	}
+	require.Equal(t, uint64(5), w.LastIndex())
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- w.WaitForMark(context.Background(), 4)
+	}()
+
+	// Finish the indices out of order, the watermark cannot move past an index that is still pending.
+	w.Done(2)
+	w.Done(4)
+	w.Done(3)
+
+	// Wait for the marks to be processed, the doneUntil should still be 0 since 1 is not done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	require.Equal(t, context.DeadlineExceeded, w.WaitForMark(ctx, 1))
+	cancel()
+	require.Equal(t, uint64(0), w.DoneUntil())
+
+	select {
+	case <-waited:
+		t.Fatal("waiter should not be notified before its index is done")
+	default:
+	}
+
+	// Once 1 is done everything up to 4 is done, but 5 is still pending.
+	w.Done(1)
+	require.NoError(t, <-waited)
+	require.Equal(t, uint64(4), w.DoneUntil())
+
+	w.Done(5)
+	require.NoError(t, w.WaitForMark(context.Background(), 5))
+	require.Equal(t, uint64(5), w.DoneUntil())
+}
@@ -2,11 +2,14 @@ package z
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"hash/crc32"
 	"math"
 	"os"
+	"reflect"
 	"sync"
+	"unsafe"
 )
 
 const (
@@ -37,12 +40,17 @@ type (
 	Closer struct {
 		closed  chan struct{}
 		waiting sync.WaitGroup
+
+		// ctx is cancelled when the closer is signaled, so the signal can be passed to functions that accept a context.
+		ctx    context.Context
+		cancel context.CancelFunc
 	}
 )
 
 // NewCloser constructs a new Closer, with an initial count on the WaitGroup.
 func NewCloser(initial int) *Closer {
 	ret := &Closer{closed: make(chan struct{})}
+	ret.ctx, ret.cancel = context.WithCancel(context.Background())
 	ret.waiting.Add(initial)
 	return ret
 }
@@ -55,6 +63,7 @@ func (lc *Closer) AddRunning(delta int) {
 // Signal signals the HasBeenClosed signal.
 func (lc *Closer) Signal() {
 	close(lc.closed)
+	lc.cancel()
 }
 
 // HasBeenClosed gets signaled when Signal() is called.
@@ -65,6 +74,14 @@ func (lc *Closer) HasBeenClosed() <-chan struct{} {
 	return lc.closed
 }
 
+// Ctx returns a context that is cancelled when Signal() is called.
+func (lc *Closer) Ctx() context.Context {
+	if lc == nil {
+		return context.Background()
+	}
+	return lc.ctx
+}
+
 // Done calls Done() on the WaitGroup.
 func (lc *Closer) Done() {
 	if lc == nil {
@@ -86,7 +103,7 @@ func (lc *Closer) SignalAndWait() {
 }
 
 // OpenExistingFile opens an existing file, errors if it doesn't exist.
-func OpenExistingFile(fileName string, flags uint32) (*os.File, error) {
+func OpenExistingFile(fs FileSystem, fileName string, flags uint32) (*os.File, error) {
 	openFlags := os.O_RDWR
 	if flags&ReadOnly != 0 {
 		openFlags = os.O_RDONLY
@@ -95,16 +112,25 @@ func OpenExistingFile(fileName string, flags uint32) (*os.File, error) {
 	if flags&Sync != 0 {
 		openFlags |= dataSyncFileFlag
 	}
-	return os.OpenFile(fileName, openFlags, 0)
+	return fs.OpenFile(fileName, openFlags, 0)
+}
+
+// CreateSyncedFile creates a new file (using O_EXCL), errors if it already existed.
+func CreateSyncedFile(fs FileSystem, fileName string, sync bool) (*os.File, error) {
+	flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if sync {
+		flags |= dataSyncFileFlag
+	}
+	return fs.OpenFile(fileName, flags, 0600)
 }
 
 // OpenTruncFile opens the file with O_RDWR | O_CREATE | O_TRUNC
-func OpenTruncFile(fileName string, sync bool) (*os.File, error) {
+func OpenTruncFile(fs FileSystem, fileName string, sync bool) (*os.File, error) {
 	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
 	if sync {
 		flags |= dataSyncFileFlag
 	}
-	return os.OpenFile(fileName, flags, 0600)
+	return fs.OpenFile(fileName, flags, 0600)
 }
 
 // CompareKeys checks the key without timestamp and checks the timestamp if keyNoTs
@@ -151,3 +177,66 @@ func SameKey(src, dst []byte) bool {
 
 	return bytes.Equal(ParseKey(src), ParseKey(dst))
 }
+
+// CompareKeysWithoutTs compares the keys ignoring their version timestamp suffix. Keys shorter than the timestamp do
+// not carry a timestamp and are compared as they are.
+func CompareKeysWithoutTs(key1, key2 []byte) int {
+	return bytes.Compare(trimTs(key1), trimTs(key2))
+}
+
+// HasPrefix checks if the key starts with the prefix ignoring the version timestamp suffix of the key, so the prefix
+// cannot match against the bytes of the timestamp. Keys shorter than the timestamp do not carry a timestamp and are
+// checked as they are.
+func HasPrefix(key, prefix []byte) bool {
+	return bytes.HasPrefix(trimTs(key), prefix)
+}
+
+// trimTs returns the key without its version timestamp suffix, keys that are too short to have a timestamp are
+// returned unchanged.
+func trimTs(key []byte) []byte {
+	if len(key) < 8 {
+		return key
+	}
+
+	return key[:len(key)-8]
+}
+
+// Copy copies a byte slice and returns the copied slice.
+func Copy(a []byte) []byte {
+	b := make([]byte, len(a))
+	copy(b, a)
+	return b
+}
+
+// SafeCopy does append(a[:0], src...).
+func SafeCopy(a, src []byte) []byte {
+	return append(a[:0], src...)
+}
+
+// U32SliceToBytes converts the given uint32 slice to a byte slice without copying. The bytes are in the native byte
+// order of the machine. See experiments/encoding_test.go for why this is used over binary encoding.
+func U32SliceToBytes(u32s []uint32) []byte {
+	if len(u32s) == 0 {
+		return nil
+	}
+	var b []byte
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	hdr.Len = len(u32s) * 4
+	hdr.Cap = hdr.Len
+	hdr.Data = uintptr(unsafe.Pointer(&u32s[0]))
+	return b
+}
+
+// BytesToU32Slice converts the given byte slice to a uint32 slice without copying. This is the inverse of
+// U32SliceToBytes.
+func BytesToU32Slice(b []byte) []uint32 {
+	if len(b) == 0 {
+		return nil
+	}
+	var u32s []uint32
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&u32s))
+	hdr.Len = len(b) / 4
+	hdr.Cap = hdr.Len
+	hdr.Data = uintptr(unsafe.Pointer(&b[0]))
+	return u32s
+}
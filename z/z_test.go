@@ -0,0 +1,150 @@
+package z
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloser_Ctx(t *testing.T) {
+	closer := NewCloser(1)
+	ctx, cancel := context.WithTimeout(closer.Ctx(), time.Minute)
+	defer cancel()
+	require.NoError(t, ctx.Err())
+
+	go func() {
+		defer closer.Done()
+		<-closer.HasBeenClosed()
+	}()
+
+	closer.SignalAndWait()
+
+	// The derived context should be cancelled by the signal rather than its own timeout.
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("derived context was not cancelled when the closer was signaled")
+	}
+	require.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestCloser_Ctx_Nil(t *testing.T) {
+	var closer *Closer
+	require.NoError(t, closer.Ctx().Err())
+}
+
+func TestHasPrefix(t *testing.T) {
+	key := KeyWithTs([]byte("!notbgr!head"), 10)
+	require.True(t, HasPrefix(key, []byte("!notbgr!")))
+	require.True(t, HasPrefix(key, []byte("!notbgr!head")))
+	require.True(t, HasPrefix(key, nil))
+	require.False(t, HasPrefix(key, []byte("!badger!")))
+
+	// The prefix should not be able to match against the timestamp of the key.
+	require.False(t, HasPrefix(key, append([]byte("!notbgr!head"), key[len(key)-8])))
+	require.False(t, HasPrefix(KeyWithTs(nil, 10), key[len(key)-8:len(key)-7]))
+
+	// Keys shorter than a timestamp do not have one.
+	require.True(t, HasPrefix([]byte("abc"), []byte("ab")))
+	require.False(t, HasPrefix([]byte("abc"), []byte("abcd")))
+	require.True(t, HasPrefix(nil, nil))
+	require.False(t, HasPrefix(nil, []byte("a")))
+}
+
+func TestCompareKeysWithoutTs(t *testing.T) {
+	require.Equal(t, 0, CompareKeysWithoutTs(KeyWithTs([]byte("a"), 1), KeyWithTs([]byte("a"), 2)))
+	require.Equal(t, -1, CompareKeysWithoutTs(KeyWithTs([]byte("a"), 2), KeyWithTs([]byte("b"), 1)))
+	require.Equal(t, 1, CompareKeysWithoutTs(KeyWithTs([]byte("aa"), 1), KeyWithTs([]byte("a"), 1)))
+
+	// Keys shorter than a timestamp do not have one.
+	require.Equal(t, 0, CompareKeysWithoutTs([]byte("abc"), []byte("abc")))
+	require.Equal(t, -1, CompareKeysWithoutTs([]byte("ab"), []byte("abc")))
+	require.Equal(t, 1, CompareKeysWithoutTs([]byte("b"), nil))
+	require.Equal(t, 0, CompareKeysWithoutTs(nil, KeyWithTs(nil, 5)))
+}
+
+func TestPreallocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file, err := CreateSyncedFile(OSFileSystem, filepath.Join(dir, "preallocated"), false)
+	require.NoError(t, err)
+	defer file.Close()
+
+	require.NoError(t, Preallocate(file, 1<<20))
+	info, err := file.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(1<<20), info.Size())
+
+	// Writing the data should not grow the file any further.
+	_, err = file.Write(make([]byte, 1<<20))
+	require.NoError(t, err)
+	info, err = file.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(1<<20), info.Size())
+}
+
+// flakyRenameFileSystem fails the first renames with the provided error before passing them through to the os package.
+type flakyRenameFileSystem struct {
+	FileSystem
+	failures int
+	err      error
+	attempts int
+}
+
+func (fs *flakyRenameFileSystem) Rename(oldPath, newPath string) error {
+	fs.attempts++
+	if fs.attempts <= fs.failures {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.err}
+	}
+
+	return fs.FileSystem.Rename(oldPath, newPath)
+}
+
+func TestRenameWithRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldPath, newPath := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	transientErr := errors.New("file is in use")
+	isTransient := func(err error) bool {
+		return err.(*os.LinkError).Err == transientErr
+	}
+
+	// A transient failure is retried until the rename succeeds.
+	require.NoError(t, ioutil.WriteFile(oldPath, []byte("data"), 0600))
+	fs := &flakyRenameFileSystem{FileSystem: OSFileSystem, failures: 2, err: transientErr}
+	require.NoError(t, renameWithRetry(fs, oldPath, newPath, isTransient, 3, time.Millisecond))
+	require.Equal(t, 3, fs.attempts)
+	data, err := ioutil.ReadFile(newPath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), data)
+
+	// The number of attempts is bounded.
+	require.NoError(t, ioutil.WriteFile(oldPath, []byte("data"), 0600))
+	fs = &flakyRenameFileSystem{FileSystem: OSFileSystem, failures: 5, err: transientErr}
+	require.Error(t, renameWithRetry(fs, oldPath, newPath, isTransient, 3, time.Millisecond))
+	require.Equal(t, 3, fs.attempts)
+
+	// Any other failure is returned right away.
+	fs = &flakyRenameFileSystem{FileSystem: OSFileSystem, failures: 1, err: os.ErrPermission}
+	require.Error(t, renameWithRetry(fs, oldPath, newPath, isTransient, 3, time.Millisecond))
+	require.Equal(t, 1, fs.attempts)
+
+	// Only Windows has transient rename failures, everywhere else the rename is tried once.
+	if runtime.GOOS != "windows" {
+		fs = &flakyRenameFileSystem{FileSystem: OSFileSystem, failures: 1, err: syscall.EACCES}
+		require.Error(t, RenameWithRetry(fs, oldPath, newPath))
+		require.Equal(t, 1, fs.attempts)
+	}
+}